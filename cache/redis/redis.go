@@ -78,6 +78,16 @@ func (m *Client) Set(ctx context.Context, key string, value interface{}, expirat
 	return m.client.Set(k, value, expiration)
 }
 
+func (m *Client) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
+	var tkeys []string
+	for _, key := range keys {
+		tkeys = append(tkeys, m.fixKey(key))
+	}
+
+	m.logSpan(ctx, "MGet", strings.Join(tkeys, ","))
+	return m.client.MGet(tkeys...)
+}
+
 func (m *Client) Exists(ctx context.Context, key string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "Exists", k)
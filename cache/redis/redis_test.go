@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis 为只支持 GET/SET/MGET 的 redis 服务, 按 RESP 协议读写
+type fakeRedis struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen err: %s", err.Error())
+	}
+
+	m := &fakeRedis{ln: ln, data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *fakeRedis) Close() {
+	m.ln.Close()
+}
+
+func (m *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		var resp string
+		m.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			resp = bulkString(m.data, args[1])
+		case "SET":
+			m.data[args[1]] = args[2]
+			resp = "+OK\r\n"
+		case "MGET":
+			resp = fmt.Sprintf("*%d\r\n", len(args)-1)
+			for _, key := range args[1:] {
+				resp += bulkString(m.data, key)
+			}
+		default:
+			resp = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+		}
+		m.mu.Unlock()
+
+		if _, err := io.WriteString(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func bulkString(data map[string]string, key string) string {
+	val, ok := data[key]
+	if !ok {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
+}
+
+// readCommand 读取一个以 bulk string 数组发送的命令
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func TestClientMGet(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeRedis(t)
+	defer server.Close()
+
+	client := &Client{
+		client:    redis.NewClient(&redis.Options{Addr: server.ln.Addr().String()}),
+		namespace: "base/report",
+		wrapper:   "cache",
+	}
+	defer client.client.Close()
+
+	assert.NoError(t, client.Set(ctx, "k1", "v1", time.Minute).Err())
+	assert.NoError(t, client.Set(ctx, "k3", "v3", time.Minute).Err())
+
+	// key 加上 namespace 与 wrapper 前缀
+	server.mu.Lock()
+	assert.Equal(t, "v1", server.data["base/report.cache.k1"])
+	server.mu.Unlock()
+
+	// 结果与 keys 的顺序一一对应, 未命中的为 nil
+	vals, err := client.MGet(ctx, "k3", "k2", "k1").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"v3", nil, "v1"}, vals)
+
+	val, err := client.Get(ctx, "k3").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", val)
+}
@@ -80,6 +80,79 @@ func (m *Cache) Get(ctx context.Context, key, value interface{}) error {
 	return nil
 }
 
+// MGet 只从缓存中批量读取 keys, 不调用 load, 返回命中的 key 对应的 json 数据, 未命中的 key 不在结果中
+func (m *Cache) MGet(ctx context.Context, keys []interface{}) (map[interface{}][]byte, error) {
+	fun := "Cache.MGet -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "cache.value.MGet")
+	defer span.Finish()
+
+	values := make(map[interface{}][]byte)
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	skeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		skey, err := m.prefixKey(key)
+		if err != nil {
+			slog.Errorf(ctx, "%s fixkey, key: %v err: %v", fun, key, err)
+			return nil, err
+		}
+		skeys = append(skeys, skey)
+	}
+
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
+	if err != nil {
+		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.namespace)
+		return nil, err
+	}
+
+	data, err := client.MGet(ctx, skeys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("mget cache keys: %v err: %s", keys, err.Error())
+	}
+
+	for i, item := range data {
+		if s, ok := item.(string); ok {
+			values[keys[i]] = []byte(s)
+		}
+	}
+	return values, nil
+}
+
+// Set 将 value 以 json 写入缓存, 过期时间与 load 写入的相同
+func (m *Cache) Set(ctx context.Context, key, value interface{}) error {
+	fun := "Cache.Set -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "cache.value.Set")
+	defer span.Finish()
+
+	skey, err := m.prefixKey(key)
+	if err != nil {
+		slog.Errorf(ctx, "%s fixkey, key: %v err: %v", fun, key, err)
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("marshal cache key: %v err: %s", key, err.Error())
+	}
+
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
+	if err != nil {
+		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.namespace)
+		return err
+	}
+
+	err = client.Set(ctx, skey, data, m.expire).Err()
+	if err != nil {
+		return fmt.Errorf("set cache key: %v err: %s", key, err.Error())
+	}
+
+	return nil
+}
+
 func (m *Cache) Del(ctx context.Context, key interface{}) error {
 	fun := "Cache.Del -->"
 
@@ -2,8 +2,10 @@ package value
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/shawnfeng/sutil/cache"
 	"github.com/shawnfeng/sutil/trace"
+	"reflect"
 
 	//"fmt"
 	"github.com/shawnfeng/sutil/slog/slog"
@@ -15,7 +17,7 @@ type Test struct {
 	Id int64
 }
 
-func load(key interface{}) (value interface{}, err error) {
+func load(ctx context.Context, key interface{}) (value interface{}, err error) {
 
 	//return nil, fmt.Errorf("not found")
 	return &Test{
@@ -48,3 +50,58 @@ func TestGet(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 }
+
+func TestMGetSet(t *testing.T) {
+	ctx := context.Background()
+	_ = trace.InitDefaultTracer("cache.test")
+
+	// load 返回与 Set 不同的值, 读到 Set 的值说明 Get 没有重新 load
+	c := NewCache("base/report", "test", 60*time.Second, func(ctx context.Context, key interface{}) (interface{}, error) {
+		return &Test{Id: -1}, nil
+	})
+	_ = SetConfiger(ctx, cache.ConfigerTypeApollo)
+
+	if err := c.Set(ctx, 21, &Test{Id: 21}); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := c.Set(ctx, "23", &Test{Id: 23}); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	c.Del(ctx, 22)
+
+	// Set 写入的 json 与 Get 读取的格式相同
+	var test Test
+	if err := c.Get(ctx, 21, &test); err != nil || test.Id != 21 {
+		t.Errorf("get test: %v err: %v", test, err)
+	}
+
+	// 结果按原来的 key 返回, 未命中的 key 不在结果中
+	values, err := c.MGet(ctx, []interface{}{"23", 22, 21})
+	if err != nil {
+		t.Fatalf("mget err: %v", err)
+	}
+	want := map[interface{}][]byte{
+		"23": []byte(`{"Id":23}`),
+		21:   []byte(`{"Id":21}`),
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("mget values: %v want: %v", values, want)
+	}
+
+	// load 写入的数据 MGet 同样可以读取
+	if err := c.Load(ctx, 22); err != nil {
+		t.Fatalf("load err: %v", err)
+	}
+	values, err = c.MGet(ctx, []interface{}{22})
+	if err != nil {
+		t.Fatalf("mget err: %v", err)
+	}
+	if err := json.Unmarshal(values[22], &test); err != nil || test.Id != -1 {
+		t.Errorf("mget loaded test: %v err: %v", test, err)
+	}
+
+	values, err = c.MGet(ctx, nil)
+	if err != nil || len(values) != 0 {
+		t.Errorf("mget empty keys: %v err: %v", values, err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// dbconfig 校验 dbrouter 的路由配置, 并查看表会被路由到哪个实例, 用于 CI 中检查配置变更
+//
+//	dbconfig -config route.json validate
+//	dbconfig -config route.json -cluster account -table user [-group g1] resolve
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/shawnfeng/sutil/dbrouter"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func main() {
+	config := flag.String("config", "", "route config json file")
+	cluster := flag.String("cluster", "", "cluster to resolve")
+	table := flag.String("table", "", "table to resolve")
+	group := flag.String("group", dbrouter.DefaultGroup, "route group to resolve")
+	flag.Parse()
+
+	if err := run(*config, *cluster, *table, *group, flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "dbconfig: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(config, cluster, table, group, command string) error {
+	if config == "" {
+		return fmt.Errorf("-config is required")
+	}
+	data, err := ioutil.ReadFile(config)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "validate":
+		errs := dbrouter.ValidateConfig(data)
+		for _, e := range errs {
+			fmt.Println(e.Error())
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%d problems found", len(errs))
+		}
+		fmt.Println("ok")
+		return nil
+
+	case "resolve":
+		if cluster == "" || table == "" {
+			return fmt.Errorf("-cluster and -table are required")
+		}
+		// NOTE: 与运行时一致使用 NewParser, 出错的配置项被跳过, 需要先用 validate 检查
+		parser, err := dbrouter.NewParser(data)
+		if err != nil {
+			return err
+		}
+		r, err := parser.Resolve(cluster, table, group)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("cluster:%s table:%s group:%q -> instance:%s group:%q match:%s express:%s dbtype:%s dbname:%s addrs:%s\n",
+			r.Cluster, r.Table, group, r.Instance, r.Group, r.Match, r.Express, r.DBType, r.DBName, strings.Join(r.DBAddr, ","))
+		if r.HasFallback {
+			fmt.Printf("fallback group:%q\n", r.Fallback)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown command %q, use validate or resolve", command)
+	}
+}
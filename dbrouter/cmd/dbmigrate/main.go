@@ -0,0 +1,99 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// dbmigrate 将目录中的版本化 sql 文件应用到 dbrouter 集群的所有实例上
+//
+//	dbmigrate -cluster account -dir ./migrations [-config route.json] [-group g1] [-dry-run] up
+//	dbmigrate -cluster account -dir ./migrations -steps 1 down
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/shawnfeng/sutil/dbrouter"
+	"github.com/shawnfeng/sutil/scontext"
+	"io/ioutil"
+	"os"
+)
+
+// routeControl 用于在 context 中指定路由分组
+type routeControl struct {
+	group string
+}
+
+func (m *routeControl) GetControlRouteGroup() (string, bool) {
+	return m.group, true
+}
+
+func (m *routeControl) SetControlRouteGroup(group string) error {
+	m.group = group
+	return nil
+}
+
+func main() {
+	config := flag.String("config", "", "route config json file, use etcd config if empty")
+	cluster := flag.String("cluster", "", "dbrouter cluster")
+	dir := flag.String("dir", "", "migration directory")
+	group := flag.String("group", "", "route group")
+	steps := flag.Int("steps", 1, "number of migrations to roll back for down")
+	dryRun := flag.Bool("dry-run", false, "print the plan without executing")
+	flag.Parse()
+
+	if err := run(*config, *cluster, *dir, *group, flag.Arg(0), *steps, *dryRun); err != nil {
+		fmt.Fprintf(os.Stderr, "dbmigrate: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(config, cluster, dir, group, direction string, steps int, dryRun bool) error {
+	if cluster == "" || dir == "" {
+		return fmt.Errorf("-cluster and -dir are required")
+	}
+
+	migrations, err := dbrouter.LoadMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	var router *dbrouter.Router
+	if config != "" {
+		data, err := ioutil.ReadFile(config)
+		if err != nil {
+			return err
+		}
+		router, err = dbrouter.NewRouterWithConfigType(dbrouter.CONFIG_TYPE_SIMPLE, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		router, err = dbrouter.NewRouter(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), scontext.ContextKeyControl, &routeControl{group: group})
+
+	migrator := dbrouter.NewMigrator(router, cluster, migrations)
+	var done []*dbrouter.MigrationStep
+	switch direction {
+	case dbrouter.MIGRATE_UP:
+		done, err = migrator.Up(ctx, dryRun)
+	case dbrouter.MIGRATE_DOWN:
+		done, err = migrator.Down(ctx, steps, dryRun)
+	default:
+		return fmt.Errorf("unknown command %q, use up or down", direction)
+	}
+
+	for _, step := range done {
+		fmt.Println(step)
+		if dryRun {
+			for _, stmt := range step.Statements {
+				fmt.Printf("\t%s;\n", stmt)
+			}
+		}
+	}
+	return err
+}
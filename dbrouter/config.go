@@ -19,6 +19,8 @@ const (
 	DB_TYPE_MONGO    = "mongo"
 	DB_TYPE_MYSQL    = "mysql"
 	DB_TYPE_POSTGRES = "postgres"
+	// DB_TYPE_SQLITE 的 addrs 为数据库文件路径, :memory: 为内存库, 主要用于测试
+	DB_TYPE_SQLITE = "sqlite"
 )
 
 const (
@@ -33,6 +35,40 @@ type Config struct {
 	UserName string
 	PassWord string
 	TimeOut  time.Duration
+	// Replicas 为从库, 只对 mysql/postgres 生效
+	Replicas []*Replica
+	// MaxReplicaLag 为从库允许的最大复制延迟, 为 0 时不检查延迟
+	MaxReplicaLag time.Duration
+
+	// Instance 与 Group 用于连接池监控的 label
+	Instance string
+	Group    string
+	// 连接池配置, 为 0 时 MaxOpenConns/MaxIdleConns 使用默认值, 其余不限制
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+func newConfig(info *dbInsInfo, instance, group string) *Config {
+	return &Config{
+		DBType:   info.DBType,
+		DBAddr:   info.DBAddr,
+		DBName:   info.DBName,
+		UserName: info.UserName,
+		PassWord: info.PassWord,
+		TimeOut:  3 * time.Second,
+
+		Replicas:      info.Replicas,
+		MaxReplicaLag: time.Duration(info.MaxReplicaLag) * time.Second,
+
+		Instance:        instance,
+		Group:           group,
+		MaxOpenConns:    info.MaxOpenConns,
+		MaxIdleConns:    info.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(info.ConnMaxLifetime) * time.Second,
+		ConnMaxIdleTime: time.Duration(info.ConnMaxIdleTime) * time.Second,
+	}
 }
 
 type Configer interface {
@@ -42,6 +78,52 @@ type Configer interface {
 	GetGroups(ctx context.Context) []string
 }
 
+// RuleConfiger 为 Configer 的可选扩展, 提供分片规则、查询超时、慢查询阈值、集群的实例与备用 group;
+// SimpleConfig 与 EtcdConfig 都实现了该接口, 其他 Configer 未实现时不分片、不设置查询超时、
+// 使用默认的慢查询阈值且没有备用 group
+type RuleConfiger interface {
+	GetShardRule(ctx context.Context, cluster, table string) *ShardRule
+	GetQueryTimeout(ctx context.Context, cluster string) time.Duration
+	GetSlowThreshold(ctx context.Context, cluster string) time.Duration
+	GetClusterInstances(ctx context.Context, cluster string) []string
+	GetFallbackGroup(ctx context.Context, group string) (string, bool)
+}
+
+func configShardRule(ctx context.Context, configer Configer, cluster, table string) *ShardRule {
+	if r, ok := configer.(RuleConfiger); ok {
+		return r.GetShardRule(ctx, cluster, table)
+	}
+	return nil
+}
+
+func configQueryTimeout(ctx context.Context, configer Configer, cluster string) time.Duration {
+	if r, ok := configer.(RuleConfiger); ok {
+		return r.GetQueryTimeout(ctx, cluster)
+	}
+	return 0
+}
+
+func configSlowThreshold(ctx context.Context, configer Configer, cluster string) time.Duration {
+	if r, ok := configer.(RuleConfiger); ok {
+		return r.GetSlowThreshold(ctx, cluster)
+	}
+	return defaultSlowThreshold
+}
+
+func configClusterInstances(ctx context.Context, configer Configer, cluster string) []string {
+	if r, ok := configer.(RuleConfiger); ok {
+		return r.GetClusterInstances(ctx, cluster)
+	}
+	return nil
+}
+
+func configFallbackGroup(ctx context.Context, configer Configer, group string) (string, bool) {
+	if r, ok := configer.(RuleConfiger); ok {
+		return r.GetFallbackGroup(ctx, group)
+	}
+	return "", false
+}
+
 func NewConfiger(configType int, data []byte, dbChangeChan chan dbConfigChange) (Configer, error) {
 
 	switch configType {
@@ -57,6 +139,8 @@ func NewConfiger(configType int, data []byte, dbChangeChan chan dbConfigChange)
 	}
 }
 
+// SimpleConfig 为静态配置, 实例引用的密钥只在创建时读取一次
+// NOTE: 不支持密钥轮换, 需要轮换 file:/env: 等引用的密钥时使用 EtcdConfig, 或在轮换后重新创建 Router
 type SimpleConfig struct {
 	parser *Parser
 }
@@ -71,26 +155,12 @@ func NewSimpleConfiger(data []byte) (Configer, error) {
 func (m *SimpleConfig) GetConfig(ctx context.Context, instance string) *Config {
 	group := scontext.GetControlRouteGroupWithDefault(ctx, DefaultGroup)
 	info := m.parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
+	return newConfig(info, instance, group)
 }
 
 func (m *SimpleConfig) GetConfigByGroup(ctx context.Context, instance, group string) *Config {
 	info := m.parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
+	return newConfig(info, instance, group)
 }
 
 func (m *SimpleConfig) GetInstance(ctx context.Context, cluster, table string) (instance string) {
@@ -98,6 +168,26 @@ func (m *SimpleConfig) GetInstance(ctx context.Context, cluster, table string) (
 	return instance
 }
 
+func (m *SimpleConfig) GetShardRule(ctx context.Context, cluster, table string) *ShardRule {
+	return m.parser.GetShardRule(cluster, table)
+}
+
+func (m *SimpleConfig) GetQueryTimeout(ctx context.Context, cluster string) time.Duration {
+	return m.parser.GetQueryTimeout(cluster)
+}
+
+func (m *SimpleConfig) GetSlowThreshold(ctx context.Context, cluster string) time.Duration {
+	return m.parser.GetSlowThreshold(cluster)
+}
+
+func (m *SimpleConfig) GetClusterInstances(ctx context.Context, cluster string) []string {
+	return m.parser.GetClusterInstances(cluster)
+}
+
+func (m *SimpleConfig) GetFallbackGroup(ctx context.Context, group string) (string, bool) {
+	return m.parser.GetFallbackGroup(group)
+}
+
 func (m *SimpleConfig) GetGroups(ctx context.Context) []string {
 	var groups []string
 	for group, _ := range m.parser.dbIns {
@@ -110,12 +200,18 @@ type EtcdConfig struct {
 	etcdAddr []string
 	parser   *Parser
 	parserMu sync.RWMutex
+	// updateMu 串行化 etcd 配置变更与密钥轮换对 parser 的替换
+	updateMu sync.Mutex
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewEtcdConfiger(ctx context.Context, dbChangeChan chan dbConfigChange) (Configer, error) {
 	fun := "NewEtcdConfiger -->"
 	etcdConfig := &EtcdConfig{
 		// TODO etcd address如何获取
+		stop:     make(chan struct{}),
 		etcdAddr: []string{"http://infra0.etcd.ibanyu.com:20002", "http://infra1.etcd.ibanyu.com:20002", "http://infra2.etcd.ibanyu.com:20002", "http://infra3.etcd.ibanyu.com:20002", "http://infra4.etcd.ibanyu.com:20002", "http://old0.etcd.ibanyu.com:20002", "http://old1.etcd.ibanyu.com:20002", "http://old2.etcd.ibanyu.com:20002"},
 	}
 	err := etcdConfig.init(ctx, dbChangeChan)
@@ -136,22 +232,14 @@ func (m *EtcdConfig) init(ctx context.Context, dbChangeChan chan dbConfigChange)
 	initCh := make(chan error)
 	var initOnce sync.Once
 	etcdInstance.Watch(ctx, "/roc/db/route", func(response *client.Response) {
-		slog.Infof(ctx, "get db conf: %s", response.Node.Value)
+		slog.Infof(ctx, "get db conf: %s", redactConfig(response.Node.Value))
 		parser, er := NewParser([]byte(response.Node.Value))
 
 		if er != nil {
 			slog.Errorf(ctx, "%s init db parser err: ", fun, er.Error())
 		} else {
 			slog.Infof(ctx, "succeed to init new parser")
-
-			if oldParser := m.getParser(ctx); oldParser != nil {
-				dbConfigChange := compareParsers(*oldParser, *parser)
-				slog.Infof(ctx, "parser changes: %+v", dbConfigChange)
-				m.setParser(ctx, parser)
-				dbChangeChan <- dbConfigChange
-			} else {
-				m.setParser(ctx, parser)
-			}
+			m.updateParser(ctx, parser, dbChangeChan)
 		}
 
 		initOnce.Do(func() {
@@ -161,9 +249,73 @@ func (m *EtcdConfig) init(ctx context.Context, dbChangeChan chan dbConfigChange)
 	// 做一次同步，等parser初始化完成
 	err = <-initCh
 	close(initCh)
+	if err == nil {
+		go m.watchSecrets(ctx, defaultSecretRefreshInterval, dbChangeChan)
+	}
 	return err
 }
 
+func (m *EtcdConfig) updateParser(ctx context.Context, parser *Parser, dbChangeChan chan dbConfigChange) {
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+
+	if oldParser := m.getParser(ctx); oldParser != nil {
+		dbConfigChange := compareParsers(*oldParser, *parser)
+		slog.Infof(ctx, "parser changes: %+v", dbConfigChange)
+		m.setParser(ctx, parser)
+		dbChangeChan <- dbConfigChange
+	} else {
+		m.setParser(ctx, parser)
+	}
+}
+
+// watchSecrets 定期重新读取实例引用的密钥, 密钥轮换后通过 dbChangeChan 通知关闭旧连接, 下次使用时按新密钥建连
+func (m *EtcdConfig) watchSecrets(ctx context.Context, interval time.Duration, dbChangeChan chan dbConfigChange) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.reloadSecrets(ctx, dbChangeChan)
+		}
+	}
+}
+
+// Close 停止密钥轮换, 由 Router.Close 调用
+func (m *EtcdConfig) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+	return nil
+}
+
+func (m *EtcdConfig) reloadSecrets(ctx context.Context, dbChangeChan chan dbConfigChange) {
+	fun := "EtcdConfig.reloadSecrets -->"
+
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+
+	oldParser := m.getParser(ctx)
+	if oldParser == nil || !oldParser.hasSecrets() {
+		return
+	}
+
+	parser := oldParser.reloadSecrets(ctx)
+	dbConfigChange := compareParsers(*oldParser, *parser)
+	if len(dbConfigChange.dbInstanceChange) == 0 {
+		return
+	}
+
+	slog.Infof(ctx, "%s secrets rotated: %+v", fun, dbConfigChange.dbInstanceChange)
+	m.setParser(ctx, parser)
+	dbChangeChan <- dbConfigChange
+}
+
 func (m *EtcdConfig) getParser(ctx context.Context) *Parser {
 	m.parserMu.RLock()
 	defer m.parserMu.RUnlock()
@@ -182,27 +334,13 @@ func (m *EtcdConfig) GetConfig(ctx context.Context, instance string) *Config {
 	group := scontext.GetControlRouteGroupWithDefault(ctx, DefaultGroup)
 	parser := m.getParser(ctx)
 	info := parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
+	return newConfig(info, instance, group)
 }
 
 func (m *EtcdConfig) GetConfigByGroup(ctx context.Context, instance, group string) *Config {
 	parser := m.getParser(ctx)
 	info := parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
+	return newConfig(info, instance, group)
 }
 
 func (m *EtcdConfig) GetInstance(ctx context.Context, cluster, table string) (instance string) {
@@ -210,6 +348,31 @@ func (m *EtcdConfig) GetInstance(ctx context.Context, cluster, table string) (in
 	return parser.GetInstance(cluster, table)
 }
 
+func (m *EtcdConfig) GetShardRule(ctx context.Context, cluster, table string) *ShardRule {
+	parser := m.getParser(ctx)
+	return parser.GetShardRule(cluster, table)
+}
+
+func (m *EtcdConfig) GetQueryTimeout(ctx context.Context, cluster string) time.Duration {
+	parser := m.getParser(ctx)
+	return parser.GetQueryTimeout(cluster)
+}
+
+func (m *EtcdConfig) GetSlowThreshold(ctx context.Context, cluster string) time.Duration {
+	parser := m.getParser(ctx)
+	return parser.GetSlowThreshold(cluster)
+}
+
+func (m *EtcdConfig) GetClusterInstances(ctx context.Context, cluster string) []string {
+	parser := m.getParser(ctx)
+	return parser.GetClusterInstances(cluster)
+}
+
+func (m *EtcdConfig) GetFallbackGroup(ctx context.Context, group string) (string, bool) {
+	parser := m.getParser(ctx)
+	return parser.GetFallbackGroup(group)
+}
+
 func (m *EtcdConfig) GetGroups(ctx context.Context) []string {
 	var groups []string
 	parser := m.getParser(ctx)
@@ -0,0 +1,82 @@
+package dbrouter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigPool(t *testing.T) {
+	configer, err := NewSimpleConfiger([]byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "full", "express": "user"}]},
+		"instances": {"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {
+			"addrs": ["127.0.0.1:3306"],
+			"max_open_conns": 64, "max_idle_conns": 16, "conn_max_lifetime": 3600, "conn_max_idle_time": 300
+		}}}
+	}`))
+	assert.NoError(t, err)
+
+	config := configer.GetConfigByGroup(context.Background(), "user0", DefaultGroup)
+	assert.Equal(t, "user0", config.Instance)
+	assert.Equal(t, DefaultGroup, config.Group)
+	assert.Equal(t, 64, config.MaxOpenConns)
+	assert.Equal(t, 16, config.MaxIdleConns)
+	assert.Equal(t, time.Hour, config.ConnMaxLifetime)
+	assert.Equal(t, 5*time.Minute, config.ConnMaxIdleTime)
+
+	configer, err = NewSimpleConfiger([]byte(`{
+		"instances": {"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"], "max_open_conns": -1}}}
+	}`))
+	assert.NoError(t, err)
+	assert.Empty(t, configer.GetConfigByGroup(context.Background(), "user0", DefaultGroup).DBAddr)
+}
+
+func TestCompareDbInfoPool(t *testing.T) {
+	info := &dbInsInfo{DBName: "account", DBAddr: []string{"127.0.0.1:3306"}, MaxOpenConns: 64}
+	changed := *info
+	changed.MaxOpenConns = 32
+	assert.False(t, compareDbInfo(info, &changed))
+}
+
+func TestConfigFallbackGroup(t *testing.T) {
+	configer, err := NewSimpleConfiger([]byte(`{
+		"instances": {"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]},
+			"ins": [{"group": "g1", "dbcfg": {"addrs": ["127.0.0.1:3307"]}}]}},
+		"fallback_groups": {"": "g1", "g1": "", "g2": "g3", "g4": "g4"}
+	}`))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	fallback, ok := configFallbackGroup(ctx, configer, DefaultGroup)
+	assert.True(t, ok)
+	assert.Equal(t, "g1", fallback)
+	fallback, ok = configFallbackGroup(ctx, configer, "g1")
+	assert.True(t, ok)
+	assert.Equal(t, DefaultGroup, fallback)
+	_, ok = configFallbackGroup(ctx, configer, "g2")
+	assert.False(t, ok)
+	_, ok = configFallbackGroup(ctx, configer, "g4")
+	assert.False(t, ok)
+}
+
+// baseConfiger 只实现 Configer, 如外部实现的配置
+type baseConfiger struct {
+	Configer
+}
+
+func TestConfigRuleFallback(t *testing.T) {
+	ctx := context.Background()
+	configer, err := NewSimpleConfiger(shardRouteConfig)
+	assert.NoError(t, err)
+	assert.NotNil(t, configShardRule(ctx, configer, "account", "user"))
+
+	base := baseConfiger{configer}
+	assert.Nil(t, configShardRule(ctx, base, "account", "user"))
+	assert.Equal(t, time.Duration(0), configQueryTimeout(ctx, base, "account"))
+	assert.Equal(t, defaultSlowThreshold, configSlowThreshold(ctx, base, "account"))
+	assert.Nil(t, configClusterInstances(ctx, base, "account"))
+	_, ok := configFallbackGroup(ctx, base, DefaultGroup)
+	assert.False(t, ok)
+}
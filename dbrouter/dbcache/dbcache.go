@@ -0,0 +1,338 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dbcache 将 dbrouter 的 cluster/table 与 cache/value 的 namespace 组合为按主键读写的 Repository,
+// 读时先查缓存, 未命中的批量回源并写回缓存; 通过 Repository 写入时删除缓存, 并延迟再删除一次,
+// 避免写后从库延迟期间回源读到旧数据再写回缓存
+package dbcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/shawnfeng/sutil/dbrouter"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIDColumn    = "id"
+	defaultDeleteDelay = time.Second
+)
+
+// ErrNotFound 为 GetByID 在缓存与数据库中都没有找到记录时返回的错误
+var ErrNotFound = errors.New("dbcache: entity not found")
+
+var columnRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Cache 为 Repository 使用的缓存操作, *value.Cache 实现了该接口
+type Cache interface {
+	// MGet 返回命中的 key 对应的 json 数据
+	MGet(ctx context.Context, keys []interface{}) (map[interface{}][]byte, error)
+	Set(ctx context.Context, key, value interface{}) error
+	Del(ctx context.Context, key interface{}) error
+}
+
+type Options struct {
+	// IDColumn 为主键列名, 实体中需要有 db tag 与之对应的字段, 默认为 id
+	IDColumn string
+	// DeleteDelay 为延迟双删的间隔, 应大于从库的复制延迟, 默认为 1s
+	DeleteDelay time.Duration
+}
+
+// Repository 为 entity 类型的实体提供带缓存的按主键读写, 主键类型需为 cache/value 支持的 int 或 string
+type Repository struct {
+	router  *dbrouter.Router
+	cluster string
+	table   string
+	cache   Cache
+
+	entityType  reflect.Type
+	idIndex     []int
+	idColumn    string
+	deleteDelay time.Duration
+}
+
+// NewRepository 创建 cluster/table 上的 Repository, entity 为实体的结构体或其指针, 字段通过 db tag 映射到列
+func NewRepository(router *dbrouter.Router, cluster, table string, cache Cache, entity interface{}, opts *Options) (*Repository, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	idColumn := opts.IDColumn
+	if idColumn == "" {
+		idColumn = defaultIDColumn
+	}
+	deleteDelay := opts.DeleteDelay
+	if deleteDelay == 0 {
+		deleteDelay = defaultDeleteDelay
+	}
+
+	entityType := reflectx.Deref(reflect.TypeOf(entity))
+	if entityType == nil || entityType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("entity must be a struct, got %T", entity)
+	}
+
+	field := reflectx.NewMapperFunc("db", sqlx.NameMapper).TypeMap(entityType).GetByPath(idColumn)
+	if field == nil {
+		return nil, fmt.Errorf("entity %s has no field for column %s", entityType, idColumn)
+	}
+
+	return &Repository{
+		router:      router,
+		cluster:     cluster,
+		table:       table,
+		cache:       cache,
+		entityType:  entityType,
+		idIndex:     field.Index,
+		idColumn:    idColumn,
+		deleteDelay: deleteDelay,
+	}, nil
+}
+
+// idKey 将主键统一为字符串, 使调用方传入的 int 与数据库读出的 int64 能够对应
+func idKey(id interface{}) string {
+	return fmt.Sprint(id)
+}
+
+// GetByID 将 id 对应的实体读入 dest, dest 为实体的指针, 记录不存在时返回 ErrNotFound
+func (m *Repository) GetByID(ctx context.Context, id interface{}, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Type() != m.entityType {
+		return fmt.Errorf("dest must be *%s, got %T", m.entityType, dest)
+	}
+
+	entities, err := m.load(ctx, []interface{}{id})
+	if err != nil {
+		return err
+	}
+
+	entity, ok := entities[idKey(id)]
+	if !ok {
+		return ErrNotFound
+	}
+	v.Elem().Set(entity.Elem())
+	return nil
+}
+
+// GetByIDs 将 ids 对应的实体按 ids 的顺序追加到 dest, dest 为 *[]T 或 *[]*T, 不存在的记录被跳过
+func (m *Repository) GetByIDs(ctx context.Context, ids []interface{}, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice || reflectx.Deref(v.Elem().Type().Elem()) != m.entityType {
+		return fmt.Errorf("dest must be *[]%s or *[]*%s, got %T", m.entityType, m.entityType, dest)
+	}
+	isPtr := v.Elem().Type().Elem().Kind() == reflect.Ptr
+
+	entities, err := m.load(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	slice := v.Elem()
+	for _, id := range ids {
+		entity, ok := entities[idKey(id)]
+		if !ok {
+			continue
+		}
+		if isPtr {
+			slice = reflect.Append(slice, entity)
+		} else {
+			slice = reflect.Append(slice, entity.Elem())
+		}
+	}
+	v.Elem().Set(slice)
+	return nil
+}
+
+// load 返回 ids 中存在的实体, key 为 idKey, 值为实体的指针
+func (m *Repository) load(ctx context.Context, ids []interface{}) (map[string]reflect.Value, error) {
+	fun := "Repository.load -->"
+
+	entities := make(map[string]reflect.Value, len(ids))
+	if len(ids) == 0 {
+		return entities, nil
+	}
+
+	cached, err := m.cache.MGet(ctx, ids)
+	if err != nil {
+		// NOTE: 缓存不可用时直接回源, 不影响读
+		slog.Warnf(ctx, "%s cluster:%s table:%s mget err:%s", fun, m.cluster, m.table, err.Error())
+		cached = nil
+	}
+
+	var misses []interface{}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		key := idKey(id)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		data, ok := cached[id]
+		if !ok {
+			misses = append(misses, id)
+			continue
+		}
+		// 数据库中不存在的记录缓存为 null, 避免反复回源
+		if string(data) == "null" {
+			continue
+		}
+
+		entity := reflect.New(m.entityType)
+		if err := json.Unmarshal(data, entity.Interface()); err != nil {
+			slog.Warnf(ctx, "%s cluster:%s table:%s id:%v unmarshal err:%s", fun, m.cluster, m.table, id, err.Error())
+			misses = append(misses, id)
+			continue
+		}
+		entities[key] = entity
+	}
+
+	if len(misses) == 0 {
+		return entities, nil
+	}
+
+	loaded, err := m.loadFromDB(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range misses {
+		var value interface{}
+		if entity, ok := loaded[idKey(id)]; ok {
+			entities[idKey(id)] = entity
+			value = entity.Interface()
+		}
+		if err := m.cache.Set(ctx, id, value); err != nil {
+			slog.Warnf(ctx, "%s cluster:%s table:%s id:%v set err:%s", fun, m.cluster, m.table, id, err.Error())
+		}
+	}
+	return entities, nil
+}
+
+func (m *Repository) loadFromDB(ctx context.Context, ids []interface{}) (map[string]reflect.Value, error) {
+	rows := reflect.New(reflect.SliceOf(reflect.PtrTo(m.entityType)))
+	err := m.router.SqlExec(ctx, m.cluster, func(db *dbrouter.DB, tables []interface{}) error {
+		query, args, err := sqlx.In(fmt.Sprintf("SELECT * FROM %%s WHERE %s IN (?)", m.idColumn), ids)
+		if err != nil {
+			return err
+		}
+		return db.SelectContextWrapper(ctx, tables, rows.Interface(), db.Rebind(query), args...)
+	}, m.table)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := make(map[string]reflect.Value, rows.Elem().Len())
+	for i := 0; i < rows.Elem().Len(); i++ {
+		entity := rows.Elem().Index(i)
+		id := reflectx.FieldByIndexesReadOnly(entity.Elem(), m.idIndex)
+		entities[idKey(id.Interface())] = entity
+	}
+	return entities, nil
+}
+
+// Exec 在 cluster/table 上执行写操作 fn, 执行前删除 ids 的缓存, 成功后在 DeleteDelay 后再删除一次;
+// Update/Delete 以外的写入, 如插入曾被缓存为不存在的主键, 也应通过 Exec 执行
+func (m *Repository) Exec(ctx context.Context, ids []interface{}, fn func(db *dbrouter.DB, tables []interface{}) error) error {
+	m.invalidate(ctx, ids)
+
+	err := m.router.SqlExec(ctx, m.cluster, fn, m.table)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: 写入到从库追上之前, 其他请求可能回源读到旧数据并写回缓存, 延迟再删除一次
+	dctx := valueOnlyContext{ctx}
+	time.AfterFunc(m.deleteDelay, func() {
+		m.invalidate(dctx, ids)
+	})
+	return nil
+}
+
+// Update 将 id 对应记录的 fields 列更新为对应的值, 返回影响的行数
+func (m *Repository) Update(ctx context.Context, id interface{}, fields map[string]interface{}) (int64, error) {
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty fields")
+	}
+
+	columns := make([]string, 0, len(fields))
+	for column := range fields {
+		if !columnRegexp.MatchString(column) {
+			return 0, fmt.Errorf("invalid column: %q", column)
+		}
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	sets := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns)+1)
+	for _, column := range columns {
+		sets = append(sets, column+" = ?")
+		args = append(args, fields[column])
+	}
+	args = append(args, id)
+	query := fmt.Sprintf("UPDATE %%s SET %s WHERE %s = ?", strings.Join(sets, ", "), m.idColumn)
+
+	var affected int64
+	err := m.Exec(ctx, []interface{}{id}, func(db *dbrouter.DB, tables []interface{}) error {
+		res, err := db.ExecContextWrapper(ctx, tables, db.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	return affected, err
+}
+
+// Delete 删除 id 对应的记录, 返回影响的行数
+func (m *Repository) Delete(ctx context.Context, id interface{}) (int64, error) {
+	query := fmt.Sprintf("DELETE FROM %%s WHERE %s = ?", m.idColumn)
+
+	var affected int64
+	err := m.Exec(ctx, []interface{}{id}, func(db *dbrouter.DB, tables []interface{}) error {
+		res, err := db.ExecContextWrapper(ctx, tables, db.Rebind(query), id)
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
+	return affected, err
+}
+
+func (m *Repository) invalidate(ctx context.Context, ids []interface{}) {
+	fun := "Repository.invalidate -->"
+
+	for _, id := range ids {
+		if err := m.cache.Del(ctx, id); err != nil {
+			slog.Errorf(ctx, "%s cluster:%s table:%s id:%v del err:%s", fun, m.cluster, m.table, id, err.Error())
+		}
+	}
+}
+
+// valueOnlyContext 保留 ctx 中的值(如路由 group), 但不随 ctx 取消, 用于请求返回后的延迟删除
+type valueOnlyContext struct {
+	context.Context
+}
+
+func (valueOnlyContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valueOnlyContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valueOnlyContext) Err() error {
+	return nil
+}
@@ -0,0 +1,156 @@
+package dbcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shawnfeng/sutil/dbrouter"
+	"github.com/shawnfeng/sutil/dbrouter/dbroutertest"
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	ID   int64  `db:"id"`
+	Name string `db:"name"`
+}
+
+type memCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemCache() *memCache {
+	return &memCache{data: make(map[string][]byte)}
+}
+
+func (m *memCache) MGet(ctx context.Context, keys []interface{}) (map[interface{}][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := make(map[interface{}][]byte)
+	for _, key := range keys {
+		if data, ok := m.data[fmt.Sprint(key)]; ok {
+			values[key] = data
+		}
+	}
+	return values, nil
+}
+
+func (m *memCache) Set(ctx context.Context, key, value interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	m.data[fmt.Sprint(key)] = data
+	return nil
+}
+
+func (m *memCache) Del(ctx context.Context, key interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.data, fmt.Sprint(key))
+	return nil
+}
+
+func (m *memCache) has(key interface{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.data[fmt.Sprint(key)]
+	return ok
+}
+
+func setupRepository(t *testing.T) (*Repository, *memCache, *dbrouter.Router) {
+	router := dbroutertest.Setup(t, map[string][]string{
+		"account": {
+			"CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT NOT NULL)",
+			"INSERT INTO user (id, name) VALUES (1, 'a'), (2, 'b'), (3, 'c')",
+		},
+	})
+
+	cache := newMemCache()
+	repo, err := NewRepository(router, "account", "user", cache, user{}, &Options{DeleteDelay: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	return repo, cache, router
+}
+
+func TestRepositoryGet(t *testing.T) {
+	ctx := context.Background()
+	repo, cache, router := setupRepository(t)
+
+	var u user
+	assert.NoError(t, repo.GetByID(ctx, 1, &u))
+	assert.Equal(t, user{ID: 1, Name: "a"}, u)
+	assert.True(t, cache.has(1))
+
+	assert.Equal(t, ErrNotFound, repo.GetByID(ctx, 9, &u))
+	assert.True(t, cache.has(9))
+
+	// 绕过 Repository 修改数据库, 读到的仍是缓存中的值
+	err := router.SqlExec(ctx, "account", func(db *dbrouter.DB, tables []interface{}) error {
+		_, err := db.ExecContext(ctx, "UPDATE user SET name = 'x' WHERE id = 1")
+		return err
+	}, "user")
+	assert.NoError(t, err)
+
+	var users []*user
+	assert.NoError(t, repo.GetByIDs(ctx, []interface{}{3, 9, 1, 2, 3}, &users))
+	assert.Equal(t, []*user{{3, "c"}, {1, "a"}, {2, "b"}, {3, "c"}}, users)
+
+	var values []user
+	assert.NoError(t, repo.GetByIDs(ctx, []interface{}{int64(2)}, &values))
+	assert.Equal(t, []user{{2, "b"}}, values)
+
+	assert.Error(t, repo.GetByID(ctx, 1, users))
+	assert.Error(t, repo.GetByIDs(ctx, []interface{}{1}, &u))
+
+	_, err = NewRepository(router, "account", "user", cache, user{}, &Options{IDColumn: "uid"})
+	assert.Error(t, err)
+	_, err = NewRepository(router, "account", "user", cache, 1, nil)
+	assert.Error(t, err)
+}
+
+func TestRepositoryWrite(t *testing.T) {
+	ctx := context.Background()
+	repo, cache, _ := setupRepository(t)
+
+	var u user
+	assert.NoError(t, repo.GetByID(ctx, 1, &u))
+
+	affected, err := repo.Update(ctx, 1, map[string]interface{}{"name": "x"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), affected)
+	assert.False(t, cache.has(1))
+
+	// 模拟从库延迟期间回源读到的旧数据被写回缓存, 延迟删除后重新读到新值
+	assert.NoError(t, cache.Set(ctx, 1, &user{ID: 1, Name: "a"}))
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, cache.has(1))
+	assert.NoError(t, repo.GetByID(ctx, 1, &u))
+	assert.Equal(t, "x", u.Name)
+
+	_, err = repo.Update(ctx, 1, map[string]interface{}{"name = 'y' --": "x"})
+	assert.Error(t, err)
+
+	affected, err = repo.Delete(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), affected)
+	assert.Equal(t, ErrNotFound, repo.GetByID(ctx, 1, &u))
+
+	// 插入曾被缓存为不存在的主键
+	err = repo.Exec(ctx, []interface{}{1}, func(db *dbrouter.DB, tables []interface{}) error {
+		_, err := db.ExecContextWrapper(ctx, tables, "INSERT INTO %s (id, name) VALUES (1, 'z')")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, repo.GetByID(ctx, 1, &u))
+	assert.Equal(t, "z", u.Name)
+}
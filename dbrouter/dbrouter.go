@@ -13,6 +13,8 @@ import (
 	stat "github.com/shawnfeng/sutil/stat"
 	"github.com/shawnfeng/sutil/stime"
 	"gopkg.in/mgo.v2"
+	"io"
+	"time"
 )
 
 const (
@@ -24,6 +26,8 @@ type Router struct {
 	configer  Configer
 	instances *InstanceManager
 	report    *stat.StatReport
+	// stmtReport 为按语句类型的统计, 与 report 中每次执行的统计分开
+	stmtReport *stat.StatReport
 }
 
 type dbConfigChange struct {
@@ -33,8 +37,13 @@ type dbConfigChange struct {
 
 func NewRouter(data []byte) (*Router, error) {
 	// TODO config type由哪里决定
+	return NewRouterWithConfigType(CONFIG_TYPE_ETCD, data)
+}
+
+// NewRouterWithConfigType 按 configType 创建 Router, CONFIG_TYPE_SIMPLE 时 data 为路由配置的 json
+func NewRouterWithConfigType(configType int, data []byte) (*Router, error) {
 	var dbChangeChan = make(chan dbConfigChange)
-	configer, err := NewConfiger(CONFIG_TYPE_ETCD, data, dbChangeChan)
+	configer, err := NewConfiger(configType, data, dbChangeChan)
 	if err != nil {
 		return nil, err
 	}
@@ -45,36 +54,87 @@ func NewRouter(data []byte) (*Router, error) {
 		}
 	}(configer)
 
+	instances := NewInstanceManager(factory, dbChangeChan, configer.GetGroups(context.TODO()))
+	instances.fallback = func(ctx context.Context, group string) (string, bool) {
+		return configFallbackGroup(ctx, configer, group)
+	}
+
 	return &Router{
-		configer:  configer,
-		instances: NewInstanceManager(factory, dbChangeChan, configer.GetGroups(context.TODO())),
-		report:    stat.NewStat(),
+		configer:   configer,
+		instances:  instances,
+		report:     stat.NewStat(),
+		stmtReport: stat.NewStat(),
 	}, nil
 }
 
+// Close 关闭所有已建立的实例连接, 并停止配置的后台任务(如 EtcdConfig 的密钥轮换)
+func (m *Router) Close() {
+	m.instances.Close()
+	if closer, ok := m.configer.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// StatInfo 返回上次调用以来各 cluster.table 的执行次数与耗时
+// NOTE: 耗时分布已通过 smetric 以 histogram 形式导出, 新的监控应使用 smetric 的 exporter
 func (m *Router) StatInfo() []*stat.QueryStat {
 	return m.report.StatInfo()
 }
 
+// StmtStatInfo 返回上次调用以来各 cluster.table.<语句类型> 的执行次数与耗时, 如 account.user.select
+func (m *Router) StmtStatInfo() []*stat.QueryStat {
+	return m.stmtReport.StatInfo()
+}
+
+func (m *Router) reportExec(cluster, table string, dur time.Duration) {
+	m.report.IncQuery(cluster, table, dur)
+	reportExecDuration(cluster, table, dur)
+}
+
+// bindDB 为本次执行注入集群的查询超时、慢查询阈值与统计, table 为逻辑表名
+func (m *Router) bindDB(ctx context.Context, cluster, table string, db *DB) *DB {
+	db = db.bind(cluster, configQueryTimeout(ctx, m.configer, cluster), configSlowThreshold(ctx, m.configer, cluster), m.stmtReport)
+	db.table = table
+	return db
+}
+
+// stmtHook 返回 cluster 上逻辑表 table 的语句统计配置
+func (m *Router) stmtHook(ctx context.Context, cluster, table string) stmtHook {
+	return stmtHook{
+		cluster:       cluster,
+		table:         table,
+		timeout:       configQueryTimeout(ctx, m.configer, cluster),
+		slowThreshold: configSlowThreshold(ctx, m.configer, cluster),
+		report:        m.stmtReport,
+	}
+}
+
 func (m *Router) sqlPrepare(ctx context.Context, cluster, table string) (db *DB, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.sqlPrepare")
 	defer span.Finish()
 
 	instance := m.configer.GetInstance(ctx, cluster, table)
+	dbsql, err := m.getSql(ctx, instance)
+	if err != nil {
+		return
+	}
+
+	db = m.bindDB(ctx, cluster, table, dbsql.getDB(ctx))
+	return
+}
+
+func (m *Router) getSql(ctx context.Context, instance string) (*Sql, error) {
 	in := m.instances.Get(ctx, generateKey(instance))
 	if in == nil {
-		err = fmt.Errorf("db instance not find: instance:%s", instance)
-		return
+		return nil, fmt.Errorf("db instance not find: instance:%s", instance)
 	}
 
 	dbsql, ok := in.(*Sql)
 	if !ok {
-		err = fmt.Errorf("db instance type error: instance:%s, dbtype:%s", instance, in.GetType())
-		return
+		return nil, fmt.Errorf("db instance type error: instance:%s, dbtype:%s", instance, in.GetType())
 	}
 
-	db = dbsql.getDB()
-	return
+	return dbsql, nil
 }
 
 func (m *Router) SqlExec(ctx context.Context, cluster string, query func(*DB, []interface{}) error, tables ...string) error {
@@ -101,7 +161,7 @@ func (m *Router) SqlExec(ctx context.Context, cluster string, query func(*DB, []
 
 	defer func() {
 		dur := st.Duration()
-		m.report.IncQuery(cluster, table, st.Duration())
+		m.reportExec(cluster, table, dur)
 		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
 	}()
 
@@ -118,19 +178,12 @@ func (m *Router) ormPrepare(ctx context.Context, cluster, table string) (db *Gor
 	defer span.Finish()
 
 	instance := m.configer.GetInstance(ctx, cluster, table)
-	in := m.instances.Get(ctx, generateKey(instance))
-	if in == nil {
-		err = fmt.Errorf("db instance not find: instance:%s", instance)
-		return
-	}
-
-	dbsql, ok := in.(*Sql)
-	if !ok {
-		err = fmt.Errorf("db instance type error: instance:%s, dbtype:%s", instance, in.GetType())
+	dbsql, err := m.getSql(ctx, instance)
+	if err != nil {
 		return
 	}
 
-	db = dbsql.getGormDB()
+	db = dbsql.getGormDB(ctx)
 	return
 }
 
@@ -155,10 +208,11 @@ func (m *Router) OrmExec(ctx context.Context, cluster string, query func(*GormDB
 	if err != nil {
 		return err
 	}
+	db = db.bind(ctx, m.stmtHook(ctx, cluster, table))
 
 	defer func() {
 		dur := st.Duration()
-		m.report.IncQuery(cluster, table, st.Duration())
+		m.reportExec(cluster, table, dur)
 		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
 	}()
 
@@ -170,14 +224,17 @@ func (m *Router) OrmExec(ctx context.Context, cluster string, query func(*GormDB
 	return query(db, tmptables)
 }
 
+// Deprecated: 基于 mgo, 使用 MongoExec 并设置 readpref.Nearest()
 func (m *Router) MongoExecEventual(ctx context.Context, cluster, table string, query func(*mgo.Collection) error) error {
 	return m.mongoExec(ctx, eventual, cluster, table, query)
 }
 
+// Deprecated: 基于 mgo, 使用 MongoExec 并设置 readpref.SecondaryPreferred(), 需要单调读时使用 causal consistency 的 session
 func (m *Router) MongoExecMonotonic(ctx context.Context, cluster, table string, query func(*mgo.Collection) error) error {
 	return m.mongoExec(ctx, monotonic, cluster, table, query)
 }
 
+// Deprecated: 基于 mgo, 使用 MongoExec 并设置 readpref.Primary()
 func (m *Router) MongoExecStrong(ctx context.Context, cluster, table string, query func(*mgo.Collection) error) error {
 	return m.mongoExec(ctx, strong, cluster, table, query)
 }
@@ -193,13 +250,13 @@ func (m *Router) mongoPrepare(ctx context.Context, consistency mode, cluster, ta
 		return
 	}
 
-	db, ok := in.(*dbMongo)
+	db, ok := in.(*Mongo)
 	if !ok {
 		err = fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, in.GetType())
 		return
 	}
 
-	ss, err := db.getSession(consistency)
+	ss, err := db.legacy.getSession(consistency)
 	if err != nil {
 		return
 	}
@@ -233,7 +290,7 @@ func (m *Router) mongoExec(ctx context.Context, consistency mode, cluster, table
 
 	defer func() {
 		dur := st.Duration()
-		m.report.IncQuery(cluster, table, st.Duration())
+		m.reportExec(cluster, table, dur)
 		slog.Tracef(ctx, "%s const:%d cls:%s table:%s dur:%d", fun, consistency, cluster, table, dur)
 	}()
 
@@ -0,0 +1,86 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dbroutertest 提供路由到 sqlite 内存库的 dbrouter.Router, 用于离线测试通过 SqlExec/OrmExec 访问数据库的代码.
+//
+// 每个内存库只有一个连接, 并发执行的语句依次排队; 持有未关闭的 Rows 或未结束的事务时,
+// 再通过同一 cluster 执行其他语句(事务中应使用 Tx)会一直等待连接
+package dbroutertest
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/shawnfeng/sutil/dbrouter"
+	"testing"
+)
+
+type lookup struct {
+	Instance string `json:"instance"`
+	Match    string `json:"match"`
+	Express  string `json:"express"`
+}
+
+type instance struct {
+	Dbtype string                 `json:"dbtype"`
+	Dbname string                 `json:"dbname"`
+	Dbcfg  map[string]interface{} `json:"dbcfg"`
+}
+
+// Config 返回 clusters 的路由配置, 每个 cluster 的所有表都路由到一个同名的 sqlite 内存库实例
+func Config(clusters ...string) []byte {
+	cfg := struct {
+		Cluster   map[string][]*lookup `json:"cluster"`
+		Instances map[string]*instance `json:"instances"`
+	}{
+		Cluster:   make(map[string][]*lookup),
+		Instances: make(map[string]*instance),
+	}
+
+	for _, cluster := range clusters {
+		cfg.Cluster[cluster] = []*lookup{{Instance: cluster, Match: "regex", Express: ".*"}}
+		cfg.Instances[cluster] = &instance{
+			Dbtype: dbrouter.DB_TYPE_SQLITE,
+			Dbname: cluster,
+			Dbcfg:  map[string]interface{}{"addrs": []string{":memory:"}},
+		}
+	}
+
+	data, _ := json.Marshal(cfg)
+	return data
+}
+
+// NewRouter 创建路由到 sqlite 内存库的 Router, 每次调用得到的都是新的空库
+func NewRouter(clusters ...string) (*dbrouter.Router, error) {
+	return dbrouter.NewRouterWithConfigType(dbrouter.CONFIG_TYPE_SIMPLE, Config(clusters...))
+}
+
+// Setup 为 schema 中的每个 cluster 创建 sqlite 内存库并执行建表语句, 测试结束时关闭
+func Setup(t testing.TB, schema map[string][]string) *dbrouter.Router {
+	var clusters []string
+	for cluster := range schema {
+		clusters = append(clusters, cluster)
+	}
+
+	router, err := NewRouter(clusters...)
+	if err != nil {
+		t.Fatalf("new router err: %s", err.Error())
+	}
+	t.Cleanup(router.Close)
+
+	ctx := context.Background()
+	for cluster, stmts := range schema {
+		err := router.SqlExec(ctx, cluster, func(db *dbrouter.DB, tables []interface{}) error {
+			for _, stmt := range stmts {
+				if _, err := db.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, "schema")
+		if err != nil {
+			t.Fatalf("setup cluster: %s err: %s", cluster, err.Error())
+		}
+	}
+	return router
+}
@@ -0,0 +1,106 @@
+package dbroutertest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/shawnfeng/sutil/dbrouter"
+	"github.com/stretchr/testify/assert"
+)
+
+type user struct {
+	ID   int64  `db:"id" gorm:"column:id;primary_key"`
+	Name string `db:"name" gorm:"column:name"`
+}
+
+func (user) TableName() string {
+	return "user"
+}
+
+func TestSetup(t *testing.T) {
+	router := Setup(t, map[string][]string{
+		"account": {"CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT NOT NULL)"},
+	})
+	ctx := context.Background()
+
+	err := router.SqlExec(ctx, "account", func(db *dbrouter.DB, tables []interface{}) error {
+		_, err := db.ExecWrapper(tables, "INSERT INTO %s (id, name) VALUES (?, ?)", 1, "alice")
+		return err
+	}, "user")
+	assert.NoError(t, err)
+
+	err = router.OrmExec(ctx, "account", func(db *dbrouter.GormDB, tables []interface{}) error {
+		return db.Create(&user{ID: 2, Name: "bob"}).Error
+	}, "user")
+	assert.NoError(t, err)
+
+	var users []user
+	err = router.SqlExec(ctx, "account", func(db *dbrouter.DB, tables []interface{}) error {
+		return db.SelectContextWrapper(ctx, tables, &users, "SELECT id, name FROM %s ORDER BY id")
+	}, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, []user{{1, "alice"}, {2, "bob"}}, users)
+
+	var name string
+	err = router.OrmExec(ctx, "account", func(db *dbrouter.GormDB, tables []interface{}) error {
+		var u user
+		err := db.Where("id = ?", 2).First(&u).Error
+		name = u.Name
+		return err
+	}, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", name)
+}
+
+func TestNewRouterIsolated(t *testing.T) {
+	schema := map[string][]string{"account": {"CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT)"}}
+	r1 := Setup(t, schema)
+	r2 := Setup(t, schema)
+	ctx := context.Background()
+
+	err := r1.SqlExec(ctx, "account", func(db *dbrouter.DB, tables []interface{}) error {
+		_, err := db.ExecWrapper(tables, "INSERT INTO %s (id, name) VALUES (?, ?)", 1, "alice")
+		return err
+	}, "user")
+	assert.NoError(t, err)
+
+	var count int
+	err = r2.SqlExec(ctx, "account", func(db *dbrouter.DB, tables []interface{}) error {
+		return db.GetWrapper(tables, &count, "SELECT COUNT(*) FROM %s")
+	}, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	router := Setup(t, map[string][]string{
+		"account": {"CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT NOT NULL)"},
+	})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			errs <- router.SqlExec(ctx, "account", func(db *dbrouter.DB, tables []interface{}) error {
+				_, err := db.ExecContextWrapper(ctx, tables, "INSERT INTO %s (id, name) VALUES (?, ?)", id, "u")
+				return err
+			}, "user")
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	var count int
+	err := router.SqlExec(ctx, "account", func(db *dbrouter.DB, tables []interface{}) error {
+		return db.GetContextWrapper(ctx, tables, &count, "SELECT COUNT(*) FROM %s")
+	}, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, 20, count)
+}
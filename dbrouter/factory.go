@@ -6,10 +6,25 @@ package dbrouter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	//"strings"
 )
 
+// instanceConfigError 为实例配置有误(实例或 group 不存在, dbtype 不支持)导致的创建失败, 重连无法恢复
+type instanceConfigError struct {
+	err error
+}
+
+func (e *instanceConfigError) Error() string {
+	return e.err.Error()
+}
+
+func isInstanceConfigError(err error) bool {
+	var e *instanceConfigError
+	return errors.As(err, &e)
+}
+
 func parseKey(key string) (instance string) {
 	/*
 		items := strings.Split(key, "-")
@@ -33,20 +48,17 @@ func Factory(ctx context.Context, key, group string, configer Configer) (in Inst
 
 	config := configer.GetConfigByGroup(ctx, instance, group)
 	if len(config.DBAddr) == 0 {
-		return nil, fmt.Errorf("config.DBAddr err, key: %s", key)
+		return nil, &instanceConfigError{fmt.Errorf("config.DBAddr err, key: %s", key)}
 	}
 
 	switch config.DBType {
 	case DB_TYPE_MONGO:
-		return NewMongo(config.DBType, config.DBName, config.UserName, config.PassWord, config.DBAddr, config.TimeOut)
-
-	case DB_TYPE_MYSQL:
-		fallthrough
+		return NewMongoWithConfig(config)
 
-	case DB_TYPE_POSTGRES:
-		return NewSql(config.DBType, config.DBName, config.DBAddr[0], config.UserName, config.PassWord, config.TimeOut)
+	case DB_TYPE_MYSQL, DB_TYPE_POSTGRES, DB_TYPE_SQLITE:
+		return NewSqlWithConfig(config)
 
 	default:
-		return nil, fmt.Errorf("dbType err, key: %s", key)
+		return nil, &instanceConfigError{fmt.Errorf("dbType err, key: %s", key)}
 	}
 }
@@ -6,41 +6,83 @@ package dbrouter
 
 import (
 	"context"
-	"fmt"
+	"database/sql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"time"
 )
 
 type GormDB struct {
 	*gorm.DB
+	// replica 为本次执行选中的从库, 为空时读写都走主库
+	replica *gorm.DB
 }
 
 func NewGormDB(gormdb *gorm.DB) *GormDB {
 	db := &GormDB{
-		gormdb,
+		DB: gormdb,
 	}
 	return db
 }
 
-func dialByGorm(info *Sql) (db *gorm.DB, err error) {
-	fun := "dialByGorm -->"
+// Replica 返回本次执行选中的从库, 没有可用从库时返回主库, 只能用于读
+func (db *GormDB) Replica() *gorm.DB {
+	if db.replica != nil {
+		return db.replica
+	}
+	return db.DB
+}
+
+// bind 返回注入了语句统计的副本, 不修改实例上共享的 gorm.DB;
+// gorm 执行每条语句后通过 logger 回调耗时, 以此上报统计、记录 span 与慢查询
+func (db *GormDB) bind(ctx context.Context, hook stmtHook) *GormDB {
+	l := &gormStmtLogger{ctx: ctx, hook: hook}
+	n := &GormDB{DB: db.DB.New()}
+	n.DB.SetLogger(l)
+	n.DB.LogMode(true)
+	if db.replica != nil {
+		n.replica = db.replica.New()
+		n.replica.SetLogger(l)
+		n.replica.LogMode(true)
+	}
+	return n
+}
 
-	var dataSourceName string
-	if info.dbType == DB_TYPE_MYSQL {
-		dataSourceName = fmt.Sprintf("%s:%s@tcp(%s)/%s", info.userName, info.passWord, info.dbAddr, info.dbName)
+// gormStmtLogger 实现 gorm 的 logger, 只在语句执行后被回调, 无法应用查询超时
+type gormStmtLogger struct {
+	ctx  context.Context
+	hook stmtHook
+}
 
-	} else if info.dbType == DB_TYPE_POSTGRES {
-		dataSourceName = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
-			info.userName, info.passWord, info.dbAddr, info.dbName)
+// Print 的参数为 gorm 的日志格式: "sql", 调用位置, 耗时, 语句, 参数, 影响行数; 或 "log", 调用位置, 错误
+func (m *gormStmtLogger) Print(values ...interface{}) {
+	fun := "gormStmtLogger.Print -->"
+
+	if len(values) < 2 {
+		return
 	}
 
-	slog.Infof(context.TODO(), "%s dbtype:%s datasourcename:%s", fun, info.dbType, dataSourceName)
-	gormdb, err := gorm.Open(info.dbType, dataSourceName)
-	if err == nil {
-		gormdb.DB().SetMaxIdleConns(8)
-		gormdb.DB().SetMaxOpenConns(128)
+	level, _ := values[0].(string)
+	if level != "sql" || len(values) < 4 {
+		slog.Errorf(m.ctx, "%s gorm %v", fun, values[2:])
+		return
 	}
 
-	return gormdb, err
+	dur, _ := values[2].(time.Duration)
+	query, _ := values[3].(string)
+	normalized := normalizeSQL(query)
+
+	span, _ := opentracing.StartSpanFromContext(m.ctx, "dbrouter.Orm", opentracing.StartTime(time.Now().Add(-dur)))
+	ext.DBType.Set(span, "sql")
+	ext.DBStatement.Set(span, normalized)
+	span.Finish()
+
+	m.hook.finishStmt(m.ctx, "Orm", normalized, dur)
+}
+
+func dialByGorm(info *Sql, sqldb *sql.DB) (db *gorm.DB, err error) {
+	return gorm.Open(driverName(info.dbType), sqldb)
 }
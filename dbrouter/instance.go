@@ -9,7 +9,19 @@ import (
 	"fmt"
 	"github.com/shawnfeng/sutil/scontext"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
 	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 3 * time.Second
+	// defaultHealthFailThreshold 次连续检查失败后摘除实例
+	defaultHealthFailThreshold = 3
+
+	defaultRedialBackOffStep = time.Second
+	defaultRedialBackOffCeil = time.Minute
 )
 
 //var DefaultInstanceManager = NewInstanceManager(Factory)
@@ -19,14 +31,37 @@ type Instancer interface {
 	Close() error
 }
 
+// Pinger 为支持健康检查的实例, 未实现的实例不做检查
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
 type FactoryFunc func(ctx context.Context, key, group string) (in Instancer, err error)
 
+// FallbackFunc 返回 group 的实例不可用时使用的备用 group
+type FallbackFunc func(ctx context.Context, group string) (string, bool)
+
+// instanceHealth 为实例的健康状态, down 为 true 时实例已被摘除, 由 redial 在后台重建
+type instanceHealth struct {
+	instance string
+	group    string
+	failures int
+	down     bool
+}
+
 type InstanceManager struct {
 	instanceMu sync.RWMutex
 	groupMu    sync.RWMutex
 	instances  map[string]Instancer
 	factory    FactoryFunc
 	groups     []string
+
+	healthMu sync.Mutex
+	health   map[string]*instanceHealth
+	fallback FallbackFunc
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewInstanceManager(factory FactoryFunc, dbChangeChan chan dbConfigChange, groups []string) *InstanceManager {
@@ -34,9 +69,12 @@ func NewInstanceManager(factory FactoryFunc, dbChangeChan chan dbConfigChange, g
 		instances: make(map[string]Instancer),
 		factory:   factory,
 		groups:    groups,
+		health:    make(map[string]*instanceHealth),
+		stop:      make(chan struct{}),
 	}
 
 	go instanceManager.dbInsChangeHandler(context.Background(), dbChangeChan)
+	go instanceManager.healthCheck(context.Background(), defaultHealthCheckInterval)
 
 	return instanceManager
 }
@@ -63,12 +101,28 @@ func (m *InstanceManager) Get(ctx context.Context, instance string) Instancer {
 	}
 
 	key := m.buildKey(instance, group)
+	if m.isDown(key) {
+		// NOTE: 实例重连期间不在请求路径上同步建连, 有备用 group 时改用备用 group 的实例
+		fallback, ok := m.fallbackGroup(ctx, group)
+		if !ok || m.isDown(m.buildKey(instance, fallback)) {
+			slog.Errorf(ctx, "%s instance: %s group: %s is down", fun, instance, group)
+			return nil
+		}
+		slog.Warnf(ctx, "%s instance: %s group: %s is down, fallback to group: %s", fun, instance, group, fallback)
+		group = fallback
+		key = m.buildKey(instance, group)
+	}
+
 	in, ok := m.getInstance(ctx, key)
 	if ok == false {
 		slog.Infof(ctx, "%s newInstance, instance: %s", fun, instance)
 		in, err = m.buildInstance(ctx, instance, group)
 		if err != nil {
 			slog.Errorf(ctx, "%s NewInstance err, instance: %s, err: %s", fun, instance, err.Error())
+			// NOTE: 配置错误重连无法恢复, 不标记为不可用, 避免为每个错误的 key 启动重连
+			if !isInstanceConfigError(err) {
+				m.markDown(ctx, instance, group)
+			}
 			return nil
 		}
 
@@ -101,7 +155,7 @@ func (m *InstanceManager) buildInstance(ctx context.Context, instance, group str
 	if group != DefaultGroup {
 		if !m.isInGroup(group) {
 			if group == TestGroup {
-				return nil, fmt.Errorf("db config don't have group: %s", group)
+				return nil, &instanceConfigError{fmt.Errorf("db config don't have group: %s", group)}
 			}
 			group = DefaultGroup
 		}
@@ -121,11 +175,189 @@ func (m *InstanceManager) buildInstance(ctx context.Context, instance, group str
 	}
 
 	m.instances[key] = in
+	m.markUp(ctx, instance, group)
 	return in, nil
 }
 
+func (m *InstanceManager) fallbackGroup(ctx context.Context, group string) (string, bool) {
+	if m.fallback == nil {
+		return "", false
+	}
+	fallback, ok := m.fallback(ctx, group)
+	if !ok || fallback == group {
+		return "", false
+	}
+	return fallback, true
+}
+
+func (m *InstanceManager) isDown(key string) bool {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+
+	h, ok := m.health[key]
+	return ok && h.down
+}
+
+func (m *InstanceManager) markUp(ctx context.Context, instance, group string) {
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+
+	m.health[m.buildKey(instance, group)] = &instanceHealth{
+		instance: instance,
+		group:    group,
+	}
+	reportInstanceHealth(instance, group, true)
+}
+
+// markDown 将实例标记为不可用并在后台重连, 已在重连中时不重复启动
+func (m *InstanceManager) markDown(ctx context.Context, instance, group string) {
+	key := m.buildKey(instance, group)
+
+	m.healthMu.Lock()
+	defer m.healthMu.Unlock()
+
+	if h, ok := m.health[key]; ok && h.down {
+		return
+	}
+	h := &instanceHealth{
+		instance: instance,
+		group:    group,
+		down:     true,
+	}
+	m.health[key] = h
+	reportInstanceHealth(instance, group, false)
+
+	go m.redial(context.Background(), key, h)
+}
+
+// evict 摘除实例并关闭, 之后由 redial 重建
+func (m *InstanceManager) evict(ctx context.Context, instance, group string) {
+	fun := "InstanceManager.evict -->"
+	slog.Warnf(ctx, "%s evict unhealthy instance: %s group: %s", fun, instance, group)
+
+	m.closeInstance(ctx, instance, group)
+	m.markDown(ctx, instance, group)
+}
+
+// redial 以退避的方式重建实例, 配置变更清除了该实例的健康状态或 InstanceManager 关闭后退出
+func (m *InstanceManager) redial(ctx context.Context, key string, h *instanceHealth) {
+	fun := "InstanceManager.redial -->"
+
+	bo := stime.NewBackOffCtrl(defaultRedialBackOffStep, defaultRedialBackOffCeil)
+	for {
+		bo.BackOff()
+
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+
+		m.healthMu.Lock()
+		current := m.health[key] == h
+		m.healthMu.Unlock()
+		if !current {
+			return
+		}
+
+		in, err := m.factory(ctx, h.instance, h.group)
+		if err == nil {
+			err = pingInstance(ctx, in)
+			if err != nil {
+				in.Close()
+			}
+		}
+		if err != nil {
+			slog.Warnf(ctx, "%s instance: %s group: %s err: %s", fun, h.instance, h.group, err.Error())
+			continue
+		}
+
+		m.instanceMu.Lock()
+		if old, ok := m.instances[key]; ok {
+			go old.Close()
+		}
+		m.instances[key] = in
+		m.instanceMu.Unlock()
+
+		slog.Infof(ctx, "%s instance: %s group: %s recovered", fun, h.instance, h.group)
+		m.markUp(ctx, h.instance, h.group)
+		return
+	}
+}
+
+func pingInstance(ctx context.Context, in Instancer) error {
+	pinger, ok := in.(Pinger)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultHealthCheckTimeout)
+	defer cancel()
+	return pinger.Ping(ctx)
+}
+
+func (m *InstanceManager) healthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.checkInstances(ctx)
+		}
+	}
+}
+
+// checkInstances ping 所有已建立的实例, 连续失败 defaultHealthFailThreshold 次后摘除
+func (m *InstanceManager) checkInstances(ctx context.Context) {
+	fun := "InstanceManager.checkInstances -->"
+
+	m.instanceMu.RLock()
+	instances := make(map[string]Instancer, len(m.instances))
+	for key, in := range m.instances {
+		instances[key] = in
+	}
+	m.instanceMu.RUnlock()
+
+	for key, in := range instances {
+		m.healthMu.Lock()
+		h, ok := m.health[key]
+		m.healthMu.Unlock()
+		if !ok || h.down {
+			continue
+		}
+
+		err := pingInstance(ctx, in)
+
+		m.healthMu.Lock()
+		if err == nil {
+			h.failures = 0
+		} else {
+			h.failures++
+		}
+		failures := h.failures
+		m.healthMu.Unlock()
+
+		if err == nil {
+			reportInstanceHealth(h.instance, h.group, true)
+			continue
+		}
+
+		slog.Warnf(ctx, "%s ping instance: %s group: %s failures: %d err: %s", fun, h.instance, h.group, failures, err.Error())
+		if failures >= defaultHealthFailThreshold {
+			m.evict(ctx, h.instance, h.group)
+		}
+	}
+}
+
 func (m *InstanceManager) Close() {
 	fun := "InstanceManager.Close -->"
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+
 	m.instanceMu.Lock()
 	defer m.instanceMu.Unlock()
 
@@ -161,7 +393,18 @@ func (m *InstanceManager) handleDbInsChange(ctx context.Context, dbInstanceChang
 }
 
 func (m *InstanceManager) closeDbInstance(ctx context.Context, insName, group string) {
-	fun := "InstanceManager.closeDbInstance -->"
+	key := m.buildKey(insName, group)
+
+	// NOTE: 配置变更后按新配置重新建连, 清除健康状态使进行中的 redial 退出
+	m.healthMu.Lock()
+	delete(m.health, key)
+	m.healthMu.Unlock()
+
+	m.closeInstance(ctx, insName, group)
+}
+
+func (m *InstanceManager) closeInstance(ctx context.Context, insName, group string) {
+	fun := "InstanceManager.closeInstance -->"
 	key := m.buildKey(insName, group)
 
 	m.instanceMu.Lock()
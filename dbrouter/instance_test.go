@@ -0,0 +1,152 @@
+package dbrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeInstance struct {
+	mu      sync.Mutex
+	pingErr error
+	closed  bool
+}
+
+func (m *fakeInstance) GetType() string {
+	return "fake"
+}
+
+func (m *fakeInstance) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pingErr
+}
+
+func (m *fakeInstance) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+type fakeFactory struct {
+	mu   sync.Mutex
+	fail map[string]bool
+	// unknown 中的实例没有配置
+	unknown map[string]bool
+}
+
+func (m *fakeFactory) setFail(group string, fail bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail[group] = fail
+}
+
+func (m *fakeFactory) build(ctx context.Context, key, group string) (Instancer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unknown[key] {
+		return nil, &instanceConfigError{errors.New("config.DBAddr err")}
+	}
+	if m.fail[group] {
+		return nil, errors.New("dial failed")
+	}
+	return &fakeInstance{}, nil
+}
+
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func newTestInstanceManager(factory *fakeFactory) *InstanceManager {
+	m := NewInstanceManager(factory.build, make(chan dbConfigChange), []string{DefaultGroup, "g1"})
+	m.fallback = func(ctx context.Context, group string) (string, bool) {
+		return "g1", group == DefaultGroup
+	}
+	return m
+}
+
+func TestInstanceManagerFallback(t *testing.T) {
+	factory := &fakeFactory{fail: map[string]bool{DefaultGroup: true}}
+	m := newTestInstanceManager(factory)
+	defer m.Close()
+	ctx := context.Background()
+
+	assert.Nil(t, m.Get(ctx, "user0"))
+	assert.True(t, m.isDown(m.buildKey("user0", DefaultGroup)))
+
+	in := m.Get(ctx, "user0")
+	assert.NotNil(t, in)
+	got, ok := m.getInstance(ctx, m.buildKey("user0", "g1"))
+	assert.True(t, ok)
+	assert.Equal(t, got, in)
+
+	factory.setFail(DefaultGroup, false)
+	assert.True(t, waitFor(5*time.Second, func() bool {
+		return !m.isDown(m.buildKey("user0", DefaultGroup))
+	}))
+
+	in, ok = m.getInstance(ctx, m.buildKey("user0", DefaultGroup))
+	assert.True(t, ok)
+	assert.Equal(t, in, m.Get(ctx, "user0"))
+}
+
+func TestInstanceManagerEvict(t *testing.T) {
+	factory := &fakeFactory{fail: map[string]bool{}}
+	m := newTestInstanceManager(factory)
+	defer m.Close()
+	ctx := context.Background()
+
+	in := m.Get(ctx, "user0").(*fakeInstance)
+	in.mu.Lock()
+	in.pingErr = errors.New("connection refused")
+	in.mu.Unlock()
+
+	factory.setFail(DefaultGroup, true)
+	for i := 0; i < defaultHealthFailThreshold-1; i++ {
+		m.checkInstances(ctx)
+		assert.False(t, m.isDown(m.buildKey("user0", DefaultGroup)))
+	}
+	m.checkInstances(ctx)
+	assert.True(t, m.isDown(m.buildKey("user0", DefaultGroup)))
+	assert.True(t, waitFor(time.Second, func() bool {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+		return in.closed
+	}))
+
+	_, ok := m.getInstance(ctx, m.buildKey("user0", DefaultGroup))
+	assert.False(t, ok)
+	assert.NotEqual(t, in, m.Get(ctx, "user0"))
+}
+
+func TestInstanceManagerConfigError(t *testing.T) {
+	factory := &fakeFactory{fail: map[string]bool{}, unknown: map[string]bool{"": true, "user9": true}}
+	m := newTestInstanceManager(factory)
+	defer m.Close()
+	ctx := context.Background()
+
+	for _, instance := range []string{"", "user9"} {
+		assert.Nil(t, m.Get(ctx, instance))
+		assert.False(t, m.isDown(m.buildKey(instance, DefaultGroup)))
+	}
+
+	m.healthMu.Lock()
+	assert.Empty(t, m.health)
+	m.healthMu.Unlock()
+
+	assert.True(t, isInstanceConfigError(fmt.Errorf("wrap: %w", &instanceConfigError{errors.New("x")})))
+	assert.False(t, isInstanceConfigError(errors.New("dial failed")))
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"database/sql"
+	"github.com/shawnfeng/sutil/smetric"
+	"time"
+)
+
+const (
+	defaultPoolStatsInterval = 10 * time.Second
+
+	metricPoolOpenConns    = "dbrouter_pool_open_connections"
+	metricPoolInUse        = "dbrouter_pool_in_use_connections"
+	metricPoolIdle         = "dbrouter_pool_idle_connections"
+	metricPoolWaitCount    = "dbrouter_pool_wait_count"
+	metricPoolWaitDuration = "dbrouter_pool_wait_duration_seconds"
+
+	metricExecDuration      = "dbrouter_exec_duration_seconds"
+	metricStatementDuration = "dbrouter_statement_duration_seconds"
+
+	metricInstanceHealthy = "dbrouter_instance_healthy"
+
+	metricLabelInstance    = "instance"
+	metricLabelGroup       = "group"
+	metricLabelAddr        = "addr"
+	metricLabelCluster     = "cluster"
+	metricLabelTable       = "table"
+	metricLabelFingerprint = "fingerprint"
+)
+
+var queryDurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func poolLabels(instance, group, addr string) []smetric.Label {
+	return []smetric.Label{
+		{Name: metricLabelInstance, Value: smetric.SafePromethuesValue(instance)},
+		{Name: metricLabelGroup, Value: smetric.SafePromethuesValue(group)},
+		{Name: metricLabelAddr, Value: smetric.SafePromethuesValue(addr)},
+	}
+}
+
+func setPoolGauge(name string, val float64, labels []smetric.Label) {
+	smetric.DefaultMetrics.SetGaugeCreateIfAbsent([]string{smetric.Name_space_palfish, name}, val, labels)
+}
+
+// reportPoolStat 上报连接池状态, WaitCount 与 WaitDuration 为累计值
+func reportPoolStat(instance, group, addr string, stats sql.DBStats) {
+	labels := poolLabels(instance, group, addr)
+	setPoolGauge(metricPoolOpenConns, float64(stats.OpenConnections), labels)
+	setPoolGauge(metricPoolInUse, float64(stats.InUse), labels)
+	setPoolGauge(metricPoolIdle, float64(stats.Idle), labels)
+	setPoolGauge(metricPoolWaitCount, float64(stats.WaitCount), labels)
+	setPoolGauge(metricPoolWaitDuration, stats.WaitDuration.Seconds(), labels)
+}
+
+// reportInstanceHealth 上报实例的健康状态, 1 为可用, 0 为已摘除等待重连
+func reportInstanceHealth(instance, group string, healthy bool) {
+	var val float64
+	if healthy {
+		val = 1
+	}
+	labels := []smetric.Label{
+		{Name: metricLabelInstance, Value: smetric.SafePromethuesValue(instance)},
+		{Name: metricLabelGroup, Value: smetric.SafePromethuesValue(group)},
+	}
+	smetric.DefaultMetrics.SetGaugeCreateIfAbsent([]string{smetric.Name_space_palfish, metricInstanceHealthy}, val, labels)
+}
+
+func queryLabels(cluster, table string) []smetric.Label {
+	return []smetric.Label{
+		{Name: metricLabelCluster, Value: smetric.SafePromethuesValue(cluster)},
+		{Name: metricLabelTable, Value: smetric.SafePromethuesValue(table)},
+	}
+}
+
+// reportExecDuration 上报一次 SqlExec/OrmExec/Mongo 执行的耗时, 分位数通过 histogram_quantile 计算
+func reportExecDuration(cluster, table string, dur time.Duration) {
+	smetric.DefaultMetrics.AddHistoramSampleCreateIfAbsent([]string{smetric.Name_space_palfish, metricExecDuration},
+		dur.Seconds(), queryLabels(cluster, table), queryDurationBuckets)
+}
+
+// reportStatement 上报单条语句的耗时, fingerprint 为语句模板的摘要
+func reportStatement(cluster, table, fingerprint string, dur time.Duration) {
+	labels := append(queryLabels(cluster, table), smetric.Label{Name: metricLabelFingerprint, Value: fingerprint})
+	smetric.DefaultMetrics.AddHistoramSampleCreateIfAbsent([]string{smetric.Name_space_palfish, metricStatementDuration},
+		dur.Seconds(), labels, queryDurationBuckets)
+}
+
+// reportPoolStats 定期上报主库与从库的连接池状态, 实例关闭后退出
+func (m *Sql) reportPoolStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			reportPoolStat(m.instance, m.group, m.dbAddr, m.db.Stats())
+			if m.replicas != nil {
+				for _, r := range m.replicas.replicas {
+					reportPoolStat(m.instance, m.group, r.addr, r.db.Stats())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"hash/fnv"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MIGRATE_UP   = "up"
+	MIGRATE_DOWN = "down"
+
+	migrationTable            = "dbrouter_schema_migrations"
+	defaultMigrateLockTimeout = 10 * time.Second
+)
+
+var (
+	migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	// {{shard:user}} 展开为逻辑表 user 在当前实例上的每个物理表
+	shardPlaceholderRegexp = regexp.MustCompile(`\{\{shard:(\w+)\}\}`)
+)
+
+// Migration 为一个版本的迁移, 由 <version>_<name>.up.sql 与可选的 <version>_<name>.down.sql 组成
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// MigrationStep 为迁移在一个实例上要执行的操作, dry run 时只返回不执行
+type MigrationStep struct {
+	Instance   string
+	Version    int64
+	Name       string
+	Direction  string
+	Statements []string
+}
+
+func (m *MigrationStep) String() string {
+	return fmt.Sprintf("%s %s %d_%s (%d statements)", m.Instance, m.Direction, m.Version, m.Name, len(m.Statements))
+}
+
+// LoadMigrations 读取 dir 下的迁移文件, 按版本升序返回
+func LoadMigrations(dir string) ([]*Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		match := migrationFileRegexp.FindStringSubmatch(f.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration:%s version err:%s", f.Name(), err.Error())
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mig
+		} else if mig.Name != match[2] {
+			return nil, fmt.Errorf("migration version:%d has different names: %s, %s", version, mig.Name, match[2])
+		}
+
+		stmts := splitStatements(string(data))
+		if match[3] == MIGRATE_UP {
+			mig.Up = stmts
+		} else {
+			mig.Down = stmts
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if len(mig.Up) == 0 {
+			return nil, fmt.Errorf("migration:%d_%s has no up statements", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// splitStatements 按 ; 切分语句, 跳过引号内的 ; 与 -- 、/* */ 注释
+func splitStatements(data string) []string {
+	var stmts []string
+	var b strings.Builder
+
+	flush := func() {
+		if s := strings.TrimSpace(b.String()); s != "" {
+			stmts = append(stmts, s)
+		}
+		b.Reset()
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			j := i + 1
+			for ; j < len(data); j++ {
+				if data[j] == '\\' && c != '`' {
+					j++
+				} else if data[j] == c {
+					break
+				}
+			}
+			if j >= len(data) {
+				j = len(data) - 1
+			}
+			b.WriteString(data[i : j+1])
+			i = j
+
+		case c == '-' && i+1 < len(data) && data[i+1] == '-':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			b.WriteByte('\n')
+
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := strings.Index(data[i+2:], "*/")
+			if end < 0 {
+				i = len(data)
+			} else {
+				i += end + 3
+			}
+			b.WriteByte(' ')
+
+		case c == ';':
+			flush()
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+	flush()
+
+	return stmts
+}
+
+// Migrator 将迁移应用到 cluster 涉及的每个实例上, 每个实例上的已执行版本记录在 dbrouter_schema_migrations 中
+type Migrator struct {
+	router     *Router
+	cluster    string
+	migrations []*Migration
+}
+
+func NewMigrator(router *Router, cluster string, migrations []*Migration) *Migrator {
+	return &Migrator{
+		router:     router,
+		cluster:    cluster,
+		migrations: migrations,
+	}
+}
+
+// expand 展开语句中的分片占位符, 返回语句在 instance 上要执行的物理语句;
+// 不含占位符的语句在集群的每个实例上执行
+func (m *Migrator) expand(ctx context.Context, instance, stmt string) ([]string, error) {
+	match := shardPlaceholderRegexp.FindAllStringSubmatch(stmt, -1)
+	if len(match) == 0 {
+		return []string{stmt}, nil
+	}
+
+	table := match[0][1]
+	for _, mt := range match[1:] {
+		if mt[1] != table {
+			return nil, fmt.Errorf("statement references more than one shard table: %s, %s", table, mt[1])
+		}
+	}
+
+	rule := configShardRule(ctx, m.router.configer, m.cluster, table)
+	if rule == nil {
+		return nil, fmt.Errorf("shard rule not find: cluster:%s table:%s", m.cluster, table)
+	}
+	// NOTE: time 算法的分片随时间增长, 不能预先全部建出, 这里返回 Shards 的错误
+	shards, err := rule.Shards(table)
+	if err != nil {
+		return nil, err
+	}
+
+	var stmts []string
+	for _, shard := range shards {
+		if shard.Instance == instance {
+			stmts = append(stmts, shardPlaceholderRegexp.ReplaceAllString(stmt, shard.Table))
+		}
+	}
+	return stmts, nil
+}
+
+func (m *Migrator) plan(ctx context.Context, instance, direction string, mig *Migration) (*MigrationStep, error) {
+	src := mig.Up
+	if direction == MIGRATE_DOWN {
+		if len(mig.Down) == 0 {
+			return nil, fmt.Errorf("migration:%d_%s has no down statements", mig.Version, mig.Name)
+		}
+		src = mig.Down
+	}
+
+	step := &MigrationStep{
+		Instance:  instance,
+		Version:   mig.Version,
+		Name:      mig.Name,
+		Direction: direction,
+	}
+	for _, stmt := range src {
+		stmts, err := m.expand(ctx, instance, stmt)
+		if err != nil {
+			return nil, fmt.Errorf("migration:%d_%s err:%s", mig.Version, mig.Name, err.Error())
+		}
+		step.Statements = append(step.Statements, stmts...)
+	}
+	return step, nil
+}
+
+// Up 在每个实例上依次执行未执行过的迁移
+func (m *Migrator) Up(ctx context.Context, dryRun bool) ([]*MigrationStep, error) {
+	return m.run(ctx, dryRun, func(ctx context.Context, instance string, applied map[int64]bool) ([]*MigrationStep, error) {
+		var steps []*MigrationStep
+		for _, mig := range m.migrations {
+			if applied[mig.Version] {
+				continue
+			}
+			step, err := m.plan(ctx, instance, MIGRATE_UP, mig)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		}
+		return steps, nil
+	})
+}
+
+// Down 在每个实例上按版本倒序回滚最近执行的 n 个迁移
+func (m *Migrator) Down(ctx context.Context, n int, dryRun bool) ([]*MigrationStep, error) {
+	return m.run(ctx, dryRun, func(ctx context.Context, instance string, applied map[int64]bool) ([]*MigrationStep, error) {
+		var steps []*MigrationStep
+		for i := len(m.migrations) - 1; i >= 0 && len(steps) < n; i-- {
+			mig := m.migrations[i]
+			if !applied[mig.Version] {
+				continue
+			}
+			step, err := m.plan(ctx, instance, MIGRATE_DOWN, mig)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		}
+		return steps, nil
+	})
+}
+
+type migratePlanner func(ctx context.Context, instance string, applied map[int64]bool) ([]*MigrationStep, error)
+
+func (m *Migrator) run(ctx context.Context, dryRun bool, planner migratePlanner) ([]*MigrationStep, error) {
+	fun := "Migrator.run -->"
+
+	instances := configClusterInstances(ctx, m.router.configer, m.cluster)
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("cluster:%s has no instance", m.cluster)
+	}
+
+	var all []*MigrationStep
+	for _, instance := range instances {
+		steps, err := m.runInstance(ctx, instance, dryRun, planner)
+		all = append(all, steps...)
+		if err != nil {
+			slog.Errorf(ctx, "%s cluster:%s instance:%s err:%s", fun, m.cluster, instance, err.Error())
+			return all, fmt.Errorf("instance:%s err:%s", instance, err.Error())
+		}
+	}
+	return all, nil
+}
+
+// runInstance 在 instance 的主库上持有迁移锁执行迁移, 返回已执行(dry run 时为计划执行)的步骤
+func (m *Migrator) runInstance(ctx context.Context, instance string, dryRun bool, planner migratePlanner) ([]*MigrationStep, error) {
+	fun := "Migrator.runInstance -->"
+
+	dbsql, err := m.router.getSql(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: 锁与迁移使用同一个连接, mysql 的 GET_LOCK 与 postgres 的 advisory lock 都是会话级的
+	conn, err := dbsql.db.DB.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dbType := dbsql.dbType
+	if !dryRun {
+		unlock, err := migrateLock(ctx, conn, dbType, m.cluster)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		if err := createMigrationTable(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	applied, err := appliedVersions(ctx, conn, dbType, m.cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	steps, err := planner(ctx, instance, applied)
+	if err != nil || dryRun {
+		return steps, err
+	}
+
+	for i, step := range steps {
+		slog.Infof(ctx, "%s cluster:%s apply %s", fun, m.cluster, step)
+		if err := m.apply(ctx, conn, dbType, step); err != nil {
+			return steps[:i], fmt.Errorf("%d_%s %s err:%s", step.Version, step.Name, step.Direction, err.Error())
+		}
+	}
+	return steps, nil
+}
+
+// apply 在事务中执行一个迁移并更新记录
+// NOTE: mysql 的 DDL 会隐式提交, 迁移中途失败时已执行的 DDL 不会回滚, 需要手动处理后重试
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, dbType string, step *MigrationStep) error {
+	fun := "Migrator.apply -->"
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range step.Statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			if rerr := tx.Rollback(); rerr != nil {
+				slog.Errorf(ctx, "%s rollback err:%s", fun, rerr.Error())
+			}
+			return fmt.Errorf("exec %q err:%s", stmt, err.Error())
+		}
+	}
+
+	if step.Direction == MIGRATE_UP {
+		_, err = tx.ExecContext(ctx, rebind(dbType, "INSERT INTO "+migrationTable+" (cluster, version, name, applied_at) VALUES (?, ?, ?, ?)"),
+			m.cluster, step.Version, step.Name, time.Now())
+	} else {
+		_, err = tx.ExecContext(ctx, rebind(dbType, "DELETE FROM "+migrationTable+" WHERE cluster = ? AND version = ?"),
+			m.cluster, step.Version)
+	}
+	if err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			slog.Errorf(ctx, "%s rollback err:%s", fun, rerr.Error())
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func rebind(dbType, query string) string {
+	return sqlx.Rebind(sqlx.BindType(driverName(dbType)), query)
+}
+
+func createMigrationTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+migrationTable+` (
+	cluster VARCHAR(128) NOT NULL,
+	version BIGINT NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (cluster, version)
+)`)
+	return err
+}
+
+// appliedVersions 返回 cluster 在实例上已执行的版本, 记录表不存在时视为没有执行过
+func appliedVersions(ctx context.Context, conn *sql.Conn, dbType, cluster string) (map[int64]bool, error) {
+	var query string
+	switch dbType {
+	case DB_TYPE_MYSQL:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	case DB_TYPE_POSTGRES:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = CURRENT_SCHEMA() AND table_name = ?"
+	case DB_TYPE_SQLITE:
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	default:
+		return nil, fmt.Errorf("dbtype:%s not support", dbType)
+	}
+
+	var count int
+	err := conn.QueryRowContext(ctx, rebind(dbType, query), migrationTable).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]bool)
+	if count == 0 {
+		return applied, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, rebind(dbType, "SELECT version FROM "+migrationTable+" WHERE cluster = ?"), cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// migrateLock 获取实例上 cluster 的迁移锁, 防止多个进程同时迁移同一个实例
+func migrateLock(ctx context.Context, conn *sql.Conn, dbType, cluster string) (func(), error) {
+	fun := "migrateLock -->"
+
+	name := migrationTable + ":" + cluster
+	switch dbType {
+	case DB_TYPE_MYSQL:
+		var got sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(defaultMigrateLockTimeout/time.Second)).Scan(&got)
+		if err != nil {
+			return nil, err
+		}
+		if got.Int64 != 1 {
+			return nil, fmt.Errorf("get migrate lock:%s timeout", name)
+		}
+		return func() {
+			if _, err := conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name); err != nil {
+				slog.Errorf(ctx, "%s release lock:%s err:%s", fun, name, err.Error())
+			}
+		}, nil
+
+	case DB_TYPE_POSTGRES:
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		key := int64(h.Sum64())
+
+		lctx, cancel := context.WithTimeout(ctx, defaultMigrateLockTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(lctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+			return nil, fmt.Errorf("get migrate lock:%s err:%s", name, err.Error())
+		}
+		return func() {
+			if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+				slog.Errorf(ctx, "%s release lock:%s err:%s", fun, name, err.Error())
+			}
+		}, nil
+
+	case DB_TYPE_SQLITE:
+		// NOTE: sqlite 没有会话级的锁, 写事务由数据库文件锁串行化
+		return func() {}, nil
+
+	default:
+		return nil, fmt.Errorf("dbtype:%s not support", dbType)
+	}
+}
@@ -0,0 +1,123 @@
+package dbrouter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+	stmts := splitStatements(`
+-- create user; table
+CREATE TABLE user (id INT, note VARCHAR(32) DEFAULT 'a;b');
+/* comment; */ INSERT INTO user VALUES (1, "x\";y");
+
+`)
+	assert.Equal(t, []string{
+		"CREATE TABLE user (id INT, note VARCHAR(32) DEFAULT 'a;b')",
+		`INSERT INTO user VALUES (1, "x\";y")`,
+	}, stmts)
+}
+
+func TestLoadMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbmigrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"2_add_name.up.sql":   "ALTER TABLE {{shard:user}} ADD name VARCHAR(32);",
+		"2_add_name.down.sql": "ALTER TABLE {{shard:user}} DROP name;",
+		"1_init.up.sql":       "CREATE TABLE {{shard:user}} (id INT); CREATE TABLE config (k VARCHAR(32));",
+		"README.md":           "not a migration",
+		"10_next.up.sql":      "SELECT 1",
+	}
+	for name, data := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+
+	migrations, err := LoadMigrations(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(migrations))
+	assert.Equal(t, int64(1), migrations[0].Version)
+	assert.Equal(t, "init", migrations[0].Name)
+	assert.Equal(t, 2, len(migrations[0].Up))
+	assert.Nil(t, migrations[0].Down)
+	assert.Equal(t, []string{"ALTER TABLE {{shard:user}} DROP name"}, migrations[1].Down)
+	assert.Equal(t, int64(10), migrations[2].Version)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "3_only_down.down.sql"), []byte("SELECT 1"), 0644))
+	_, err = LoadMigrations(dir)
+	assert.Error(t, err)
+}
+
+func TestMigratorPlan(t *testing.T) {
+	configer, err := NewSimpleConfiger(shardRouteConfig)
+	assert.NoError(t, err)
+	router := &Router{configer: configer}
+	ctx := context.Background()
+
+	assert.Equal(t, []string{"user0", "user1"}, configClusterInstances(ctx, configer, "account"))
+
+	migrator := NewMigrator(router, "account", []*Migration{
+		{Version: 1, Name: "init", Up: []string{"CREATE TABLE {{shard:user}} (id INT)", "CREATE TABLE config (k INT)"}},
+		{Version: 2, Name: "event", Up: []string{"CREATE TABLE {{shard:event}} (id INT)"}},
+	})
+
+	step, err := migrator.plan(ctx, "user1", MIGRATE_UP, migrator.migrations[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"CREATE TABLE user_2 (id INT)",
+		"CREATE TABLE user_3 (id INT)",
+		"CREATE TABLE config (k INT)",
+	}, step.Statements)
+
+	_, err = migrator.plan(ctx, "user1", MIGRATE_DOWN, migrator.migrations[0])
+	assert.Error(t, err)
+
+	_, err = migrator.plan(ctx, "user0", MIGRATE_UP, migrator.migrations[1])
+	assert.Error(t, err)
+
+	_, err = migrator.expand(ctx, "user0", "INSERT INTO {{shard:user}} SELECT * FROM {{shard:profile}}")
+	assert.Error(t, err)
+}
+
+func TestMigratorSqlite(t *testing.T) {
+	router, err := NewRouterWithConfigType(CONFIG_TYPE_SIMPLE, []byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "regex", "express": ".*"}]},
+		"instances": {"user0": {"dbtype": "sqlite", "dbname": "account", "dbcfg": {"addrs": [":memory:"]}}}
+	}`))
+	assert.NoError(t, err)
+	defer router.Close()
+	ctx := context.Background()
+
+	migrator := NewMigrator(router, "account", []*Migration{
+		{Version: 1, Name: "init", Up: []string{"CREATE TABLE user (id INTEGER)"}, Down: []string{"DROP TABLE user"}},
+		{Version: 2, Name: "profile", Up: []string{"CREATE TABLE profile (id INTEGER)"}, Down: []string{"DROP TABLE profile"}},
+	})
+
+	steps, err := migrator.Up(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(steps))
+
+	steps, err = migrator.Up(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(steps))
+
+	steps, err = migrator.Up(ctx, false)
+	assert.NoError(t, err)
+	assert.Empty(t, steps)
+
+	steps, err = migrator.Down(ctx, 1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(steps))
+	assert.Equal(t, int64(2), steps[0].Version)
+
+	steps, err = migrator.Up(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(steps))
+	assert.Equal(t, int64(2), steps[0].Version)
+}
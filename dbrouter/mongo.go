@@ -133,5 +133,14 @@ func (m *dbMongo) getSession(consistency mode) (*mgo.Session, error) {
 }
 
 func (m *dbMongo) Close() error {
+	m.sessMu.Lock()
+	defer m.sessMu.Unlock()
+
+	for i, s := range m.session {
+		if s != nil {
+			s.Close()
+			m.session[i] = nil
+		}
+	}
 	return nil
 }
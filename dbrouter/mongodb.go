@@ -0,0 +1,272 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"fmt"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"time"
+)
+
+const (
+	defaultMongoTimeout     = 5 * time.Second
+	defaultMongoMaxPoolSize = 128
+)
+
+// MongoOptions 为单次调用的读写选项, 为 nil 的字段使用连接的默认值(主库读, 服务端默认的 read/write concern)
+type MongoOptions struct {
+	ReadPreference *readpref.ReadPref
+	ReadConcern    *readconcern.ReadConcern
+	WriteConcern   *writeconcern.WriteConcern
+}
+
+func (m *MongoOptions) collectionOptions() *options.CollectionOptions {
+	opts := options.Collection()
+	if m == nil {
+		return opts
+	}
+	if m.ReadPreference != nil {
+		opts.SetReadPreference(m.ReadPreference)
+	}
+	if m.ReadConcern != nil {
+		opts.SetReadConcern(m.ReadConcern)
+	}
+	if m.WriteConcern != nil {
+		opts.SetWriteConcern(m.WriteConcern)
+	}
+	return opts
+}
+
+// transactionOptions 事务只能在主库上执行, 忽略 ReadPreference
+func (m *MongoOptions) transactionOptions() *options.TransactionOptions {
+	opts := options.Transaction().SetReadPreference(readpref.Primary())
+	if m == nil {
+		return opts
+	}
+	if m.ReadConcern != nil {
+		opts.SetReadConcern(m.ReadConcern)
+	}
+	if m.WriteConcern != nil {
+		opts.SetWriteConcern(m.WriteConcern)
+	}
+	return opts
+}
+
+// Mongo 为基于官方驱动的 mongo 实例, 同时保留 mgo 的连接供 MongoExecEventual 等旧接口使用
+type Mongo struct {
+	instance string
+	group    string
+	dbType   string
+	dbName   string
+	client   *mongo.Client
+
+	// legacy 的 session 在第一次使用旧接口时才建立
+	legacy *dbMongo
+}
+
+// mongoClientOptions 将实例配置转换为驱动的连接选项, 认证库与 mgo 一致, 为 dbname
+func mongoClientOptions(config *Config) *options.ClientOptions {
+	timeout := config.TimeOut
+	if timeout == 0 {
+		timeout = defaultMongoTimeout
+	}
+	maxPoolSize := config.MaxOpenConns
+	if maxPoolSize == 0 {
+		maxPoolSize = defaultMongoMaxPoolSize
+	}
+
+	opts := options.Client().
+		SetHosts(config.DBAddr).
+		SetConnectTimeout(timeout).
+		SetServerSelectionTimeout(timeout).
+		SetMaxPoolSize(uint64(maxPoolSize)).
+		SetMinPoolSize(uint64(config.MaxIdleConns)).
+		SetMaxConnIdleTime(config.ConnMaxIdleTime)
+	if config.UserName != "" {
+		opts.SetAuth(options.Credential{
+			AuthSource: config.DBName,
+			Username:   config.UserName,
+			Password:   config.PassWord,
+		})
+	}
+	return opts
+}
+
+// NewMongoWithConfig 创建 mongo 实例, 驱动在后台建立连接, 这里不等待连接成功
+func NewMongoWithConfig(config *Config) (*Mongo, error) {
+	fun := "NewMongoWithConfig -->"
+
+	opts := mongoClientOptions(config)
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("%s instance: %s err: %s", fun, config.Instance, err.Error())
+	}
+
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		slog.Errorf(context.TODO(), "%s instance:%s connect err:%s", fun, config.Instance, err.Error())
+		return nil, err
+	}
+
+	legacy, err := NewMongo(config.DBType, config.DBName, config.UserName, config.PassWord, config.DBAddr, config.TimeOut)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return &Mongo{
+		instance: config.Instance,
+		group:    config.Group,
+		dbType:   config.DBType,
+		dbName:   config.DBName,
+		client:   client,
+		legacy:   legacy,
+	}, nil
+}
+
+func (m *Mongo) GetType() string {
+	return m.dbType
+}
+
+// Client 返回驱动的 client, 用于 MongoExec 没有覆盖的场景, 如 change stream
+func (m *Mongo) Client() *mongo.Client {
+	return m.client
+}
+
+func (m *Mongo) collection(table string, opts *MongoOptions) *mongo.Collection {
+	return m.client.Database(m.dbName).Collection(table, opts.collectionOptions())
+}
+
+// Ping 检查主库的连通性, 供 InstanceManager 健康检查使用
+func (m *Mongo) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, readpref.Primary())
+}
+
+func (m *Mongo) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultMongoTimeout)
+	defer cancel()
+
+	err := m.client.Disconnect(ctx)
+	m.legacy.Close()
+	return err
+}
+
+func (m *Router) getMongo(ctx context.Context, cluster, table string) (*Mongo, error) {
+	instance := m.configer.GetInstance(ctx, cluster, table)
+	in := m.instances.Get(ctx, generateKey(instance))
+	if in == nil {
+		return nil, fmt.Errorf("db instance not find: cluster:%s table:%s", cluster, table)
+	}
+
+	db, ok := in.(*Mongo)
+	if !ok {
+		return nil, fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, in.GetType())
+	}
+	return db, nil
+}
+
+// withQueryTimeout 与 SQL 一致, ctx 没有更早的 deadline 时使用 cluster 的默认查询超时
+func (m *Router) withQueryTimeout(ctx context.Context, cluster string) (context.Context, context.CancelFunc) {
+	timeout := configQueryTimeout(ctx, m.configer, cluster)
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// MongoExec 在 cluster/table 对应的集合上执行 query, opts 控制本次调用的 read preference 与 read/write concern;
+// query 中的操作应使用传入的 ctx, 其 deadline 为调用方 ctx 与 cluster 默认查询超时中较早的一个
+func (m *Router) MongoExec(ctx context.Context, cluster, table string, opts *MongoOptions, query func(context.Context, *mongo.Collection) error) error {
+	fun := "Router.MongoExec -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.MongoExec")
+	defer span.Finish()
+	ext.DBType.Set(span, DB_TYPE_MONGO)
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, table))
+
+	st := stime.NewTimeStat()
+
+	db, err := m.getMongo(ctx, cluster, table)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		dur := st.Duration()
+		m.reportExec(cluster, table, dur)
+		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
+	}()
+
+	ctx, cancel := m.withQueryTimeout(ctx, cluster)
+	defer cancel()
+
+	err = query(ctx, db.collection(table, opts))
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(log.String(spanLogKeyError, err.Error()))
+	}
+	return err
+}
+
+// MongoTx 在 cluster/table 所在实例上以多文档事务执行 fn, fn 返回错误时回滚;
+// 遇到 TransientTransactionError 或 UnknownTransactionCommitResult 时由驱动重试整个事务, 因此 fn 需要可重入
+// NOTE: 事务需要副本集或分片集群, 且 fn 中的操作必须使用传入的 SessionContext
+func (m *Router) MongoTx(ctx context.Context, cluster, table string, opts *MongoOptions, fn func(mongo.SessionContext, *mongo.Collection) error) error {
+	fun := "Router.MongoTx -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.MongoTx")
+	defer span.Finish()
+	ext.DBType.Set(span, DB_TYPE_MONGO)
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, table))
+
+	st := stime.NewTimeStat()
+
+	db, err := m.getMongo(ctx, cluster, table)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		dur := st.Duration()
+		m.reportExec(cluster, table, dur)
+		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
+	}()
+
+	ctx, cancel := m.withQueryTimeout(ctx, cluster)
+	defer cancel()
+
+	session, err := db.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	coll := db.collection(table, opts)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc, coll)
+	}, opts.transactionOptions())
+	if err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(log.String(spanLogKeyError, err.Error()))
+		slog.Warnf(ctx, "%s cls:%s table:%s err:%s", fun, cluster, table, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package dbrouter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+func TestMongoOptions(t *testing.T) {
+	var opts *MongoOptions
+	assert.Nil(t, opts.collectionOptions().ReadPreference)
+	assert.Equal(t, readpref.PrimaryMode, opts.transactionOptions().ReadPreference.Mode())
+
+	opts = &MongoOptions{
+		ReadPreference: readpref.SecondaryPreferred(),
+		ReadConcern:    readconcern.Majority(),
+		WriteConcern:   writeconcern.Majority(),
+	}
+	coll := opts.collectionOptions()
+	assert.Equal(t, readpref.SecondaryPreferredMode, coll.ReadPreference.Mode())
+	assert.Equal(t, readconcern.Majority(), coll.ReadConcern)
+	assert.Equal(t, writeconcern.Majority(), coll.WriteConcern)
+
+	tx := opts.transactionOptions()
+	assert.Equal(t, readpref.PrimaryMode, tx.ReadPreference.Mode())
+	assert.Equal(t, readconcern.Majority(), tx.ReadConcern)
+}
+
+func TestMongoClientOptions(t *testing.T) {
+	opts := mongoClientOptions(&Config{
+		DBName:   "account",
+		DBAddr:   []string{"127.0.0.1:27017", "127.0.0.1:27018"},
+		UserName: "user",
+		PassWord: "passwd",
+	})
+	assert.NoError(t, opts.Validate())
+	assert.Equal(t, []string{"127.0.0.1:27017", "127.0.0.1:27018"}, opts.Hosts)
+	assert.Equal(t, defaultMongoTimeout, *opts.ConnectTimeout)
+	assert.Equal(t, uint64(defaultMongoMaxPoolSize), *opts.MaxPoolSize)
+	assert.Equal(t, "account", opts.Auth.AuthSource)
+
+	opts = mongoClientOptions(&Config{DBName: "account", DBAddr: []string{"127.0.0.1:27017"}, TimeOut: time.Second, MaxOpenConns: 16})
+	assert.Nil(t, opts.Auth)
+	assert.Equal(t, time.Second, *opts.ServerSelectionTimeout)
+	assert.Equal(t, uint64(16), *opts.MaxPoolSize)
+}
@@ -9,6 +9,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"sort"
+	"time"
 )
 
 const(
@@ -16,6 +18,9 @@ const(
 	TestGroup    = "test"
 )
 
+// defaultSlowThreshold 为未配置 cluster_options.slow_threshold 时的慢查询阈值
+const defaultSlowThreshold = 500 * time.Millisecond
+
 type dbLookupCfg struct {
 	Instance string `json:"instance"`
 	Match    string `json:"match"`
@@ -26,6 +31,13 @@ func (m *dbLookupCfg) String() string {
 	return fmt.Sprintf("ins:%s exp:%s match:%s", m.Instance, m.Express, m.Match)
 }
 
+type dbClusterCfg struct {
+	// QueryTimeout 为 *ContextWrapper 方法的默认查询超时, 单位毫秒, 为 0 时只受 ctx 控制
+	QueryTimeout int64 `json:"query_timeout"`
+	// SlowThreshold 为慢查询阈值, 单位毫秒, 为 0 时使用 defaultSlowThreshold, 小于 0 时不记录
+	SlowThreshold int64 `json:"slow_threshold"`
+}
+
 type dbInsCfg struct {
 	Dbtype string          `json:"dbtype"`
 	Dbname string          `json:"dbname"`
@@ -47,16 +59,42 @@ type dbInsInfo struct {
 	DBAddr   []string `json:"addrs"`
 	UserName string   `json:"user"`
 	PassWord string   `json:"passwd"`
+	// UserSecret 与 PassWordSecret 为 "<scheme>:<ref>" 形式的密钥引用, 如 env:DB_PASSWD, 配置后覆盖 user/passwd
+	UserSecret     string `json:"user_secret"`
+	PassWordSecret string `json:"passwd_secret"`
+	// Replicas 为从库列表, DBAddr[0] 为主库
+	Replicas []*Replica `json:"replicas"`
+	// MaxReplicaLag 为从库允许的最大复制延迟, 单位秒, 为 0 时不检查
+	MaxReplicaLag int64 `json:"max_replica_lag"`
+	// 连接池配置, ConnMaxLifetime 与 ConnMaxIdleTime 单位为秒
+	MaxOpenConns    int   `json:"max_open_conns"`
+	MaxIdleConns    int   `json:"max_idle_conns"`
+	ConnMaxLifetime int64 `json:"conn_max_lifetime"`
+	ConnMaxIdleTime int64 `json:"conn_max_idle_time"`
 }
 
 type routeConfig struct {
 	Cluster   map[string][]*dbLookupCfg `json:"cluster"`
 	Instances map[string]*dbInsCfg      `json:"instances"`
+	// Shards 为 cluster -> 逻辑表 -> 分片规则
+	Shards map[string]map[string]*ShardRule `json:"shards"`
+	// ClusterOptions 为 cluster 级别的选项
+	ClusterOptions map[string]*dbClusterCfg `json:"cluster_options"`
+	// FallbackGroups 为 group -> 备用 group, group 的实例不可用时改用备用 group 的同名实例
+	FallbackGroups map[string]string `json:"fallback_groups"`
 }
 
 type Parser struct {
 	dbCls *dbCluster
 	dbIns map[string]map[string]*dbInsInfo
+	// cluster -> 逻辑表 -> 分片规则
+	dbShard map[string]map[string]*ShardRule
+	// cluster -> 默认查询超时
+	queryTimeout map[string]time.Duration
+	// cluster -> 慢查询阈值
+	slowThreshold map[string]time.Duration
+	// group -> 备用 group
+	fallbackGroup map[string]string
 }
 
 func (m *Parser) String() string {
@@ -68,6 +106,52 @@ func (m *Parser) GetInstance(cluster, table string) string {
 	return instance
 }
 
+func (m *Parser) GetShardRule(cluster, table string) *ShardRule {
+	return m.dbShard[cluster][table]
+}
+
+func (m *Parser) GetQueryTimeout(cluster string) time.Duration {
+	return m.queryTimeout[cluster]
+}
+
+// GetClusterInstances 返回 cluster 的路由规则与分片规则涉及的所有实例, 按名称排序
+func (m *Parser) GetClusterInstances(cluster string) []string {
+	set := make(map[string]bool)
+	if exp := m.dbCls.clusters[cluster]; exp != nil {
+		for _, e := range exp.full {
+			set[e.lookup.Instance] = true
+		}
+		for _, e := range exp.regex {
+			set[e.lookup.Instance] = true
+		}
+	}
+	for _, rule := range m.dbShard[cluster] {
+		for _, ins := range rule.Instances {
+			set[ins] = true
+		}
+	}
+
+	instances := make([]string, 0, len(set))
+	for ins := range set {
+		instances = append(instances, ins)
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// GetFallbackGroup 返回 group 的实例不可用时使用的备用 group
+func (m *Parser) GetFallbackGroup(group string) (string, bool) {
+	fallback, ok := m.fallbackGroup[group]
+	return fallback, ok
+}
+
+func (m *Parser) GetSlowThreshold(cluster string) time.Duration {
+	if threshold, ok := m.slowThreshold[cluster]; ok {
+		return threshold
+	}
+	return defaultSlowThreshold
+}
+
 func (m *Parser) getConfig(instance, group string) *dbInsInfo {
 	if infoMap, ok := m.dbIns[group]; ok {
 		if info, ok := infoMap[instance]; ok {
@@ -121,7 +205,11 @@ func NewParser(jscfg []byte) (*Parser, error) {
 		dbCls: &dbCluster{
 			clusters: make(map[string]*clsEntry),
 		},
-		dbIns: make(map[string]map[string]*dbInsInfo),
+		dbIns:         make(map[string]map[string]*dbInsInfo),
+		dbShard:       make(map[string]map[string]*ShardRule),
+		queryTimeout:  make(map[string]time.Duration),
+		slowThreshold: make(map[string]time.Duration),
+		fallbackGroup: make(map[string]string),
 	}
 
 	var cfg routeConfig
@@ -178,6 +266,9 @@ func NewParser(jscfg []byte) (*Parser, error) {
 		// 外层配置为默认的group
 		group := DefaultGroup
 		info, err := parseDbIns(dbtype, dbname, ins, cfg, level)
+		if err == nil {
+			info, err = info.resolveSecrets(context.TODO())
+		}
 		if err != nil {
 			slog.Errorf(context.TODO(), "%s parse default dbInsInfo error, %s", fun, err.Error())
 		} else {
@@ -193,6 +284,9 @@ func NewParser(jscfg []byte) (*Parser, error) {
 			cfg = itemIns.Dbcfg
 			group = itemIns.Group
 			info, err := parseDbIns(dbtype, dbname, ins, cfg, level)
+			if err == nil {
+				info, err = info.resolveSecrets(context.TODO())
+			}
 			if err != nil {
 				slog.Errorf(context.TODO(), "%s parse %s dbInsInfo error, %s", fun, group, err.Error())
 			} else {
@@ -215,9 +309,59 @@ func NewParser(jscfg []byte) (*Parser, error) {
 		}
 	}
 
+	for c, rules := range cfg.Shards {
+		for table, rule := range rules {
+			if err := parseShardRule(rule, inss); err != nil {
+				slog.Errorf(context.TODO(), "%s shard rule in cluster:%s table:%s err:%s", fun, c, table, err.Error())
+				continue
+			}
+
+			if _, ok := r.dbShard[c]; !ok {
+				r.dbShard[c] = make(map[string]*ShardRule)
+			}
+			r.dbShard[c][table] = rule
+		}
+	}
+
+	for c, opt := range cfg.ClusterOptions {
+		if opt == nil || opt.QueryTimeout < 0 {
+			slog.Errorf(context.TODO(), "%s invalid cluster options in cluster:%s", fun, c)
+			continue
+		}
+		r.queryTimeout[c] = time.Duration(opt.QueryTimeout) * time.Millisecond
+
+		if opt.SlowThreshold < 0 {
+			r.slowThreshold[c] = 0
+		} else if opt.SlowThreshold > 0 {
+			r.slowThreshold[c] = time.Duration(opt.SlowThreshold) * time.Millisecond
+		}
+	}
+
+	for group, fallback := range cfg.FallbackGroups {
+		if _, ok := r.dbIns[fallback]; group == fallback || !ok {
+			slog.Errorf(context.TODO(), "%s invalid fallback group:%s for group:%s", fun, fallback, group)
+			continue
+		}
+		r.fallbackGroup[group] = fallback
+	}
+
 	return r, nil
 }
 
+func parseShardRule(rule *ShardRule, inss map[string]*dbInsCfg) error {
+	if rule == nil {
+		return fmt.Errorf("empty rule")
+	}
+
+	for _, ins := range rule.Instances {
+		if _, ok := inss[ins]; !ok {
+			return fmt.Errorf("instance:%s not in instances", ins)
+		}
+	}
+
+	return rule.check()
+}
+
 func parseDbIns(dbtype, dbname, ins string, dbcfg json.RawMessage, level int32) (*dbInsInfo, error) {
 	if er := checkVarname(dbtype); er != nil {
 		return nil, fmt.Errorf("dbtype instance:%s err:%s", ins, er.Error())
@@ -234,7 +378,23 @@ func parseDbIns(dbtype, dbname, ins string, dbcfg json.RawMessage, level int32)
 	var info = new(dbInsInfo)
 	err := json.Unmarshal(dbcfg, info)
 	if err != nil {
-		return nil, fmt.Errorf("unmarshal err, cfg:%s", string(dbcfg))
+		return nil, fmt.Errorf("unmarshal err, cfg:%s", redactConfig(string(dbcfg)))
+	}
+	if info.MaxOpenConns < 0 || info.MaxIdleConns < 0 || info.ConnMaxLifetime < 0 || info.ConnMaxIdleTime < 0 {
+		return nil, fmt.Errorf("invalid pool config instance:%s", ins)
+	}
+	for _, r := range info.Replicas {
+		if r == nil || len(r.Addr) == 0 {
+			return nil, fmt.Errorf("empty replica addr instance:%s", ins)
+		}
+	}
+	for _, secret := range []string{info.UserSecret, info.PassWordSecret} {
+		if secret == "" {
+			continue
+		}
+		if _, _, err := parseSecretRef(secret); err != nil {
+			return nil, fmt.Errorf("secret instance:%s err:%s", ins, err.Error())
+		}
 	}
 	info.DBType = dbtype
 	info.DBName = dbname
@@ -289,7 +449,25 @@ func compareDbInstances(originDbInstances map[string]*dbInsInfo, newDbInstances
 
 func compareDbInfo(dbInsInfo1 *dbInsInfo, dbInsInfo2 *dbInsInfo) bool {
 	return dbInsInfo1.DBName == dbInsInfo2.DBName && dbInsInfo1.UserName == dbInsInfo2.UserName &&
-		dbInsInfo1.PassWord == dbInsInfo2.PassWord && compareStringList(dbInsInfo1.DBAddr, dbInsInfo2.DBAddr)
+		dbInsInfo1.PassWord == dbInsInfo2.PassWord && dbInsInfo1.UserSecret == dbInsInfo2.UserSecret &&
+		dbInsInfo1.PassWordSecret == dbInsInfo2.PassWordSecret && compareStringList(dbInsInfo1.DBAddr, dbInsInfo2.DBAddr) &&
+		dbInsInfo1.MaxReplicaLag == dbInsInfo2.MaxReplicaLag && compareReplicas(dbInsInfo1.Replicas, dbInsInfo2.Replicas) &&
+		dbInsInfo1.MaxOpenConns == dbInsInfo2.MaxOpenConns && dbInsInfo1.MaxIdleConns == dbInsInfo2.MaxIdleConns &&
+		dbInsInfo1.ConnMaxLifetime == dbInsInfo2.ConnMaxLifetime && dbInsInfo1.ConnMaxIdleTime == dbInsInfo2.ConnMaxIdleTime
+}
+
+func compareReplicas(replicas1 []*Replica, replicas2 []*Replica) bool {
+	if len(replicas1) != len(replicas2) {
+		return false
+	}
+
+	for index := range replicas1 {
+		if *replicas1[index] != *replicas2[index] {
+			return false
+		}
+	}
+
+	return true
 }
 
 func compareStringList(stringList1 []string, stringList2 []string) bool {
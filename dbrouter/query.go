@@ -0,0 +1,217 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"fmt"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/slog/slog"
+	stat "github.com/shawnfeng/sutil/stat"
+	"github.com/shawnfeng/sutil/stime"
+	"hash/fnv"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	spanLogKeyError = "error"
+)
+
+// normalizeSQL 将语句中的字符串与数字字面量替换为 ?, 合并连续空白, 并将 in 列表折叠为 (?),
+// 使同一模板的语句得到相同的结果, 用于 span 与统计, 避免参数值泄露到监控系统中
+func normalizeSQL(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+
+	space := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = b.Len() > 0
+			continue
+
+		case c == '\'' || c == '"':
+			// 跳过字符串字面量, 支持 '' 转义
+			j := i + 1
+			for ; j < len(query); j++ {
+				if query[j] == '\\' {
+					j++
+				} else if query[j] == c {
+					if j+1 < len(query) && query[j+1] == c {
+						j++
+					} else {
+						break
+					}
+				}
+			}
+			i = j
+			c = '?'
+
+		case c >= '0' && c <= '9' && !isIdentByte(prevByte(query, i)):
+			for i+1 < len(query) && (isIdentByte(query[i+1]) || query[i+1] == '.') {
+				i++
+			}
+			c = '?'
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+
+	return collapseInList(b.String())
+}
+
+func prevByte(s string, i int) byte {
+	if i == 0 {
+		return ' '
+	}
+	return s[i-1]
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// collapseInList 将 (?, ?, ?) 折叠为 (?)
+func collapseInList(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '(' {
+			j := i + 1
+			n := 0
+			for j < len(s) {
+				if s[j] == '?' {
+					n++
+					j++
+				} else if s[j] == ',' || s[j] == ' ' {
+					j++
+				} else {
+					break
+				}
+			}
+			if n > 0 && j < len(s) && s[j] == ')' {
+				b.WriteString("(?)")
+				i = j
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// stmtHook 为单条语句的超时、span、统计与慢查询日志所需的集群信息, 由 SqlExec/ShardExec/SqlTx/OrmExec 注入
+type stmtHook struct {
+	cluster string
+	// table 为逻辑表名, 作为统计的 label; 分片执行时语句中的物理表名(如按天分片)数量不受限, 不能作为 label
+	table         string
+	timeout       time.Duration
+	slowThreshold time.Duration
+	// report 为按语句类型的统计, 见 Router.StmtStatInfo
+	report *stat.StatReport
+}
+
+// startStmt 为单条语句应用查询超时并创建子 span, 返回的 done 在语句结束时调用, 负责结束 span、上报统计
+// 并记录超过集群慢查询阈值的语句; keep 为 true 时语句返回的结果集在函数返回后仍需使用, done 不释放超时 context,
+// 由返回的 cancel 在结果集使用完(Rows.Close/Row.Scan)后释放, 否则都返回空操作的 cancel.
+// ctx 为 nil 时用于不带 context 的 *Wrapper 方法, 只上报统计与慢查询, 不创建 span 也不应用超时
+func (h *stmtHook) startStmt(ctx context.Context, op, query string, keep bool) (context.Context, func(error), context.CancelFunc) {
+	normalized := normalizeSQL(query)
+
+	if ctx == nil {
+		st := stime.NewTimeStat()
+		return nil, func(err error) {
+			h.finishStmt(context.Background(), op, normalized, st.Duration())
+		}, func() {}
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter."+op)
+	ext.DBType.Set(span, "sql")
+	ext.DBStatement.Set(span, normalized)
+	span.LogFields(log.String(spanLogKeyCluster, h.cluster))
+
+	cancel := func() {}
+	if h.timeout > 0 {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > h.timeout {
+			ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		}
+	}
+
+	st := stime.NewTimeStat()
+	done := func(err error) {
+		if !keep {
+			cancel()
+		}
+		if err != nil {
+			ext.Error.Set(span, true)
+			span.LogFields(log.String(spanLogKeyError, err.Error()))
+		}
+		span.Finish()
+
+		h.finishStmt(ctx, op, normalized, st.Duration())
+	}
+	if keep {
+		return ctx, done, cancel
+	}
+	return ctx, done, func() {}
+}
+
+// finishStmt 上报语句的耗时, 超过慢查询阈值时记录日志
+func (h *stmtHook) finishStmt(ctx context.Context, op, normalized string, dur time.Duration) {
+	fun := "stmtHook.finishStmt -->"
+
+	fingerprint := fingerprintSQL(normalized)
+	reportStatement(h.cluster, h.table, fingerprint, dur)
+	if h.report != nil {
+		h.report.IncQuery(h.cluster, h.table+"."+strings.ToLower(op), dur)
+	}
+
+	if h.slowThreshold > 0 && dur >= h.slowThreshold {
+		slog.Warnf(ctx, "%s slow query cls:%s table:%s fingerprint:%s dur:%s caller:%s sql:%s",
+			fun, h.cluster, h.table, fingerprint, dur, queryCaller(), normalized)
+	}
+}
+
+// fingerprintSQL 为归一化后语句的短摘要, 作为监控的 label, 与慢查询日志中的语句对应
+func fingerprintSQL(normalized string) string {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(normalized)))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// queryCaller 返回 dbrouter 之外的第一个调用方
+func queryCaller() string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame.Function) {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+func isInternalFrame(function string) bool {
+	for _, prefix := range []string{"github.com/shawnfeng/sutil/dbrouter.", "github.com/jmoiron/sqlx.", "github.com/jinzhu/gorm.", "database/sql.", "runtime."} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package dbrouter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM user_1 WHERE id = 10":                          "SELECT * FROM user_1 WHERE id = ?",
+		"select  *\n\tfrom user where name='it''s' and age>1.5":       "select * from user where name=? and age>?",
+		"SELECT * FROM user WHERE id IN (1, 2, 3) AND s IN ('a','b')": "SELECT * FROM user WHERE id IN (?) AND s IN (?)",
+		"UPDATE user SET name=$1 WHERE id=$2":                         "UPDATE user SET name=$1 WHERE id=$2",
+		"INSERT INTO t (a, b) VALUES (:a, :b)":                        "INSERT INTO t (a, b) VALUES (:a, :b)",
+		"  SELECT 1  ":                                                "SELECT ?",
+	}
+	for query, expect := range cases {
+		assert.Equal(t, expect, normalizeSQL(query), query)
+	}
+}
+
+func TestDBBind(t *testing.T) {
+	db := NewDB(nil)
+	bound := db.bind("account", time.Second, 0, nil)
+	assert.Equal(t, "account", bound.cluster)
+	assert.Equal(t, time.Second, bound.timeout)
+	assert.Equal(t, "", db.cluster)
+}
+
+func TestParseQueryTimeout(t *testing.T) {
+	parser, err := NewParser([]byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "full", "express": "user"}]},
+		"instances": {"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]}}},
+		"cluster_options": {"account": {"query_timeout": 500}}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, parser.GetQueryTimeout("account"))
+	assert.Equal(t, time.Duration(0), parser.GetQueryTimeout("other"))
+}
+
+func TestFingerprintSQL(t *testing.T) {
+	f1 := fingerprintSQL(normalizeSQL("SELECT * FROM user_1 WHERE id IN (1, 2)"))
+	f2 := fingerprintSQL(normalizeSQL("select * from user_1 where id in (3,4,5)"))
+	f3 := fingerprintSQL(normalizeSQL("SELECT * FROM user_2 WHERE id IN (1, 2)"))
+	assert.Equal(t, f1, f2)
+	assert.NotEqual(t, f1, f3)
+	assert.Len(t, f1, 8)
+}
+
+func TestIsInternalFrame(t *testing.T) {
+	assert.True(t, isInternalFrame("github.com/shawnfeng/sutil/dbrouter.(*DB).GetContextWrapper"))
+	assert.True(t, isInternalFrame("database/sql.(*DB).QueryContext"))
+	assert.False(t, isInternalFrame("github.com/shawnfeng/sutil/dbrouterx.Query"))
+	assert.False(t, isInternalFrame("main.main"))
+	assert.NotEqual(t, "unknown", queryCaller())
+}
+
+func TestParseSlowThreshold(t *testing.T) {
+	parser, err := NewParser([]byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "full", "express": "user"}]},
+		"instances": {"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]}}},
+		"cluster_options": {"account": {"slow_threshold": 200}, "order": {"slow_threshold": -1}}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 200*time.Millisecond, parser.GetSlowThreshold("account"))
+	assert.Equal(t, time.Duration(0), parser.GetSlowThreshold("order"))
+	assert.Equal(t, defaultSlowThreshold, parser.GetSlowThreshold("other"))
+}
+
+func stmtStatKeys(router *Router) map[string]int64 {
+	keys := make(map[string]int64)
+	for _, item := range router.StmtStatInfo() {
+		keys[item.ClusterTable] = item.Count
+	}
+	return keys
+}
+
+func TestStmtHookStats(t *testing.T) {
+	ctx := context.Background()
+	router, err := NewRouterWithConfigType(CONFIG_TYPE_SIMPLE, []byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "regex", "express": ".*"}]},
+		"instances": {"user0": {"dbtype": "sqlite", "dbname": "account", "dbcfg": {"addrs": [":memory:"]}}},
+		"shards": {"account": {"event": {"key": "ct", "algorithm": "time", "time_unit": "day", "instances": ["user0"]}}}
+	}`))
+	assert.NoError(t, err)
+	defer router.Close()
+
+	// 不带 context 的旧接口
+	err = router.SqlExec(ctx, "account", func(db *DB, tables []interface{}) error {
+		if _, err := db.ExecWrapper(tables, "CREATE TABLE %s (id INTEGER PRIMARY KEY)"); err != nil {
+			return err
+		}
+		var ids []int
+		return db.SelectWrapper(tables, &ids, "SELECT id FROM %s")
+	}, "user")
+	assert.NoError(t, err)
+
+	err = router.SqlTx(ctx, "account", "user", nil, func(tx *Tx, tables []interface{}) error {
+		_, err := tx.ExecWrapper(tables, "INSERT INTO %s (id) VALUES (?)", 1)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = router.OrmExec(ctx, "account", func(db *GormDB, tables []interface{}) error {
+		var count int
+		return db.Table(tables[0].(string)).Count(&count).Error
+	}, "user")
+	assert.NoError(t, err)
+
+	// 按天分片时以逻辑表作为 label
+	day := time.Date(2020, 1, 2, 0, 0, 0, 0, time.Local)
+	err = router.ShardExec(ctx, "account", "event", day, func(db *DB, tables []interface{}) error {
+		_, err := db.ExecContextWrapper(ctx, tables, "CREATE TABLE %s (id INTEGER PRIMARY KEY)")
+		return err
+	})
+	assert.NoError(t, err)
+
+	// 每次执行的统计不包含按语句类型的统计
+	for _, item := range router.StatInfo() {
+		assert.NotContains(t, item.ClusterTable, ".exec")
+	}
+	keys := stmtStatKeys(router)
+	assert.Equal(t, int64(2), keys["account.user.exec"])
+	assert.Equal(t, int64(1), keys["account.user.select"])
+	assert.Equal(t, int64(1), keys["account.user.orm"])
+	assert.Equal(t, int64(1), keys["account.event.exec"])
+	for key := range keys {
+		assert.NotContains(t, key, "20200102")
+	}
+}
+
+func TestStmtHookKeepCancel(t *testing.T) {
+	hook := &stmtHook{cluster: "account", table: "user", timeout: time.Hour}
+
+	// 结果集使用完之前 context 保持有效, 由 cancel 释放
+	ctx, done, cancel := hook.startStmt(context.Background(), "Queryx", "SELECT 1", true)
+	done(nil)
+	assert.NoError(t, ctx.Err())
+	cancel()
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	ctx, done, _ = hook.startStmt(context.Background(), "Exec", "SELECT 1", false)
+	done(nil)
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestRowsRelease(t *testing.T) {
+	ctx := context.Background()
+	router, err := NewRouterWithConfigType(CONFIG_TYPE_SIMPLE, []byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "regex", "express": ".*"}]},
+		"instances": {"user0": {"dbtype": "sqlite", "dbname": "account", "dbcfg": {"addrs": [":memory:"]}}},
+		"cluster_options": {"account": {"query_timeout": 3600000}}
+	}`))
+	assert.NoError(t, err)
+	defer router.Close()
+
+	err = router.SqlExec(ctx, "account", func(db *DB, tables []interface{}) error {
+		rows, err := db.QueryxContextWrapper(ctx, tables, "SELECT 1 AS n_%s")
+		if err != nil {
+			return err
+		}
+		canceled := false
+		cancel := rows.cancel
+		rows.cancel = func() {
+			canceled = true
+			cancel()
+		}
+		assert.NoError(t, rows.Close())
+		assert.True(t, canceled)
+
+		row := db.QueryRowxContextWrapper(ctx, tables, "SELECT 1 AS n_%s")
+		canceled = false
+		cancel = row.cancel
+		row.cancel = func() {
+			canceled = true
+			cancel()
+		}
+		var n int
+		assert.NoError(t, row.Scan(&n))
+		assert.Equal(t, 1, n)
+		assert.True(t, canceled)
+		return nil
+	}, "user")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,252 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReplicaCheckInterval = 5 * time.Second
+)
+
+// Replica 为只读从库配置, Weight 为读流量权重, 不大于 0 时按 1 处理
+type Replica struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+}
+
+type primaryHintKey struct{}
+
+// WithPrimary 返回强制走主库的 context, 用于写后立即读等对一致性有要求的场景
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryHintKey{}, true)
+}
+
+func isForcePrimary(ctx context.Context) bool {
+	force, _ := ctx.Value(primaryHintKey{}).(bool)
+	return force
+}
+
+// isReadQuery 判断语句是否可以发往从库, 只有不加锁的 select/show 才认为是读
+// NOTE: postgres 的 insert ... returning 同样通过 Queryx 执行, 因此不能按调用的方法区分读写
+func isReadQuery(query string) bool {
+	q := strings.ToLower(strings.TrimSpace(query))
+	if !strings.HasPrefix(q, "select") && !strings.HasPrefix(q, "show") {
+		return false
+	}
+	return !strings.Contains(q, "for update") && !strings.Contains(q, "lock in share mode") &&
+		!strings.Contains(q, "for share")
+}
+
+type sqlReplica struct {
+	addr    string
+	weight  int
+	db      *DB
+	gormdb  *GormDB
+	healthy int32
+}
+
+func (m *sqlReplica) isHealthy() bool {
+	return atomic.LoadInt32(&m.healthy) == 1
+}
+
+func (m *sqlReplica) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&m.healthy, v)
+}
+
+// replicaSet 维护实例的从库连接, 后台定期检查从库的连通性与复制延迟,
+// 不可用或延迟超过 maxLag 的从库不参与读流量分配
+type replicaSet struct {
+	dbType   string
+	maxLag   time.Duration
+	replicas []*sqlReplica
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplicaSet(info *Sql, replicas []*Replica, maxLag time.Duration) *replicaSet {
+	fun := "newReplicaSet -->"
+
+	m := &replicaSet{
+		dbType: info.dbType,
+		maxLag: maxLag,
+		stop:   make(chan struct{}),
+	}
+
+	for _, r := range replicas {
+		db, gormdb, err := dial(info.replicaInfo(r.Addr))
+		if err != nil {
+			// NOTE: 从库连不上不影响主库的使用
+			slog.Errorf(context.TODO(), "%s dial replica:%s err:%s", fun, r.Addr, err.Error())
+			continue
+		}
+
+		weight := r.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		m.replicas = append(m.replicas, &sqlReplica{
+			addr:    r.Addr,
+			weight:  weight,
+			db:      db,
+			gormdb:  gormdb,
+			healthy: 1,
+		})
+	}
+
+	if len(m.replicas) > 0 {
+		m.check(context.TODO())
+		go m.run(defaultReplicaCheckInterval)
+	}
+	return m
+}
+
+// pick 按权重随机选择一个健康的从库, 没有可用从库时返回 nil
+func (m *replicaSet) pick() *sqlReplica {
+	if m == nil {
+		return nil
+	}
+
+	total := 0
+	for _, r := range m.replicas {
+		if r.isHealthy() {
+			total += r.weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	for _, r := range m.replicas {
+		if !r.isHealthy() {
+			continue
+		}
+		if n < r.weight {
+			return r
+		}
+		n -= r.weight
+	}
+	return nil
+}
+
+func (m *replicaSet) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.check(context.TODO())
+		}
+	}
+}
+
+func (m *replicaSet) check(ctx context.Context) {
+	fun := "replicaSet.check -->"
+
+	for _, r := range m.replicas {
+		err := r.db.Ping()
+		if err == nil && m.maxLag > 0 {
+			var lag time.Duration
+			lag, err = replicaLag(r.db.DB, m.dbType)
+			if err == nil && lag > m.maxLag {
+				err = fmt.Errorf("replication lag:%s exceeds:%s", lag, m.maxLag)
+			}
+		}
+
+		if err != nil {
+			if r.isHealthy() {
+				slog.Warnf(ctx, "%s replica:%s unhealthy, err:%s", fun, r.addr, err.Error())
+			}
+			r.setHealthy(false)
+			continue
+		}
+
+		if !r.isHealthy() {
+			slog.Infof(ctx, "%s replica:%s recovered", fun, r.addr)
+		}
+		r.setHealthy(true)
+	}
+}
+
+// replicaLag 查询从库的复制延迟
+// NOTE: mysql 需要 REPLICATION CLIENT 权限; postgres 在主库长时间无写入时延迟会偏大
+func replicaLag(db *sqlx.DB, dbType string) (time.Duration, error) {
+	switch dbType {
+	case DB_TYPE_MYSQL:
+		rows, err := db.Queryx("SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+
+		if !rows.Next() {
+			return 0, fmt.Errorf("not a replica")
+		}
+		status := make(map[string]interface{})
+		if err := rows.MapScan(status); err != nil {
+			return 0, err
+		}
+
+		var seconds sql.NullInt64
+		if err := seconds.Scan(status["Seconds_Behind_Master"]); err != nil {
+			return 0, err
+		}
+		if !seconds.Valid {
+			return 0, fmt.Errorf("replication not running")
+		}
+		return time.Duration(seconds.Int64) * time.Second, nil
+
+	case DB_TYPE_POSTGRES:
+		var seconds float64
+		err := db.Get(&seconds, "SELECT COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)")
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+
+	default:
+		return 0, fmt.Errorf("dbtype:%s not support", dbType)
+	}
+}
+
+func (m *replicaSet) Close() error {
+	if m == nil {
+		return nil
+	}
+
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+
+	var errs []string
+	for _, r := range m.replicas {
+		if err := r.db.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("close replicas err: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
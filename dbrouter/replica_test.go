@@ -0,0 +1,70 @@
+package dbrouter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsReadQuery(t *testing.T) {
+	assert.True(t, isReadQuery("SELECT * FROM user_0 WHERE id=?"))
+	assert.True(t, isReadQuery("  select count(*) from %s"))
+	assert.True(t, isReadQuery("SHOW TABLES"))
+	assert.False(t, isReadQuery("SELECT * FROM user WHERE id=? FOR UPDATE"))
+	assert.False(t, isReadQuery("select * from user where id=? lock in share mode"))
+	assert.False(t, isReadQuery("INSERT INTO user (name) VALUES ($1) RETURNING id"))
+	assert.False(t, isReadQuery("UPDATE user SET name=? WHERE id=?"))
+}
+
+func TestReplicaSetPick(t *testing.T) {
+	var m *replicaSet
+	assert.Nil(t, m.pick())
+
+	r1 := &sqlReplica{addr: "r1", weight: 1, healthy: 1}
+	r2 := &sqlReplica{addr: "r2", weight: 3, healthy: 1}
+	m = &replicaSet{replicas: []*sqlReplica{r1, r2}}
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[m.pick().addr]++
+	}
+	assert.InDelta(t, 3.0, float64(counts["r2"])/float64(counts["r1"]), 0.6)
+
+	r2.setHealthy(false)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, r1, m.pick())
+	}
+
+	r1.setHealthy(false)
+	assert.Nil(t, m.pick())
+}
+
+func TestWithPrimary(t *testing.T) {
+	ctx := context.Background()
+	assert.False(t, isForcePrimary(ctx))
+	assert.True(t, isForcePrimary(WithPrimary(ctx)))
+}
+
+func TestParseReplicas(t *testing.T) {
+	parser, err := NewParser([]byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "full", "express": "user"}]},
+		"instances": {
+			"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {
+				"addrs": ["127.0.0.1:3306"],
+				"replicas": [{"addr": "127.0.0.1:3307", "weight": 2}, {"addr": "127.0.0.1:3308"}],
+				"max_replica_lag": 5
+			}}
+		}
+	}`))
+	assert.NoError(t, err)
+
+	info := parser.GetConfig("user0", DefaultGroup)
+	assert.Equal(t, []*Replica{{Addr: "127.0.0.1:3307", Weight: 2}, {Addr: "127.0.0.1:3308"}}, info.Replicas)
+	assert.Equal(t, int64(5), info.MaxReplicaLag)
+
+	changed := *info
+	changed.Replicas = []*Replica{{Addr: "127.0.0.1:3307", Weight: 1}}
+	assert.False(t, compareDbInfo(info, &changed))
+	assert.True(t, compareDbInfo(info, info))
+}
@@ -0,0 +1,241 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SECRET_PROVIDER_ENV  = "env"
+	SECRET_PROVIDER_FILE = "file"
+	SECRET_PROVIDER_AES  = "aes"
+
+	// defaultSecretRefreshInterval 为重新读取密钥的间隔, 密钥轮换后在一个间隔内重建连接
+	defaultSecretRefreshInterval = time.Minute
+
+	redactedPassword = "xxxxx"
+)
+
+// SecretProvider 根据引用返回密钥的明文, 如 env 的引用为环境变量名, file 的引用为文件路径
+type SecretProvider interface {
+	GetSecret(ctx context.Context, ref string) (string, error)
+}
+
+// SecretProviderFunc 使普通函数实现 SecretProvider
+type SecretProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretProviderFunc) GetSecret(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		SECRET_PROVIDER_ENV:  SecretProviderFunc(envSecret),
+		SECRET_PROVIDER_FILE: SecretProviderFunc(fileSecret),
+	}
+)
+
+// RegisterSecretProvider 注册 scheme 对应的 SecretProvider, 实例配置中以 user_secret/passwd_secret 为 "<scheme>:<ref>" 引用,
+// 已注册的 scheme 会被覆盖; aes 需要由业务方使用 NewAesSecretProvider 注册
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+
+	secretProviders[scheme] = provider
+}
+
+func getSecretProvider(scheme string) (SecretProvider, bool) {
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+
+	provider, ok := secretProviders[scheme]
+	return provider, ok
+}
+
+func envSecret(ctx context.Context, ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("env %s not set", ref)
+	}
+	return value, nil
+}
+
+// fileSecret 读取文件内容作为密钥, 去掉末尾的换行, 适用于 k8s secret 挂载的文件
+func fileSecret(ctx context.Context, ref string) (string, error) {
+	data, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// NewAesSecretProvider 返回解密 AES-CBC PKCS5Padding 密文的 SecretProvider, 引用为 base64 编码的密文;
+// 密文损坏或密钥错误时返回错误
+func NewAesSecretProvider(key, iv []byte) (SecretProvider, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid aes iv length %d, expect %d", len(iv), aes.BlockSize)
+	}
+	return SecretProviderFunc(func(ctx context.Context, ref string) (string, error) {
+		return aesDecryptSecret(block, iv, ref)
+	}), nil
+}
+
+// aesDecryptSecret 校验密文长度与 padding 后解密
+// NOTE: scrypto 解密不检查长度与 padding, 密文损坏时会 panic; CBC 的 decrypter 解密后会更新 iv, 每次解密重新创建
+func aesDecryptSecret(block cipher.Block, iv []byte, ref string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("invalid aes ciphertext length %d", len(data))
+	}
+
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+
+	padding := int(decrypted[len(decrypted)-1])
+	if padding < 1 || padding > aes.BlockSize {
+		return "", fmt.Errorf("invalid aes padding, wrong key or corrupted ciphertext")
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			return "", fmt.Errorf("invalid aes padding, wrong key or corrupted ciphertext")
+		}
+	}
+	return string(decrypted[:len(decrypted)-padding]), nil
+}
+
+// parseSecretRef 拆分 "<scheme>:<ref>" 形式的密钥引用
+func parseSecretRef(secret string) (scheme, ref string, err error) {
+	idx := strings.Index(secret, ":")
+	if idx <= 0 || idx == len(secret)-1 {
+		return "", "", fmt.Errorf("invalid secret reference, expect <scheme>:<ref>")
+	}
+	return secret[:idx], secret[idx+1:], nil
+}
+
+func resolveSecret(ctx context.Context, secret string) (string, error) {
+	scheme, ref, err := parseSecretRef(secret)
+	if err != nil {
+		return "", err
+	}
+
+	provider, ok := getSecretProvider(scheme)
+	if !ok {
+		return "", fmt.Errorf("secret provider %s not registered", scheme)
+	}
+	return provider.GetSecret(ctx, ref)
+}
+
+func (m *dbInsInfo) hasSecrets() bool {
+	return m.UserSecret != "" || m.PassWordSecret != ""
+}
+
+// resolveSecrets 返回用引用的密钥替换 user/passwd 后的实例配置, 不修改 m
+func (m *dbInsInfo) resolveSecrets(ctx context.Context) (*dbInsInfo, error) {
+	info := *m
+	if m.UserSecret != "" {
+		user, err := resolveSecret(ctx, m.UserSecret)
+		if err != nil {
+			return nil, fmt.Errorf("resolve user_secret instance:%s err:%s", m.Instance, err.Error())
+		}
+		info.UserName = user
+	}
+	if m.PassWordSecret != "" {
+		passwd, err := resolveSecret(ctx, m.PassWordSecret)
+		if err != nil {
+			return nil, fmt.Errorf("resolve passwd_secret instance:%s err:%s", m.Instance, err.Error())
+		}
+		info.PassWord = passwd
+	}
+	return &info, nil
+}
+
+func (m *Parser) hasSecrets() bool {
+	for _, insMap := range m.dbIns {
+		for _, info := range insMap {
+			if info.hasSecrets() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reloadSecrets 重新读取所有实例引用的密钥, 返回新的 Parser, 读取失败的实例保留原来的值
+func (m *Parser) reloadSecrets(ctx context.Context) *Parser {
+	fun := "Parser.reloadSecrets -->"
+
+	parser := *m
+	parser.dbIns = make(map[string]map[string]*dbInsInfo, len(m.dbIns))
+	for group, insMap := range m.dbIns {
+		parser.dbIns[group] = make(map[string]*dbInsInfo, len(insMap))
+		for ins, info := range insMap {
+			parser.dbIns[group][ins] = info
+			if !info.hasSecrets() {
+				continue
+			}
+
+			resolved, err := info.resolveSecrets(ctx)
+			if err != nil {
+				slog.Errorf(ctx, "%s group:%s %s", fun, group, err.Error())
+				continue
+			}
+			parser.dbIns[group][ins] = resolved
+		}
+	}
+	return &parser
+}
+
+// redactDSN 隐藏连接串中的密码, 用于日志输出
+func redactDSN(dbType, dsn string) string {
+	switch dbType {
+	case DB_TYPE_MYSQL:
+		// user:passwd@tcp(addr)/dbname, 密码中可能含有 @, 以最后一个 @ 为准
+		at := strings.LastIndex(dsn, "@")
+		if at < 0 {
+			return dsn
+		}
+		colon := strings.Index(dsn[:at], ":")
+		if colon < 0 {
+			return dsn
+		}
+		return dsn[:colon+1] + redactedPassword + dsn[at:]
+
+	case DB_TYPE_POSTGRES:
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return redactedPassword
+		}
+		return u.Redacted()
+	}
+	return dsn
+}
+
+var configPasswordRegexp = regexp.MustCompile(`("passwd"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactConfig 隐藏路由配置 json 中明文的 passwd, 用于日志输出
+func redactConfig(jscfg string) string {
+	return configPasswordRegexp.ReplaceAllString(jscfg, `${1}"`+redactedPassword+`"`)
+}
@@ -0,0 +1,408 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"fmt"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SHARD_ALGO_MOD   = "mod"
+	SHARD_ALGO_HASH  = "hash"
+	SHARD_ALGO_RANGE = "range"
+	SHARD_ALGO_TIME  = "time"
+)
+
+const (
+	SHARD_TIME_UNIT_DAY   = "day"
+	SHARD_TIME_UNIT_MONTH = "month"
+	SHARD_TIME_UNIT_YEAR  = "year"
+)
+
+const (
+	spanLogKeyShard = "shard"
+
+	// scatter 时同时执行的分片数上限, 避免打满连接池
+	defaultShardScatterConcurrency = 16
+)
+
+// ShardRule 为逻辑表的分片规则, 配置在 router json 的 shards.<cluster>.<table> 下, 例如:
+//
+//	"shards": {"account": {"user": {"key": "uid", "algorithm": "mod", "table_count": 16, "instances": ["user0", "user1"]}}}
+//
+// 逻辑表 user 被拆为 user_0 ~ user_15, 其中 user_0 ~ user_7 在实例 user0 上, user_8 ~ user_15 在实例 user1 上
+type ShardRule struct {
+	// Key 为分片键的字段名, 仅用于说明与日志
+	Key       string   `json:"key"`
+	Algorithm string   `json:"algorithm"`
+	Instances []string `json:"instances"`
+	// TableCount 为物理表总数, 按顺序平均分布到 Instances 上; range 算法下为 len(Ranges)+1, 可不配置
+	TableCount int `json:"table_count"`
+	// Ranges 为 range 算法的分界点, 升序, key < Ranges[0] 落在第 0 张表, 以此类推
+	Ranges []int64 `json:"ranges"`
+	// TimeUnit 为 time 算法的分表粒度, 物理表名为 table_20060102/table_200601/table_2006,
+	// 物理表按时间顺序轮流分布到 Instances 上
+	TimeUnit string `json:"time_unit"`
+}
+
+// Shard 为分片键解析后的物理位置
+type Shard struct {
+	Instance string
+	Table    string
+}
+
+func (m *Shard) String() string {
+	return fmt.Sprintf("%s.%s", m.Instance, m.Table)
+}
+
+func (m *ShardRule) check() error {
+	if len(m.Instances) == 0 {
+		return fmt.Errorf("empty instances")
+	}
+
+	switch m.Algorithm {
+	case SHARD_ALGO_MOD, SHARD_ALGO_HASH:
+
+	case SHARD_ALGO_RANGE:
+		if len(m.Ranges) == 0 {
+			return fmt.Errorf("empty ranges")
+		}
+		if !sort.SliceIsSorted(m.Ranges, func(i, j int) bool { return m.Ranges[i] < m.Ranges[j] }) {
+			return fmt.Errorf("ranges not sorted")
+		}
+		if m.TableCount == 0 {
+			m.TableCount = len(m.Ranges) + 1
+		}
+		if m.TableCount != len(m.Ranges)+1 {
+			return fmt.Errorf("table_count:%d not match ranges:%d", m.TableCount, len(m.Ranges))
+		}
+
+	case SHARD_ALGO_TIME:
+		if _, err := timeUnitLayout(m.TimeUnit); err != nil {
+			return err
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("algorithm:%s not support", m.Algorithm)
+	}
+
+	if m.TableCount < len(m.Instances) {
+		return fmt.Errorf("table_count:%d less than instances:%d", m.TableCount, len(m.Instances))
+	}
+	return nil
+}
+
+func timeUnitLayout(unit string) (string, error) {
+	switch unit {
+	case SHARD_TIME_UNIT_DAY:
+		return "20060102", nil
+	case SHARD_TIME_UNIT_MONTH:
+		return "200601", nil
+	case SHARD_TIME_UNIT_YEAR:
+		return "2006", nil
+	default:
+		return "", fmt.Errorf("time_unit:%s not support", unit)
+	}
+}
+
+func shardKeyInt64(key interface{}) (int64, error) {
+	switch v := key.(type) {
+	case int:
+		return int64(v), nil
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case uint:
+		return int64(v), nil
+	case uint8:
+		return int64(v), nil
+	case uint16:
+		return int64(v), nil
+	case uint32:
+		return int64(v), nil
+	case uint64:
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("shard key type %T not support", key)
+	}
+}
+
+// shardKeyTime 支持 time.Time 以及整数形式的 unix 秒
+func shardKeyTime(key interface{}) (time.Time, error) {
+	if t, ok := key.(time.Time); ok {
+		return t, nil
+	}
+
+	sec, err := shardKeyInt64(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// truncateTime 将 t 截断到所在分表周期的起点
+func (m *ShardRule) truncateTime(t time.Time) time.Time {
+	y, mon, d := t.Date()
+	switch m.TimeUnit {
+	case SHARD_TIME_UNIT_DAY:
+		return time.Date(y, mon, d, 0, 0, 0, 0, t.Location())
+	case SHARD_TIME_UNIT_MONTH:
+		return time.Date(y, mon, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+func (m *ShardRule) nextTime(t time.Time) time.Time {
+	switch m.TimeUnit {
+	case SHARD_TIME_UNIT_DAY:
+		return t.AddDate(0, 0, 1)
+	case SHARD_TIME_UNIT_MONTH:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(1, 0, 0)
+	}
+}
+
+// period 返回 t 所在周期的序号, 用于将时间分表轮流分布到实例上
+func (m *ShardRule) period(t time.Time) int64 {
+	y, mon, d := t.Date()
+	switch m.TimeUnit {
+	case SHARD_TIME_UNIT_DAY:
+		return time.Date(y, mon, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+	case SHARD_TIME_UNIT_MONTH:
+		return int64(y)*12 + int64(mon) - 1
+	default:
+		return int64(y)
+	}
+}
+
+func (m *ShardRule) timeShard(table string, t time.Time) *Shard {
+	layout, _ := timeUnitLayout(m.TimeUnit)
+	period := m.period(t)
+	n := int64(len(m.Instances))
+	return &Shard{
+		Instance: m.Instances[(period%n+n)%n],
+		Table:    fmt.Sprintf("%s_%s", table, t.Format(layout)),
+	}
+}
+
+func (m *ShardRule) indexShard(table string, index int) *Shard {
+	return &Shard{
+		Instance: m.Instances[index*len(m.Instances)/m.TableCount],
+		Table:    fmt.Sprintf("%s_%d", table, index),
+	}
+}
+
+func (m *ShardRule) tableIndex(key interface{}) (int, error) {
+	n := int64(m.TableCount)
+
+	switch m.Algorithm {
+	case SHARD_ALGO_MOD:
+		v, err := shardKeyInt64(key)
+		if err != nil {
+			return 0, err
+		}
+		return int((v%n + n) % n), nil
+
+	case SHARD_ALGO_HASH:
+		h := fnv.New32a()
+		h.Write([]byte(fmt.Sprint(key)))
+		return int(h.Sum32() % uint32(n)), nil
+
+	case SHARD_ALGO_RANGE:
+		v, err := shardKeyInt64(key)
+		if err != nil {
+			return 0, err
+		}
+		return sort.Search(len(m.Ranges), func(i int) bool { return v < m.Ranges[i] }), nil
+
+	default:
+		return 0, fmt.Errorf("algorithm:%s not support", m.Algorithm)
+	}
+}
+
+// Resolve 根据分片键计算逻辑表 table 对应的物理实例与物理表
+func (m *ShardRule) Resolve(table string, shardKey interface{}) (*Shard, error) {
+	if m.Algorithm == SHARD_ALGO_TIME {
+		t, err := shardKeyTime(shardKey)
+		if err != nil {
+			return nil, err
+		}
+		return m.timeShard(table, t), nil
+	}
+
+	index, err := m.tableIndex(shardKey)
+	if err != nil {
+		return nil, err
+	}
+	return m.indexShard(table, index), nil
+}
+
+// Shards 返回逻辑表 table 的所有物理分片, time 算法的分片数量不固定, 需使用 ShardsBetween
+func (m *ShardRule) Shards(table string) ([]*Shard, error) {
+	if m.Algorithm == SHARD_ALGO_TIME {
+		return nil, fmt.Errorf("algorithm:%s shards unbounded, use ShardsBetween", m.Algorithm)
+	}
+
+	shards := make([]*Shard, 0, m.TableCount)
+	for i := 0; i < m.TableCount; i++ {
+		shards = append(shards, m.indexShard(table, i))
+	}
+	return shards, nil
+}
+
+// ShardsBetween 返回 time 算法下 [begin, end] 覆盖的所有物理分片
+func (m *ShardRule) ShardsBetween(table string, begin, end time.Time) ([]*Shard, error) {
+	if m.Algorithm != SHARD_ALGO_TIME {
+		return nil, fmt.Errorf("algorithm:%s not time based", m.Algorithm)
+	}
+	if end.Before(begin) {
+		return nil, fmt.Errorf("end:%s before begin:%s", end, begin)
+	}
+
+	var shards []*Shard
+	for t := m.truncateTime(begin); !t.After(end); t = m.nextTime(t) {
+		shards = append(shards, m.timeShard(table, t))
+	}
+	return shards, nil
+}
+
+func (m *Router) shardRule(ctx context.Context, cluster, table string) (*ShardRule, error) {
+	rule := configShardRule(ctx, m.configer, cluster, table)
+	if rule == nil {
+		return nil, fmt.Errorf("shard rule not find: cluster:%s table:%s", cluster, table)
+	}
+	return rule, nil
+}
+
+// ShardExec 根据分片键 shardKey 将逻辑表 table 路由到物理实例与物理表上执行 query,
+// query 中的 tables 只有一个元素, 即物理表名
+func (m *Router) ShardExec(ctx context.Context, cluster, table string, shardKey interface{}, query func(*DB, []interface{}) error) error {
+	fun := "Router.ShardExec -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.ShardExec")
+	defer span.Finish()
+
+	rule, err := m.shardRule(ctx, cluster, table)
+	if err != nil {
+		return err
+	}
+
+	shard, err := rule.Resolve(table, shardKey)
+	if err != nil {
+		slog.Errorf(ctx, "%s resolve shard err, cluster:%s table:%s key:%v err:%s", fun, cluster, table, shardKey, err.Error())
+		return err
+	}
+
+	return m.shardExec(ctx, cluster, table, shard, query)
+}
+
+// ShardScatter 在逻辑表 table 的所有物理分片上并发执行 query, 返回第一个出错分片的错误
+// NOTE: query 会被并发调用, 汇总结果时需要自行加锁
+func (m *Router) ShardScatter(ctx context.Context, cluster, table string, query func(*DB, []interface{}) error) error {
+	rule, err := m.shardRule(ctx, cluster, table)
+	if err != nil {
+		return err
+	}
+
+	shards, err := rule.Shards(table)
+	if err != nil {
+		return err
+	}
+
+	return m.shardScatter(ctx, cluster, table, shards, query)
+}
+
+// ShardScatterBetween 用于 time 算法, 在 [begin, end] 覆盖的物理分片上并发执行 query
+func (m *Router) ShardScatterBetween(ctx context.Context, cluster, table string, begin, end time.Time, query func(*DB, []interface{}) error) error {
+	rule, err := m.shardRule(ctx, cluster, table)
+	if err != nil {
+		return err
+	}
+
+	shards, err := rule.ShardsBetween(table, begin, end)
+	if err != nil {
+		return err
+	}
+
+	return m.shardScatter(ctx, cluster, table, shards, query)
+}
+
+func (m *Router) shardScatter(ctx context.Context, cluster, table string, shards []*Shard, query func(*DB, []interface{}) error) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.shardScatter")
+	defer span.Finish()
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, table))
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(shards))
+	sem := make(chan struct{}, defaultShardScatterConcurrency)
+	for i, shard := range shards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, shard *Shard) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = m.shardExec(ctx, cluster, table, shard, query)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard:%s err:%s", shards[i], err.Error())
+		}
+	}
+	return nil
+}
+
+func (m *Router) shardExec(ctx context.Context, cluster, table string, shard *Shard, query func(*DB, []interface{}) error) error {
+	fun := "Router.shardExec -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.shardExec")
+	defer span.Finish()
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, table),
+		log.String(spanLogKeyShard, shard.String()))
+
+	st := stime.NewTimeStat()
+
+	dbsql, err := m.getSql(ctx, shard.Instance)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		dur := st.Duration()
+		m.reportExec(cluster, table, dur)
+		slog.Tracef(ctx, "%s cls:%s table:%s shard:%s dur:%d", fun, cluster, table, shard, dur)
+	}()
+
+	db := m.bindDB(ctx, cluster, table, dbsql.getDB(ctx))
+	return query(db, []interface{}{shard.Table})
+}
@@ -0,0 +1,99 @@
+package dbrouter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var shardRouteConfig = []byte(`{
+	"cluster": {"account": [{"instance": "user0", "match": "full", "express": "user"}]},
+	"instances": {
+		"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]}},
+		"user1": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3307"]}}
+	},
+	"shards": {
+		"account": {
+			"user": {"key": "uid", "algorithm": "mod", "table_count": 4, "instances": ["user0", "user1"]},
+			"profile": {"key": "name", "algorithm": "hash", "table_count": 8, "instances": ["user0", "user1"]},
+			"order": {"key": "id", "algorithm": "range", "ranges": [100, 200], "instances": ["user0", "user1"]},
+			"event": {"key": "ct", "algorithm": "time", "time_unit": "month", "instances": ["user0", "user1"]},
+			"bad": {"key": "uid", "algorithm": "mod", "table_count": 4, "instances": ["user9"]}
+		}
+	}
+}`)
+
+func TestShardRuleParse(t *testing.T) {
+	parser, err := NewParser(shardRouteConfig)
+	assert.NoError(t, err)
+
+	assert.NotNil(t, parser.GetShardRule("account", "user"))
+	assert.Equal(t, 3, parser.GetShardRule("account", "order").TableCount)
+	assert.Nil(t, parser.GetShardRule("account", "bad"))
+	assert.Nil(t, parser.GetShardRule("other", "user"))
+}
+
+func TestShardRuleResolve(t *testing.T) {
+	parser, err := NewParser(shardRouteConfig)
+	assert.NoError(t, err)
+
+	user := parser.GetShardRule("account", "user")
+	shard, err := user.Resolve("user", int64(6))
+	assert.NoError(t, err)
+	assert.Equal(t, &Shard{Instance: "user1", Table: "user_2"}, shard)
+
+	shard, err = user.Resolve("user", "5")
+	assert.NoError(t, err)
+	assert.Equal(t, &Shard{Instance: "user0", Table: "user_1"}, shard)
+
+	_, err = user.Resolve("user", 1.5)
+	assert.Error(t, err)
+
+	profile := parser.GetShardRule("account", "profile")
+	s1, err := profile.Resolve("profile", "alice")
+	assert.NoError(t, err)
+	s2, err := profile.Resolve("profile", "alice")
+	assert.NoError(t, err)
+	assert.Equal(t, s1, s2)
+
+	order := parser.GetShardRule("account", "order")
+	for key, table := range map[int]string{0: "order_0", 99: "order_0", 100: "order_1", 199: "order_1", 200: "order_2"} {
+		shard, err := order.Resolve("order", key)
+		assert.NoError(t, err)
+		assert.Equal(t, table, shard.Table)
+	}
+
+	event := parser.GetShardRule("account", "event")
+	shard, err = event.Resolve("event", time.Date(2019, 3, 15, 0, 0, 0, 0, time.Local))
+	assert.NoError(t, err)
+	assert.Equal(t, "event_201903", shard.Table)
+}
+
+func TestShardRuleShards(t *testing.T) {
+	parser, err := NewParser(shardRouteConfig)
+	assert.NoError(t, err)
+
+	shards, err := parser.GetShardRule("account", "user").Shards("user")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Shard{
+		{Instance: "user0", Table: "user_0"},
+		{Instance: "user0", Table: "user_1"},
+		{Instance: "user1", Table: "user_2"},
+		{Instance: "user1", Table: "user_3"},
+	}, shards)
+
+	event := parser.GetShardRule("account", "event")
+	_, err = event.Shards("event")
+	assert.Error(t, err)
+
+	shards, err = event.ShardsBetween("event",
+		time.Date(2019, 11, 20, 0, 0, 0, 0, time.Local), time.Date(2020, 2, 1, 0, 0, 0, 0, time.Local))
+	assert.NoError(t, err)
+	var tables []string
+	for _, shard := range shards {
+		tables = append(tables, shard.Table)
+	}
+	assert.Equal(t, []string{"event_201911", "event_201912", "event_202001", "event_202002"}, tables)
+	assert.NotEqual(t, shards[0].Instance, shards[1].Instance)
+}
@@ -6,15 +6,30 @@ package dbrouter
 
 import (
 	"context"
-	//	"database/sql"
+	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultMaxIdleConns = 8
+	defaultMaxOpenConns = 128
+
+	sqliteMemoryAddr = ":memory:"
+)
+
+// sqliteMemorySeq 用于为每个 :memory: 实例生成独立的共享缓存内存库
+var sqliteMemorySeq int64
+
 type Sql struct {
+	instance string
+	group    string
 	dbType   string
 	dbName   string
 	dbAddr   string
@@ -23,56 +38,194 @@ type Sql struct {
 	passWord string
 	db       *DB
 	gormdb   *GormDB
+	replicas *replicaSet
+
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewSql(dbtype, dbname, addr, userName, passWord string, timeout time.Duration) (*Sql, error) {
-	fun := "NewSql-->"
+	return NewSqlWithConfig(&Config{
+		DBType:   dbtype,
+		DBName:   dbname,
+		DBAddr:   []string{addr},
+		UserName: userName,
+		PassWord: passWord,
+		TimeOut:  timeout,
+	})
+}
+
+// NewSqlWithConfig 连接 config.DBAddr[0] 作为主库, 并连接 config.Replicas 中配置的从库
+func NewSqlWithConfig(config *Config) (*Sql, error) {
+	fun := "NewSqlWithConfig -->"
 
-	if timeout == 0 {
-		timeout = 3 * time.Second
+	if len(config.DBAddr) == 0 {
+		return nil, fmt.Errorf("%s empty addr, instance: %s", fun, config.Instance)
 	}
 
 	info := &Sql{
-		dbType:   dbtype,
-		dbName:   dbname,
-		dbAddr:   addr,
-		timeOut:  timeout,
-		userName: userName,
-		passWord: passWord,
+		instance:        config.Instance,
+		group:           config.Group,
+		dbType:          config.DBType,
+		dbName:          config.DBName,
+		dbAddr:          config.DBAddr[0],
+		timeOut:         config.TimeOut,
+		userName:        config.UserName,
+		passWord:        config.PassWord,
+		maxOpenConns:    config.MaxOpenConns,
+		maxIdleConns:    config.MaxIdleConns,
+		connMaxLifetime: config.ConnMaxLifetime,
+		connMaxIdleTime: config.ConnMaxIdleTime,
+		stop:            make(chan struct{}),
+	}
+	if info.timeOut == 0 {
+		info.timeOut = 3 * time.Second
+	}
+	if info.maxOpenConns == 0 {
+		info.maxOpenConns = defaultMaxOpenConns
+	}
+	if info.maxIdleConns == 0 {
+		info.maxIdleConns = defaultMaxIdleConns
 	}
 
 	var err error
 	info.db, info.gormdb, err = dial(info)
 	if err != nil {
-		slog.Errorf(context.TODO(), "%s info:%v, err:%s", fun, *info, err.Error())
+		slog.Errorf(context.TODO(), "%s instance:%s addr:%s, err:%s", fun, info.instance, info.dbAddr, err.Error())
 		return nil, err
 	}
-	return info, err
+
+	if len(config.Replicas) > 0 {
+		info.replicas = newReplicaSet(info, config.Replicas, config.MaxReplicaLag)
+	}
+
+	go info.reportPoolStats(defaultPoolStatsInterval)
+	return info, nil
+}
+
+// replicaInfo 返回从库 addr 的连接信息, 连接池配置与主库相同
+func (m *Sql) replicaInfo(addr string) *Sql {
+	return &Sql{
+		instance:        m.instance,
+		group:           m.group,
+		dbType:          m.dbType,
+		dbName:          m.dbName,
+		dbAddr:          addr,
+		timeOut:         m.timeOut,
+		userName:        m.userName,
+		passWord:        m.passWord,
+		maxOpenConns:    m.maxOpenConns,
+		maxIdleConns:    m.maxIdleConns,
+		connMaxLifetime: m.connMaxLifetime,
+		connMaxIdleTime: m.connMaxIdleTime,
+	}
+}
+
+// driverName 返回 dbType 对应的 database/sql 驱动名, 同时用作 sqlx 的 bind 类型与 gorm 的 dialect
+func driverName(dbType string) string {
+	if dbType == DB_TYPE_SQLITE {
+		return "sqlite3"
+	}
+	return dbType
+}
+
+func dataSourceName(info *Sql) string {
+	if info.dbType == DB_TYPE_MYSQL {
+		return fmt.Sprintf("%s:%s@tcp(%s)/%s", info.userName, info.passWord, info.dbAddr, info.dbName)
+
+	} else if info.dbType == DB_TYPE_POSTGRES {
+		return fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
+			info.userName, info.passWord, info.dbAddr, info.dbName)
+
+	} else if info.dbType == DB_TYPE_SQLITE {
+		// NOTE: 普通的 :memory: 每个连接都是独立的库, 这里改为按实例命名的共享缓存内存库, 使连接池中的连接看到同一份数据
+		if info.dbAddr == sqliteMemoryAddr {
+			return fmt.Sprintf("file:%s_%d?mode=memory&cache=shared", info.instance, atomic.AddInt64(&sqliteMemorySeq, 1))
+		}
+		return info.dbAddr
+	}
+	return ""
+}
+
+// dialSqlDB 建立连接池, sqlx 与 gorm 共用同一个 *sql.DB
+func dialSqlDB(info *Sql) (*sql.DB, error) {
+	fun := "dialSqlDB -->"
+
+	dataSourceName := dataSourceName(info)
+	slog.Infof(context.TODO(), "%s dbtype:%s datasourcename:%s", fun, info.dbType, redactDSN(info.dbType, dataSourceName))
+	sqldb, err := sql.Open(driverName(info.dbType), dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.dbType == DB_TYPE_SQLITE && info.dbAddr == sqliteMemoryAddr {
+		// NOTE: 共享缓存的内存库在并发写时直接返回 SQLITE_LOCKED 而不是等待, 这里只使用一个一直保持的连接,
+		// 语句在连接池中排队执行; 最后一个连接关闭时内存库被删除, 因此连接不过期
+		sqldb.SetMaxOpenConns(1)
+		sqldb.SetMaxIdleConns(1)
+		sqldb.SetConnMaxLifetime(0)
+		sqldb.SetConnMaxIdleTime(0)
+	} else {
+		sqldb.SetMaxOpenConns(info.maxOpenConns)
+		sqldb.SetMaxIdleConns(info.maxIdleConns)
+		sqldb.SetConnMaxLifetime(info.connMaxLifetime)
+		sqldb.SetConnMaxIdleTime(info.connMaxIdleTime)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), info.timeOut)
+	defer cancel()
+	if err := sqldb.PingContext(ctx); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+	return sqldb, nil
 }
 
 func dial(info *Sql) (*DB, *GormDB, error) {
 	fun := "dial -->"
 
-	sqlxdb, err := dialBySqlx(info)
+	sqldb, err := dialSqlDB(info)
 	if err != nil {
-		slog.Errorf(context.TODO(), "%s info:%v, dialBySqlx err:%s", fun, *info, err.Error())
+		slog.Errorf(context.TODO(), "%s instance:%s addr:%s, dialSqlDB err:%s", fun, info.instance, info.dbAddr, err.Error())
 		return nil, nil, err
 	}
 
-	gormdb, err := dialByGorm(info)
+	gormdb, err := dialByGorm(info, sqldb)
 	if err != nil {
-		slog.Errorf(context.TODO(), "%s info:%v, dialByGorm err:%s", fun, *info, err.Error())
+		slog.Errorf(context.TODO(), "%s instance:%s addr:%s, dialByGorm err:%s", fun, info.instance, info.dbAddr, err.Error())
+		sqldb.Close()
 		return nil, nil, err
 	}
 
-	return NewDB(sqlxdb), NewGormDB(gormdb), nil
+	return NewDB(dialBySqlx(info, sqldb)), NewGormDB(gormdb), nil
 }
 
-func (m *Sql) getDB() *DB {
+// getDB 返回主库连接, 其中的读语句会被路由到健康的从库, ctx 中设置了 WithPrimary 时全部走主库
+func (m *Sql) getDB(ctx context.Context) *DB {
+	if isForcePrimary(ctx) {
+		return m.db
+	}
+
+	if r := m.replicas.pick(); r != nil {
+		return &DB{DB: m.db.DB, reader: r.db.DB}
+	}
 	return m.db
 }
 
-func (m *Sql) getGormDB() *GormDB {
+// getGormDB 返回主库连接, gorm 无法区分读写, 读从库需通过 GormDB.Replica 显式指定
+func (m *Sql) getGormDB(ctx context.Context) *GormDB {
+	if isForcePrimary(ctx) {
+		return m.gormdb
+	}
+
+	if r := m.replicas.pick(); r != nil {
+		return &GormDB{DB: m.gormdb.DB, replica: r.gormdb.DB}
+	}
 	return m.gormdb
 }
 
@@ -80,12 +233,23 @@ func (m *Sql) GetType() string {
 	return m.dbType
 }
 
+// Ping 检查主库的连通性, 供 InstanceManager 健康检查使用
+func (m *Sql) Ping(ctx context.Context) error {
+	return m.db.PingContext(ctx)
+}
+
+// Close 关闭主库与从库的连接池
+// NOTE: gorm 与 sqlx 共用 *sql.DB, 只需关闭一次
 func (m *Sql) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+	})
+
 	err1 := m.db.Close()
-	err2 := m.gormdb.Close()
+	err2 := m.replicas.Close()
 
 	if err1 != nil || err2 != nil {
-		return fmt.Errorf("sqlx.Close err: %v, gorm.Close err: %v", err1, err2)
+		return fmt.Errorf("db.Close err: %v, replicas.Close err: %v", err1, err2)
 	}
 
 	return nil
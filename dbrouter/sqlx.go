@@ -11,72 +11,212 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
-	"github.com/shawnfeng/sutil/slog/slog"
+	stat "github.com/shawnfeng/sutil/stat"
+	"time"
 )
 
 type DB struct {
 	*sqlx.DB
+	// reader 为本次执行选中的从库, 为空时读写都走主库
+	reader *sqlx.DB
+
+	// 由 SqlExec 注入, 为每条语句上报统计, *ContextWrapper 还会应用查询超时并记录 span
+	stmtHook
 }
 
 func NewDB(sqlxdb *sqlx.DB) *DB {
 	db := &DB{
-		sqlxdb,
+		DB: sqlxdb,
 	}
 	return db
 }
 
-func dialBySqlx(info *Sql) (db *sqlx.DB, err error) {
-	fun := "dialBySqlx -->"
+// Replica 返回本次执行选中的从库, 没有可用从库时返回主库
+func (db *DB) Replica() *sqlx.DB {
+	if db.reader != nil {
+		return db.reader
+	}
+	return db.DB
+}
 
-	var dataSourceName string
-	if info.dbType == DB_TYPE_MYSQL {
-		dataSourceName = fmt.Sprintf("%s:%s@tcp(%s)/%s", info.userName, info.passWord, info.dbAddr, info.dbName)
+// bind 返回注入了集群信息的副本, 不修改实例上共享的 DB
+func (db *DB) bind(cluster string, timeout, slowThreshold time.Duration, report *stat.StatReport) *DB {
+	n := *db
+	n.cluster = cluster
+	n.timeout = timeout
+	n.slowThreshold = slowThreshold
+	n.report = report
+	return &n
+}
 
-	} else if info.dbType == DB_TYPE_POSTGRES {
-		dataSourceName = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
-			info.userName, info.passWord, info.dbAddr, info.dbName)
+// route 只读语句走从库, 其余走主库
+func (db *DB) route(query string) *sqlx.DB {
+	if db.reader != nil && isReadQuery(query) {
+		return db.reader
 	}
+	return db.DB
+}
 
-	slog.Infof(context.TODO(), "%s dbtype:%s datasourcename:%s", fun, info.dbType, dataSourceName)
-	sqlxdb, err := sqlx.Connect(info.dbType, dataSourceName)
-	if err == nil {
-		sqlxdb.SetMaxIdleConns(8)
-		sqlxdb.SetMaxOpenConns(128)
-	}
-	return sqlxdb, err
+func dialBySqlx(info *Sql, sqldb *sql.DB) *sqlx.DB {
+	return sqlx.NewDb(sqldb, driverName(info.dbType))
 }
 
 func (db *DB) NamedExecWrapper(tables []interface{}, query string, arg interface{}) (sql.Result, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.NamedExec(query, arg)
+	_, done, _ := db.startStmt(nil, "NamedExec", query, false)
+	res, err := db.DB.NamedExec(query, arg)
+	done(err)
+	return res, err
 }
 
 func (db *DB) NamedQueryWrapper(tables []interface{}, query string, arg interface{}) (*sqlx.Rows, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.NamedQuery(query, arg)
+	_, done, _ := db.startStmt(nil, "NamedQuery", query, false)
+	rows, err := db.route(query).NamedQuery(query, arg)
+	done(err)
+	return rows, err
 }
 
 func (db *DB) SelectWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Select(dest, query, args...)
+	_, done, _ := db.startStmt(nil, "Select", query, false)
+	err := db.route(query).Select(dest, query, args...)
+	done(err)
+	return err
 }
 
 func (db *DB) ExecWrapper(tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Exec(query, args...)
+	_, done, _ := db.startStmt(nil, "Exec", query, false)
+	res, err := db.DB.Exec(query, args...)
+	done(err)
+	return res, err
 }
 
 func (db *DB) QueryRowxWrapper(tables []interface{}, query string, args ...interface{}) *sqlx.Row {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.QueryRowx(query, args...)
+	_, done, _ := db.startStmt(nil, "QueryRowx", query, false)
+	row := db.route(query).QueryRowx(query, args...)
+	done(row.Err())
+	return row
 }
 
 func (db *DB) QueryxWrapper(tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Queryx(query, args...)
+	_, done, _ := db.startStmt(nil, "Queryx", query, false)
+	rows, err := db.route(query).Queryx(query, args...)
+	done(err)
+	return rows, err
 }
 
 func (db *DB) GetWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Get(dest, query, args...)
+	_, done, _ := db.startStmt(nil, "Get", query, false)
+	err := db.route(query).Get(dest, query, args...)
+	done(err)
+	return err
+}
+
+// 以下 *ContextWrapper 方法在 ctx 取消或超过集群配置的查询超时后中断语句, 并为每条语句记录 span 与统计
+
+func (db *DB) NamedExecContextWrapper(ctx context.Context, tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := db.startStmt(ctx, "NamedExec", query, false)
+	res, err := db.DB.NamedExecContext(ctx, query, arg)
+	done(err)
+	return res, err
+}
+
+func (db *DB) NamedQueryContextWrapper(ctx context.Context, tables []interface{}, query string, arg interface{}) (*Rows, error) {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, cancel := db.startStmt(ctx, "NamedQuery", query, true)
+	rows, err := db.route(query).NamedQueryContext(ctx, query, arg)
+	done(err)
+	return newRows(rows, err, cancel)
+}
+
+func (db *DB) SelectContextWrapper(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := db.startStmt(ctx, "Select", query, false)
+	err := db.route(query).SelectContext(ctx, dest, query, args...)
+	done(err)
+	return err
+}
+
+func (db *DB) ExecContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := db.startStmt(ctx, "Exec", query, false)
+	res, err := db.DB.ExecContext(ctx, query, args...)
+	done(err)
+	return res, err
+}
+
+func (db *DB) QueryRowxContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) *Row {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, cancel := db.startStmt(ctx, "QueryRowx", query, true)
+	row := db.route(query).QueryRowxContext(ctx, query, args...)
+	done(row.Err())
+	return &Row{Row: row, cancel: cancel}
+}
+
+func (db *DB) QueryxContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) (*Rows, error) {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, cancel := db.startStmt(ctx, "Queryx", query, true)
+	rows, err := db.route(query).QueryxContext(ctx, query, args...)
+	done(err)
+	return newRows(rows, err, cancel)
+}
+
+// Rows 为 *ContextWrapper 查询返回的结果集, Close 时释放查询超时的 context;
+// 未调用 Close 时 context 在超时后才释放
+type Rows struct {
+	*sqlx.Rows
+	cancel context.CancelFunc
+}
+
+func newRows(rows *sqlx.Rows, err error, cancel context.CancelFunc) (*Rows, error) {
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Rows{Rows: rows, cancel: cancel}, nil
+}
+
+func (r *Rows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// Row 为 *ContextWrapper 查询返回的单行结果, Scan 后释放查询超时的 context
+type Row struct {
+	*sqlx.Row
+	cancel context.CancelFunc
+}
+
+func (r *Row) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return r.Row.Scan(dest...)
+}
+
+func (r *Row) StructScan(dest interface{}) error {
+	defer r.cancel()
+	return r.Row.StructScan(dest)
+}
+
+func (r *Row) MapScan(dest map[string]interface{}) error {
+	defer r.cancel()
+	return r.Row.MapScan(dest)
+}
+
+func (r *Row) SliceScan() ([]interface{}, error) {
+	defer r.cancel()
+	return r.Row.SliceScan()
+}
+
+func (db *DB) GetContextWrapper(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := db.startStmt(ctx, "Get", query, false)
+	err := db.route(query).GetContext(ctx, dest, query, args...)
+	done(err)
+	return err
 }
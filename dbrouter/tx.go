@@ -0,0 +1,249 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+	"time"
+)
+
+const (
+	defaultTxRetryBackoff    = 10 * time.Millisecond
+	defaultTxRetryMaxBackoff = 500 * time.Millisecond
+
+	mysqlErrLockDeadlock = 1213
+
+	spanLogKeyRetry = "retry"
+)
+
+// TxOptions 为事务选项, nil 表示使用数据库默认的隔离级别且不重试
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxRetries 为遇到死锁或序列化失败时整个事务的最大重试次数, 嵌套事务不重试
+	MaxRetries int
+}
+
+type txKey struct{}
+
+// Tx 为 SqlTx 中的事务, 总是在主库上执行
+type Tx struct {
+	*sqlx.Tx
+	ctx      context.Context
+	instance string
+	// savepoints 为根事务已创建的 savepoint 数量, 嵌套事务间共享
+	savepoints *int
+	// 为每条语句应用查询超时, 记录 span 与统计
+	stmtHook
+}
+
+// Context 返回绑定了该事务的 context, 用它再次调用 SqlTx 时会在同一事务中以 savepoint 的方式执行
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+func txFromContext(ctx context.Context) *Tx {
+	tx, _ := ctx.Value(txKey{}).(*Tx)
+	return tx
+}
+
+func (tx *Tx) NamedExecWrapper(tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := tx.startStmt(tx.ctx, "NamedExec", query, false)
+	res, err := tx.Tx.NamedExecContext(ctx, query, arg)
+	done(err)
+	return res, err
+}
+
+func (tx *Tx) SelectWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := tx.startStmt(tx.ctx, "Select", query, false)
+	err := tx.Tx.SelectContext(ctx, dest, query, args...)
+	done(err)
+	return err
+}
+
+func (tx *Tx) ExecWrapper(tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := tx.startStmt(tx.ctx, "Exec", query, false)
+	res, err := tx.Tx.ExecContext(ctx, query, args...)
+	done(err)
+	return res, err
+}
+
+func (tx *Tx) QueryRowxWrapper(tables []interface{}, query string, args ...interface{}) *Row {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, cancel := tx.startStmt(tx.ctx, "QueryRowx", query, true)
+	row := tx.Tx.QueryRowxContext(ctx, query, args...)
+	done(row.Err())
+	return &Row{Row: row, cancel: cancel}
+}
+
+func (tx *Tx) QueryxWrapper(tables []interface{}, query string, args ...interface{}) (*Rows, error) {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, cancel := tx.startStmt(tx.ctx, "Queryx", query, true)
+	rows, err := tx.Tx.QueryxContext(ctx, query, args...)
+	done(err)
+	return newRows(rows, err, cancel)
+}
+
+func (tx *Tx) GetWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	ctx, done, _ := tx.startStmt(tx.ctx, "Get", query, false)
+	err := tx.Tx.GetContext(ctx, dest, query, args...)
+	done(err)
+	return err
+}
+
+// isRetryableTxErr 判断是否为可以重试整个事务的错误: mysql 死锁, postgres 死锁或序列化失败, 包括被包装过的驱动错误
+func isRetryableTxErr(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrLockDeadlock
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
+}
+
+// SqlTx 在 cluster/table 所在实例的主库上开启事务执行 fn, fn 返回错误或 panic 时回滚, 否则提交;
+// 在 Tx.Context() 下再次调用 SqlTx 且路由到同一实例时, 以 savepoint 的方式嵌套执行
+// NOTE: 嵌套调用路由到其他实例时会开启独立的事务, 两个事务之间不保证原子性
+func (m *Router) SqlTx(ctx context.Context, cluster, table string, opts *TxOptions, fn func(*Tx, []interface{}) error) error {
+	fun := "Router.SqlTx -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.SqlTx")
+	defer span.Finish()
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, table))
+
+	st := stime.NewTimeStat()
+
+	instance := m.configer.GetInstance(ctx, cluster, table)
+	dbsql, err := m.getSql(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		dur := st.Duration()
+		m.reportExec(cluster, table, dur)
+		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
+	}()
+
+	tables := []interface{}{table}
+	if parent := txFromContext(ctx); parent != nil && parent.instance == instance {
+		return m.savepointTx(ctx, parent, m.stmtHook(ctx, cluster, table), tables, fn)
+	}
+
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+
+	backoff := defaultTxRetryBackoff
+	for retry := 0; ; retry++ {
+		err = m.runTx(ctx, dbsql.db, instance, m.stmtHook(ctx, cluster, table), opts, tables, fn)
+		if err == nil || !isRetryableTxErr(err) || retry >= opts.MaxRetries {
+			return err
+		}
+
+		span.LogFields(log.Int(spanLogKeyRetry, retry+1))
+		slog.Warnf(ctx, "%s retry tx, cls:%s table:%s retry:%d err:%s", fun, cluster, table, retry+1, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > defaultTxRetryMaxBackoff {
+			backoff = defaultTxRetryMaxBackoff
+		}
+	}
+}
+
+func (m *Router) runTx(ctx context.Context, db *DB, instance string, hook stmtHook, opts *TxOptions, tables []interface{}, fn func(*Tx, []interface{}) error) (err error) {
+	fun := "Router.runTx -->"
+
+	stx, err := db.BeginTxx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return err
+	}
+
+	tx := &Tx{
+		Tx:         stx,
+		instance:   instance,
+		savepoints: new(int),
+		stmtHook:   hook,
+	}
+	tx.ctx = context.WithValue(ctx, txKey{}, tx)
+
+	defer func() {
+		if p := recover(); p != nil {
+			if rerr := stx.Rollback(); rerr != nil {
+				slog.Errorf(ctx, "%s rollback on panic err:%s", fun, rerr.Error())
+			}
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx, tables); err != nil {
+		if rerr := stx.Rollback(); rerr != nil {
+			slog.Errorf(ctx, "%s rollback err:%s", fun, rerr.Error())
+		}
+		return err
+	}
+
+	return stx.Commit()
+}
+
+func (m *Router) savepointTx(ctx context.Context, parent *Tx, hook stmtHook, tables []interface{}, fn func(*Tx, []interface{}) error) (err error) {
+	fun := "Router.savepointTx -->"
+
+	*parent.savepoints++
+	name := fmt.Sprintf("sp_%d", *parent.savepoints)
+	if _, err = parent.Tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+
+	tx := &Tx{
+		Tx:         parent.Tx,
+		instance:   parent.instance,
+		savepoints: parent.savepoints,
+		stmtHook:   hook,
+	}
+	tx.ctx = context.WithValue(ctx, txKey{}, tx)
+
+	defer func() {
+		if p := recover(); p != nil {
+			if _, rerr := parent.Tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rerr != nil {
+				slog.Errorf(ctx, "%s rollback to %s on panic err:%s", fun, name, rerr.Error())
+			}
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx, tables); err != nil {
+		if _, rerr := parent.Tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rerr != nil {
+			slog.Errorf(ctx, "%s rollback to %s err:%s", fun, name, rerr.Error())
+		}
+		return err
+	}
+
+	_, err = parent.Tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
@@ -0,0 +1,167 @@
+package dbrouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryableTxErr(t *testing.T) {
+	assert.True(t, isRetryableTxErr(&mysql.MySQLError{Number: 1213}))
+	assert.False(t, isRetryableTxErr(&mysql.MySQLError{Number: 1062}))
+	assert.True(t, isRetryableTxErr(&pq.Error{Code: "40001"}))
+	assert.True(t, isRetryableTxErr(&pq.Error{Code: "40P01"}))
+	assert.False(t, isRetryableTxErr(&pq.Error{Code: "23505"}))
+	assert.True(t, isRetryableTxErr(fmt.Errorf("exec: %w", &mysql.MySQLError{Number: 1213})))
+	assert.False(t, isRetryableTxErr(errors.New("deadlock")))
+	assert.False(t, isRetryableTxErr(nil))
+}
+
+func TestTxFromContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, txFromContext(ctx))
+
+	tx := &Tx{instance: "user0", savepoints: new(int)}
+	tx.ctx = context.WithValue(ctx, txKey{}, tx)
+	assert.Equal(t, tx, txFromContext(tx.Context()))
+}
+
+func newTxTestRouter(t *testing.T) *Router {
+	router, err := NewRouterWithConfigType(CONFIG_TYPE_SIMPLE, []byte(`{
+		"cluster": {"account": [{"instance": "user0", "match": "regex", "express": ".*"}]},
+		"instances": {"user0": {"dbtype": "sqlite", "dbname": "account", "dbcfg": {"addrs": [":memory:"]}}}
+	}`))
+	assert.NoError(t, err)
+
+	err = router.SqlExec(context.Background(), "account", func(db *DB, tables []interface{}) error {
+		_, err := db.Exec("CREATE TABLE user (id INTEGER PRIMARY KEY)")
+		return err
+	}, "user")
+	assert.NoError(t, err)
+	return router
+}
+
+func txTestUserIds(t *testing.T, router *Router) []int {
+	var ids []int
+	err := router.SqlExec(context.Background(), "account", func(db *DB, tables []interface{}) error {
+		return db.Select(&ids, "SELECT id FROM user ORDER BY id")
+	}, "user")
+	assert.NoError(t, err)
+	return ids
+}
+
+func txTestInsert(tx *Tx, id int) error {
+	_, err := tx.ExecWrapper([]interface{}{"user"}, "INSERT INTO %s (id) VALUES (?)", id)
+	return err
+}
+
+func TestSqlTx(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("commit", func(t *testing.T) {
+		router := newTxTestRouter(t)
+		defer router.Close()
+
+		err := router.SqlTx(ctx, "account", "user", nil, func(tx *Tx, tables []interface{}) error {
+			return txTestInsert(tx, 1)
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1}, txTestUserIds(t, router))
+	})
+
+	t.Run("rollback on error", func(t *testing.T) {
+		router := newTxTestRouter(t)
+		defer router.Close()
+
+		txErr := errors.New("tx err")
+		err := router.SqlTx(ctx, "account", "user", nil, func(tx *Tx, tables []interface{}) error {
+			assert.NoError(t, txTestInsert(tx, 1))
+			return txErr
+		})
+		assert.Equal(t, txErr, err)
+		assert.Empty(t, txTestUserIds(t, router))
+	})
+
+	t.Run("rollback on panic", func(t *testing.T) {
+		router := newTxTestRouter(t)
+		defer router.Close()
+
+		assert.Panics(t, func() {
+			router.SqlTx(ctx, "account", "user", nil, func(tx *Tx, tables []interface{}) error {
+				assert.NoError(t, txTestInsert(tx, 1))
+				panic("tx panic")
+			})
+		})
+		assert.Empty(t, txTestUserIds(t, router))
+	})
+
+	t.Run("nested savepoint", func(t *testing.T) {
+		router := newTxTestRouter(t)
+		defer router.Close()
+
+		err := router.SqlTx(ctx, "account", "user", nil, func(tx *Tx, tables []interface{}) error {
+			assert.NoError(t, txTestInsert(tx, 1))
+
+			// 嵌套事务失败只回滚到 savepoint
+			err := router.SqlTx(tx.Context(), "account", "user", nil, func(ntx *Tx, tables []interface{}) error {
+				assert.NoError(t, txTestInsert(ntx, 2))
+				return errors.New("nested err")
+			})
+			assert.Error(t, err)
+
+			assert.Panics(t, func() {
+				router.SqlTx(tx.Context(), "account", "user", nil, func(ntx *Tx, tables []interface{}) error {
+					assert.NoError(t, txTestInsert(ntx, 3))
+					panic("nested panic")
+				})
+			})
+
+			return router.SqlTx(tx.Context(), "account", "user", nil, func(ntx *Tx, tables []interface{}) error {
+				return txTestInsert(ntx, 4)
+			})
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 4}, txTestUserIds(t, router))
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		router := newTxTestRouter(t)
+		defer router.Close()
+
+		calls := 0
+		err := router.SqlTx(ctx, "account", "user", &TxOptions{MaxRetries: 2}, func(tx *Tx, tables []interface{}) error {
+			calls++
+			assert.NoError(t, txTestInsert(tx, calls))
+			if calls == 1 {
+				return fmt.Errorf("insert: %w", &mysql.MySQLError{Number: mysqlErrLockDeadlock})
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		// 第一次的写入已回滚
+		assert.Equal(t, []int{2}, txTestUserIds(t, router))
+
+		calls = 0
+		err = router.SqlTx(ctx, "account", "user", &TxOptions{MaxRetries: 2}, func(tx *Tx, tables []interface{}) error {
+			calls++
+			return &mysql.MySQLError{Number: mysqlErrLockDeadlock}
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 3, calls)
+
+		// 不可重试的错误不重试
+		calls = 0
+		err = router.SqlTx(ctx, "account", "user", &TxOptions{MaxRetries: 2}, func(tx *Tx, tables []interface{}) error {
+			calls++
+			return errors.New("tx err")
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+}
@@ -0,0 +1,433 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxRegexSamples 为每个正则生成的样例串上限, 用于检测正则之间的重叠
+	maxRegexSamples = 64
+)
+
+// ConfigError 为配置校验发现的一个问题, Path 指出问题所在的配置项, 如 cluster.account[1]
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+func (m *ConfigError) Error() string {
+	if m.Path == "" {
+		return m.Message
+	}
+	return m.Path + ": " + m.Message
+}
+
+// ConfigErrors 为校验发现的全部问题
+type ConfigErrors []*ConfigError
+
+func (m ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(m))
+	for _, e := range m {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (m *ConfigErrors) add(path, format string, args ...interface{}) {
+	*m = append(*m, &ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// NewParserStrict 与 NewParser 相同, 但配置中有任何问题时都返回 ConfigErrors, 而不是跳过出错的部分
+func NewParserStrict(jscfg []byte) (*Parser, error) {
+	if errs := ValidateConfig(jscfg); len(errs) > 0 {
+		return nil, errs
+	}
+	return NewParser(jscfg)
+}
+
+type regexLookup struct {
+	path string
+	cfg  *dbLookupCfg
+	reg  *regexp.Regexp
+}
+
+// ValidateConfig 校验路由配置, 返回发现的全部问题, 没有问题时返回 nil
+// NOTE: 正则之间的重叠通过样例串检测, 能发现常见的写法问题, 但不保证发现所有重叠
+func ValidateConfig(jscfg []byte) ConfigErrors {
+	var errs ConfigErrors
+
+	var cfg routeConfig
+	if err := json.Unmarshal(jscfg, &cfg); err != nil {
+		errs.add("", "unmarshal err: %s", err.Error())
+		return errs
+	}
+
+	referenced := make(map[string]bool)
+	for _, c := range sortedKeys(cfg.Cluster) {
+		path := "cluster." + c
+		if err := checkVarname(c); err != nil {
+			errs.add(path, "invalid cluster name: %s", err.Error())
+		}
+		if len(cfg.Cluster[c]) == 0 {
+			errs.add(path, "empty lookup list")
+		}
+
+		full := make(map[string]bool)
+		var regexes []*regexLookup
+		for i, v := range cfg.Cluster[c] {
+			path := fmt.Sprintf("cluster.%s[%d]", c, i)
+			if v == nil {
+				errs.add(path, "empty lookup")
+				continue
+			}
+
+			if err := checkVarname(v.Instance); err != nil {
+				errs.add(path, "invalid instance name: %s", err.Error())
+			} else if _, ok := cfg.Instances[v.Instance]; !ok {
+				errs.add(path, "instance %s not in instances", v.Instance)
+			}
+			referenced[v.Instance] = true
+
+			if len(v.Express) == 0 {
+				errs.add(path, "empty express")
+				continue
+			}
+
+			switch v.Match {
+			case "full":
+				if full[v.Express] {
+					errs.add(path, "duplicate full express %s", v.Express)
+				}
+				full[v.Express] = true
+
+			case "regex":
+				reg, err := regexp.CompilePOSIX(v.Express)
+				if err != nil {
+					errs.add(path, "invalid regex %s: %s", v.Express, err.Error())
+					continue
+				}
+				for _, r := range regexes {
+					if r.cfg.Express == v.Express {
+						errs.add(path, "duplicate regex express %s", v.Express)
+					}
+				}
+				regexes = append(regexes, &regexLookup{path: path, cfg: v, reg: reg})
+
+			default:
+				errs.add(path, "match type %q not support, use full or regex", v.Match)
+			}
+		}
+
+		checkRegexOverlap(&errs, regexes)
+	}
+
+	groups := make(map[string]bool)
+	instanceGroups := make(map[string]map[string]bool)
+	for _, ins := range sortedKeys(cfg.Instances) {
+		path := "instances." + ins
+		db := cfg.Instances[ins]
+		if err := checkVarname(ins); err != nil {
+			errs.add(path, "invalid instance name: %s", err.Error())
+			continue
+		}
+		if db == nil {
+			errs.add(path, "empty instance")
+			continue
+		}
+
+		switch db.Dbtype {
+		case DB_TYPE_MONGO, DB_TYPE_MYSQL, DB_TYPE_POSTGRES, DB_TYPE_SQLITE:
+		default:
+			errs.add(path, "dbtype %q not support", db.Dbtype)
+		}
+
+		instanceGroups[ins] = make(map[string]bool)
+		if _, err := parseDbIns(db.Dbtype, db.Dbname, ins, db.Dbcfg, db.Level); err != nil {
+			errs.add(path, "%s", err.Error())
+		} else {
+			instanceGroups[ins][DefaultGroup] = true
+		}
+		groups[DefaultGroup] = true
+
+		for i, item := range db.Ins {
+			path := fmt.Sprintf("instances.%s.ins[%d]", ins, i)
+			if item.Group == DefaultGroup {
+				errs.add(path, "empty group")
+				continue
+			}
+			if instanceGroups[ins][item.Group] {
+				errs.add(path, "duplicate group %s", item.Group)
+			}
+			if _, err := parseDbIns(db.Dbtype, db.Dbname, ins, item.Dbcfg, db.Level); err != nil {
+				errs.add(path, "%s", err.Error())
+			}
+			instanceGroups[ins][item.Group] = true
+			groups[item.Group] = true
+		}
+	}
+
+	for _, ins := range sortedKeys(instanceGroups) {
+		for _, group := range sortedKeys(groups) {
+			if !instanceGroups[ins][group] && group != DefaultGroup {
+				errs.add("instances."+ins, "missing group %s", group)
+			}
+		}
+	}
+
+	for _, c := range sortedKeys(cfg.Shards) {
+		for _, table := range sortedKeys(cfg.Shards[c]) {
+			rule := cfg.Shards[c][table]
+			if err := parseShardRule(rule, cfg.Instances); err != nil {
+				errs.add(fmt.Sprintf("shards.%s.%s", c, table), "%s", err.Error())
+				continue
+			}
+			for _, ins := range rule.Instances {
+				referenced[ins] = true
+			}
+		}
+	}
+
+	for _, ins := range sortedKeys(cfg.Instances) {
+		if !referenced[ins] {
+			errs.add("instances."+ins, "not referenced by any cluster or shard rule")
+		}
+	}
+
+	for _, c := range sortedKeys(cfg.ClusterOptions) {
+		if opt := cfg.ClusterOptions[c]; opt == nil || opt.QueryTimeout < 0 {
+			errs.add("cluster_options."+c, "invalid query_timeout")
+		}
+	}
+
+	for _, group := range sortedKeys(cfg.FallbackGroups) {
+		fallback := cfg.FallbackGroups[group]
+		path := fmt.Sprintf("fallback_groups.%q", group)
+		if !groups[group] {
+			errs.add(path, "group %q not in instances", group)
+		}
+		if group == fallback {
+			errs.add(path, "fallback to itself")
+		} else if !groups[fallback] {
+			errs.add(path, "fallback group %q not in instances", fallback)
+		}
+	}
+
+	return errs
+}
+
+// checkRegexOverlap 检查同一 cluster 中指向不同实例的正则是否可能匹配同一个表名,
+// getLookup 遍历 map 的顺序不固定, 重叠时同一张表可能被路由到不同的实例
+func checkRegexOverlap(errs *ConfigErrors, regexes []*regexLookup) {
+	for i, a := range regexes {
+		for _, b := range regexes[i+1:] {
+			if a.cfg.Instance == b.cfg.Instance {
+				continue
+			}
+			if sample, ok := regexOverlap(a.reg, b.reg); ok {
+				errs.add(b.path, "regex %s overlaps with %s (%s), both match %q", b.cfg.Express, a.cfg.Express, a.path, sample)
+			}
+		}
+	}
+}
+
+func regexOverlap(a, b *regexp.Regexp) (string, bool) {
+	for _, pair := range [][2]*regexp.Regexp{{a, b}, {b, a}} {
+		for _, s := range regexSamples(pair[0].String()) {
+			if fullMatch(pair[0], s) && fullMatch(pair[1], s) {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+func fullMatch(reg *regexp.Regexp, s string) bool {
+	return reg.FindString(s) == s
+}
+
+// regexSamples 根据正则的语法树生成一组能被它匹配的样例串
+func regexSamples(expr string) []string {
+	re, err := syntax.Parse(expr, syntax.POSIX)
+	if err != nil {
+		return nil
+	}
+	return sampleRegex(re.Simplify())
+}
+
+func sampleRegex(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+
+	case syntax.OpCharClass:
+		var samples []string
+		for i := 0; i+1 < len(re.Rune) && len(samples) < 3; i += 2 {
+			samples = append(samples, string(re.Rune[i]))
+		}
+		return samples
+
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"a", "_"}
+
+	case syntax.OpCapture:
+		return sampleRegex(re.Sub[0])
+
+	case syntax.OpStar, syntax.OpQuest:
+		return limitSamples(append([]string{""}, sampleRegex(re.Sub[0])...))
+
+	case syntax.OpPlus:
+		return sampleRegex(re.Sub[0])
+
+	case syntax.OpRepeat:
+		samples := []string{""}
+		for i := 0; i < re.Min; i++ {
+			samples = concatSamples(samples, sampleRegex(re.Sub[0]))
+		}
+		if re.Min == 0 {
+			samples = limitSamples(append(samples, sampleRegex(re.Sub[0])...))
+		}
+		return samples
+
+	case syntax.OpConcat:
+		samples := []string{""}
+		for _, sub := range re.Sub {
+			samples = concatSamples(samples, sampleRegex(sub))
+		}
+		return samples
+
+	case syntax.OpAlternate:
+		var samples []string
+		for _, sub := range re.Sub {
+			samples = append(samples, sampleRegex(sub)...)
+		}
+		return limitSamples(samples)
+
+	case syntax.OpNoMatch:
+		return nil
+
+	default:
+		// 空串与 ^ $ \b 等位置断言
+		return []string{""}
+	}
+}
+
+func concatSamples(heads, tails []string) []string {
+	var samples []string
+	for _, h := range heads {
+		for _, t := range tails {
+			samples = append(samples, h+t)
+			if len(samples) >= maxRegexSamples {
+				return samples
+			}
+		}
+	}
+	return samples
+}
+
+func limitSamples(samples []string) []string {
+	if len(samples) > maxRegexSamples {
+		return samples[:maxRegexSamples]
+	}
+	return samples
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string][]*dbLookupCfg:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*dbInsCfg:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]bool:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]*ShardRule:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*ShardRule:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*dbClusterCfg:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Resolution 为 (cluster, table, route group) 的路由结果
+type Resolution struct {
+	Cluster string
+	Table   string
+	// Group 为实际使用的 group, 请求的 group 不在配置中时为 DefaultGroup
+	Group    string
+	Instance string
+	Match    string
+	Express  string
+	DBType   string
+	DBName   string
+	DBAddr   []string
+	// Fallback 为实例不可用时使用的备用 group, 没有配置时为空
+	Fallback    string
+	HasFallback bool
+}
+
+// Resolve 返回 (cluster, table, group) 会路由到的实例与 group, 与 Router 运行时的选择逻辑一致
+func (m *Parser) Resolve(cluster, table, group string) (*Resolution, error) {
+	lookup := m.dbCls.getLookup(cluster, table)
+	if lookup == nil {
+		return nil, fmt.Errorf("no lookup rule matches cluster:%s table:%s", cluster, table)
+	}
+
+	if _, ok := m.dbIns[group]; !ok && group != DefaultGroup {
+		if group == TestGroup {
+			return nil, fmt.Errorf("db config don't have group: %s", group)
+		}
+		group = DefaultGroup
+	}
+
+	info, ok := m.dbIns[group][lookup.Instance]
+	if !ok {
+		return nil, fmt.Errorf("db instance not find: instance:%s group:%s", lookup.Instance, group)
+	}
+
+	fallback, hasFallback := m.GetFallbackGroup(group)
+	return &Resolution{
+		Cluster:     cluster,
+		Table:       table,
+		Group:       group,
+		Instance:    lookup.Instance,
+		Match:       lookup.Match,
+		Express:     lookup.Express,
+		DBType:      info.DBType,
+		DBName:      info.DBName,
+		DBAddr:      info.DBAddr,
+		Fallback:    fallback,
+		HasFallback: hasFallback,
+	}, nil
+}
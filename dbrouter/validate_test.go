@@ -0,0 +1,108 @@
+package dbrouter
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfig(t *testing.T) {
+	errs := ValidateConfig(shardRouteConfig)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "shards.account.bad", errs[0].Path)
+
+	errs = ValidateConfig([]byte(`{
+		"cluster": {
+			"account": [
+				{"instance": "user0", "match": "regex", "express": "user_[0-9]+"},
+				{"instance": "user1", "match": "regex", "express": "user_.*"},
+				{"instance": "user0", "match": "like", "express": "user"},
+				{"instance": "user9", "match": "full", "express": "profile"}
+			]
+		},
+		"instances": {
+			"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]},
+				"ins": [{"group": "g1", "dbcfg": {"addrs": ["127.0.0.1:3307"]}}]},
+			"user1": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]}},
+			"orphan": {"dbtype": "oracle", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]}}
+		},
+		"fallback_groups": {"g1": "g2"}
+	}`))
+
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal(t, []string{
+		"cluster.account[2]",
+		"cluster.account[3]",
+		"cluster.account[1]",
+		"instances.orphan",
+		"instances.orphan",
+		"instances.user1",
+		"instances.orphan",
+		`fallback_groups."g1"`,
+	}, paths)
+	assert.Contains(t, errs[2].Message, "overlaps")
+	assert.Contains(t, errs[5].Message, "missing group g1")
+
+	errs = ValidateConfig([]byte(`{"cluster": [}`))
+	assert.Equal(t, 1, len(errs))
+
+	_, err := NewParserStrict(shardRouteConfig)
+	assert.Error(t, err)
+}
+
+func TestRegexOverlap(t *testing.T) {
+	for _, c := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"user_[0-9]+", "user_.*", true},
+		{"user_[0-9]+", "order_[0-9]+", false},
+		{"(user|profile)", "profile", true},
+		{"a+b", "ab", true},
+		{"user", "users", false},
+	} {
+		_, overlap := regexOverlap(regexp.MustCompilePOSIX(c.a), regexp.MustCompilePOSIX(c.b))
+		assert.Equal(t, c.overlap, overlap, "%s %s", c.a, c.b)
+	}
+}
+
+func TestParserResolve(t *testing.T) {
+	parser, err := NewParser([]byte(`{
+		"cluster": {"account": [
+			{"instance": "user0", "match": "full", "express": "user"},
+			{"instance": "user1", "match": "regex", "express": "order_.*"}
+		]},
+		"instances": {
+			"user0": {"dbtype": "mysql", "dbname": "account", "dbcfg": {"addrs": ["127.0.0.1:3306"]},
+				"ins": [{"group": "g1", "dbcfg": {"addrs": ["127.0.0.1:3307"]}}]},
+			"user1": {"dbtype": "mysql", "dbname": "order", "dbcfg": {"addrs": ["127.0.0.1:3308"]},
+				"ins": [{"group": "g1", "dbcfg": {"addrs": ["127.0.0.1:3309"]}}]}
+		},
+		"fallback_groups": {"g1": ""}
+	}`))
+	assert.NoError(t, err)
+
+	r, err := parser.Resolve("account", "user", "g1")
+	assert.NoError(t, err)
+	assert.Equal(t, "user0", r.Instance)
+	assert.Equal(t, "g1", r.Group)
+	assert.Equal(t, []string{"127.0.0.1:3307"}, r.DBAddr)
+	assert.True(t, r.HasFallback)
+	assert.Equal(t, DefaultGroup, r.Fallback)
+
+	r, err = parser.Resolve("account", "order_1", "g2")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", r.Instance)
+	assert.Equal(t, DefaultGroup, r.Group)
+	assert.Equal(t, "regex", r.Match)
+	assert.False(t, r.HasFallback)
+
+	_, err = parser.Resolve("account", "user", TestGroup)
+	assert.Error(t, err)
+	_, err = parser.Resolve("account", "profile", DefaultGroup)
+	assert.Error(t, err)
+}
@@ -2,13 +2,16 @@ module github.com/shawnfeng/sutil
 
 require (
 	github.com/ZhengHe-MD/agollo/v4 v4.1.3
+	github.com/BurntSushi/toml v0.4.1
 	github.com/ZhengHe-MD/properties v0.2.1
 	github.com/bitly/go-simplejson v0.4.4-0.20140701141959-3378bdcb5ceb
 	github.com/coreos/etcd v3.0.0-beta.0.0.20160712024141-cc26f2c8892e+incompatible
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/fzzy/radix v0.4.9-0.20141113025130-a3a55de9c594
 	github.com/go-redis/redis v6.15.1+incompatible
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/golang/protobuf v1.2.0
+	github.com/golang/snappy v0.0.1 // indirect
 	github.com/google/uuid v1.1.0
 	github.com/jinzhu/gorm v1.9.10
 	github.com/jmoiron/sqlx v0.0.0-20170430194603-d9bd385d68c0
@@ -16,7 +19,9 @@ require (
 	github.com/kaneshin/go-pkg v0.0.0-20150919125626-a8e1479186cf
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/lib/pq v1.1.1
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/opentracing/opentracing-go v1.1.0
+	github.com/pierrec/lz4 v2.0.5+incompatible // indirect
 	github.com/pkg/errors v0.8.0
 	github.com/prometheus/client_golang v0.9.3-0.20190127221311-3c4408c8b829
 	github.com/sdming/gosnow v0.0.0-20130403030620-3a05c415e886
@@ -30,11 +35,13 @@ require (
 	github.com/ugorji/go v0.0.0-20160531122944-b94837a2404a // indirect
 	github.com/vaughan0/go-ini v0.0.0-20130923145212-a98ad7ee00ec
 
+	go.mongodb.org/mongo-driver v1.17.6
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.9.1
 
 	gopkg.in/mgo.v2 v2.0.0-20141107142503-e2e914857713
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 
 )
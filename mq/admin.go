@@ -0,0 +1,143 @@
+// Copyright 2014 The mqrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"net"
+	"strconv"
+)
+
+type TopicConfig struct {
+	Topic             string
+	NumPartitions     int
+	ReplicationFactor int
+	// Configs 为 topic 级别的配置, 如 retention.ms, cleanup.policy
+	Configs map[string]string
+}
+
+type PartitionInfo struct {
+	ID       int
+	Leader   string
+	Replicas []string
+	Isr      []string
+}
+
+func brokerAddr(b kafka.Broker) string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+func brokerAddrs(bs []kafka.Broker) []string {
+	addrs := make([]string, 0, len(bs))
+	for _, b := range bs {
+		addrs = append(addrs, brokerAddr(b))
+	}
+	return addrs
+}
+
+// dialController 创建 topic 等操作必须发往 controller
+func dialController(ctx context.Context, brokers []string) (conn *kafka.Conn, err error) {
+	for _, broker := range brokers {
+		conn, err = kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			continue
+		}
+
+		var controller kafka.Broker
+		controller, err = conn.Controller()
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		return kafka.DialContext(ctx, "tcp", brokerAddr(controller))
+	}
+
+	if err == nil {
+		err = errors.New("no brokers")
+	}
+	return
+}
+
+// CreateTopic 创建 topic, brokers 从 topic 的配置中获取; topic 已存在时不做任何修改并返回 nil
+func CreateTopic(ctx context.Context, conf *TopicConfig) error {
+	fun := "mq.CreateTopic -->"
+
+	if conf.NumPartitions <= 0 || conf.ReplicationFactor <= 0 {
+		return fmt.Errorf("%s invalid partitions:%d or replication factor:%d",
+			fun, conf.NumPartitions, conf.ReplicationFactor)
+	}
+
+	brokers, err := getBrokers(ctx, conf.Topic)
+	if err != nil {
+		slog.Errorf(ctx, "%s get brokers err, topic: %s, err: %v", fun, conf.Topic, err)
+		return err
+	}
+
+	conn, err := dialController(ctx, brokers)
+	if err != nil {
+		slog.Errorf(ctx, "%s dial controller err, topic: %s, err: %v", fun, conf.Topic, err)
+		return err
+	}
+	defer conn.Close()
+
+	var entries []kafka.ConfigEntry
+	for k, v := range conf.Configs {
+		entries = append(entries, kafka.ConfigEntry{ConfigName: k, ConfigValue: v})
+	}
+
+	err = conn.CreateTopics(kafka.TopicConfig{
+		Topic:             conf.Topic,
+		NumPartitions:     conf.NumPartitions,
+		ReplicationFactor: conf.ReplicationFactor,
+		ConfigEntries:     entries,
+	})
+	if err != nil {
+		slog.Errorf(ctx, "%s create topic err, topic: %s, err: %v", fun, conf.Topic, err)
+	}
+	return err
+}
+
+// DescribeTopic 返回 topic 每个 partition 的 leader 与副本分布, 按 partition 升序排列
+func DescribeTopic(ctx context.Context, topic string) ([]PartitionInfo, error) {
+	brokers, err := getBrokers(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions, err := lookupPartitions(ctx, brokers, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]PartitionInfo, 0, len(partitions))
+	for _, p := range partitions {
+		infos = append(infos, PartitionInfo{
+			ID:       p.ID,
+			Leader:   brokerAddr(p.Leader),
+			Replicas: brokerAddrs(p.Replicas),
+			Isr:      brokerAddrs(p.Isr),
+		})
+	}
+	return infos, nil
+}
+
+// Partitions 返回 topic 的所有 partition, 可配合 ReadMsgByPartition 使用
+func Partitions(ctx context.Context, topic string) ([]int, error) {
+	infos, err := DescribeTopic(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(infos))
+	for _, info := range infos {
+		ids = append(ids, info.ID)
+	}
+	return ids, nil
+}
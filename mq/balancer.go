@@ -0,0 +1,91 @@
+// Copyright 2014 The mqrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"fmt"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+type BalancerType string
+
+const (
+	// BalancerHash 为历史默认值, 使用 fnv-1a 对 key 做 hash, 与 java 客户端不兼容
+	BalancerHash BalancerType = "hash"
+	// BalancerMurmur2 与 java 客户端的 DefaultPartitioner 一致, 相同 key 会落在相同 partition
+	BalancerMurmur2    BalancerType = "murmur2"
+	BalancerRoundRobin BalancerType = "roundrobin"
+	BalancerLeastBytes BalancerType = "leastbytes"
+)
+
+func (b BalancerType) balancer() (kafka.Balancer, error) {
+	switch b {
+	case "", BalancerHash:
+		return &kafka.Hash{}, nil
+	case BalancerMurmur2:
+		return &Murmur2Balancer{}, nil
+	case BalancerRoundRobin:
+		return &kafka.RoundRobin{}, nil
+	case BalancerLeastBytes:
+		return &kafka.LeastBytes{}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancer:%s", b)
+	}
+}
+
+// Murmur2Balancer 按 java 客户端的算法选择 partition: toPositive(murmur2(key)) % len(partitions)
+// key 为空时退化为 round robin
+type Murmur2Balancer struct {
+	rr kafka.RoundRobin
+}
+
+func (b *Murmur2Balancer) Balance(msg kafka.Message, partitions ...int) int {
+	if len(msg.Key) == 0 {
+		return b.rr.Balance(msg, partitions...)
+	}
+
+	idx := (murmur2(msg.Key) & 0x7fffffff) % int32(len(partitions))
+	return partitions[idx]
+}
+
+// murmur2 移植自 java 客户端 org.apache.kafka.common.utils.Utils.murmur2
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
@@ -0,0 +1,51 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/kaneshin/go-pkg/testing/assert"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// 期望值取自 java 客户端 UtilsTest.testMurmur2
+func TestMurmur2(t *testing.T) {
+	cases := []struct {
+		key      string
+		expected int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, murmur2([]byte(c.key)))
+	}
+}
+
+func TestMurmur2Balancer(t *testing.T) {
+	b := &Murmur2Balancer{}
+	partitions := []int{0, 1, 2, 3, 4, 5}
+
+	p := b.Balance(kafka.Message{Key: []byte("foobar")}, partitions...)
+	assert.Equal(t, p, b.Balance(kafka.Message{Key: []byte("foobar")}, partitions...))
+	assert.Equal(t, p, int((-790332482&0x7fffffff)%6))
+
+	// 没有 key 时轮询
+	assert.Equal(t, 0, b.Balance(kafka.Message{}, partitions...))
+	assert.Equal(t, 1, b.Balance(kafka.Message{}, partitions...))
+}
+
+func TestBalancerType_balancer(t *testing.T) {
+	for _, b := range []BalancerType{"", BalancerHash, BalancerMurmur2, BalancerRoundRobin, BalancerLeastBytes} {
+		balancer, err := b.balancer()
+		assert.Equal(t, err, nil)
+		assert.True(t, balancer != nil)
+	}
+
+	_, err := BalancerType("random").balancer()
+	assert.NotEqual(t, err, nil)
+}
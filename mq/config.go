@@ -11,6 +11,7 @@ import (
 	"github.com/shawnfeng/sutil/sconf/center"
 	"github.com/shawnfeng/sutil/scontext"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -53,7 +54,11 @@ func (c ConfigerType) String() string {
 }
 
 const (
-	defaultTimeout = 3 * time.Second
+	defaultTimeout       = 3 * time.Second
+	defaultBatchSize     = 1
+	defaultBatchTimeout  = 10 * time.Millisecond
+	defaultRequiredAcks  = -1
+	defaultQueueCapacity = 1024
 )
 
 type Config struct {
@@ -63,6 +68,47 @@ type Config struct {
 	TimeOut        time.Duration
 	CommitInterval time.Duration
 	Offset         int64
+
+	// 以下为 producer 相关配置
+	// BatchSize 为每批发送的最大消息数, BatchTimeout 为攒批的最长等待时间(linger)
+	BatchSize    int
+	BatchTimeout time.Duration
+	// Compression 取值为 none/gzip/snappy/lz4
+	Compression CompressionType
+	// RequiredAcks: -1 等待所有副本确认, 1 只等待 leader 确认
+	RequiredAcks int
+	// Async 为 true 时 WriteMsg/WriteMsgs 只负责入队, 由后台协程攒批发送
+	Async         bool
+	QueueCapacity int
+	// Balancer 决定消息写入哪个 partition, 取值为 hash/murmur2/roundrobin/leastbytes
+	Balancer BalancerType
+}
+
+type CompressionType string
+
+const (
+	CompressionNone   CompressionType = "none"
+	CompressionGzip   CompressionType = "gzip"
+	CompressionSnappy CompressionType = "snappy"
+	CompressionLz4    CompressionType = "lz4"
+)
+
+func defaultConfig(topic string, brokers []string) *Config {
+	return &Config{
+		MQType:         MQTypeKafka,
+		MQAddr:         brokers,
+		Topic:          topic,
+		TimeOut:        defaultTimeout,
+		CommitInterval: 1 * time.Second,
+		Offset:         FirstOffset,
+		BatchSize:      defaultBatchSize,
+		BatchTimeout:   defaultBatchTimeout,
+		Compression:    CompressionNone,
+		RequiredAcks:   defaultRequiredAcks,
+		Async:          false,
+		QueueCapacity:  defaultQueueCapacity,
+		Balancer:       BalancerHash,
+	}
 }
 
 type KeyParts struct {
@@ -113,14 +159,7 @@ func (m *SimpleConfig) GetConfig(ctx context.Context, topic string) (*Config, er
 	fun := "SimpleConfig.GetConfig-->"
 	slog.Infof(ctx, "%s get simple config topic:%s", fun, topic)
 
-	return &Config{
-		MQType:         MQTypeKafka,
-		MQAddr:         m.mqAddr,
-		Topic:          topic,
-		TimeOut:        defaultTimeout,
-		CommitInterval: 1 * time.Second,
-		Offset:         FirstOffset,
-	}, nil
+	return defaultConfig(topic, m.mqAddr), nil
 }
 
 func (m *SimpleConfig) ParseKey(ctx context.Context, k string) (*KeyParts, error) {
@@ -175,6 +214,13 @@ const (
 	apolloConfigSep        = "."
 	apolloBrokersSep       = ","
 	apolloBrokersKey       = "brokers"
+	apolloBatchSizeKey     = "batchsize"
+	apolloLingerKey        = "linger"
+	apolloCompressionKey   = "compression"
+	apolloRequiredAcksKey  = "acks"
+	apolloAsyncKey         = "async"
+	apolloQueueCapacityKey = "queuecapacity"
+	apolloBalancerKey      = "balancer"
 )
 
 type ApolloConfig struct {
@@ -246,14 +292,74 @@ func (m *ApolloConfig) GetConfig(ctx context.Context, topic string) (*Config, er
 
 	slog.Infof(ctx, "%s got config brokers:%s", fun, brokers)
 
-	return &Config{
-		MQType:         MQTypeKafka,
-		MQAddr:         brokers,
-		Topic:          topic,
-		TimeOut:        defaultTimeout,
-		CommitInterval: 1 * time.Second,
-		Offset:         FirstOffset,
-	}, nil
+	config := defaultConfig(topic, brokers)
+	if err := m.fillProducerConfig(ctx, topic, config); err != nil {
+		return nil, fmt.Errorf("%s topic:%s err:%v", fun, topic, err)
+	}
+
+	return config, nil
+}
+
+// NOTE: producer 配置均为可选项, 未配置时保持默认值
+func (m *ApolloConfig) fillProducerConfig(ctx context.Context, topic string, config *Config) error {
+	if val, ok := m.getConfigItemWithFallback(ctx, topic, apolloBatchSizeKey); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s:%s", apolloBatchSizeKey, val)
+		}
+		config.BatchSize = n
+	}
+
+	if val, ok := m.getConfigItemWithFallback(ctx, topic, apolloLingerKey); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(val))
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid %s:%s", apolloLingerKey, val)
+		}
+		config.BatchTimeout = d
+	}
+
+	if val, ok := m.getConfigItemWithFallback(ctx, topic, apolloCompressionKey); ok {
+		compression := CompressionType(strings.ToLower(strings.TrimSpace(val)))
+		if _, err := compression.codec(); err != nil {
+			return err
+		}
+		config.Compression = compression
+	}
+
+	if val, ok := m.getConfigItemWithFallback(ctx, topic, apolloRequiredAcksKey); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		// NOTE: kafka-go 只支持 -1 与 1
+		if err != nil || (n != -1 && n != 1) {
+			return fmt.Errorf("invalid %s:%s", apolloRequiredAcksKey, val)
+		}
+		config.RequiredAcks = n
+	}
+
+	if val, ok := m.getConfigItemWithFallback(ctx, topic, apolloAsyncKey); ok {
+		async, err := strconv.ParseBool(strings.TrimSpace(val))
+		if err != nil {
+			return fmt.Errorf("invalid %s:%s", apolloAsyncKey, val)
+		}
+		config.Async = async
+	}
+
+	if val, ok := m.getConfigItemWithFallback(ctx, topic, apolloQueueCapacityKey); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid %s:%s", apolloQueueCapacityKey, val)
+		}
+		config.QueueCapacity = n
+	}
+
+	if val, ok := m.getConfigItemWithFallback(ctx, topic, apolloBalancerKey); ok {
+		balancer := BalancerType(strings.ToLower(strings.TrimSpace(val)))
+		if _, err := balancer.balancer(); err != nil {
+			return err
+		}
+		config.Balancer = balancer
+	}
+
+	return nil
 }
 
 func (m *ApolloConfig) ParseKey(ctx context.Context, key string) (*KeyParts, error) {
@@ -0,0 +1,332 @@
+// Copyright 2014 The mqrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil"
+	"github.com/shawnfeng/sutil/cache/redisext"
+	"github.com/shawnfeng/sutil/scontext"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	delayQueueKey        = "mq.delay.queue"
+	delayLeaderKey       = "mq.delay.leader"
+	defaultDelayBatch    = 100
+	defaultDelayTick     = time.Second
+	defaultDelayLeaseTTL = 10 * time.Second
+	// defaultDelayRetryBackoff 为投递失败的消息重新入队后的延后时间
+	defaultDelayRetryBackoff = 10 * time.Second
+)
+
+var (
+	defaultDelayQueue   *DelayQueue
+	defaultDelayQueueMu sync.RWMutex
+
+	DelayQueueNotSetErr = errors.New("delay queue not set, call mq.SetDelayQueue first")
+)
+
+// delayedMsg 为存放在 redis sorted set 中的成员, score 为投递时间戳(秒)
+// NOTE: payload.ID 保证了相同内容的消息在 sorted set 中也不会被合并
+type delayedMsg struct {
+	Topic   string   `json:"topic"`
+	Key     string   `json:"key"`
+	Group   string   `json:"group"`
+	Payload *Payload `json:"payload"`
+}
+
+// delayZSet 为 DelayQueue 使用的 sorted set 操作, 由 redisext.RedisExt 实现
+type delayZSet interface {
+	ZAdd(ctx context.Context, key string, members []redisext.Z) (int64, error)
+	ZRem(ctx context.Context, key string, members []interface{}) (int64, error)
+	ZRangeByScore(ctx context.Context, key string, by redisext.ZRangeBy) ([]string, error)
+}
+
+// DelayQueue 基于 redis sorted set 实现延时消息:
+// WriteDelayedMsg 将消息写入 sorted set, 由 dispatcher 在到期后投递到真实的 topic
+// 多个实例同时启动 dispatcher 时, 通过 redis 租约选主, 只有 leader 进行投递
+type DelayQueue struct {
+	redisExt  *redisext.RedisExt
+	zset      delayZSet
+	getWriter func(ctx context.Context, conf *instanceConf) Writer
+	id        string
+
+	batch        int64
+	tick         time.Duration
+	leaseTTL     time.Duration
+	retryBackoff time.Duration
+
+	dispatchOnce sync.Once
+}
+
+func NewDelayQueue(namespace, prefix string) (*DelayQueue, error) {
+	id, err := sutil.GetUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	redisExt := redisext.NewRedisExt(namespace, prefix)
+	return &DelayQueue{
+		redisExt:     redisExt,
+		zset:         redisExt,
+		getWriter:    defaultInstanceManager.getWriter,
+		id:           id,
+		batch:        defaultDelayBatch,
+		tick:         defaultDelayTick,
+		leaseTTL:     defaultDelayLeaseTTL,
+		retryBackoff: defaultDelayRetryBackoff,
+	}, nil
+}
+
+// SetDelayQueue 设置 mq.WriteDelayedMsg 使用的延时队列
+func SetDelayQueue(q *DelayQueue) {
+	defaultDelayQueueMu.Lock()
+	defer defaultDelayQueueMu.Unlock()
+	defaultDelayQueue = q
+}
+
+func getDelayQueue() *DelayQueue {
+	defaultDelayQueueMu.RLock()
+	defer defaultDelayQueueMu.RUnlock()
+	return defaultDelayQueue
+}
+
+// WriteDelayedMsg 在 deliverAt 之后将消息投递到 topic, 投递精度为秒级
+func WriteDelayedMsg(ctx context.Context, topic string, key string, value interface{}, deliverAt time.Time) error {
+	q := getDelayQueue()
+	if q == nil {
+		return DelayQueueNotSetErr
+	}
+	return q.WriteDelayedMsg(ctx, topic, key, value, deliverAt)
+}
+
+func (q *DelayQueue) WriteDelayedMsg(ctx context.Context, topic string, key string, value interface{}, deliverAt time.Time) error {
+	fun := "DelayQueue.WriteDelayedMsg -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "mq.WriteDelayedMsg")
+	defer span.Finish()
+	span.LogFields(
+		log.String(spanLogKeyTopic, topic),
+		log.String(spanLogKeyKey, key))
+
+	payload, err := generatePayload(ctx, value)
+	if err != nil {
+		slog.Errorf(ctx, "%s generatePayload err, topic: %s", fun, topic)
+		return fmt.Errorf("%s, generatePayload err, topic: %s", fun, topic)
+	}
+
+	member, err := json.Marshal(&delayedMsg{
+		Topic:   topic,
+		Key:     key,
+		Group:   scontext.GetControlRouteGroupWithDefault(ctx, defaultRouteGroup),
+		Payload: payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = q.zset.ZAdd(ctx, delayQueueKey, []redisext.Z{
+		{Score: float64(deliverAt.Unix()), Member: string(member)},
+	})
+	if err != nil {
+		slog.Errorf(ctx, "%s zadd err, topic: %s, err: %v", fun, topic, err)
+	}
+	return err
+}
+
+// StartDispatcher 启动后台投递协程, 重复调用只会启动一次, ctx 取消后退出
+func (q *DelayQueue) StartDispatcher(ctx context.Context) {
+	q.dispatchOnce.Do(func() {
+		go q.dispatchLoop(ctx)
+	})
+}
+
+func (q *DelayQueue) dispatchLoop(ctx context.Context) {
+	fun := "DelayQueue.dispatchLoop -->"
+	slog.Infof(ctx, "%s start, id: %s", fun, q.id)
+
+	ticker := time.NewTicker(q.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Infof(ctx, "%s context err:%v", fun, ctx.Err())
+			q.resign(context.Background())
+			return
+		case <-ticker.C:
+			leader, err := q.campaign(ctx)
+			if err != nil {
+				slog.Errorf(ctx, "%s campaign err:%v", fun, err)
+				continue
+			}
+			if !leader {
+				continue
+			}
+
+			if err := q.dispatch(ctx, q.campaign); err != nil {
+				slog.Errorf(ctx, "%s dispatch err:%v", fun, err)
+			}
+		}
+	}
+}
+
+// campaign 尝试获取或续约 leader 租约
+// NOTE: 续约时 get 与 expire 不是原子操作, 租约恰好过期时可能短暂出现两个 leader,
+// 因此投递为 at-least-once 语义, 消费方可配合 IdempotentConsumer 去重
+func (q *DelayQueue) campaign(ctx context.Context) (bool, error) {
+	ok, err := q.redisExt.SetNX(ctx, delayLeaderKey, q.id, q.leaseTTL)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		return true, nil
+	}
+
+	holder, err := q.redisExt.Get(ctx, delayLeaderKey)
+	if err != nil {
+		return false, err
+	}
+	if holder != q.id {
+		return false, nil
+	}
+
+	return q.redisExt.Expire(ctx, delayLeaderKey, q.leaseTTL)
+}
+
+func (q *DelayQueue) resign(ctx context.Context) {
+	holder, err := q.redisExt.Get(ctx, delayLeaderKey)
+	if err == nil && holder == q.id {
+		_, _ = q.redisExt.Del(ctx, delayLeaderKey)
+	}
+}
+
+// dispatch 投递所有到期的消息, 投递失败的消息延后 retryBackoff 重新入队, 不影响其他消息的投递;
+// 每批消息投递前以 renew 续约 leader 租约, 续约失败或已不是 leader 时停止, 避免投递耗时超过租约后与新的 leader 重复投递
+func (q *DelayQueue) dispatch(ctx context.Context, renew func(ctx context.Context) (bool, error)) error {
+	fun := "DelayQueue.dispatch -->"
+
+	for first := true; ; first = false {
+		if !first {
+			leader, err := renew(ctx)
+			if err != nil {
+				return err
+			}
+			if !leader {
+				slog.Warnf(ctx, "%s lost leader lease, stop dispatching", fun)
+				return nil
+			}
+		}
+
+		members, err := q.zset.ZRangeByScore(ctx, delayQueueKey, redisext.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(time.Now().Unix(), 10),
+			Count: q.batch,
+		})
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+
+		var delivered []interface{}
+		var retries []redisext.Z
+		retryAt := float64(time.Now().Add(q.retryBackoff).Unix())
+		for i, err := range q.deliverBatch(ctx, members) {
+			if err != nil {
+				slog.Errorf(ctx, "%s deliver err, retry after %s, err:%v", fun, q.retryBackoff, err)
+				retries = append(retries, redisext.Z{Score: retryAt, Member: members[i]})
+				continue
+			}
+			delivered = append(delivered, members[i])
+		}
+
+		if len(delivered) > 0 {
+			if _, err := q.zset.ZRem(ctx, delayQueueKey, delivered); err != nil {
+				return err
+			}
+		}
+		if len(retries) > 0 {
+			// NOTE: 更新 score 延后重试; 更新失败时消息仍然到期, 结束本轮避免反复取到同一批消息
+			if _, err := q.zset.ZAdd(ctx, delayQueueKey, retries); err != nil {
+				return err
+			}
+		}
+
+		if int64(len(members)) < q.batch {
+			return nil
+		}
+	}
+}
+
+// deliverBatch 将一批消息写入真实的 topic, 全部发出后一起等待投递结果, 返回每条消息的错误;
+// NOTE: 使用 WriteMsgAsync 并等待 callback, async 的 writer 只入队就返回, 发送失败时消息已被移出队列而丢失
+func (q *DelayQueue) deliverBatch(ctx context.Context, members []string) []error {
+	fun := "DelayQueue.deliverBatch -->"
+
+	type result struct {
+		index int
+		err   error
+	}
+
+	errs := make([]error, len(members))
+	results := make(chan result, len(members))
+	waiting := make(map[int]bool)
+	for i, member := range members {
+		var msg delayedMsg
+		if err := json.Unmarshal([]byte(member), &msg); err != nil {
+			// NOTE: 无法解析的成员直接丢弃, 避免阻塞整个队列
+			slog.Errorf(ctx, "%s invalid member:%s err:%v", fun, member, err)
+			continue
+		}
+
+		conf := &instanceConf{
+			group:     msg.Group,
+			role:      RoleTypeWriter,
+			topic:     msg.Topic,
+			groupId:   "",
+			partition: 0,
+		}
+		writer := q.getWriter(ctx, conf)
+		if writer == nil {
+			errs[i] = fmt.Errorf("%s getWriter err, topic: %s", fun, msg.Topic)
+			continue
+		}
+
+		index := i
+		callback := func(ctx context.Context, report *DeliveryReport) {
+			results <- result{index: index, err: report.Err}
+		}
+		if err := writer.WriteMsgAsync(ctx, msg.Key, msg.Payload, callback); err != nil {
+			errs[i] = err
+			continue
+		}
+		waiting[i] = true
+	}
+
+	for len(waiting) > 0 {
+		select {
+		case r := <-results:
+			errs[r.index] = r.err
+			delete(waiting, r.index)
+		case <-ctx.Done():
+			for i := range waiting {
+				errs[i] = ctx.Err()
+			}
+			return errs
+		}
+	}
+	return errs
+}
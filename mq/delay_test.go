@@ -0,0 +1,219 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaneshin/go-pkg/testing/assert"
+	"github.com/shawnfeng/sutil/cache/redisext"
+)
+
+func TestWriteDelayedMsg_notSet(t *testing.T) {
+	SetDelayQueue(nil)
+	err := WriteDelayedMsg(context.TODO(), defaultTestTopic, "key", "value", time.Now())
+	assert.Equal(t, err, DelayQueueNotSetErr)
+}
+
+func TestDelayedMsg_json(t *testing.T) {
+	payload, err := generatePayload(context.TODO(), "value")
+	assert.Equal(t, err, nil)
+
+	member, err := json.Marshal(&delayedMsg{
+		Topic:   defaultTestTopic,
+		Key:     "key",
+		Group:   defaultRouteGroup,
+		Payload: payload,
+	})
+	assert.Equal(t, err, nil)
+
+	var msg delayedMsg
+	assert.Equal(t, json.Unmarshal(member, &msg), nil)
+	assert.Equal(t, msg.Topic, defaultTestTopic)
+	assert.Equal(t, msg.Group, defaultRouteGroup)
+	assert.Equal(t, msg.Payload.ID, payload.ID)
+	assert.Equal(t, msg.Payload.Value, payload.Value)
+}
+
+type fakeZSet struct {
+	mu     sync.Mutex
+	scores map[string]float64
+}
+
+func newFakeZSet() *fakeZSet {
+	return &fakeZSet{scores: make(map[string]float64)}
+}
+
+func (m *fakeZSet) ZAdd(ctx context.Context, key string, members []redisext.Z) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, z := range members {
+		m.scores[z.Member.(string)] = z.Score
+	}
+	return int64(len(members)), nil
+}
+
+func (m *fakeZSet) ZRem(ctx context.Context, key string, members []interface{}) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, member := range members {
+		delete(m.scores, member.(string))
+	}
+	return int64(len(members)), nil
+}
+
+func (m *fakeZSet) ZRangeByScore(ctx context.Context, key string, by redisext.ZRangeBy) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	max, _ := strconv.ParseFloat(by.Max, 64)
+	var members []string
+	for member, score := range m.scores {
+		if score <= max {
+			members = append(members, member)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return m.scores[members[i]] < m.scores[members[j]]
+	})
+	if by.Count > 0 && int64(len(members)) > by.Count {
+		members = members[:by.Count]
+	}
+	return members, nil
+}
+
+func (m *fakeZSet) score(t *testing.T, topic string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for member, score := range m.scores {
+		var msg delayedMsg
+		assert.Equal(t, json.Unmarshal([]byte(member), &msg), nil)
+		if msg.Topic == topic {
+			return score, true
+		}
+	}
+	return 0, false
+}
+
+// fakeDelayWriter 在后台协程中回调投递结果, 与 async 的 KafkaWriter 相同
+type fakeDelayWriter struct {
+	err error
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func (m *fakeDelayWriter) WriteMsg(ctx context.Context, key string, value interface{}) error {
+	return errors.New("WriteMsg should not be used")
+}
+
+func (m *fakeDelayWriter) WriteMsgs(ctx context.Context, msgs ...Message) error {
+	return errors.New("WriteMsgs should not be used")
+}
+
+func (m *fakeDelayWriter) WriteMsgAsync(ctx context.Context, key string, value interface{}, callback DeliveryCallback) error {
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if m.err == nil {
+			m.mu.Lock()
+			m.keys = append(m.keys, key)
+			m.mu.Unlock()
+		}
+		callback(ctx, &DeliveryReport{Key: key, Err: m.err})
+	}()
+	return nil
+}
+
+func (m *fakeDelayWriter) Close() error {
+	return nil
+}
+
+func TestDelayQueue_dispatch(t *testing.T) {
+	ctx := context.TODO()
+	zset := newFakeZSet()
+	okWriter := &fakeDelayWriter{}
+	failWriter := &fakeDelayWriter{err: errors.New("kafka unavailable")}
+
+	q := &DelayQueue{
+		zset: zset,
+		getWriter: func(ctx context.Context, conf *instanceConf) Writer {
+			switch conf.topic {
+			case "ok":
+				return okWriter
+			case "fail":
+				return failWriter
+			default:
+				return nil
+			}
+		},
+		batch:        2,
+		retryBackoff: time.Minute,
+	}
+
+	now := time.Now()
+	// 未配置的 topic 排在最前, 不应阻塞后面的消息
+	assert.Equal(t, q.WriteDelayedMsg(ctx, "unknown", "k0", "v", now.Add(-3*time.Second)), nil)
+	assert.Equal(t, q.WriteDelayedMsg(ctx, "fail", "k1", "v", now.Add(-2*time.Second)), nil)
+	assert.Equal(t, q.WriteDelayedMsg(ctx, "ok", "k2", "v", now.Add(-time.Second)), nil)
+	assert.Equal(t, q.WriteDelayedMsg(ctx, "later", "k3", "v", now.Add(time.Hour)), nil)
+
+	renews := 0
+	renew := func(ctx context.Context) (bool, error) {
+		renews++
+		return true, nil
+	}
+	assert.Equal(t, q.dispatch(ctx, renew), nil)
+	// 第一批之后每批续约一次
+	assert.Equal(t, renews, 1)
+
+	assert.Equal(t, okWriter.keys, []string{"k2"})
+	_, ok := zset.score(t, "ok")
+	assert.False(t, ok)
+
+	// 投递失败(包括 async 发送失败)的消息延后重试, 不被删除
+	for _, topic := range []string{"unknown", "fail"} {
+		score, ok := zset.score(t, topic)
+		assert.True(t, ok)
+		assert.True(t, score >= float64(now.Add(q.retryBackoff).Unix()))
+	}
+	score, ok := zset.score(t, "later")
+	assert.True(t, ok)
+	assert.Equal(t, score, float64(now.Add(time.Hour).Unix()))
+}
+
+func TestDelayQueue_dispatchLostLeader(t *testing.T) {
+	ctx := context.TODO()
+	zset := newFakeZSet()
+	writer := &fakeDelayWriter{}
+
+	q := &DelayQueue{
+		zset: zset,
+		getWriter: func(ctx context.Context, conf *instanceConf) Writer {
+			return writer
+		},
+		batch:        2,
+		retryBackoff: time.Minute,
+	}
+
+	now := time.Now()
+	for i, topic := range []string{"t0", "t1", "t2"} {
+		assert.Equal(t, q.WriteDelayedMsg(ctx, topic, fmt.Sprintf("k%d", i), "v", now.Add(time.Duration(i-3)*time.Second)), nil)
+	}
+
+	// 续约失败后不再投递下一批
+	assert.Equal(t, q.dispatch(ctx, func(ctx context.Context) (bool, error) {
+		return false, nil
+	}), nil)
+	assert.Equal(t, len(writer.keys), 2)
+	_, ok := zset.score(t, "t2")
+	assert.True(t, ok)
+}
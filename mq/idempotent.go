@@ -0,0 +1,205 @@
+// Copyright 2014 The mqrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"context"
+	"fmt"
+	"github.com/shawnfeng/sutil/cache/redisext"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIdempotentWindow = 24 * time.Hour
+	// defaultIdempotentProcessingTTL 为处理中记录的有效期, 处理过程中进程退出时, 过期后消息可以被重新处理
+	defaultIdempotentProcessingTTL = time.Minute
+	// handle 失败或消息处理中时原地重试的间隔, 每次翻倍直到 defaultIdempotentRetryMaxBackoff
+	defaultIdempotentRetryBackoff    = 100 * time.Millisecond
+	defaultIdempotentRetryMaxBackoff = 10 * time.Second
+	idempotentKeySep                 = ":"
+
+	idempotentStateProcessing = "processing"
+	idempotentStateDone       = "done"
+)
+
+// IdempotentStore 记录消息的处理状态: 处理中的记录在 ttl 后过期, 处理完成后记录为已处理并保留 window 时间
+type IdempotentStore interface {
+	// Acquire 在 ttl 时间内将 id 记录为处理中; id 已有记录时 acquired 为 false, done 表示已有记录是否为已处理
+	Acquire(ctx context.Context, id string, ttl time.Duration) (acquired bool, done bool, err error)
+	// MarkDone 将 id 记录为已处理, 覆盖处理中的记录
+	MarkDone(ctx context.Context, id string, window time.Duration) error
+	// Unmark 删除 id 的记录, 用于消息处理失败后允许重新消费
+	Unmark(ctx context.Context, id string) error
+}
+
+type RedisIdempotentStore struct {
+	redisExt *redisext.RedisExt
+}
+
+func NewRedisIdempotentStore(namespace, prefix string) *RedisIdempotentStore {
+	return &RedisIdempotentStore{
+		redisExt: redisext.NewRedisExt(namespace, prefix),
+	}
+}
+
+func (m *RedisIdempotentStore) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, bool, error) {
+	ok, err := m.redisExt.SetNX(ctx, id, idempotentStateProcessing, ttl)
+	if err != nil || ok {
+		return ok, false, err
+	}
+
+	state, err := m.redisExt.Get(ctx, id)
+	if err != nil {
+		// NOTE: 记录可能在 SetNX 之后恰好过期, 按处理中返回, 由调用方稍后重试
+		return false, false, nil
+	}
+	return false, state == idempotentStateDone, nil
+}
+
+func (m *RedisIdempotentStore) MarkDone(ctx context.Context, id string, window time.Duration) error {
+	_, err := m.redisExt.Set(ctx, id, idempotentStateDone, window)
+	return err
+}
+
+func (m *RedisIdempotentStore) Unmark(ctx context.Context, id string) error {
+	_, err := m.redisExt.Del(ctx, id)
+	return err
+}
+
+// IdempotentConsumer 在 FetchMsgByGroup 的基础上做消费幂等:
+// 同一条消息(因 rebalance 等原因重复投递)在 window 时间内只会被处理成功一次
+type IdempotentConsumer struct {
+	store           IdempotentStore
+	window          time.Duration
+	processingTTL   time.Duration
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+}
+
+func NewIdempotentConsumer(store IdempotentStore, window time.Duration) *IdempotentConsumer {
+	if window <= 0 {
+		window = defaultIdempotentWindow
+	}
+	return &IdempotentConsumer{
+		store:           store,
+		window:          window,
+		processingTTL:   defaultIdempotentProcessingTTL,
+		retryBackoff:    defaultIdempotentRetryBackoff,
+		retryMaxBackoff: defaultIdempotentRetryMaxBackoff,
+	}
+}
+
+type identifiable interface {
+	Identity() string
+}
+
+// 优先使用生产方写入的消息 ID, 老版本生产方没有 ID 时退化为 topic/partition/offset
+func msgIdentity(topic, groupId string, payload *Payload, handler Handler) (string, error) {
+	if payload != nil && len(payload.ID) > 0 {
+		return strings.Join([]string{groupId, topic, payload.ID}, idempotentKeySep), nil
+	}
+
+	if h, ok := handler.(identifiable); ok {
+		return strings.Join([]string{groupId, h.Identity()}, idempotentKeySep), nil
+	}
+
+	return "", fmt.Errorf("no identity for msg, topic: %s", topic)
+}
+
+// ConsumeByGroup 拉取一条消息并交给 handle 处理, handle 返回 nil 后记录为已处理并提交 offset
+// 已处理过的消息不会调用 handle, 直接提交 offset, 此时返回的 skipped 为 true
+// handle 返回错误, 或消息正在被其他消费者处理时, 按退避间隔原地重试直到成功, 保证消息至少被处理一次;
+// ctx 结束时不提交 offset 并返回错误, 此时 reader 已越过该消息, 调用方应停止消费,
+// 继续消费并提交后续消息会跳过它, 重启后从已提交的 offset 重新消费
+// handle panic 时清除处理中的记录, 不提交 offset; 进程在处理过程中退出时, 处理中的记录在 processingTTL 后过期
+func (c *IdempotentConsumer) ConsumeByGroup(ctx context.Context, topic, groupId string, value interface{},
+	handle func(mctx context.Context) error) (skipped bool, err error) {
+	mctx, payload, handler, err := fetchMsgByGroup(ctx, "mq.IdempotentConsumer.ConsumeByGroup", topic, groupId, value)
+	if err != nil {
+		return false, err
+	}
+
+	return c.consume(ctx, mctx, topic, groupId, payload, handler, handle)
+}
+
+func (c *IdempotentConsumer) consume(ctx, mctx context.Context, topic, groupId string, payload *Payload, handler Handler,
+	handle func(mctx context.Context) error) (skipped bool, err error) {
+	fun := "IdempotentConsumer.ConsumeByGroup -->"
+
+	id, err := msgIdentity(topic, groupId, payload, handler)
+	if err != nil {
+		slog.Errorf(ctx, "%s msgIdentity err:%v", fun, err)
+		return false, err
+	}
+
+	backoff := c.retryBackoff
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			select {
+			case <-ctx.Done():
+				return false, fmt.Errorf("%s msg:%s not consumed, last err:%v, ctx err:%v", fun, id, err, ctx.Err())
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > c.retryMaxBackoff {
+				backoff = c.retryMaxBackoff
+			}
+		}
+
+		var done bool
+		done, err = c.consumeOnce(ctx, mctx, id, handle)
+		if err != nil {
+			slog.Warnf(ctx, "%s consume msg:%s retry:%d err:%v", fun, id, retry, err)
+			continue
+		}
+		if done {
+			slog.Infof(ctx, "%s skip duplicated msg:%s", fun, id)
+		}
+		return done, handler.CommitMsg(ctx)
+	}
+}
+
+// consumeOnce 处理一次消息, 消息已处理过时 skipped 为 true; 返回错误时消息未处理成功, 可以重试
+func (c *IdempotentConsumer) consumeOnce(ctx, mctx context.Context, id string, handle func(mctx context.Context) error) (skipped bool, err error) {
+	fun := "IdempotentConsumer.consumeOnce -->"
+
+	acquired, done, err := c.store.Acquire(ctx, id, c.processingTTL)
+	if err != nil {
+		return false, err
+	}
+
+	if !acquired {
+		if done {
+			return true, nil
+		}
+		// NOTE: 其他消费者正在处理(或处理中退出且记录还未过期), 等待其完成或记录过期
+		return false, fmt.Errorf("msg:%s is being processed", id)
+	}
+
+	unmark := func() {
+		if uerr := c.store.Unmark(ctx, id); uerr != nil {
+			slog.Errorf(ctx, "%s unmark msg:%s err:%v", fun, id, uerr)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			unmark()
+			panic(r)
+		}
+	}()
+
+	if err = handle(mctx); err != nil {
+		unmark()
+		return false, err
+	}
+
+	if err := c.store.MarkDone(ctx, id, c.window); err != nil {
+		// NOTE: 消息已处理成功, 仍然提交 offset; 处理中的记录过期后, 重复投递的消息可能被再次处理
+		slog.Errorf(ctx, "%s mark msg:%s done err:%v", fun, id, err)
+	}
+	return false, nil
+}
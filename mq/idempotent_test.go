@@ -0,0 +1,217 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaneshin/go-pkg/testing/assert"
+)
+
+type identityHandler struct {
+	identity string
+	commits  int
+}
+
+func (m *identityHandler) CommitMsg(ctx context.Context) error {
+	m.commits++
+	return nil
+}
+
+func (m *identityHandler) Identity() string {
+	return m.identity
+}
+
+func TestMsgIdentity(t *testing.T) {
+	handler := &identityHandler{identity: defaultTestTopic + "/1/100"}
+
+	t.Run("payload with id", func(t *testing.T) {
+		id, err := msgIdentity(defaultTestTopic, "g1", &Payload{ID: "abc"}, handler)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, id, "g1:"+defaultTestTopic+":abc")
+	})
+
+	t.Run("payload without id", func(t *testing.T) {
+		id, err := msgIdentity(defaultTestTopic, "g1", &Payload{}, handler)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, id, "g1:"+defaultTestTopic+"/1/100")
+	})
+
+	t.Run("no identity", func(t *testing.T) {
+		_, err := msgIdentity(defaultTestTopic, "g1", &Payload{}, nil)
+		assert.NotEqual(t, err, nil)
+	})
+}
+
+func TestGeneratePayload(t *testing.T) {
+	payload, err := generatePayload(context.TODO(), "value")
+	assert.Equal(t, err, nil)
+	assert.True(t, len(payload.ID) > 0)
+
+	msgs, err := generateMsgsPayload(context.TODO(), Message{"k1", "v1"}, Message{"k2", "v2"})
+	assert.Equal(t, err, nil)
+	assert.NotEqual(t, msgs[0].Value.(*Payload).ID, msgs[1].Value.(*Payload).ID)
+}
+
+type fakeIdempotentStore struct {
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func newFakeIdempotentStore() *fakeIdempotentStore {
+	return &fakeIdempotentStore{states: make(map[string]string)}
+}
+
+func (m *fakeIdempotentStore) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := m.states[id]; ok {
+		return false, state == idempotentStateDone, nil
+	}
+	m.states[id] = idempotentStateProcessing
+	return true, false, nil
+}
+
+func (m *fakeIdempotentStore) MarkDone(ctx context.Context, id string, window time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.states[id] = idempotentStateDone
+	return nil
+}
+
+func (m *fakeIdempotentStore) Unmark(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.states, id)
+	return nil
+}
+
+func (m *fakeIdempotentStore) state(id string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.states[id]
+}
+
+func TestIdempotentConsume(t *testing.T) {
+	ctx := context.TODO()
+	id := "g1:" + defaultTestTopic + ":abc"
+	payload := &Payload{ID: "abc"}
+
+	consume := func(c *IdempotentConsumer, handler *identityHandler, handle func(context.Context) error) (bool, error) {
+		return c.consume(ctx, ctx, defaultTestTopic, "g1", payload, handler, handle)
+	}
+
+	t.Run("duplicate skipped", func(t *testing.T) {
+		store := newFakeIdempotentStore()
+		c := NewIdempotentConsumer(store, 0)
+
+		calls := 0
+		handle := func(context.Context) error {
+			calls++
+			return nil
+		}
+		handler := &identityHandler{}
+		skipped, err := consume(c, handler, handle)
+		assert.Equal(t, err, nil)
+		assert.False(t, skipped)
+		assert.Equal(t, store.state(id), idempotentStateDone)
+
+		skipped, err = consume(c, handler, handle)
+		assert.Equal(t, err, nil)
+		assert.True(t, skipped)
+		assert.Equal(t, calls, 1)
+		assert.Equal(t, handler.commits, 2)
+	})
+
+	t.Run("failed handle retried", func(t *testing.T) {
+		store := newFakeIdempotentStore()
+		c := NewIdempotentConsumer(store, 0)
+		c.retryBackoff = time.Millisecond
+
+		handler := &identityHandler{}
+		calls := 0
+		skipped, err := consume(c, handler, func(context.Context) error {
+			calls++
+			if calls < 3 {
+				assert.Equal(t, handler.commits, 0)
+				return errors.New("handle err")
+			}
+			return nil
+		})
+		assert.Equal(t, err, nil)
+		assert.False(t, skipped)
+		assert.Equal(t, calls, 3)
+		assert.Equal(t, handler.commits, 1)
+		assert.Equal(t, store.state(id), idempotentStateDone)
+	})
+
+	t.Run("failed handle not committed on ctx done", func(t *testing.T) {
+		store := newFakeIdempotentStore()
+		c := NewIdempotentConsumer(store, 0)
+		c.retryBackoff = time.Millisecond
+
+		cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		handler := &identityHandler{}
+		_, err := c.consume(cctx, cctx, defaultTestTopic, "g1", payload, handler, func(context.Context) error {
+			return errors.New("handle err")
+		})
+		assert.NotEqual(t, err, nil)
+		assert.Equal(t, handler.commits, 0)
+		assert.Equal(t, store.state(id), "")
+	})
+
+	t.Run("panic leaves msg unmarked", func(t *testing.T) {
+		store := newFakeIdempotentStore()
+		c := NewIdempotentConsumer(store, 0)
+
+		handler := &identityHandler{}
+		func() {
+			defer func() {
+				assert.NotEqual(t, recover(), nil)
+			}()
+			consume(c, handler, func(context.Context) error {
+				panic("handle panic")
+			})
+		}()
+		assert.Equal(t, handler.commits, 0)
+		assert.Equal(t, store.state(id), "")
+	})
+
+	t.Run("being processed waits", func(t *testing.T) {
+		store := newFakeIdempotentStore()
+		c := NewIdempotentConsumer(store, 0)
+		c.retryBackoff = time.Millisecond
+		store.states[id] = idempotentStateProcessing
+
+		cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		handler := &identityHandler{}
+		skipped, err := c.consume(cctx, cctx, defaultTestTopic, "g1", payload, handler, func(context.Context) error {
+			t.Fatal("handle should not be called")
+			return nil
+		})
+		assert.NotEqual(t, err, nil)
+		assert.False(t, skipped)
+		assert.Equal(t, handler.commits, 0)
+
+		// 其他消费者处理完成后跳过
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			store.MarkDone(ctx, id, time.Minute)
+		}()
+		skipped, err = consume(c, handler, func(context.Context) error {
+			t.Fatal("handle should not be called")
+			return nil
+		})
+		assert.Equal(t, err, nil)
+		assert.True(t, skipped)
+		assert.Equal(t, handler.commits, 1)
+	})
+}
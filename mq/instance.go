@@ -243,6 +243,31 @@ func (m *InstanceManager) watch(ctx context.Context) {
 	})
 }
 
+// groupReaderTargets 返回当前所有消费组 reader 对应的 topic 与 groupId
+func (m *InstanceManager) groupReaderTargets() []lagTarget {
+	seen := make(map[lagTarget]bool)
+	var targets []lagTarget
+	m.instances.Range(func(key, val interface{}) bool {
+		sk, ok := key.(string)
+		if !ok {
+			return true
+		}
+
+		conf, err := m.confFromKey(sk)
+		if err != nil || conf.role != RoleTypeReader || len(conf.groupId) == 0 {
+			return true
+		}
+
+		target := lagTarget{topic: conf.topic, groupId: conf.groupId}
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+		return true
+	})
+	return targets
+}
+
 func (m *InstanceManager) getReader(ctx context.Context, conf *instanceConf) Reader {
 	fun := "InstanceManager.getReader -->"
 
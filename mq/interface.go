@@ -110,6 +110,39 @@ func WriteMsgs(ctx context.Context, topic string, msgs ...Message) error {
 	return writer.WriteMsgs(ctx, nmsgs...)
 }
 
+// 消息入队后立即返回, 由后台协程攒批发送, 投递结果通过 callback 通知
+// callback 可为 nil; 调用 Close 时会等待队列中的消息全部发送完毕
+func WriteMsgAsync(ctx context.Context, topic string, key string, value interface{}, callback DeliveryCallback) error {
+	fun := "mq.WriteMsgAsync -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "mq.WriteMsgAsync")
+	defer span.Finish()
+	span.LogFields(
+		log.String(spanLogKeyTopic, topic),
+		log.String(spanLogKeyKey, key))
+
+	conf := &instanceConf{
+		group:     scontext.GetControlRouteGroupWithDefault(ctx, defaultRouteGroup),
+		role:      RoleTypeWriter,
+		topic:     topic,
+		groupId:   "",
+		partition: 0,
+	}
+	writer := defaultInstanceManager.getWriter(ctx, conf)
+	if writer == nil {
+		slog.Errorf(ctx, "%s getWriter err, topic: %s", fun, topic)
+		return fmt.Errorf("%s, getWriter err, topic: %s", fun, topic)
+	}
+
+	payload, err := generatePayload(ctx, value)
+	if err != nil {
+		slog.Errorf(ctx, "%s generatePayload err, topic: %s", fun, topic)
+		return fmt.Errorf("%s, generatePayload err, topic: %s", fun, topic)
+	}
+
+	return writer.WriteMsgAsync(ctx, key, payload, callback)
+}
+
 // 读完消息后会自动提交offset
 func ReadMsgByGroup(ctx context.Context, topic, groupId string, value interface{}) (context.Context, error) {
 	fun := "mq.ReadMsgByGroup -->"
@@ -214,9 +247,14 @@ func ReadMsgByPartition(ctx context.Context, topic string, partition int, value
 
 // 读完消息后不会自动提交offset,需要手动调用Handle.CommitMsg方法来提交offset
 func FetchMsgByGroup(ctx context.Context, topic, groupId string, value interface{}) (context.Context, Handler, error) {
-	fun := "mq.FetchMsgByGroup -->"
+	mctx, _, handler, err := fetchMsgByGroup(ctx, "mq.FetchMsgByGroup", topic, groupId, value)
+	return mctx, handler, err
+}
+
+func fetchMsgByGroup(ctx context.Context, opName, topic, groupId string, value interface{}) (context.Context, *Payload, Handler, error) {
+	fun := opName + " -->"
 
-	span, ctx := opentracing.StartSpanFromContext(ctx, "mq.FetchMsgByGroup")
+	span, ctx := opentracing.StartSpanFromContext(ctx, opName)
 	defer span.Finish()
 	span.LogFields(
 		log.String(spanLogKeyTopic, topic))
@@ -231,7 +269,7 @@ func FetchMsgByGroup(ctx context.Context, topic, groupId string, value interface
 	reader := defaultInstanceManager.getReader(ctx, conf)
 	if reader == nil {
 		slog.Errorf(ctx, "%s getReader err, topic: %s", fun, topic)
-		return nil, nil, fmt.Errorf("%s, getReader err, topic: %s", fun, topic)
+		return nil, nil, nil, fmt.Errorf("%s, getReader err, topic: %s", fun, topic)
 	}
 
 	var payload Payload
@@ -246,21 +284,21 @@ func FetchMsgByGroup(ctx context.Context, topic, groupId string, value interface
 
 	if err != nil {
 		slog.Errorf(ctx, "%s ReadMsg err, topic: %s", fun, topic)
-		return nil, nil, fmt.Errorf("%s, ReadMsg err, topic: %s", fun, topic)
+		return nil, nil, nil, fmt.Errorf("%s, ReadMsg err, topic: %s", fun, topic)
 	}
 
 	if len(payload.Value) == 0 {
-		return context.TODO(), handler, nil
+		return context.TODO(), &payload, handler, nil
 	}
 
-	mctx, err := parsePayload(&payload, "mq.FetchMsgByGroup", value)
+	mctx, err := parsePayload(&payload, opName, value)
 	mspan := opentracing.SpanFromContext(mctx)
 	if mspan != nil {
 		defer mspan.Finish()
 		mspan.LogFields(
 			log.String(spanLogKeyTopic, topic))
 	}
-	return mctx, handler, err
+	return mctx, &payload, handler, err
 }
 
 func SetConfiger(ctx context.Context, configerType ConfigerType) error {
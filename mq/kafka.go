@@ -11,7 +11,12 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
 	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/gzip"
+	"github.com/segmentio/kafka-go/lz4"
+	"github.com/segmentio/kafka-go/snappy"
+	"github.com/shawnfeng/sutil/slog/slog"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -31,6 +36,11 @@ func (m *KafkaHandler) CommitMsg(ctx context.Context) error {
 	return m.reader.CommitMessages(ctx, m.msg)
 }
 
+// Identity 返回消息在 kafka 中的唯一位置 topic/partition/offset
+func (m *KafkaHandler) Identity() string {
+	return fmt.Sprintf("%s/%d/%d", m.msg.Topic, m.msg.Partition, m.msg.Offset)
+}
+
 type KafkaReader struct {
 	*kafka.Reader
 }
@@ -114,27 +124,105 @@ func (m *KafkaReader) Close() error {
 	return m.Reader.Close()
 }
 
+func (c CompressionType) codec() (kafka.CompressionCodec, error) {
+	switch c {
+	case "", CompressionNone:
+		return nil, nil
+	case CompressionGzip:
+		return gzip.NewCompressionCodec(), nil
+	case CompressionSnappy:
+		return snappy.NewCompressionCodec(), nil
+	case CompressionLz4:
+		return lz4.NewCompressionCodec(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression:%s", c)
+	}
+}
+
+// kafkaWriterFlushTimeout 为 async 模式下 kafka.Writer 的 BatchTimeout, 队列已经攒好批, 不需要再等待
+const kafkaWriterFlushTimeout = time.Millisecond
+
+type kafkaAsyncMsg struct {
+	ctx      context.Context
+	msg      kafka.Message
+	callback DeliveryCallback
+}
+
 type KafkaWriter struct {
 	*kafka.Writer
 	// NOTE: KafkaWriter 没有 config 的 getter，故在此保留一份
 	config kafka.WriterConfig
+
+	async     bool
+	batchSize int
+	linger    time.Duration
+
+	// NOTE: mu 保护 closed, 保证 Close 之后不会再向 queue 写入
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *kafkaAsyncMsg
+	done   chan struct{}
 }
 
 func NewKafkaWriter(brokers []string, topic string) *KafkaWriter {
-	config := kafka.WriterConfig{
-		Brokers:   brokers,
-		Topic:     topic,
-		Balancer:  &kafka.Hash{},
-		BatchSize: 1,
-		//RequiredAcks: 1,
-		//Async:        true,
+	// NOTE: 默认配置的压缩方式与 balancer 一定合法, 不会出错
+	writer, _ := NewKafkaWriterWithConfig(defaultConfig(topic, brokers))
+	return writer
+}
+
+func NewKafkaWriterWithConfig(config *Config) (*KafkaWriter, error) {
+	codec, err := config.Compression.codec()
+	if err != nil {
+		return nil, err
+	}
+	balancer, err := config.Balancer.balancer()
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	linger := config.BatchTimeout
+	if linger <= 0 {
+		linger = defaultBatchTimeout
+	}
+	queueCapacity := config.QueueCapacity
+	if queueCapacity <= 0 {
+		queueCapacity = defaultQueueCapacity
 	}
-	writer := kafka.NewWriter(config)
 
-	return &KafkaWriter{
-		Writer: writer,
-		config: config,
+	wconfig := kafka.WriterConfig{
+		Brokers:          config.MQAddr,
+		Topic:            config.Topic,
+		Balancer:         balancer,
+		BatchSize:        1,
+		RequiredAcks:     config.RequiredAcks,
+		CompressionCodec: codec,
+	}
+	if config.Async {
+		// NOTE: 攒批(linger)只在 async 的队列中进行, kafka.Writer 收到一批消息后立即发送,
+		// 同步写入不受 BatchSize/BatchTimeout 影响
+		wconfig.BatchSize = batchSize
+		wconfig.BatchTimeout = kafkaWriterFlushTimeout
+	}
+	writer := &KafkaWriter{
+		Writer:    kafka.NewWriter(wconfig),
+		config:    wconfig,
+		async:     config.Async,
+		batchSize: batchSize,
+		linger:    linger,
+		queue:     make(chan *kafkaAsyncMsg, queueCapacity),
+		done:      make(chan struct{}),
 	}
+	if writer.async {
+		go writer.run()
+	} else {
+		close(writer.done)
+	}
+
+	return writer, nil
 }
 
 func (m *KafkaWriter) logConfigToSpan(span opentracing.Span) {
@@ -146,6 +234,10 @@ func (m *KafkaWriter) logConfigToSpan(span opentracing.Span) {
 }
 
 func (m *KafkaWriter) WriteMsg(ctx context.Context, k string, v interface{}) error {
+	if m.async {
+		return m.WriteMsgAsync(ctx, k, v, nil)
+	}
+
 	span := opentracing.SpanFromContext(ctx)
 	if span != nil {
 		m.logConfigToSpan(span)
@@ -156,13 +248,26 @@ func (m *KafkaWriter) WriteMsg(ctx context.Context, k string, v interface{}) err
 		return err
 	}
 
-	return m.WriteMessages(ctx, kafka.Message{
+	err = m.WriteMessages(ctx, kafka.Message{
 		Key:   []byte(k),
 		Value: msg,
 	})
+	if err != nil {
+		reportProducerSendErrors(m.config.Topic, 1)
+	}
+	return err
 }
 
 func (m *KafkaWriter) WriteMsgs(ctx context.Context, msgs ...Message) error {
+	if m.async {
+		for _, msg := range msgs {
+			if err := m.WriteMsgAsync(ctx, msg.Key, msg.Value, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	span := opentracing.SpanFromContext(ctx)
 	if span != nil {
 		m.logConfigToSpan(span)
@@ -180,9 +285,119 @@ func (m *KafkaWriter) WriteMsgs(ctx context.Context, msgs ...Message) error {
 		})
 	}
 
-	return m.WriteMessages(ctx, kmsgs...)
+	err := m.WriteMessages(ctx, kmsgs...)
+	if err != nil {
+		reportProducerSendErrors(m.config.Topic, len(kmsgs))
+	}
+	return err
+}
+
+func (m *KafkaWriter) WriteMsgAsync(ctx context.Context, k string, v interface{}, callback DeliveryCallback) error {
+	fun := "KafkaWriter.WriteMsgAsync -->"
+	span := opentracing.SpanFromContext(ctx)
+	if span != nil {
+		m.logConfigToSpan(span)
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return fmt.Errorf("%s writer closed, topic: %s", fun, m.config.Topic)
+	}
+
+	// 非 async 的 writer 没有后台协程, 同步发送后调用 callback
+	if !m.async {
+		m.flush([]*kafkaAsyncMsg{{ctx: ctx, msg: kafka.Message{Key: []byte(k), Value: body}, callback: callback}})
+		return nil
+	}
+
+	select {
+	case m.queue <- &kafkaAsyncMsg{
+		ctx:      ctx,
+		msg:      kafka.Message{Key: []byte(k), Value: body},
+		callback: callback,
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	reportProducerQueueDepth(m.config.Topic, len(m.queue))
+
+	return nil
+}
+
+func (m *KafkaWriter) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.linger)
+	defer ticker.Stop()
+
+	var batch []*kafkaAsyncMsg
+	for {
+		select {
+		case am, ok := <-m.queue:
+			if !ok {
+				m.flush(batch)
+				return
+			}
+			batch = append(batch, am)
+			if len(batch) >= m.batchSize {
+				m.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				m.flush(batch)
+				batch = nil
+			}
+		}
+	}
+}
+
+func (m *KafkaWriter) flush(batch []*kafkaAsyncMsg) {
+	fun := "KafkaWriter.flush -->"
+	topic := m.config.Topic
+	reportProducerQueueDepth(topic, len(m.queue))
+	if len(batch) == 0 {
+		return
+	}
+
+	msgs := make([]kafka.Message, 0, len(batch))
+	for _, am := range batch {
+		msgs = append(msgs, am.msg)
+	}
+
+	// NOTE: 不使用调用方的 ctx, 避免调用方返回后 ctx 被取消导致消息丢失
+	err := m.WriteMessages(context.Background(), msgs...)
+	if err != nil {
+		slog.Errorf(context.TODO(), "%s write messages err, topic: %s, count: %d, err: %v", fun, topic, len(msgs), err)
+		reportProducerSendErrors(topic, len(msgs))
+	}
+
+	for _, am := range batch {
+		if am.callback != nil {
+			am.callback(am.ctx, &DeliveryReport{
+				Topic: topic,
+				Key:   string(am.msg.Key),
+				Err:   err,
+			})
+		}
+	}
 }
 
 func (m *KafkaWriter) Close() error {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+
+	// NOTE: 等待队列中剩余的消息发送完毕
+	<-m.done
 	return m.Writer.Close()
 }
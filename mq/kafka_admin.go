@@ -0,0 +1,284 @@
+// Copyright 2014 The mqrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	kafka "github.com/segmentio/kafka-go"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// NOTE: kafka-go v0.2.x 没有导出消费组 offset 的查询与提交接口,
+// 这里按照 kafka 协议实现 FindCoordinator/OffsetFetch/OffsetCommit 三个请求.
+// kafka-go v0.2.4 的 Conn 中虽然有 findCoordinator/offsetFetch/offsetCommit, 但都未导出, 只供 Reader 内部的消费组使用;
+// Reader 也只能提交自己 FetchMessage 得到的消息, 不能查询其他消费组或重置到任意 offset.
+// 导出这些接口的 kafka.Client 在 v0.4 才加入, 升级 kafka-go 后应改为使用 Client.OffsetFetch/OffsetCommit 并删除本文件
+
+const (
+	kafkaApiKeyOffsetCommit    int16 = 8
+	kafkaApiKeyOffsetFetch     int16 = 9
+	kafkaApiKeyFindCoordinator int16 = 10
+
+	kafkaAdminClientID = "sutil-mq-admin"
+	kafkaAdminTimeout  = 10 * time.Second
+	// kafkaAdminMaxResponseSize 为响应的最大长度, 避免地址不是 kafka 时按读到的垃圾数据分配内存
+	kafkaAdminMaxResponseSize = 100 * 1024 * 1024
+)
+
+var errKafkaShortResponse = errors.New("kafka response too short")
+
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf.WriteString(s)
+}
+
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.err = errKafkaShortResponse
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// string 同时支持 nullable string, 长度为 -1 时返回空串
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n <= 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+type kafkaAdminConn struct {
+	conn          net.Conn
+	correlationID int32
+}
+
+func dialKafkaAdmin(ctx context.Context, addr string) (*kafkaAdminConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaAdminConn{conn: conn}, nil
+}
+
+func (c *kafkaAdminConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *kafkaAdminConn) request(ctx context.Context, apiKey, apiVersion int16, body []byte) (*kafkaDecoder, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(kafkaAdminTimeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	c.correlationID++
+	var header kafkaEncoder
+	header.int16(apiKey)
+	header.int16(apiVersion)
+	header.int32(c.correlationID)
+	header.string(kafkaAdminClientID)
+
+	var req kafkaEncoder
+	req.int32(int32(header.buf.Len() + len(body)))
+	req.buf.Write(header.buf.Bytes())
+	req.buf.Write(body)
+	if _, err := c.conn.Write(req.buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var size int32
+	if err := binary.Read(c.conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 || size > kafkaAdminMaxResponseSize {
+		return nil, fmt.Errorf("invalid kafka response size:%d", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, err
+	}
+
+	d := &kafkaDecoder{data: resp}
+	if id := d.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("kafka correlation id mismatch, expect:%d got:%d", c.correlationID, id)
+	}
+	return d, d.err
+}
+
+// findCoordinator v0
+func (c *kafkaAdminConn) findCoordinator(ctx context.Context, groupId string) (string, error) {
+	var body kafkaEncoder
+	body.string(groupId)
+
+	d, err := c.request(ctx, kafkaApiKeyFindCoordinator, 0, body.buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	code := d.int16()
+	_ = d.int32() // node id
+	host := d.string()
+	port := d.int32()
+	if d.err != nil {
+		return "", d.err
+	}
+	if code != 0 {
+		return "", kafka.Error(code)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// offsetFetch v1, 返回 partition -> committed offset, 未提交过的 partition offset 为 -1
+func (c *kafkaAdminConn) offsetFetch(ctx context.Context, groupId, topic string, partitions []int) (map[int]int64, error) {
+	var body kafkaEncoder
+	body.string(groupId)
+	body.int32(1)
+	body.string(topic)
+	body.int32(int32(len(partitions)))
+	for _, p := range partitions {
+		body.int32(int32(p))
+	}
+
+	d, err := c.request(ctx, kafkaApiKeyOffsetFetch, 1, body.buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[int]int64, len(partitions))
+	for nt := d.int32(); nt > 0 && d.err == nil; nt-- {
+		_ = d.string() // topic
+		for np := d.int32(); np > 0 && d.err == nil; np-- {
+			partition := d.int32()
+			offset := d.int64()
+			_ = d.string() // metadata
+			if code := d.int16(); code != 0 {
+				return nil, kafka.Error(code)
+			}
+			offsets[int(partition)] = offset
+		}
+	}
+	return offsets, d.err
+}
+
+// offsetCommit v2, generation 为 -1 且 member 为空, 只有消费组内没有活跃成员时 broker 才会接受
+func (c *kafkaAdminConn) offsetCommit(ctx context.Context, groupId, topic string, offsets map[int]int64) error {
+	var body kafkaEncoder
+	body.string(groupId)
+	body.int32(-1)  // generation id
+	body.string("") // member id
+	body.int64(-1)  // retention time, 使用 broker 默认值
+	body.int32(1)
+	body.string(topic)
+	body.int32(int32(len(offsets)))
+	for p, offset := range offsets {
+		body.int32(int32(p))
+		body.int64(offset)
+		body.string("") // metadata
+	}
+
+	d, err := c.request(ctx, kafkaApiKeyOffsetCommit, 2, body.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for nt := d.int32(); nt > 0 && d.err == nil; nt-- {
+		_ = d.string() // topic
+		for np := d.int32(); np > 0 && d.err == nil; np-- {
+			_ = d.int32() // partition
+			if code := d.int16(); code != 0 {
+				return kafka.Error(code)
+			}
+		}
+	}
+	return d.err
+}
+
+// dialGroupCoordinator 依次尝试 brokers, 返回到消费组 coordinator 的连接
+func dialGroupCoordinator(ctx context.Context, brokers []string, groupId string) (*kafkaAdminConn, error) {
+	var lastErr error
+	for _, broker := range brokers {
+		conn, err := dialKafkaAdmin(ctx, broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		addr, err := conn.findCoordinator(ctx, groupId)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return dialKafkaAdmin(ctx, addr)
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no brokers")
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,64 @@
+package mq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kaneshin/go-pkg/testing/assert"
+)
+
+func TestCompressionType_codec(t *testing.T) {
+	cases := []struct {
+		compression CompressionType
+		expectError bool
+		expectNil   bool
+	}{
+		{"", false, true},
+		{CompressionNone, false, true},
+		{CompressionGzip, false, false},
+		{CompressionSnappy, false, false},
+		{CompressionLz4, false, false},
+		{"zip", true, true},
+	}
+
+	for _, c := range cases {
+		codec, err := c.compression.codec()
+		assert.Equal(t, c.expectError, err != nil)
+		assert.Equal(t, c.expectNil, codec == nil)
+	}
+}
+
+func TestNewKafkaWriterWithConfig(t *testing.T) {
+	t.Run("invalid compression", func(t *testing.T) {
+		config := defaultConfig(defaultTestTopic, []string{"127.0.0.1:9092"})
+		config.Compression = "zip"
+		writer, err := NewKafkaWriterWithConfig(config)
+		assert.NotEqual(t, err, nil)
+		assert.True(t, writer == nil)
+	})
+
+	t.Run("write after close", func(t *testing.T) {
+		writer, err := NewKafkaWriterWithConfig(defaultConfig(defaultTestTopic, []string{"127.0.0.1:9092"}))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, writer.Close(), nil)
+		assert.NotEqual(t, writer.WriteMsgAsync(context.TODO(), "key", "value", nil), nil)
+	})
+
+	t.Run("linger only for async", func(t *testing.T) {
+		config := defaultConfig(defaultTestTopic, []string{"127.0.0.1:9092"})
+		config.BatchSize = 100
+		config.BatchTimeout = time.Second
+		writer, err := NewKafkaWriterWithConfig(config)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, 1, writer.config.BatchSize)
+		assert.Equal(t, writer.Close(), nil)
+
+		config.Async = true
+		writer, err = NewKafkaWriterWithConfig(config)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, 100, writer.config.BatchSize)
+		assert.Equal(t, kafkaWriterFlushTimeout, writer.config.BatchTimeout)
+		assert.Equal(t, writer.Close(), nil)
+	})
+}
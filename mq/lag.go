@@ -0,0 +1,267 @@
+// Copyright 2014 The mqrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PartitionLag struct {
+	Partition int
+	// CommittedOffset 为消费组已提交的 offset, 未提交过时为 -1
+	CommittedOffset int64
+	// FirstOffset 为 partition 中最早的可读 offset
+	FirstOffset int64
+	// HighWatermark 为 partition 中下一条消息的 offset
+	HighWatermark int64
+	// Lag 为未消费的消息数, 未提交过 offset 时按 HighWatermark-FirstOffset 计算
+	Lag int64
+}
+
+type partitionOffsets struct {
+	partition int
+	first     int64
+	last      int64
+}
+
+func getBrokers(ctx context.Context, topic string) ([]string, error) {
+	config, err := DefaultConfiger.GetConfig(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	if config.MQType != MQTypeKafka {
+		return nil, fmt.Errorf("mqType %d error", config.MQType)
+	}
+	if len(config.MQAddr) == 0 {
+		return nil, errors.New("no brokers")
+	}
+	return config.MQAddr, nil
+}
+
+func lookupPartitions(ctx context.Context, brokers []string, topic string) (partitions []kafka.Partition, err error) {
+	for _, broker := range brokers {
+		partitions, err = kafka.LookupPartitions(ctx, "tcp", broker, topic)
+		if err == nil {
+			sort.Slice(partitions, func(i, j int) bool {
+				return partitions[i].ID < partitions[j].ID
+			})
+			return
+		}
+	}
+	return
+}
+
+// readPartitionOffsets 读取 partition 的最早 offset 与 high watermark, when 非零时额外读取该时间点对应的 offset
+func readPartitionOffsets(ctx context.Context, brokers []string, topic string, partition int, when time.Time) (first, last, at int64, err error) {
+	for _, broker := range brokers {
+		var conn *kafka.Conn
+		conn, err = kafka.DialLeader(ctx, "tcp", broker, topic, partition)
+		if err != nil {
+			continue
+		}
+
+		first, last, err = conn.ReadOffsets()
+		if err == nil && !when.IsZero() {
+			at, err = conn.ReadOffset(when)
+		}
+		conn.Close()
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func readTopicOffsets(ctx context.Context, brokers []string, topic string) ([]partitionOffsets, error) {
+	partitions, err := lookupPartitions(ctx, brokers, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var offsets []partitionOffsets
+	for _, p := range partitions {
+		first, last, _, err := readPartitionOffsets(ctx, brokers, topic, p.ID, time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("read offsets of partition:%d err:%v", p.ID, err)
+		}
+		offsets = append(offsets, partitionOffsets{partition: p.ID, first: first, last: last})
+	}
+	return offsets, nil
+}
+
+// Lag 返回消费组 groupId 在 topic 每个 partition 上的消费进度
+func Lag(ctx context.Context, topic, groupId string) ([]PartitionLag, error) {
+	fun := "mq.Lag -->"
+
+	brokers, err := getBrokers(ctx, topic)
+	if err != nil {
+		slog.Errorf(ctx, "%s get brokers err, topic: %s, err: %v", fun, topic, err)
+		return nil, err
+	}
+
+	offsets, err := readTopicOffsets(ctx, brokers, topic)
+	if err != nil {
+		slog.Errorf(ctx, "%s read offsets err, topic: %s, err: %v", fun, topic, err)
+		return nil, err
+	}
+
+	partitions := make([]int, 0, len(offsets))
+	for _, o := range offsets {
+		partitions = append(partitions, o.partition)
+	}
+
+	conn, err := dialGroupCoordinator(ctx, brokers, groupId)
+	if err != nil {
+		slog.Errorf(ctx, "%s dial coordinator err, groupId: %s, err: %v", fun, groupId, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	committed, err := conn.offsetFetch(ctx, groupId, topic, partitions)
+	if err != nil {
+		slog.Errorf(ctx, "%s fetch offsets err, topic: %s, groupId: %s, err: %v", fun, topic, groupId, err)
+		return nil, err
+	}
+
+	lags := make([]PartitionLag, 0, len(offsets))
+	for _, o := range offsets {
+		lags = append(lags, calcPartitionLag(o, committed))
+	}
+	return lags, nil
+}
+
+func calcPartitionLag(o partitionOffsets, committed map[int]int64) PartitionLag {
+	offset, ok := committed[o.partition]
+	if !ok {
+		offset = -1
+	}
+
+	lag := PartitionLag{
+		Partition:       o.partition,
+		CommittedOffset: offset,
+		FirstOffset:     o.first,
+		HighWatermark:   o.last,
+	}
+
+	switch {
+	case offset < 0:
+		lag.Lag = o.last - o.first
+	// NOTE: 已提交的 offset 可能已经因过期被删除
+	case offset < o.first:
+		lag.Lag = o.last - o.first
+	default:
+		lag.Lag = o.last - offset
+	}
+	if lag.Lag < 0 {
+		lag.Lag = 0
+	}
+	return lag
+}
+
+// ResetOffsetsToEarliest 将消费组的 offset 重置到最早的消息, 用于回放
+// NOTE: 重置 offset 前需要停止该消费组的所有消费者, 否则 broker 会拒绝提交
+func ResetOffsetsToEarliest(ctx context.Context, topic, groupId string) error {
+	return resetOffsets(ctx, topic, groupId, func(o partitionOffsets, at int64) int64 {
+		return o.first
+	}, time.Time{})
+}
+
+// ResetOffsetsToLatest 将消费组的 offset 重置到最新, 跳过所有未消费的消息
+func ResetOffsetsToLatest(ctx context.Context, topic, groupId string) error {
+	return resetOffsets(ctx, topic, groupId, func(o partitionOffsets, at int64) int64 {
+		return o.last
+	}, time.Time{})
+}
+
+// ResetOffsetsToTime 将消费组的 offset 重置到 t 之后的第一条消息, t 之后没有消息的 partition 重置到最新
+func ResetOffsetsToTime(ctx context.Context, topic, groupId string, t time.Time) error {
+	return resetOffsets(ctx, topic, groupId, offsetAtTime, t)
+}
+
+// offsetAtTime 返回按时间查询到的 offset; 时间之后没有消息时 broker 返回 -1, 此时取最新的 offset
+func offsetAtTime(o partitionOffsets, at int64) int64 {
+	if at < 0 {
+		return o.last
+	}
+	return at
+}
+
+func resetOffsets(ctx context.Context, topic, groupId string, pick func(o partitionOffsets, at int64) int64, when time.Time) error {
+	fun := "mq.resetOffsets -->"
+
+	brokers, err := getBrokers(ctx, topic)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := lookupPartitions(ctx, brokers, topic)
+	if err != nil {
+		return err
+	}
+
+	offsets := make(map[int]int64, len(partitions))
+	for _, p := range partitions {
+		first, last, at, err := readPartitionOffsets(ctx, brokers, topic, p.ID, when)
+		if err != nil {
+			return fmt.Errorf("read offsets of partition:%d err:%v", p.ID, err)
+		}
+		offsets[p.ID] = pick(partitionOffsets{partition: p.ID, first: first, last: last}, at)
+	}
+
+	conn, err := dialGroupCoordinator(ctx, brokers, groupId)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	slog.Infof(ctx, "%s topic: %s, groupId: %s, offsets: %v", fun, topic, groupId, offsets)
+	return conn.offsetCommit(ctx, groupId, topic, offsets)
+}
+
+type lagTarget struct {
+	topic   string
+	groupId string
+}
+
+var lagExporterOnce sync.Once
+
+// StartLagExporter 定期将本进程中所有消费组 reader 的消费进度以 gauge 形式上报到 smetric
+func StartLagExporter(ctx context.Context, interval time.Duration) {
+	lagExporterOnce.Do(func() {
+		go runLagExporter(ctx, interval)
+	})
+}
+
+func runLagExporter(ctx context.Context, interval time.Duration) {
+	fun := "mq.runLagExporter -->"
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Infof(ctx, "%s context err:%v", fun, ctx.Err())
+			return
+		case <-ticker.C:
+			for _, target := range defaultInstanceManager.groupReaderTargets() {
+				lags, err := Lag(ctx, target.topic, target.groupId)
+				if err != nil {
+					slog.Errorf(ctx, "%s topic: %s, groupId: %s, err: %v", fun, target.topic, target.groupId, err)
+					continue
+				}
+				for _, lag := range lags {
+					reportConsumerLag(target.topic, target.groupId, lag)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package mq
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/kaneshin/go-pkg/testing/assert"
+)
+
+func TestCalcPartitionLag(t *testing.T) {
+	cases := []struct {
+		offsets     partitionOffsets
+		committed   map[int]int64
+		expectedLag int64
+	}{
+		{partitionOffsets{0, 10, 100}, map[int]int64{0: 40}, 60},
+		{partitionOffsets{0, 10, 100}, map[int]int64{0: -1}, 90},
+		{partitionOffsets{0, 10, 100}, map[int]int64{}, 90},
+		{partitionOffsets{0, 50, 100}, map[int]int64{0: 20}, 50},
+		{partitionOffsets{0, 10, 100}, map[int]int64{0: 100}, 0},
+	}
+
+	for _, c := range cases {
+		lag := calcPartitionLag(c.offsets, c.committed)
+		assert.Equal(t, c.expectedLag, lag.Lag)
+		assert.Equal(t, c.offsets.last, lag.HighWatermark)
+	}
+}
+
+func TestOffsetAtTime(t *testing.T) {
+	o := partitionOffsets{0, 10, 100}
+	assert.Equal(t, offsetAtTime(o, 42), int64(42))
+	assert.Equal(t, offsetAtTime(o, 10), int64(10))
+	// t 之后没有消息
+	assert.Equal(t, offsetAtTime(o, -1), int64(100))
+}
+
+// fakeOffsetFetchBroker 读取一个请求, 校验 api key 后返回 partition 0 的 offset 为 42
+func fakeOffsetFetchBroker(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	var size int32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		t.Error(err)
+		return
+	}
+	req := make([]byte, size)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		t.Error(err)
+		return
+	}
+	d := &kafkaDecoder{data: req}
+	apiKey := d.int16()
+	_ = d.int16()
+	correlationID := d.int32()
+	if apiKey != kafkaApiKeyOffsetFetch {
+		t.Errorf("unexpected api key:%d", apiKey)
+	}
+
+	var body kafkaEncoder
+	body.int32(correlationID)
+	body.int32(1)
+	body.string(defaultTestTopic)
+	body.int32(1)
+	body.int32(0)
+	body.int64(42)
+	body.int16(-1)
+	body.int16(0)
+
+	var resp kafkaEncoder
+	resp.int32(int32(body.buf.Len()))
+	resp.buf.Write(body.buf.Bytes())
+	_, _ = conn.Write(resp.buf.Bytes())
+}
+
+func TestKafkaAdminConn_offsetFetch(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeOffsetFetchBroker(t, server)
+
+	conn := &kafkaAdminConn{conn: client}
+	defer conn.Close()
+
+	offsets, err := conn.offsetFetch(context.TODO(), "g1", defaultTestTopic, []int{0})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, offsets[0], int64(42))
+}
+
+func TestKafkaAdminConn_invalidResponseSize(t *testing.T) {
+	for _, size := range []int32{-1, kafkaAdminMaxResponseSize + 1} {
+		client, server := net.Pipe()
+		go func(size int32) {
+			defer server.Close()
+			var reqSize int32
+			if err := binary.Read(server, binary.BigEndian, &reqSize); err != nil {
+				return
+			}
+			_, _ = io.ReadFull(server, make([]byte, reqSize))
+			var resp kafkaEncoder
+			resp.int32(size)
+			_, _ = server.Write(resp.buf.Bytes())
+		}(size)
+
+		conn := &kafkaAdminConn{conn: client}
+		_, err := conn.request(context.TODO(), kafkaApiKeyOffsetFetch, 1, nil)
+		assert.NotEqual(t, err, nil)
+		conn.Close()
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2014 The mqrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mq
+
+import (
+	"github.com/shawnfeng/sutil/smetric"
+	"strconv"
+)
+
+const (
+	metricProducerQueueDepth = "mq_producer_queue_depth"
+	metricProducerSendErrors = "mq_producer_send_error_total"
+	metricConsumerLag        = "mq_consumer_lag"
+	metricConsumerOffset     = "mq_consumer_committed_offset"
+
+	metricLabelTopic     = "topic"
+	metricLabelGroup     = "group"
+	metricLabelPartition = "partition"
+)
+
+func topicLabels(topic string) []smetric.Label {
+	return []smetric.Label{
+		{Name: metricLabelTopic, Value: smetric.SafePromethuesValue(topic)},
+	}
+}
+
+func reportProducerQueueDepth(topic string, depth int) {
+	smetric.DefaultMetrics.SetGaugeCreateIfAbsent(
+		[]string{smetric.Name_space_palfish, metricProducerQueueDepth}, float64(depth), topicLabels(topic))
+}
+
+func reportProducerSendErrors(topic string, n int) {
+	smetric.DefaultMetrics.IncrCounterCreateIfAbsent(
+		[]string{smetric.Name_space_palfish, metricProducerSendErrors}, float64(n), topicLabels(topic))
+}
+
+func reportConsumerLag(topic, groupId string, lag PartitionLag) {
+	labels := append(topicLabels(topic),
+		smetric.Label{Name: metricLabelGroup, Value: smetric.SafePromethuesValue(groupId)},
+		smetric.Label{Name: metricLabelPartition, Value: strconv.Itoa(lag.Partition)},
+	)
+	smetric.DefaultMetrics.SetGaugeCreateIfAbsent(
+		[]string{smetric.Name_space_palfish, metricConsumerLag}, float64(lag.Lag), labels)
+	smetric.DefaultMetrics.SetGaugeCreateIfAbsent(
+		[]string{smetric.Name_space_palfish, metricConsumerOffset}, float64(lag.CommittedOffset), labels)
+}
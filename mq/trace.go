@@ -9,10 +9,13 @@ import (
 	"encoding/json"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	"github.com/shawnfeng/sutil"
 	"github.com/shawnfeng/sutil/scontext"
 )
 
 type Payload struct {
+	// ID 由生产方生成, 用于消费方幂等去重
+	ID      string                     `json:"id,omitempty"`
 	Carrier opentracing.TextMapCarrier `json:"c"`
 	Value   string                     `json:"v"`
 	Head    interface{}                `json:"h"`
@@ -37,6 +40,7 @@ func generatePayload(ctx context.Context, value interface{}) (*Payload, error) {
 	control := ctx.Value(scontext.ContextKeyControl)
 
 	return &Payload{
+		ID:      generateMsgID(),
 		Carrier: carrier,
 		Value:   string(msg),
 		Head:    head,
@@ -65,6 +69,7 @@ func generateMsgsPayload(ctx context.Context, msgs ...Message) ([]Message, error
 		nmsgs = append(nmsgs, Message{
 			Key: msg.Key,
 			Value: &Payload{
+				ID:      generateMsgID(),
 				Carrier: carrier,
 				Value:   string(body),
 				Head:    head,
@@ -76,6 +81,15 @@ func generateMsgsPayload(ctx context.Context, msgs ...Message) ([]Message, error
 	return nmsgs, nil
 }
 
+// NOTE: 生成失败时返回空串, 消费方会退化为使用 topic/partition/offset 去重
+func generateMsgID() string {
+	id, err := sutil.GetUUID()
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
 func parsePayload(payload *Payload, opName string, value interface{}) (context.Context, error) {
 	tracer := opentracing.GlobalTracer()
 	spanCtx, err := tracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier(payload.Carrier))
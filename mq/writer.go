@@ -9,9 +9,29 @@ import (
 	"fmt"
 )
 
+// DeliveryReport 为异步发送的投递结果, Err 为 nil 表示发送成功
+type DeliveryReport struct {
+	Topic string
+	Key   string
+	Err   error
+}
+
+// DeliveryCallback 在消息投递完成(成功或失败)后被调用
+type DeliveryCallback func(ctx context.Context, report *DeliveryReport)
+
+// DeliveryChan 将投递结果转发到 ch, 调用方需保证 ch 有足够的缓冲或及时消费
+func DeliveryChan(ch chan<- *DeliveryReport) DeliveryCallback {
+	return func(ctx context.Context, report *DeliveryReport) {
+		ch <- report
+	}
+}
+
 type Writer interface {
 	WriteMsg(ctx context.Context, key string, value interface{}) error
 	WriteMsgs(ctx context.Context, msgs ...Message) error
+	// 消息入队后立即返回, 投递结果通过 callback 通知, callback 可为 nil
+	WriteMsgAsync(ctx context.Context, key string, value interface{}, callback DeliveryCallback) error
+	// 关闭前会将队列中的消息全部发送完毕
 	Close() error
 }
 
@@ -24,7 +44,7 @@ func NewWriter(ctx context.Context, topic string) (Writer, error) {
 	mqType := config.MQType
 	switch mqType {
 	case MQTypeKafka:
-		return NewKafkaWriter(config.MQAddr, topic), nil
+		return NewKafkaWriterWithConfig(config)
 
 	default:
 		return nil, fmt.Errorf("mqType %d error", mqType)
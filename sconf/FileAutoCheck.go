@@ -15,7 +15,9 @@ import (
 
 type FileAutoCheck struct {
 	file string
+	// modtime 为纳秒, 避免同一秒内的多次修改被忽略
 	modtime int64
+	size int64
 	filehash string
 
 }
@@ -35,12 +37,20 @@ func (m *FileAutoCheck) Check() (bool, []byte, error) {
 		return false, nil, err
 	}
 
-	stamp := info.ModTime().Unix()
-	if stamp == m.modtime {
+	stamp := info.ModTime().UnixNano()
+	if stamp == m.modtime && info.Size() == m.size {
 		// 不需要更新
 		return false, nil, nil
 	}
 	m.modtime = stamp
+	m.size = info.Size()
+
+	return m.checkData()
+}
+
+// checkData 不比较modtime, 直接读取文件并比较hash
+// 用于已经收到文件变更通知的情况, 如文件系统mtime精度不够, 或替换文件时保留了原来的mtime
+func (m *FileAutoCheck) checkData() (bool, []byte, error) {
 	data, err := ioutil.ReadFile(m.file)
 	if err != nil {
 		return false, nil, err
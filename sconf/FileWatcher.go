@@ -0,0 +1,381 @@
+// Copyright 2014 The sutil Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sconf
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchDebounce     = 100 * time.Millisecond
+	defaultWatchPollInterval = 5 * time.Second
+)
+
+// FileEvent 为文件变更后的内容, 读取失败时 Err 不为空
+type FileEvent struct {
+	Data []byte
+	Err  error
+}
+
+type FileWatcherOptions struct {
+	// Debounce 为收到变更通知后等待的时间, 期间的多次通知合并为一次读取, 默认为 100ms
+	Debounce time.Duration
+	// PollInterval 为轮询检查(size, modtime)的间隔, 无法使用 inotify 时以此轮询, 使用 inotify 时作为兜底检查, 默认为 5s;
+	// 轮询发现的变化同样经过 Debounce 等待, 文件状态稳定后才读取
+	PollInterval time.Duration
+	// DisableNotify 为 true 时只轮询
+	DisableNotify bool
+}
+
+// fileStat 为判断文件是否变化及是否已写完使用的状态
+type fileStat struct {
+	realFile string
+	size     int64
+	modtime  int64
+	err      string
+}
+
+// FileWatcher 监听文件的变更, 内容(sha1)变化时推送新的内容.
+// 监听的是文件所在的目录, 编辑器先写临时文件再 rename 覆盖, 以及 kubernetes ConfigMap 通过切换 ..data 符号链接
+// 更新文件时都能收到通知; 符号链接指向其他目录时同时监听目标所在的目录
+type FileWatcher struct {
+	file     string
+	debounce time.Duration
+	interval time.Duration
+
+	check   *FileAutoCheck
+	notify  *fsnotify.Watcher
+	watched map[string]bool
+	// realFile 为 file 解析符号链接后的路径
+	realFile string
+	lastErr  string
+	// polled 为轮询时最近一次看到的文件状态, settle 为等待文件写完时记录的状态
+	polled fileStat
+	settle fileStat
+
+	events    chan *FileEvent
+	stopChan  chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewFileWatcher 开始监听 file, 文件需要存在, 当前的内容不会推送; 变更通过 Events 获取
+func NewFileWatcher(file string, opts *FileWatcherOptions) (*FileWatcher, error) {
+	if opts == nil {
+		opts = &FileWatcherOptions{}
+	}
+	debounce := opts.Debounce
+	if debounce <= 0 {
+		debounce = defaultWatchDebounce
+	}
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = defaultWatchPollInterval
+	}
+
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &FileWatcher{
+		file:     file,
+		debounce: debounce,
+		interval: interval,
+		check:    NewFileAutoCheck(file),
+		watched:  make(map[string]bool),
+		events:   make(chan *FileEvent, 1),
+		stopChan: make(chan struct{}),
+	}
+
+	// 记录当前的内容, 之后只推送变化
+	if _, _, err := m.check.Check(); err != nil {
+		return nil, err
+	}
+	m.realFile, _ = filepath.EvalSymlinks(file)
+	m.polled = m.stat()
+
+	if !opts.DisableNotify {
+		// NOTE: inotify 不可用(如实例数达到上限)时退化为轮询
+		if notify, err := fsnotify.NewWatcher(); err == nil {
+			m.notify = notify
+			if err := m.watchDirs(); err != nil {
+				notify.Close()
+				m.notify = nil
+			}
+		}
+	}
+
+	m.wg.Add(1)
+	go m.loop()
+	return m, nil
+}
+
+// WatchFile 与 NewFileWatcher 相同, 变更时在监听的 goroutine 中调用 fn
+func WatchFile(file string, opts *FileWatcherOptions, fn func(data []byte, err error)) (*FileWatcher, error) {
+	m, err := NewFileWatcher(file, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for event := range m.events {
+			fn(event.Data, event.Err)
+		}
+	}()
+	return m, nil
+}
+
+// Notify 返回是否在使用 inotify
+func (m *FileWatcher) Notify() bool {
+	return m.notify != nil
+}
+
+// Events 返回推送变更的 channel, 未及时读取时只保留最新的一次, Close 后被关闭
+func (m *FileWatcher) Events() <-chan *FileEvent {
+	return m.events
+}
+
+func (m *FileWatcher) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stopChan)
+		if m.notify != nil {
+			m.notify.Close()
+		}
+	})
+	m.wg.Wait()
+	return nil
+}
+
+// watchDirs 监听 file 与其符号链接目标所在的目录
+func (m *FileWatcher) watchDirs() error {
+	dirs := []string{filepath.Dir(m.file)}
+	if m.realFile != "" {
+		dirs = append(dirs, filepath.Dir(m.realFile))
+	}
+
+	for _, dir := range dirs {
+		if m.watched[dir] {
+			continue
+		}
+		if err := m.notify.Add(dir); err != nil {
+			return err
+		}
+		m.watched[dir] = true
+	}
+	return nil
+}
+
+// relevant 判断目录中的变更是否与 file 有关
+func (m *FileWatcher) relevant(event fsnotify.Event) bool {
+	name := filepath.Clean(event.Name)
+	if name == m.file || name == m.realFile {
+		return true
+	}
+
+	// 符号链接(或其路径上的目录链接, 如 ConfigMap 的 ..data)切换
+	realFile, _ := filepath.EvalSymlinks(m.file)
+	return realFile != m.realFile
+}
+
+func (m *FileWatcher) loop() {
+	defer m.wg.Done()
+	// NOTE: WatchFile 的回调 goroutine 在 events 关闭后退出
+	defer close(m.events)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	var notifyEvents <-chan fsnotify.Event
+	var notifyErrors <-chan error
+	if m.notify != nil {
+		notifyEvents = m.notify.Events
+		notifyErrors = m.notify.Errors
+	}
+
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-m.stopChan:
+			return
+
+		case event, ok := <-notifyEvents:
+			if !ok {
+				notifyEvents = nil
+				continue
+			}
+			if m.relevant(event) {
+				m.arm(debounce)
+			}
+
+		case _, ok := <-notifyErrors:
+			if !ok {
+				notifyErrors = nil
+			}
+			// NOTE: 如事件队列溢出, 可能丢失了通知, 读取一次
+			m.arm(debounce)
+
+		case <-debounce.C:
+			// NOTE: 等待期间文件仍在变化(如刚创建还未写入)时继续等待, 避免读到不完整的内容
+			st := m.stat()
+			if st != m.settle {
+				m.settle = st
+				debounce.Reset(m.debounce)
+				continue
+			}
+			m.polled = st
+			m.reload()
+
+		case <-ticker.C:
+			// 轮询发现变化时同样经过 debounce 等待文件写完
+			if st := m.stat(); st != m.polled {
+				m.polled = st
+				m.arm(debounce)
+			}
+		}
+	}
+}
+
+// stat 返回 file 当前的状态
+func (m *FileWatcher) stat() fileStat {
+	var st fileStat
+	st.realFile, _ = filepath.EvalSymlinks(m.file)
+	info, err := os.Stat(m.file)
+	if err != nil {
+		st.err = err.Error()
+		return st
+	}
+	st.size = info.Size()
+	st.modtime = info.ModTime().UnixNano()
+	return st
+}
+
+// arm 记录文件当前的状态并开始等待, 到期时状态不变才读取
+func (m *FileWatcher) arm(debounce *time.Timer) {
+	m.settle = m.stat()
+	debounce.Reset(m.debounce)
+}
+
+// reload 读取文件, 内容(sha1)变化时推送
+func (m *FileWatcher) reload() {
+	if realFile, err := filepath.EvalSymlinks(m.file); err == nil && realFile != m.realFile {
+		m.realFile = realFile
+		if m.notify != nil {
+			m.watchDirs()
+		}
+	}
+
+	// NOTE: 不比较 modtime, 文件系统 mtime 精度不够或替换文件时保留了原来的 mtime 时也能发现变化
+	changed, data, err := m.check.checkData()
+	if err != nil {
+		// 同一个错误只推送一次, 如文件被删除
+		if err.Error() == m.lastErr {
+			return
+		}
+		m.lastErr = err.Error()
+		m.send(&FileEvent{Err: err})
+		return
+	}
+	m.lastErr = ""
+
+	if changed {
+		m.send(&FileEvent{Data: data})
+	}
+}
+
+func (m *FileWatcher) send(event *FileEvent) {
+	for {
+		select {
+		case m.events <- event:
+			return
+		default:
+		}
+
+		// 丢弃未读取的旧变更
+		select {
+		case <-m.events:
+		default:
+		}
+	}
+}
+
+// TierConfWatcher 在配置文件变更时重新加载 TierConf
+type TierConfWatcher struct {
+	files    string
+	watchers []*FileWatcher
+
+	reloadMu sync.Mutex
+	mu       sync.Mutex
+	conf     *TierConf
+}
+
+// WatchTierConf 加载 files(逗号分隔, 格式见 LoadFromFile)并监听其变更, 任一文件变更后重新加载全部文件,
+// 加载成功时以新的 TierConf 调用 fn, 失败时保留原配置并以 err 调用 fn; fn 在监听的 goroutine 中调用
+func WatchTierConf(files string, opts *FileWatcherOptions, fn func(conf *TierConf, err error)) (*TierConfWatcher, error) {
+	conf := NewTierConf()
+	if err := conf.LoadFromFile(files); err != nil {
+		return nil, err
+	}
+
+	m := &TierConfWatcher{
+		files: files,
+		conf:  conf,
+	}
+	for _, file := range strings.Split(files, ",") {
+		w, err := WatchFile(file, opts, func(data []byte, err error) {
+			m.reload(err, fn)
+		})
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.watchers = append(m.watchers, w)
+	}
+	return m, nil
+}
+
+func (m *TierConfWatcher) reload(err error, fn func(conf *TierConf, err error)) {
+	// NOTE: 多个文件的监听在不同的 goroutine 中, 串行重新加载
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	if err == nil {
+		conf := NewTierConf()
+		if err = conf.LoadFromFile(m.files); err == nil {
+			m.mu.Lock()
+			m.conf = conf
+			m.mu.Unlock()
+		}
+	}
+
+	if fn != nil {
+		fn(m.Conf(), err)
+	}
+}
+
+// Conf 返回最近一次加载成功的配置
+func (m *TierConfWatcher) Conf() *TierConf {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.conf
+}
+
+func (m *TierConfWatcher) Close() error {
+	for _, w := range m.watchers {
+		w.Close()
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package sconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitFileEvent(t *testing.T, w *FileWatcher, timeout time.Duration) *FileEvent {
+	select {
+	case event := <-w.Events():
+		return event
+	case <-time.After(timeout):
+		t.Fatalf("no file event in %s", timeout)
+		return nil
+	}
+}
+
+func assertNoFileEvent(t *testing.T, w *FileWatcher, d time.Duration) {
+	select {
+	case event := <-w.Events():
+		t.Fatalf("unexpected file event: %+v", event)
+	case <-time.After(d):
+	}
+}
+
+func testWatcherOptions() *FileWatcherOptions {
+	// 轮询间隔足够长, 确认变更是通过 inotify 收到的
+	return &FileWatcherOptions{Debounce: 20 * time.Millisecond, PollInterval: time.Hour}
+}
+
+func TestFileWatcherWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sconf_watch")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.ini")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v1"), 0644))
+
+	w, err := NewFileWatcher(file, testWatcherOptions())
+	assert.NoError(t, err)
+	defer w.Close()
+	if !w.Notify() {
+		t.Skip("inotify not available")
+	}
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v2"), 0644))
+	event := waitFileEvent(t, w, 2*time.Second)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, "v2", string(event.Data))
+
+	// 内容不变时不推送
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v2"), 0644))
+	assertNoFileEvent(t, w, 200*time.Millisecond)
+}
+
+func TestFileWatcherDebounce(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sconf_watch")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.ini")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v0"), 0644))
+
+	opts := testWatcherOptions()
+	opts.Debounce = 200 * time.Millisecond
+	w, err := NewFileWatcher(file, opts)
+	assert.NoError(t, err)
+	defer w.Close()
+	if !w.Notify() {
+		t.Skip("inotify not available")
+	}
+
+	for _, v := range []string{"v1", "v2", "v3"} {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(v), 0644))
+		time.Sleep(20 * time.Millisecond)
+	}
+	event := waitFileEvent(t, w, 2*time.Second)
+	assert.Equal(t, "v3", string(event.Data))
+	assertNoFileEvent(t, w, 400*time.Millisecond)
+}
+
+func TestFileWatcherRenameSwap(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sconf_watch")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.ini")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v1"), 0644))
+
+	w, err := NewFileWatcher(file, testWatcherOptions())
+	assert.NoError(t, err)
+	defer w.Close()
+	if !w.Notify() {
+		t.Skip("inotify not available")
+	}
+
+	// 编辑器保存: 写临时文件后 rename 覆盖, 并保留原来的 mtime
+	info, _ := os.Stat(file)
+	tmp := filepath.Join(dir, ".a.ini.swp")
+	assert.NoError(t, ioutil.WriteFile(tmp, []byte("v2"), 0644))
+	assert.NoError(t, os.Chtimes(tmp, info.ModTime(), info.ModTime()))
+	assert.NoError(t, os.Rename(tmp, file))
+
+	event := waitFileEvent(t, w, 2*time.Second)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, "v2", string(event.Data))
+
+	// rename 后仍然监听新的文件
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v3"), 0644))
+	event = waitFileEvent(t, w, 2*time.Second)
+	assert.Equal(t, "v3", string(event.Data))
+}
+
+// TestFileWatcherSymlinkFlip 模拟 kubernetes ConfigMap 的更新:
+// a.ini -> ..data/a.ini, ..data -> ..v1, 更新时创建 ..v2 并将 ..data 原子地切换过去
+func TestFileWatcherSymlinkFlip(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sconf_watch")
+	defer os.RemoveAll(dir)
+
+	writeVersion := func(version, data string) {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, version), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, version, "a.ini"), []byte(data), 0644))
+	}
+	writeVersion("..v1", "v1")
+	assert.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	assert.NoError(t, os.Symlink(filepath.Join("..data", "a.ini"), filepath.Join(dir, "a.ini")))
+
+	w, err := NewFileWatcher(filepath.Join(dir, "a.ini"), testWatcherOptions())
+	assert.NoError(t, err)
+	defer w.Close()
+	if !w.Notify() {
+		t.Skip("inotify not available")
+	}
+
+	flip := func(version string) {
+		tmp := filepath.Join(dir, "..data_tmp")
+		assert.NoError(t, os.Symlink(version, tmp))
+		assert.NoError(t, os.Rename(tmp, filepath.Join(dir, "..data")))
+	}
+
+	writeVersion("..v2", "v2")
+	flip("..v2")
+	event := waitFileEvent(t, w, 2*time.Second)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, "v2", string(event.Data))
+
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "..v1")))
+	writeVersion("..v3", "v3")
+	flip("..v3")
+	event = waitFileEvent(t, w, 2*time.Second)
+	assert.Equal(t, "v3", string(event.Data))
+}
+
+func TestFileWatcherPolling(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sconf_watch")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.ini")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v1"), 0644))
+	// 先写临时文件再 rename, 轮询不会看到写了一半的文件
+	replace := func(data string) {
+		tmp := filepath.Join(dir, "a.ini.tmp")
+		assert.NoError(t, ioutil.WriteFile(tmp, []byte(data), 0644))
+		assert.NoError(t, os.Rename(tmp, file))
+	}
+
+	w, err := NewFileWatcher(file, &FileWatcherOptions{Debounce: 10 * time.Millisecond, PollInterval: 20 * time.Millisecond, DisableNotify: true})
+	assert.NoError(t, err)
+	defer w.Close()
+	assert.False(t, w.Notify())
+
+	replace("v2")
+	event := waitFileEvent(t, w, 2*time.Second)
+	assert.Equal(t, "v2", string(event.Data))
+
+	// 删除文件只推送一次错误, 恢复后推送内容
+	assert.NoError(t, os.Remove(file))
+	event = waitFileEvent(t, w, 2*time.Second)
+	assert.Error(t, event.Err)
+	assertNoFileEvent(t, w, 100*time.Millisecond)
+
+	replace("v3")
+	event = waitFileEvent(t, w, 2*time.Second)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, "v3", string(event.Data))
+}
+
+func TestFileWatcherSettle(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sconf_watch")
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.ini")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("v1"), 0644))
+
+	// 轮询与 debounce 都很长, 手动驱动 loop 中的步骤
+	w, err := NewFileWatcher(file, &FileWatcherOptions{Debounce: time.Hour, PollInterval: time.Hour, DisableNotify: true})
+	assert.NoError(t, err)
+	w.Close()
+
+	// 轮询时文件刚被截断还未写入, 等待到期时内容已写完, 继续等待而不读取
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	debounce := time.NewTimer(time.Hour)
+	defer debounce.Stop()
+	w.arm(debounce)
+	assert.NoError(t, ioutil.WriteFile(file, []byte("version3"), 0644))
+	assert.NotEqual(t, w.settle, w.stat())
+
+	w.settle = w.stat()
+	w.events = make(chan *FileEvent, 1)
+	w.reload()
+	event := <-w.events
+	assert.Equal(t, "version3", string(event.Data))
+}
+
+func TestNewFileWatcherNotExist(t *testing.T) {
+	_, err := NewFileWatcher(filepath.Join(os.TempDir(), "sconf_watch_not_exist.ini"), nil)
+	assert.Error(t, err)
+}
+
+func TestWatchTierConf(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sconf_watch")
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.ini")
+	override := filepath.Join(dir, "override.yaml")
+	assert.NoError(t, ioutil.WriteFile(base, []byte("[server]\nhost=a\nport=80\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(override, []byte("server:\n  port: 8080\n"), 0644))
+
+	type result struct {
+		conf *TierConf
+		err  error
+	}
+	results := make(chan result, 10)
+	w, err := WatchTierConf(base+","+override, testWatcherOptions(), func(conf *TierConf, err error) {
+		results <- result{conf, err}
+	})
+	assert.NoError(t, err)
+	defer w.Close()
+
+	port, _ := w.Conf().ToInt("server", "port")
+	assert.Equal(t, 8080, port)
+
+	wait := func() result {
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatal("no reload")
+			return result{}
+		}
+	}
+
+	assert.NoError(t, ioutil.WriteFile(base, []byte("[server]\nhost=b\nport=80\n"), 0644))
+	r := wait()
+	assert.NoError(t, r.err)
+	host, _ := r.conf.ToString("server", "host")
+	assert.Equal(t, "b", host)
+	port, _ = r.conf.ToInt("server", "port")
+	assert.Equal(t, 8080, port)
+	assert.Equal(t, r.conf, w.Conf())
+
+	// 加载失败时保留原配置
+	assert.NoError(t, ioutil.WriteFile(override, []byte("server: [\n"), 0644))
+	r = wait()
+	assert.Error(t, r.err)
+	host, _ = w.Conf().ToString("server", "host")
+	assert.Equal(t, "b", host)
+}
@@ -14,6 +14,7 @@ import (
 	"io/ioutil"
 	"sort"
 	"reflect"
+	"os"
 
 	"github.com/vaughan0/go-ini"
 )
@@ -96,12 +97,13 @@ func (m *TierConf) LoadFromFile(conf string) error {
 }
 
 
+// 按扩展名识别格式: .yaml/.yml, .toml, .json, 其他按ini加载
 func (m *TierConf) LoadFromOneFile(conf string) error {
 	data, err := ioutil.ReadFile(conf)
 	if err != nil {
 		return err
 	} else {
-		return m.Load(data)
+		return m.loadByExt(conf, data)
 	}
 
 
@@ -333,6 +335,10 @@ func (m *TierConf) unmarshalMap(cfg map[string]string, vf reflect.Value) error {
 		if err != nil {
 			return err
 		}
+
+		if err := m.unmarshalNestedField(sk, sv, vstruct); err != nil {
+			return err
+		}
 	}
 
 	//fmt.Println("[[", vf.Interface(), "]]")
@@ -342,6 +348,67 @@ func (m *TierConf) unmarshalMap(cfg map[string]string, vf reflect.Value) error {
 }
 
 
+func isStructType(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct || (t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct)
+}
+
+// 嵌套的struct和struct slice
+// sk 为 field.property 时递归到struct field
+// sk 为 field[i].property 时递归到slice的第i个元素, slice长度不够时扩展
+func (m *TierConf) unmarshalNestedField(sk string, sv string, vstruct reflect.Value) error {
+	tstruct := vstruct.Type()
+	for i := 0; i < tstruct.NumField(); i++ {
+		f := tstruct.Field(i)
+
+		tag := f.Tag.Get("sconf")
+		if len(tag) == 0 {
+			tag = f.Name
+		}
+
+		if len(sk) <= len(tag)+1 || !strings.EqualFold(sk[:len(tag)], tag) {
+			continue
+		}
+
+		vf := vstruct.Field(i)
+
+		if isStructType(f.Type) && sk[len(tag)] == '.' {
+			if !vf.CanSet() {
+				return fmt.Errorf("field cannot set:%s", f.Name)
+			}
+
+			if err := m.unmarshalMap(map[string]string{sk[len(tag)+1:]: sv}, vf); err != nil {
+				return err
+			}
+
+		} else if f.Type.Kind() == reflect.Slice && isStructType(f.Type.Elem()) && sk[len(tag)] == '[' {
+			end := strings.Index(sk, "]")
+			if end == -1 || end+1 >= len(sk) || sk[end+1] != '.' {
+				continue
+			}
+			idx, err := strconv.Atoi(sk[len(tag)+1:end])
+			if err != nil || idx < 0 {
+				continue
+			}
+
+			if !vf.CanSet() {
+				return fmt.Errorf("field cannot set:%s", f.Name)
+			}
+
+			if idx >= vf.Len() {
+				nsv := reflect.MakeSlice(f.Type, idx+1, idx+1)
+				reflect.Copy(nsv, vf)
+				vf.Set(nsv)
+			}
+
+			if err := m.unmarshalMap(map[string]string{sk[end+2:]: sv}, vf.Index(idx)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // 1. struct {struct {}, *struct{}, map[string]struct{}, map[string]*struct{} }
 func (m *TierConf) unmarshalToStruct(sk string, sv map[string]string, vstruct reflect.Value) error {
 	err := m.unmarshalStructField(sk,
@@ -414,6 +481,14 @@ func (m *TierConf) Unmarshal(v interface{}) error {
 	if reflect.Struct == k {
 		// struct { struct }
 		for sk, sv := range cfg {
+			if sk == "" {
+				// 不属于任何section的配置对应最外层struct的field
+				if err := m.unmarshalMap(sv, vstruct); err != nil {
+					return err
+				}
+				continue
+			}
+
 			if err := m.unmarshalToStruct(sk, sv, vstruct); err != nil {
 				return err
 			}
@@ -488,36 +563,57 @@ func (m *TierConf) parseVar(history []string, value string) (string, error) {
 		pv := value[index[0]:index[1]]
 		v := strings.Trim(pv, " \t${}")
 
-		tmp := strings.Index(v, ".")
+		// ${x:-y} 引用不存在时使用默认值y
+		deft, hasDeft := "", false
+		if tmp := strings.Index(v, ":-"); tmp != -1 {
+			v, deft, hasDeft = strings.Trim(v[:tmp], " \t"), v[tmp+2:], true
+		}
+		notFound := pv
+		if hasDeft {
+			notFound = deft
+		}
 
+		// ${env:NAME} 引用环境变量
+		if strings.HasPrefix(v, "env:") {
+			if ev, ok := os.LookupEnv(strings.Trim(v[len("env:"):], " \t")); ok {
+				rv += ev
+			} else {
+				rv += notFound
+			}
+			lastpos = index[1]
+			continue
+		}
+
+		// ${section.a.b} 第一个.之前为section, 没有.时引用section ""中的property
+		var trims, trimp string
+		tmp := strings.Index(v, ".")
 		if tmp == -1 {
-			rv += pv
+			trimp = v
 		} else {
-			trims := strings.Trim(v[:tmp], " \t")
-			trimp := strings.Trim(v[tmp+1:], " \t")
-			// 检查循环引用
-			newhis := fmt.Sprintf("%s.%s", trims, trimp)
-			for _, his := range history {
-				if newhis == his {
-					return "", fmt.Errorf("cyclic reference:${%s}", his)
-				}
+			trims = strings.Trim(v[:tmp], " \t")
+			trimp = strings.Trim(v[tmp+1:], " \t")
+		}
+
+		// 检查循环引用
+		newhis := fmt.Sprintf("%s.%s", trims, trimp)
+		for _, his := range history {
+			if newhis == his {
+				return "", fmt.Errorf("cyclic reference:${%s}", his)
 			}
-			history = append(history, newhis)
-			newval, err := m.toString(history, trims, trimp)
-			history = history[:len(history)-1]
-			if err != nil {
-				if strings.Index(err.Error(), "cyclic reference") != -1 {
-					return "", err
-				} else {
-					newval = pv
-				}
+		}
+		history = append(history, newhis)
+		newval, err := m.toString(history, trims, trimp)
+		history = history[:len(history)-1]
+		if err != nil {
+			if strings.Index(err.Error(), "cyclic reference") != -1 {
+				return "", err
+			} else {
+				newval = notFound
 			}
-
-			rv += newval
-
-			//fmt.Println(v[:tmp], v[tmp:], pv, ids, history)
 		}
 
+		rv += newval
+
 		lastpos = index[1]
 	}
 
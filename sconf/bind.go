@@ -0,0 +1,26 @@
+// Copyright 2014 The sutil Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sconf
+
+import (
+	"github.com/shawnfeng/sutil/sconf/bind"
+)
+
+// Bind 按 struct tag 将配置绑定到 v, 规则见 sconf/bind, 配置的 key 为 section.property(没有 section 时为 property),
+// 值中的 ${section.property} 引用会先被展开
+func (m *TierConf) Bind(v interface{}) error {
+	kv := make(map[string]string)
+	for section, properties := range m.conf {
+		for property := range properties {
+			value, err := m.ToString(section, property)
+			if err != nil {
+				return err
+			}
+			kv[joinSectionKey(section, property)] = value
+		}
+	}
+
+	return bind.KV(kv, v)
+}
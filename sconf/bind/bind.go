@@ -0,0 +1,430 @@
+// Package bind 按 struct tag 将扁平的 key/value 配置绑定到结构体, 供 sconf.TierConf 与 sconf/center 使用
+package bind
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 绑定使用的 struct tag
+//
+//	conf:"key"              配置的 key, 默认为小写的字段名, "-" 表示忽略该字段; 嵌套结构体的 key 以 "." 连接
+//	default:"value"         配置不存在时使用的值
+//	validate:"required,min=1,max=10"
+//	                        required 要求配置存在或有默认值; min/max 对数值与 time.Duration 比较大小, 对 string/slice/map 比较长度
+//	regex:"^[a-z]+$"        配置的原始值需要匹配的正则, slice 与 map 对每个元素检查
+//	sep:";"                 slice 与 map 元素的分隔符, 默认为 ","
+const (
+	tagConf     = "conf"
+	tagDefault  = "default"
+	tagValidate = "validate"
+	tagRegex    = "regex"
+	tagSep      = "sep"
+
+	defaultSep = ","
+	// mapKVSep 为 map 元素中 key 与 value 的分隔符, 如 a:1,b:2
+	mapKVSep = ":"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Error 为绑定时一个配置项的错误
+type Error struct {
+	Key     string
+	Message string
+}
+
+func (m *Error) Error() string {
+	return fmt.Sprintf("%s: %s", m.Key, m.Message)
+}
+
+// Errors 汇总一次绑定中的所有错误
+type Errors []*Error
+
+func (m Errors) Error() string {
+	msgs := make([]string, 0, len(m))
+	for _, e := range m {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (m *Errors) add(key, format string, args ...interface{}) {
+	*m = append(*m, &Error{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+type binder struct {
+	// kv 的 key 统一为小写, 匹配时不区分大小写
+	kv   map[string]string
+	errs Errors
+}
+
+// KV 按 struct tag 将 kv 中的配置绑定到 v, v 需为结构体指针, 返回的错误为汇总了所有配置项问题的 Errors
+func KV(kv map[string]string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bind target must be a non-nil pointer to struct, got %T", v)
+	}
+
+	b := &binder{kv: make(map[string]string, len(kv))}
+	for k, val := range kv {
+		b.kv[strings.ToLower(k)] = val
+	}
+
+	b.bindStruct("", rv.Elem())
+	if len(b.errs) > 0 {
+		return b.errs
+	}
+	return nil
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func (m *binder) bindStruct(prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Tag.Get(tagConf)
+		if name == "-" {
+			continue
+		}
+
+		fv := v.Field(i)
+		// 没有指定 key 的匿名结构体展开到当前层级
+		if field.Anonymous && name == "" && isStruct(field.Type) {
+			m.bindStruct(prefix, allocPtr(fv))
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		m.bindField(joinKey(prefix, name), field.Tag, fv)
+	}
+}
+
+// isStruct 判断 t 是否为结构体或结构体指针, 按嵌套配置处理
+func isStruct(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+func allocPtr(v reflect.Value) reflect.Value {
+	if v.Kind() != reflect.Ptr {
+		return v
+	}
+	if v.IsNil() {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	return v.Elem()
+}
+
+func (m *binder) lookup(key string) (string, bool) {
+	val, ok := m.kv[strings.ToLower(key)]
+	return val, ok
+}
+
+// lookupPrefix 返回以 key. 开头的配置, 结果的 key 为去掉前缀后的部分
+func (m *binder) lookupPrefix(key string) map[string]string {
+	prefix := strings.ToLower(key) + "."
+	var sub map[string]string
+	for k, val := range m.kv {
+		if strings.HasPrefix(k, prefix) && len(k) > len(prefix) {
+			if sub == nil {
+				sub = make(map[string]string)
+			}
+			sub[k[len(prefix):]] = val
+		}
+	}
+	return sub
+}
+
+func (m *binder) bindField(key string, tag reflect.StructTag, v reflect.Value) {
+	rules, err := parseValidate(tag.Get(tagValidate))
+	if err != nil {
+		m.errs.add(key, "%s", err.Error())
+		return
+	}
+
+	if isStruct(v.Type()) {
+		if _, ok := m.lookup(key); ok {
+			m.errs.add(key, "nested struct can not be set by a single value")
+			return
+		}
+		if rules.required && m.lookupPrefix(key) == nil {
+			m.errs.add(key, "required")
+			return
+		}
+		m.bindStruct(key, allocPtr(v))
+		return
+	}
+
+	sep := tag.Get(tagSep)
+	if sep == "" {
+		sep = defaultSep
+	}
+
+	raw, ok := m.lookup(key)
+	if !ok {
+		raw, ok = tag.Lookup(tagDefault)
+	}
+
+	var elems []string
+	switch {
+	case ok:
+		elems, err = m.setValue(raw, sep, v)
+	case v.Kind() == reflect.Map && m.lookupPrefix(key) != nil:
+		// map 也可以由 key.<mapkey> 形式的多个配置组成
+		elems, err = m.setMapEntries(m.lookupPrefix(key), v)
+	case rules.required:
+		m.errs.add(key, "required")
+		return
+	default:
+		return
+	}
+	if err != nil {
+		m.errs.add(key, "%s", err.Error())
+		return
+	}
+
+	if expr := tag.Get(tagRegex); expr != "" {
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			m.errs.add(key, "invalid regex %q: %s", expr, err.Error())
+			return
+		}
+		for _, elem := range elems {
+			if !reg.MatchString(elem) {
+				m.errs.add(key, "value %q does not match %q", elem, expr)
+			}
+		}
+	}
+
+	if err := rules.check(v); err != nil {
+		m.errs.add(key, "%s", err.Error())
+	}
+}
+
+// setValue 将 raw 解析到 v, 返回用于正则检查的原始元素
+func (m *binder) setValue(raw, sep string, v reflect.Value) ([]string, error) {
+	switch v.Kind() {
+	case reflect.Slice:
+		items := splitTrim(raw, sep)
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setScalar(item, slice.Index(i)); err != nil {
+				return nil, fmt.Errorf("element %d: %s", i, err.Error())
+			}
+		}
+		v.Set(slice)
+		return items, nil
+
+	case reflect.Map:
+		entries := make(map[string]string)
+		for _, item := range splitTrim(raw, sep) {
+			idx := strings.Index(item, mapKVSep)
+			if idx < 0 {
+				return nil, fmt.Errorf("invalid map entry %q, expect key%svalue", item, mapKVSep)
+			}
+			entries[strings.TrimSpace(item[:idx])] = strings.TrimSpace(item[idx+1:])
+		}
+		return m.setMapEntries(entries, v)
+	}
+
+	return []string{raw}, setScalar(raw, v)
+}
+
+func (m *binder) setMapEntries(entries map[string]string, v reflect.Value) ([]string, error) {
+	t := v.Type()
+	mv := reflect.MakeMapWithSize(t, len(entries))
+
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	elems := make([]string, 0, len(entries))
+	for _, k := range keys {
+		kv := reflect.New(t.Key()).Elem()
+		if err := setScalar(k, kv); err != nil {
+			return nil, fmt.Errorf("key %q: %s", k, err.Error())
+		}
+		ev := reflect.New(t.Elem()).Elem()
+		if err := setScalar(entries[k], ev); err != nil {
+			return nil, fmt.Errorf("key %q: %s", k, err.Error())
+		}
+		mv.SetMapIndex(kv, ev)
+		elems = append(elems, entries[k])
+	}
+	v.Set(mv)
+	return elems, nil
+}
+
+func splitTrim(raw, sep string) []string {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	items := strings.Split(raw, sep)
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items
+}
+
+func setScalar(raw string, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		ev := reflect.New(v.Type().Elem())
+		if err := setScalar(raw, ev.Elem()); err != nil {
+			return err
+		}
+		v.Set(ev)
+		return nil
+	}
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(strings.TrimSpace(raw))
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(raw), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(strings.TrimSpace(raw), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(strings.TrimSpace(raw), v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+type validateRules struct {
+	required bool
+	min, max string
+}
+
+func parseValidate(tag string) (*validateRules, error) {
+	rules := &validateRules{}
+	for _, item := range splitTrim(tag, ",") {
+		switch {
+		case item == "required":
+			rules.required = true
+		case strings.HasPrefix(item, "min="):
+			rules.min = item[len("min="):]
+		case strings.HasPrefix(item, "max="):
+			rules.max = item[len("max="):]
+		default:
+			return nil, fmt.Errorf("unknown validate rule %q", item)
+		}
+	}
+	return rules, nil
+}
+
+// check 检查 v 是否在 [min, max] 范围内
+func (m *validateRules) check(v reflect.Value) error {
+	if m.min == "" && m.max == "" {
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	var value float64
+	var parse func(string) (float64, error)
+	desc := fmt.Sprint(v.Interface())
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		value = float64(v.Len())
+		parse = parseFloat
+		desc = fmt.Sprintf("length %d", v.Len())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value = float64(v.Int())
+		parse = parseFloat
+		if v.Type() == durationType {
+			parse = parseDurationFloat
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value = float64(v.Uint())
+		parse = parseFloat
+	case reflect.Float32, reflect.Float64:
+		value = v.Float()
+		parse = parseFloat
+	default:
+		return fmt.Errorf("min/max not support type %s", v.Type())
+	}
+
+	if m.min != "" {
+		min, err := parse(m.min)
+		if err != nil {
+			return fmt.Errorf("invalid min %q: %s", m.min, err.Error())
+		}
+		if value < min {
+			return fmt.Errorf("%s less than min %s", desc, m.min)
+		}
+	}
+	if m.max != "" {
+		max, err := parse(m.max)
+		if err != nil {
+			return fmt.Errorf("invalid max %q: %s", m.max, err.Error())
+		}
+		if value > max {
+			return fmt.Errorf("%s greater than max %s", desc, m.max)
+		}
+	}
+	return nil
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseDurationFloat(s string) (float64, error) {
+	d, err := time.ParseDuration(s)
+	return float64(d), err
+}
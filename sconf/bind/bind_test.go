@@ -0,0 +1,103 @@
+package bind
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type bindRedisConf struct {
+	Addr     string        `conf:"addr" validate:"required" regex:"^[a-z0-9.]+:[0-9]+$"`
+	PoolSize int           `conf:"pool_size" default:"128" validate:"min=1,max=1024"`
+	Timeout  time.Duration `default:"1s" validate:"min=10ms,max=10s"`
+}
+
+type bindConf struct {
+	bindRedisConf `conf:"-"`
+
+	Name    string
+	Debug   *bool
+	Ratio   float64           `default:"0.5"`
+	Hosts   []string          `validate:"min=1"`
+	Ports   []int             `sep:";"`
+	Weights map[string]int    `conf:"weights"`
+	Labels  map[string]string `conf:"labels" regex:"^[a-z]+$"`
+	Redis   bindRedisConf     `conf:"redis"`
+	Backup  *bindRedisConf    `conf:"backup"`
+	Ignored string            `conf:"-"`
+	ignored string
+}
+
+func TestBindKV(t *testing.T) {
+	var c bindConf
+	err := KV(map[string]string{
+		"NAME":             "svc",
+		"debug":            "true",
+		"hosts":            "a, b ,c",
+		"ports":            "80;443",
+		"weights":          "a:1, b:2",
+		"labels.env":       "prod",
+		"labels.zone":      "sh",
+		"redis.addr":       "127.0.0.1:6379",
+		"redis.timeout":    "200ms",
+		"backup.addr":      "127.0.0.2:6379",
+		"backup.Pool_Size": "8",
+		"ignored":          "x",
+	}, &c)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "svc", c.Name)
+	assert.True(t, *c.Debug)
+	assert.Equal(t, 0.5, c.Ratio)
+	assert.Equal(t, []string{"a", "b", "c"}, c.Hosts)
+	assert.Equal(t, []int{80, 443}, c.Ports)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, c.Weights)
+	assert.Equal(t, map[string]string{"env": "prod", "zone": "sh"}, c.Labels)
+	assert.Equal(t, bindRedisConf{Addr: "127.0.0.1:6379", PoolSize: 128, Timeout: 200 * time.Millisecond}, c.Redis)
+	assert.Equal(t, &bindRedisConf{Addr: "127.0.0.2:6379", PoolSize: 8, Timeout: time.Second}, c.Backup)
+	assert.Equal(t, "", c.Ignored)
+}
+
+func TestBindKVErrors(t *testing.T) {
+	var c bindConf
+	err := KV(map[string]string{
+		"debug":           "yes",
+		"hosts":           "",
+		"labels":          "env:Prod",
+		"redis.addr":      "localhost",
+		"redis.pool_size": "0",
+		"redis.timeout":   "1m",
+		"backup":          "x",
+	}, &c)
+
+	errs, ok := err.(Errors)
+	assert.True(t, ok)
+	var keys []string
+	for _, e := range errs {
+		keys = append(keys, e.Key)
+	}
+	assert.Equal(t, []string{
+		"debug",
+		"hosts",
+		"labels",
+		"redis.addr",
+		"redis.pool_size",
+		"redis.timeout",
+		"backup",
+	}, keys)
+	assert.Contains(t, errs[1].Message, "length 0 less than min 1")
+	assert.Contains(t, errs[3].Message, "does not match")
+	assert.Contains(t, errs[5].Message, "greater than max 10s")
+
+	// 缺少必填项, 不存在的可选项不做校验
+	err = KV(map[string]string{}, &c)
+	assert.Equal(t, "redis.addr: required; backup.addr: required", err.Error())
+
+	assert.Error(t, KV(map[string]string{}, c))
+
+	var bad struct {
+		Size int `validate:"between=1"`
+	}
+	assert.Error(t, KV(map[string]string{}, &bad))
+}
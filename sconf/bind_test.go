@@ -0,0 +1,41 @@
+package sconf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTierConfBind(t *testing.T) {
+	tf := NewTierConf()
+	err := tf.Load([]byte(`
+[server]
+host=127.0.0.1
+port=8080
+addr=${server.host}:${server.port}
+timeout=3s
+
+[db]
+hosts=a,b
+`))
+	assert.NoError(t, err)
+
+	var c struct {
+		Server struct {
+			Addr    string        `validate:"required"`
+			Timeout time.Duration `validate:"max=5s"`
+			Workers int           `default:"4"`
+		}
+		DB struct {
+			Hosts []string `validate:"min=1"`
+			User  string   `validate:"required"`
+		} `conf:"db"`
+	}
+	err = tf.Bind(&c)
+	assert.Equal(t, "db.user: required", err.Error())
+	assert.Equal(t, "127.0.0.1:8080", c.Server.Addr)
+	assert.Equal(t, 3*time.Second, c.Server.Timeout)
+	assert.Equal(t, 4, c.Server.Workers)
+	assert.Equal(t, []string{"a", "b"}, c.DB.Hosts)
+}
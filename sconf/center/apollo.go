@@ -2,13 +2,18 @@ package center
 
 import (
 	"context"
+	"fmt"
 	"github.com/ZhengHe-MD/agollo/v4"
 	"github.com/ZhengHe-MD/properties"
 	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/sconf/bind"
 	"github.com/shawnfeng/sutil/slog/slog"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -22,16 +27,51 @@ const (
 	defaultChangeEventSize = 32
 )
 
+// apolloConfigCenter 将每个 namespace 的配置保存为本地快照, apollo 不可用时还未同步成功的 namespace
+// 先使用快照中的配置, 第一次同步成功时按快照与 apollo 的配置之差生成变更
 type apolloConfigCenter struct {
 	conf            *agollo.Conf
 	ag              *agollo.Agollo
 	watchUpdateOnce sync.Once
 	changeEventChan chan *ChangeEvent
+
+	backupDir     string
+	stateInterval time.Duration
+	snapshots     *snapshotStore
+	// cached 保存从快照加载的配置
+	cached *kvConfigCenter
+
+	stateMu    sync.Mutex
+	namespaces map[string]*namespaceState
+
+	observerMu     sync.RWMutex
+	observers      map[int]ConfigObserver
+	nextObserverID int
+	watching       bool
+
+	stateOnce sync.Once
+	stopOnce  sync.Once
+	stopChan  chan struct{}
+}
+
+type namespaceState struct {
+	// fromCache 为 true 时 namespace 在使用快照的配置, 第一次同步成功并生成变更后为 false
+	fromCache bool
+	// snapshotTime 为使用中的快照的保存时间
+	snapshotTime time.Time
+	// savedReleaseKey 为最近一次保存快照时的 releaseKey
+	savedReleaseKey string
 }
 
 func newApolloConfigCenter() *apolloConfigCenter {
 	return &apolloConfigCenter{
 		changeEventChan: make(chan *ChangeEvent, defaultChangeEventSize),
+		backupDir:       getEnvWithDefault(envApolloBackupDir, defaultBackupDir),
+		stateInterval:   defaultStateInterval,
+		cached:          newKVConfigCenter(Apollo),
+		namespaces:      make(map[string]*namespaceState),
+		observers:       make(map[int]ConfigObserver),
+		stopChan:        make(chan struct{}),
 	}
 }
 
@@ -79,8 +119,10 @@ func (ap *apolloConfigCenter) Init(ctx context.Context, serviceName string, name
 
 	ap.conf = conf
 	ap.ag = agollo.NewAgollo(conf)
+	ap.ag.RegisterObserver(&agolloObserver{ap})
+	ap.snapshots = newSnapshotStore(filepath.Join(ap.backupDir, conf.AppID, conf.Cluster))
 
-	slog.Infof(ctx, "%s start agollo with conf:%v", fun, ap.conf)
+	slog.Infof(ctx, "%s start agollo with conf:%v backup dir:%s", fun, ap.conf, ap.snapshots.dir)
 
 	if err := ap.ag.Start(); err != nil {
 		slog.Errorf(ctx, "%s agollo starts err:%v", fun, err)
@@ -88,24 +130,239 @@ func (ap *apolloConfigCenter) Init(ctx context.Context, serviceName string, name
 		slog.Infof(ctx, "%s agollo starts succeed:%v", fun, err)
 	}
 
+	// NOTE: apollo 不可用时 agollo 的 Start 不一定返回错误, 以每个 namespace 是否有 releaseKey 判断是否同步成功
+	ap.addNamespaces(ctx, conf.NameSpaceNames)
+	ap.stateOnce.Do(func() {
+		go ap.stateLoop()
+	})
+
 	return nil
 }
 
 func (ap *apolloConfigCenter) Stop(ctx context.Context) error {
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.Stop")
 	defer span.Finish()
+
+	ap.stopOnce.Do(func() {
+		close(ap.stopChan)
+	})
 	return ap.ag.Stop()
 }
 
 func (ap *apolloConfigCenter) SubscribeNamespaces(ctx context.Context, namespaceNames []string) error {
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.SubscribeNamespaces")
 	defer span.Finish()
-	return ap.ag.SubscribeToNamespaces(namespaceNames...)
+
+	err := ap.ag.SubscribeToNamespaces(namespaceNames...)
+	ap.addNamespaces(ctx, namespaceNames)
+	return err
+}
+
+// synced 返回 namespace 是否已从 apollo 同步成功, agollo 只在同步成功后记录 releaseKey
+func (ap *apolloConfigCenter) synced(namespace string) bool {
+	_, ok := ap.ag.GetReleaseKey(namespace)
+	return ok
+}
+
+// fromCache 返回 namespace 是否使用快照的配置
+func (ap *apolloConfigCenter) fromCache(namespace string) bool {
+	ap.stateMu.Lock()
+	state, ok := ap.namespaces[namespace]
+	fromCache := ok && state.fromCache
+	ap.stateMu.Unlock()
+
+	return fromCache && !ap.synced(namespace)
+}
+
+// takeCache 在 namespace 第一次同步成功后返回其使用过的快照配置, 每个 namespace 只返回一次
+func (ap *apolloConfigCenter) takeCache(namespace string) (map[string]string, bool) {
+	if !ap.synced(namespace) {
+		return nil, false
+	}
+
+	ap.stateMu.Lock()
+	defer ap.stateMu.Unlock()
+
+	state, ok := ap.namespaces[namespace]
+	if !ok || !state.fromCache {
+		return nil, false
+	}
+	state.fromCache = false
+	return ap.cached.snapshot(namespace), true
+}
+
+// addNamespaces 记录订阅的 namespace, 还未从 apollo 同步成功的 namespace 使用快照
+func (ap *apolloConfigCenter) addNamespaces(ctx context.Context, namespaceNames []string) {
+	fun := "apolloConfigCenter.addNamespaces -->"
+
+	for _, namespace := range namespaceNames {
+		ap.stateMu.Lock()
+		_, ok := ap.namespaces[namespace]
+		state := &namespaceState{}
+		if !ok {
+			ap.namespaces[namespace] = state
+		}
+		ap.stateMu.Unlock()
+		if ok || ap.synced(namespace) {
+			continue
+		}
+
+		snapshot, err := ap.snapshots.load(namespace)
+		if err != nil {
+			slog.Errorf(ctx, "%s namespace:%s not synced from apollo and no snapshot, err:%v", fun, namespace, err)
+			continue
+		}
+
+		ap.cached.update(namespace, snapshot.Configurations)
+		ap.stateMu.Lock()
+		state.fromCache = true
+		state.snapshotTime = time.Unix(snapshot.UpdateTime, 0)
+		ap.stateMu.Unlock()
+		slog.Warnf(ctx, "%s namespace:%s not synced from apollo, use snapshot saved at %s",
+			fun, namespace, state.snapshotTime.Format(time.RFC3339))
+	}
+
+	ap.reportStates(ctx)
+}
+
+// agolloKV 返回 agollo 中 namespace 的所有配置
+func (ap *apolloConfigCenter) agolloKV(namespace string) map[string]string {
+	kv := make(map[string]string)
+	for _, k := range ap.ag.GetAllKeys(namespace) {
+		if v, ok := ap.ag.GetStringWithNamespace(namespace, k); ok {
+			kv[k] = v
+		}
+	}
+	return kv
+}
+
+// firstSyncEvent 返回 namespace 从快照的配置 cached 切换为 apollo 的配置的变更, 包括 apollo 中已删除的 key;
+// agollo 按其自身的缓存生成变更, 没有加载快照时只有 ADD
+func (ap *apolloConfigCenter) firstSyncEvent(namespace string, cached map[string]string) *ChangeEvent {
+	changes := diffChanges(cached, ap.agolloKV(namespace))
+	if len(changes) == 0 {
+		return nil
+	}
+	return &ChangeEvent{
+		Source:    Apollo,
+		Namespace: namespace,
+		Changes:   changes,
+	}
+}
+
+// saveSnapshot 在 namespace 的 releaseKey 变化后保存快照
+func (ap *apolloConfigCenter) saveSnapshot(ctx context.Context, namespace, savedReleaseKey string) {
+	fun := "apolloConfigCenter.saveSnapshot -->"
+
+	releaseKey, ok := ap.ag.GetReleaseKey(namespace)
+	if !ok || releaseKey == savedReleaseKey {
+		return
+	}
+
+	snapshot := &namespaceSnapshot{
+		Namespace:      namespace,
+		ReleaseKey:     releaseKey,
+		UpdateTime:     time.Now().Unix(),
+		Configurations: ap.agolloKV(namespace),
+	}
+	if err := ap.snapshots.save(snapshot); err != nil {
+		slog.Errorf(ctx, "%s namespace:%s save snapshot err:%v", fun, namespace, err)
+		return
+	}
+
+	ap.stateMu.Lock()
+	if state, ok := ap.namespaces[namespace]; ok {
+		state.savedReleaseKey = releaseKey
+	}
+	ap.stateMu.Unlock()
+}
+
+// reportStates 上报每个 namespace 的同步状态并保存已同步的 namespace 的快照;
+// 第一次同步成功时 agollo 没有产生变更(如 apollo 中的配置为空)的 namespace 在这里生成与快照之差的变更
+func (ap *apolloConfigCenter) reportStates(ctx context.Context) {
+	ap.stateMu.Lock()
+	states := make(map[string]namespaceState, len(ap.namespaces))
+	for namespace, state := range ap.namespaces {
+		states[namespace] = *state
+	}
+	ap.stateMu.Unlock()
+
+	for namespace, state := range states {
+		if !ap.synced(namespace) {
+			var age time.Duration
+			if state.fromCache {
+				age = time.Since(state.snapshotTime)
+			}
+			reportNamespaceState(ap.conf.AppID, namespace, false, age)
+			continue
+		}
+		reportNamespaceState(ap.conf.AppID, namespace, true, 0)
+
+		if cached, ok := ap.takeCache(namespace); ok {
+			if event := ap.firstSyncEvent(namespace, cached); event != nil {
+				ap.deliveryChangeEvent(event)
+			}
+		}
+		ap.saveSnapshot(ctx, namespace, state.savedReleaseKey)
+	}
+}
+
+func (ap *apolloConfigCenter) stateLoop() {
+	ctx := context.Background()
+
+	ticker := time.NewTicker(ap.stateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ap.stopChan:
+			return
+		case <-ticker.C:
+			ap.reportStates(ctx)
+		}
+	}
+}
+
+// Ready 等待订阅的 namespace 都从 apollo 同步成功; ctx 结束时返回错误, 此时未同步的 namespace 使用快照(如果有)
+func (ap *apolloConfigCenter) Ready(ctx context.Context) error {
+	ticker := time.NewTicker(defaultReadyInterval)
+	defer ticker.Stop()
+
+	for {
+		var pending, cached []string
+		ap.stateMu.Lock()
+		for namespace, state := range ap.namespaces {
+			if ap.synced(namespace) {
+				continue
+			}
+			pending = append(pending, namespace)
+			if state.fromCache {
+				cached = append(cached, namespace)
+			}
+		}
+		ap.stateMu.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			sort.Strings(pending)
+			sort.Strings(cached)
+			return fmt.Errorf("namespaces %v not synced from apollo, %v use snapshot: %s", pending, cached, ctx.Err().Error())
+		case <-ticker.C:
+		}
+	}
 }
 
 func (ap *apolloConfigCenter) GetString(ctx context.Context, key string) (string, bool) {
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetString")
 	defer span.Finish()
+
+	if ap.fromCache(defaultNamespaceApplication) {
+		return ap.cached.GetString(ctx, key)
+	}
 	return ap.ag.GetString(key)
 }
 
@@ -113,6 +370,9 @@ func (ap *apolloConfigCenter) GetStringWithNamespace(ctx context.Context, namesp
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetStringWithNamespace")
 	defer span.Finish()
 
+	if ap.fromCache(namespace) {
+		return ap.cached.GetStringWithNamespace(ctx, namespace, key)
+	}
 	return ap.ag.GetStringWithNamespace(namespace, key)
 }
 
@@ -120,6 +380,9 @@ func (ap *apolloConfigCenter) GetBool(ctx context.Context, key string) (bool, bo
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetBool")
 	defer span.Finish()
 
+	if ap.fromCache(defaultNamespaceApplication) {
+		return ap.cached.GetBool(ctx, key)
+	}
 	return ap.ag.GetBool(key)
 }
 
@@ -127,6 +390,9 @@ func (ap *apolloConfigCenter) GetBoolWithNamespace(ctx context.Context, namespac
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetBoolWithNamespace")
 	defer span.Finish()
 
+	if ap.fromCache(namespace) {
+		return ap.cached.GetBoolWithNamespace(ctx, namespace, key)
+	}
 	return ap.ag.GetBoolWithNamespace(namespace, key)
 }
 
@@ -134,6 +400,9 @@ func (ap *apolloConfigCenter) GetInt(ctx context.Context, key string) (int, bool
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetInt")
 	defer span.Finish()
 
+	if ap.fromCache(defaultNamespaceApplication) {
+		return ap.cached.GetInt(ctx, key)
+	}
 	return ap.ag.GetInt(key)
 }
 
@@ -141,6 +410,9 @@ func (ap *apolloConfigCenter) GetIntWithNamespace(ctx context.Context, namespace
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetIntWithNamespace")
 	defer span.Finish()
 
+	if ap.fromCache(namespace) {
+		return ap.cached.GetIntWithNamespace(ctx, namespace, key)
+	}
 	return ap.ag.GetIntWithNamespace(namespace, key)
 }
 
@@ -148,37 +420,89 @@ func (ap *apolloConfigCenter) GetAllKeys(ctx context.Context) []string {
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetAllKeys")
 	defer span.Finish()
 
-	return ap.ag.GetAllKeys("application")
+	return ap.GetAllKeysWithNamespace(ctx, defaultNamespaceApplication)
 }
 
 func (ap *apolloConfigCenter) GetAllKeysWithNamespace(ctx context.Context, namespace string) []string {
 	span, _ := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.GetAllKeysWithNamespace")
 	defer span.Finish()
 
+	if ap.fromCache(namespace) {
+		return ap.cached.GetAllKeysWithNamespace(ctx, namespace)
+	}
 	return ap.ag.GetAllKeys(namespace)
 }
 
+// StartWatchUpdate 只启动一次, agollo 每次调用都会启动一个分发变更的 goroutine
 func (ap *apolloConfigCenter) StartWatchUpdate(ctx context.Context) {
-	ap.ag.StartWatchUpdate()
+	ap.watchUpdateOnce.Do(func() {
+		ap.observerMu.Lock()
+		ap.watching = true
+		ap.observerMu.Unlock()
+
+		ap.ag.StartWatchUpdate()
+	})
 }
 
+// agolloObserver 接收 agollo 的变更, 转换后分发给注册的 ConfigObserver
 type agolloObserver struct {
-	observer ConfigObserver
+	ap *apolloConfigCenter
 }
 
 func (o *agolloObserver) HandleChangeEvent(ce *agollo.ChangeEvent) {
-	o.observer.HandleChangeEvent(fromAgolloChangeEvent(ce))
+	event := fromAgolloChangeEvent(ce)
+	if cached, ok := o.ap.takeCache(ce.Namespace); ok {
+		// NOTE: 使用过快照的 namespace 第一次同步成功时, 以快照为基准生成变更
+		if event = o.ap.firstSyncEvent(ce.Namespace, cached); event == nil {
+			return
+		}
+	}
+	o.ap.deliveryChangeEvent(event)
+}
+
+// deliveryChangeEvent 按注册的顺序将变更分发给 observer, StartWatchUpdate 之前的变更被丢弃
+func (ap *apolloConfigCenter) deliveryChangeEvent(event *ChangeEvent) {
+	ap.observerMu.RLock()
+	if !ap.watching {
+		ap.observerMu.RUnlock()
+		return
+	}
+	ids := make([]int, 0, len(ap.observers))
+	for id := range ap.observers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	observers := make([]ConfigObserver, 0, len(ids))
+	for _, id := range ids {
+		observers = append(observers, ap.observers[id])
+	}
+	ap.observerMu.RUnlock()
+
+	for _, ob := range observers {
+		ob.HandleChangeEvent(event)
+	}
 }
 
 func (ap *apolloConfigCenter) RegisterObserver(ctx context.Context, observer ConfigObserver) func() {
-	return ap.ag.RegisterObserver(&agolloObserver{observer})
+	ap.observerMu.Lock()
+	defer ap.observerMu.Unlock()
+
+	id := ap.nextObserverID
+	ap.nextObserverID++
+	ap.observers[id] = observer
+	return func() {
+		ap.observerMu.Lock()
+		defer ap.observerMu.Unlock()
+
+		delete(ap.observers, id)
+	}
 }
 
 func (ap *apolloConfigCenter) Unmarshal(ctx context.Context, v interface{}) error {
 	return ap.UnmarshalWithNamespace(ctx, defaultNamespaceApplication, v)
 }
 
-func (ap *apolloConfigCenter) UnmarshalWithNamespace(ctx context.Context, namespace string, v interface{}) error {
+func (ap *apolloConfigCenter) getAllWithNamespace(ctx context.Context, namespace string) map[string]string {
 	var kv = map[string]string{}
 
 	ks := ap.GetAllKeysWithNamespace(ctx, namespace)
@@ -187,8 +511,11 @@ func (ap *apolloConfigCenter) UnmarshalWithNamespace(ctx context.Context, namesp
 			kv[k] = v
 		}
 	}
+	return kv
+}
 
-	return properties.UnmarshalKV(kv, v)
+func (ap *apolloConfigCenter) UnmarshalWithNamespace(ctx context.Context, namespace string, v interface{}) error {
+	return properties.UnmarshalKV(ap.getAllWithNamespace(ctx, namespace), v)
 }
 
 func (ap *apolloConfigCenter) UnmarshalKey(ctx context.Context, key string, v interface{}) error {
@@ -196,14 +523,7 @@ func (ap *apolloConfigCenter) UnmarshalKey(ctx context.Context, key string, v in
 }
 
 func (ap *apolloConfigCenter) UnmarshalKeyWithNamespace(ctx context.Context, namespace string, key string, v interface{}) error {
-	var kv = map[string]string{}
-
-	ks := ap.GetAllKeysWithNamespace(ctx, namespace)
-	for _, k := range ks {
-		if v, ok := ap.GetStringWithNamespace(ctx, namespace, k); ok {
-			kv[k] = v
-		}
-	}
+	kv := ap.getAllWithNamespace(ctx, namespace)
 
 	bs, err := properties.Marshal(&kv)
 	if err != nil {
@@ -213,3 +533,13 @@ func (ap *apolloConfigCenter) UnmarshalKeyWithNamespace(ctx context.Context, nam
 	return properties.UnmarshalKey(key, bs, v)
 }
 
+func (ap *apolloConfigCenter) Bind(ctx context.Context, v interface{}) error {
+	return ap.BindWithNamespace(ctx, defaultNamespaceApplication, v)
+}
+
+func (ap *apolloConfigCenter) BindWithNamespace(ctx context.Context, namespace string, v interface{}) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "apolloConfigCenter.BindWithNamespace")
+	defer span.Finish()
+
+	return bind.KV(ap.getAllWithNamespace(ctx, namespace), v)
+}
@@ -0,0 +1,209 @@
+package center
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeApollo 实现 agollo 使用的 notifications/v2 与 configs 接口, available 为 false 时返回 503
+type fakeApollo struct {
+	mu             sync.Mutex
+	available      bool
+	notificationID int
+	releaseKey     string
+	configurations map[string]string
+}
+
+func (m *fakeApollo) set(available bool, releaseKey string, configurations map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.available = available
+	m.notificationID++
+	m.releaseKey = releaseKey
+	m.configurations = configurations
+}
+
+func (m *fakeApollo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.available {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/notifications/v2"):
+		var notifications []*struct {
+			NamespaceName  string `json:"namespaceName"`
+			NotificationID int    `json:"notificationId"`
+		}
+		json.Unmarshal([]byte(r.URL.Query().Get("notifications")), &notifications)
+		for _, n := range notifications {
+			n.NotificationID = m.notificationID
+		}
+		json.NewEncoder(w).Encode(notifications)
+	case strings.HasPrefix(r.URL.Path, "/configs/"):
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"namespaceName":  filepath.Base(r.URL.Path),
+			"releaseKey":     m.releaseKey,
+			"configurations": m.configurations,
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// changeCollector 将收到的变更转发到 events
+type changeCollector struct {
+	events chan *ChangeEvent
+}
+
+func (c *changeCollector) HandleChangeEvent(event *ChangeEvent) {
+	c.events <- event
+}
+
+func TestApolloConfigCenterSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "sconfcenter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	apollo := &fakeApollo{}
+	server := httptest.NewServer(apollo)
+	defer server.Close()
+	os.Setenv(envApolloHostPort, strings.TrimPrefix(server.URL, "http://"))
+	defer os.Unsetenv(envApolloHostPort)
+	os.Setenv(envApolloBackupDir, dir)
+	defer os.Unsetenv(envApolloBackupDir)
+
+	// 上次运行保存的快照, other 本次不订阅, 其快照不受影响
+	store := newSnapshotStore(filepath.Join(dir, "base.snapshot", defaultCluster))
+	snapshotTime := time.Now().Add(-time.Hour).Unix()
+	assert.NoError(t, store.save(&namespaceSnapshot{
+		Namespace:      "application",
+		ReleaseKey:     "r1",
+		UpdateTime:     snapshotTime,
+		Configurations: map[string]string{"pool_size": "8", "name": "old"},
+	}))
+	other := &namespaceSnapshot{Namespace: "other", ReleaseKey: "r1", UpdateTime: snapshotTime, Configurations: map[string]string{"a": "1"}}
+	assert.NoError(t, store.save(other))
+
+	center := newApolloConfigCenter()
+	center.stateInterval = 10 * time.Millisecond
+	assert.NoError(t, center.Init(ctx, "base/snapshot", []string{"application", "missing"}))
+	// NOTE: agollo 的 Client.Stop 与其 poller 读写 updateChan 时没有同步, -race 下会报错, 只停止上报状态
+	defer center.stopOnce.Do(func() { close(center.stopChan) })
+
+	collector := &changeCollector{events: make(chan *ChangeEvent, 8)}
+	center.RegisterObserver(ctx, collector)
+	center.StartWatchUpdate(ctx)
+
+	// apollo 不可用时使用快照, 没有快照的 namespace 为空
+	val, ok := center.GetInt(ctx, "pool_size")
+	assert.True(t, ok)
+	assert.Equal(t, 8, val)
+	assert.Equal(t, []string{"name", "pool_size"}, center.GetAllKeys(ctx))
+	_, ok = center.GetStringWithNamespace(ctx, "missing", "pool_size")
+	assert.False(t, ok)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	err = center.Ready(timeoutCtx)
+	cancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "[application missing] not synced from apollo, [application] use snapshot")
+
+	// apollo 恢复后切换为 apollo 的配置, 变更以快照为基准, 包括 apollo 中已删除的 key
+	apollo.set(true, "r2", map[string]string{"pool_size": "16"})
+	timeoutCtx, cancel = context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	assert.NoError(t, center.Ready(timeoutCtx))
+
+	val, _ = center.GetInt(ctx, "pool_size")
+	assert.Equal(t, 16, val)
+	_, ok = center.GetString(ctx, "name")
+	assert.False(t, ok)
+
+	// missing 没有使用快照, 变更由 agollo 生成
+	events := map[string]map[string]*Change{}
+	for len(events) < 2 {
+		select {
+		case event := <-collector.events:
+			events[event.Namespace] = event.Changes
+		case <-time.After(2 * time.Second):
+			t.Fatalf("change events not received, got:%v", events)
+		}
+	}
+	assert.Equal(t, map[string]*Change{
+		"pool_size": {OldValue: "8", NewValue: "16", ChangeType: MODIFY},
+		"name":      {OldValue: "old", ChangeType: DELETE},
+	}, events["application"])
+	assert.Equal(t, map[string]*Change{
+		"pool_size": {NewValue: "16", ChangeType: ADD},
+	}, events["missing"])
+
+	// 同步成功的 namespace 各自保存快照
+	for _, namespace := range []string{"application", "missing"} {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			snapshot, err := store.load(namespace)
+			if err == nil && snapshot.ReleaseKey == "r2" {
+				assert.Equal(t, map[string]string{"pool_size": "16"}, snapshot.Configurations)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("snapshot of %s not saved, err:%v", namespace, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	loaded, err := store.load("other")
+	assert.NoError(t, err)
+	assert.Equal(t, other, loaded)
+}
+
+func TestSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sconfcenter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newSnapshotStore(filepath.Join(dir, "app", "default"))
+	_, err = store.load("application")
+	assert.True(t, os.IsNotExist(err))
+
+	snapshot := &namespaceSnapshot{Namespace: "application", ReleaseKey: "r1", UpdateTime: 1, Configurations: map[string]string{"a": "1"}}
+	assert.NoError(t, store.save(snapshot))
+	loaded, err := store.load("application")
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot, loaded)
+
+	// 不留下临时文件
+	files, _ := ioutil.ReadDir(store.dir)
+	assert.Len(t, files, 1)
+
+	assert.NoError(t, ioutil.WriteFile(store.path("broken"), []byte("{"), 0644))
+	_, err = store.load("broken")
+	assert.Error(t, err)
+}
+
+func TestDiffChanges(t *testing.T) {
+	changes := diffChanges(map[string]string{"a": "1", "b": "2", "c": "3"}, map[string]string{"a": "1", "b": "20", "d": "4"})
+	assert.Equal(t, map[string]*Change{
+		"b": {OldValue: "2", NewValue: "20", ChangeType: MODIFY},
+		"c": {OldValue: "3", ChangeType: DELETE},
+		"d": {NewValue: "4", ChangeType: ADD},
+	}, changes)
+}
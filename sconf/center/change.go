@@ -18,6 +18,8 @@ type ChangeEventSource int
 const (
 	Etcd ChangeEventSource = iota
 	Apollo
+	File
+	Memory
 )
 
 var (
@@ -41,11 +43,32 @@ type ChangeEvent struct {
 	Source ChangeEventSource
 	// Namespace means
 	//   Namespace in Apollo
-	//   Path in Etcd
+	//   Namespace in Etcd, the <namespace> segment of <prefix>/<serviceName>/<namespace>/<key>, not the full path
+	//   File name without extension in File
+	//   Namespace in Memory
 	Namespace string
 	Changes   map[string]*Change
 }
 
+// diffChanges 返回 namespace 的配置从 old 变为 kv 的变更
+func diffChanges(old, kv map[string]string) map[string]*Change {
+	changes := make(map[string]*Change)
+	for k, v := range kv {
+		oldValue, ok := old[k]
+		if !ok {
+			changes[k] = &Change{NewValue: v, ChangeType: ADD}
+		} else if oldValue != v {
+			changes[k] = &Change{OldValue: oldValue, NewValue: v, ChangeType: MODIFY}
+		}
+	}
+	for k, v := range old {
+		if _, ok := kv[k]; !ok {
+			changes[k] = &Change{OldValue: v, ChangeType: DELETE}
+		}
+	}
+	return changes
+}
+
 func fromAgolloChangeEvent(ace *agollo.ChangeEvent) *ChangeEvent {
 	var changes = map[string]*Change{}
 	for k, ac := range ace.Changes {
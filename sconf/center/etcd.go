@@ -0,0 +1,338 @@
+package center
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envEtcdEndpoints = "SCONF_ETCD_ENDPOINTS"
+	envEtcdPrefix    = "SCONF_ETCD_PREFIX"
+
+	defaultEtcdEndpoints      = "http://127.0.0.1:2379"
+	defaultEtcdPrefix         = "/sconf"
+	defaultEtcdRequestTimeout = 5 * time.Second
+	defaultEtcdRetryInterval  = 3 * time.Second
+
+	etcdEventTypeDelete = "DELETE"
+)
+
+// etcdConfigCenter 通过 etcd v3 的 gRPC gateway(HTTP/JSON 接口)读取配置, namespace 下的配置保存在
+// <prefix>/<serviceName>/<namespace>/<key>; 每个 namespace 通过 watch 接收变更,
+// watch 断开后重新读取全部配置, 对比后通知期间发生的变更, 再从读取时的 revision 继续 watch
+type etcdConfigCenter struct {
+	*kvConfigCenter
+	endpoints     []string
+	prefix        string
+	client        *http.Client
+	retryInterval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	watchMu     sync.Mutex
+	serviceName string
+	watched     map[string]bool
+}
+
+// NewEtcdConfigCenter 创建读取 etcd 中 prefix 下配置的 ConfigCenter, endpoints 如 http://127.0.0.1:2379,
+// 通过 NewConfigCenter 创建时 endpoints 与 prefix 取自环境变量 SCONF_ETCD_ENDPOINTS(逗号分隔) 与 SCONF_ETCD_PREFIX
+func NewEtcdConfigCenter(endpoints []string, prefix string) ConfigCenter {
+	return newEtcdConfigCenter(endpoints, prefix)
+}
+
+func newEtcdConfigCenter(endpoints []string, prefix string) *etcdConfigCenter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdConfigCenter{
+		kvConfigCenter: newKVConfigCenter(Etcd),
+		endpoints:      endpoints,
+		prefix:         prefix,
+		// NOTE: watch 为长连接, 不设置整体超时, 读取配置的超时通过 ctx 控制
+		client:        &http.Client{},
+		retryInterval: defaultEtcdRetryInterval,
+		ctx:           ctx,
+		cancel:        cancel,
+		watched:       make(map[string]bool),
+	}
+}
+
+func etcdEndpointsFromEnv() []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(getEnvWithDefault(envEtcdEndpoints, defaultEtcdEndpoints), ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+func (m *etcdConfigCenter) Init(ctx context.Context, serviceName string, namespaceNames []string) error {
+	fun := "etcdConfigCenter.Init -->"
+
+	m.watchMu.Lock()
+	m.serviceName = serviceName
+	m.watchMu.Unlock()
+
+	if len(namespaceNames) == 0 {
+		namespaceNames = []string{defaultNamespaceApplication}
+	}
+	slog.Infof(ctx, "%s endpoints:%v prefix:%s service:%s namespaces:%v", fun, m.endpoints, m.prefix, serviceName, namespaceNames)
+
+	return m.SubscribeNamespaces(ctx, namespaceNames)
+}
+
+func (m *etcdConfigCenter) Stop(ctx context.Context) error {
+	m.cancel()
+	m.stop()
+	return nil
+}
+
+// SubscribeNamespaces 读取 namespace 的配置并开始 watch, 读取失败的 namespace 在后台重试
+func (m *etcdConfigCenter) SubscribeNamespaces(ctx context.Context, namespaceNames []string) error {
+	fun := "etcdConfigCenter.SubscribeNamespaces -->"
+	m.expect(namespaceNames)
+
+	var errs []string
+	for _, namespace := range namespaceNames {
+		m.watchMu.Lock()
+		watched := m.watched[namespace]
+		m.watched[namespace] = true
+		m.watchMu.Unlock()
+		if watched {
+			continue
+		}
+
+		revision, err := m.load(namespace)
+		if err != nil {
+			slog.Errorf(ctx, "%s namespace:%s load err:%s", fun, namespace, err.Error())
+			errs = append(errs, fmt.Sprintf("namespace %s: %s", namespace, err.Error()))
+		}
+		go m.watchLoop(namespace, revision)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// namespacePrefix 返回 namespace 下配置的 key 前缀, 以 / 结尾
+func (m *etcdConfigCenter) namespacePrefix(namespace string) string {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+
+	return path.Join(m.prefix, m.serviceName, namespace) + "/"
+}
+
+// prefixRangeEnd 返回包含所有以 prefix 开头的 key 的 range_end
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// prefix 全为 0xff 时表示到最后一个 key
+	return []byte{0}
+}
+
+// etcdKeyValue 等为 gRPC gateway 的 json 格式, bytes 类型为 base64 编码, int64 类型为字符串
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdResponseHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdResponseHeader `json:"header"`
+	Kvs    []*etcdKeyValue    `json:"kvs"`
+}
+
+type etcdWatchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end"`
+	StartRevision int64  `json:"start_revision,string"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest *etcdWatchCreateRequest `json:"create_request"`
+}
+
+type etcdEvent struct {
+	// Type 为 PUT 时可能被省略
+	Type string        `json:"type"`
+	Kv   *etcdKeyValue `json:"kv"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Header          etcdResponseHeader `json:"header"`
+		Created         bool               `json:"created"`
+		Canceled        bool               `json:"canceled"`
+		CompactRevision int64              `json:"compact_revision,string"`
+		CancelReason    string             `json:"cancel_reason"`
+		Events          []*etcdEvent       `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// post 依次向 endpoints 发送请求, 返回第一个成功的响应
+func (m *etcdConfigCenter) post(ctx context.Context, api string, req interface{}) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := fmt.Errorf("no etcd endpoints")
+	for _, endpoint := range m.endpoints {
+		url := strings.TrimRight(endpoint, "/") + api
+		r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Content-Type", "application/json")
+
+		resp, err := m.client.Do(r)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s status:%d body:%s", url, resp.StatusCode, msg)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// load 读取 namespace 的全部配置并替换, 返回读取时的 revision
+func (m *etcdConfigCenter) load(namespace string) (int64, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, defaultEtcdRequestTimeout)
+	defer cancel()
+
+	prefix := m.namespacePrefix(namespace)
+	resp, err := m.post(ctx, "/v3/kv/range", &etcdRangeRequest{
+		Key:      []byte(prefix),
+		RangeEnd: prefixRangeEnd(prefix),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var rr etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rr); err != nil {
+		return 0, fmt.Errorf("decode range response err:%s", err.Error())
+	}
+
+	kv := make(map[string]string, len(rr.Kvs))
+	for _, item := range rr.Kvs {
+		kv[strings.TrimPrefix(string(item.Key), prefix)] = string(item.Value)
+	}
+	m.update(namespace, kv)
+	return rr.Header.Revision, nil
+}
+
+// watchLoop 持续 watch namespace, revision 为 0 时先读取全部配置
+func (m *etcdConfigCenter) watchLoop(namespace string, revision int64) {
+	fun := "etcdConfigCenter.watchLoop -->"
+	ctx := m.ctx
+
+	for {
+		var err error
+		if revision == 0 {
+			revision, err = m.load(namespace)
+		}
+		if err == nil {
+			err = m.watch(namespace, revision+1)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warnf(ctx, "%s namespace:%s retry after %s, err:%v", fun, namespace, m.retryInterval, err)
+
+		// NOTE: watch 断开期间的变更通过重新读取全部配置得到
+		revision = 0
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.retryInterval):
+		}
+	}
+}
+
+// watch 从 startRevision 开始 watch namespace, 将收到的变更应用到配置, 返回时 watch 已断开
+func (m *etcdConfigCenter) watch(namespace string, startRevision int64) error {
+	prefix := m.namespacePrefix(namespace)
+	resp, err := m.post(m.ctx, "/v3/watch", &etcdWatchRequest{
+		CreateRequest: &etcdWatchCreateRequest{
+			Key:           []byte(prefix),
+			RangeEnd:      prefixRangeEnd(prefix),
+			StartRevision: startRevision,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var wr etcdWatchResponse
+		if err := decoder.Decode(&wr); err != nil {
+			return fmt.Errorf("watch stream closed: %s", err.Error())
+		}
+		if wr.Error != nil {
+			return fmt.Errorf("watch err:%s", wr.Error.Message)
+		}
+		if wr.Result == nil {
+			continue
+		}
+		if wr.Result.Canceled {
+			return fmt.Errorf("watch canceled, compact_revision:%d reason:%s", wr.Result.CompactRevision, wr.Result.CancelReason)
+		}
+		if len(wr.Result.Events) == 0 {
+			continue
+		}
+
+		events := wr.Result.Events
+		m.apply(namespace, func(kv map[string]string) map[string]string {
+			for _, event := range events {
+				if event.Kv == nil {
+					continue
+				}
+				key := strings.TrimPrefix(string(event.Kv.Key), prefix)
+				if event.Type == etcdEventTypeDelete {
+					delete(kv, key)
+				} else {
+					kv[key] = string(event.Kv.Value)
+				}
+			}
+			return kv
+		})
+	}
+}
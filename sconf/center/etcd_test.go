@@ -0,0 +1,192 @@
+package center
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEtcd 实现 etcd gRPC gateway 的 range 与 watch 接口
+type fakeEtcd struct {
+	mu       sync.Mutex
+	revision int64
+	data     map[string]string
+	watchers map[chan []*etcdEvent]*etcdWatchCreateRequest
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		revision: 1,
+		data:     make(map[string]string),
+		watchers: make(map[chan []*etcdEvent]*etcdWatchCreateRequest),
+	}
+}
+
+func inRange(key string, start, end []byte) bool {
+	return bytes.Compare([]byte(key), start) >= 0 && bytes.Compare([]byte(key), end) < 0
+}
+
+func (m *fakeEtcd) put(key, value string) {
+	m.notify(&etcdEvent{Kv: &etcdKeyValue{Key: []byte(key), Value: []byte(value)}}, func() {
+		m.data[key] = value
+	})
+}
+
+func (m *fakeEtcd) del(key string) {
+	m.notify(&etcdEvent{Type: etcdEventTypeDelete, Kv: &etcdKeyValue{Key: []byte(key)}}, func() {
+		delete(m.data, key)
+	})
+}
+
+func (m *fakeEtcd) notify(event *etcdEvent, fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revision++
+	fn()
+	for ch, req := range m.watchers {
+		if inRange(string(event.Kv.Key), req.Key, req.RangeEnd) {
+			ch <- []*etcdEvent{event}
+		}
+	}
+}
+
+func (m *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req etcdRangeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		m.mu.Lock()
+		resp := etcdRangeResponse{Header: etcdResponseHeader{Revision: m.revision}}
+		var keys []string
+		for k := range m.data {
+			if inRange(k, req.Key, req.RangeEnd) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			resp.Kvs = append(resp.Kvs, &etcdKeyValue{Key: []byte(k), Value: []byte(m.data[k])})
+		}
+		m.mu.Unlock()
+		json.NewEncoder(w).Encode(&resp)
+
+	case "/v3/watch":
+		var req etcdWatchRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		ch := make(chan []*etcdEvent, 16)
+		m.mu.Lock()
+		m.watchers[ch] = req.CreateRequest
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.watchers, ch)
+			m.mu.Unlock()
+		}()
+
+		w.Write([]byte(`{"result":{"header":{"revision":"1"},"created":true}}` + "\n"))
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case events := <-ch:
+				data, _ := json.Marshal(map[string]interface{}{"result": map[string]interface{}{"events": events}})
+				w.Write(append(data, '\n'))
+				w.(http.Flusher).Flush()
+			}
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *fakeEtcd) watcherCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.watchers)
+}
+
+func waitWatchers(t *testing.T, etcd *fakeEtcd, n int) {
+	for i := 0; i < 300; i++ {
+		if etcd.watcherCount() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("wait %d watchers timeout", n)
+}
+
+func TestEtcdConfigCenter(t *testing.T) {
+	ctx := context.Background()
+
+	etcd := newFakeEtcd()
+	etcd.put("/sconf/base/authapi/application/pool_size", "16")
+	etcd.put("/sconf/base/authapi/application/redis.addr", "127.0.0.1:6379")
+	etcd.put("/sconf/base/authapi/application0/other", "x")
+	etcd.put("/sconf/base/authapi/infra.cache/timeout", "3")
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	// 不可用的 endpoint 被跳过
+	center := newEtcdConfigCenter([]string{"http://127.0.0.1:1", server.URL + "/"}, "/sconf")
+	center.retryInterval = 10 * time.Millisecond
+	defer center.Stop(ctx)
+	assert.NoError(t, center.Init(ctx, testService, nil))
+
+	assert.Equal(t, []string{"pool_size", "redis.addr"}, center.GetAllKeys(ctx))
+	val, ok := center.GetInt(ctx, "pool_size")
+	assert.True(t, ok)
+	assert.Equal(t, 16, val)
+
+	recorder := newEventRecorder()
+	center.RegisterObserver(ctx, recorder)
+	center.StartWatchUpdate(ctx)
+	waitWatchers(t, etcd, 1)
+
+	etcd.put("/sconf/base/authapi/application/pool_size", "32")
+	assert.Equal(t, &ChangeEvent{Source: Etcd, Namespace: "application", Changes: map[string]*Change{
+		"pool_size": {OldValue: "16", NewValue: "32", ChangeType: MODIFY},
+	}}, recorder.next(t))
+
+	etcd.del("/sconf/base/authapi/application/redis.addr")
+	etcd.put("/sconf/base/authapi/application0/other", "y")
+	assert.Equal(t, &ChangeEvent{Source: Etcd, Namespace: "application", Changes: map[string]*Change{
+		"redis.addr": {OldValue: "127.0.0.1:6379", ChangeType: DELETE},
+	}}, recorder.next(t))
+	recorder.assertEmpty(t)
+
+	// 与 agollo 一致, watch 之后订阅的 namespace 以 ADD 通知已有的配置
+	assert.NoError(t, center.SubscribeNamespaces(ctx, []string{"infra.cache"}))
+	val, ok = center.GetIntWithNamespace(ctx, "infra.cache", "timeout")
+	assert.True(t, ok)
+	assert.Equal(t, 3, val)
+	assert.Equal(t, &ChangeEvent{Source: Etcd, Namespace: "infra.cache", Changes: map[string]*Change{
+		"timeout": {NewValue: "3", ChangeType: ADD},
+	}}, recorder.next(t))
+	waitWatchers(t, etcd, 2)
+
+	// watch 断开期间的变更在重新读取后通知
+	server.CloseClientConnections()
+	etcd.put("/sconf/base/authapi/infra.cache/timeout", "5")
+	assert.Equal(t, &ChangeEvent{Source: Etcd, Namespace: "infra.cache", Changes: map[string]*Change{
+		"timeout": {OldValue: "3", NewValue: "5", ChangeType: MODIFY},
+	}}, recorder.next(t))
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	assert.Equal(t, []byte("/a/c"), prefixRangeEnd("/a/b"))
+	assert.Equal(t, []byte("/b"), prefixRangeEnd("/a\xff"))
+	assert.Equal(t, []byte{0}, prefixRangeEnd("\xff"))
+}
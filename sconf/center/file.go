@@ -0,0 +1,292 @@
+package center
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/shawnfeng/sutil/sconf"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envFileConfigDir         = "SCONF_FILE_DIR"
+	defaultFileConfigDir     = "conf"
+	defaultFileCheckInterval = time.Second
+)
+
+// fileExts 为 namespace 配置文件支持的扩展名, 同一个 namespace 存在多个文件时按此顺序取第一个
+var fileExts = []string{".yaml", ".yml", ".json", ".properties"}
+
+// fileConfigCenter 从本地目录读取配置, 每个 namespace 对应 dir 下的 <namespace>.yaml|.yml|.json|.properties,
+// 通过 sconf.FileAutoCheck 定期检查文件变更; yaml 与 json 的嵌套结构展开为 a.b 形式的 key,
+// 数组元素展开为 a[0], a[0].b, 与 apollo 中 properties 格式的配置一致
+type fileConfigCenter struct {
+	*kvConfigCenter
+	dir      string
+	interval time.Duration
+
+	filesMu sync.Mutex
+	files   map[string]*namespaceFile
+
+	startOnce sync.Once
+}
+
+type namespaceFile struct {
+	path  string
+	check *sconf.FileAutoCheck
+}
+
+// NewFileConfigCenter 创建读取 dir 下配置文件的 ConfigCenter, 通过 NewConfigCenter 创建时 dir 取自环境变量 SCONF_FILE_DIR
+func NewFileConfigCenter(dir string) ConfigCenter {
+	return newFileConfigCenter(dir, defaultFileCheckInterval)
+}
+
+func newFileConfigCenter(dir string, interval time.Duration) *fileConfigCenter {
+	return &fileConfigCenter{
+		kvConfigCenter: newKVConfigCenter(File),
+		dir:            dir,
+		interval:       interval,
+		files:          make(map[string]*namespaceFile),
+	}
+}
+
+// Init 读取 namespace 对应的配置文件, serviceName 不影响文件的位置
+func (m *fileConfigCenter) Init(ctx context.Context, serviceName string, namespaceNames []string) error {
+	fun := "fileConfigCenter.Init -->"
+
+	if len(namespaceNames) == 0 {
+		namespaceNames = []string{defaultNamespaceApplication}
+	}
+	slog.Infof(ctx, "%s dir:%s namespaces:%v", fun, m.dir, namespaceNames)
+
+	err := m.SubscribeNamespaces(ctx, namespaceNames)
+	m.startOnce.Do(func() {
+		go m.checkLoop(ctx)
+	})
+	return err
+}
+
+func (m *fileConfigCenter) Stop(ctx context.Context) error {
+	m.stop()
+	return nil
+}
+
+func (m *fileConfigCenter) SubscribeNamespaces(ctx context.Context, namespaceNames []string) error {
+	m.expect(namespaceNames)
+
+	var errs []string
+	for _, namespace := range namespaceNames {
+		m.filesMu.Lock()
+		if _, ok := m.files[namespace]; !ok {
+			m.files[namespace] = &namespaceFile{}
+		}
+		m.filesMu.Unlock()
+
+		if err := m.checkNamespace(ctx, namespace); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m *fileConfigCenter) checkLoop(ctx context.Context) {
+	fun := "fileConfigCenter.checkLoop -->"
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopChan:
+			return
+		case <-ticker.C:
+		}
+
+		for _, namespace := range m.namespaces() {
+			if err := m.checkNamespace(ctx, namespace); err != nil {
+				slog.Errorf(ctx, "%s namespace:%s keep old config, err:%s", fun, namespace, err.Error())
+			}
+		}
+	}
+}
+
+func (m *fileConfigCenter) namespaces() []string {
+	m.filesMu.Lock()
+	defer m.filesMu.Unlock()
+
+	namespaces := make([]string, 0, len(m.files))
+	for namespace := range m.files {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// findFile 返回 namespace 的配置文件, 不存在时返回空
+func (m *fileConfigCenter) findFile(namespace string) string {
+	for _, ext := range fileExts {
+		path := filepath.Join(m.dir, namespace+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// checkNamespace 检查 namespace 的配置文件是否变更, 变更时重新解析并替换配置;
+// 配置文件被删除时 namespace 的配置被清空, 解析失败时保留原配置; 还未加载过的 namespace 文件不存在时保持未加载, Ready 继续等待
+func (m *fileConfigCenter) checkNamespace(ctx context.Context, namespace string) error {
+	m.filesMu.Lock()
+	defer m.filesMu.Unlock()
+
+	file := m.files[namespace]
+	path := m.findFile(namespace)
+	if path == "" {
+		file.path, file.check = "", nil
+		if m.hasNamespace(namespace) {
+			m.update(namespace, map[string]string{})
+		}
+		return nil
+	}
+
+	if path != file.path {
+		file.path, file.check = path, sconf.NewFileAutoCheck(path)
+	}
+
+	changed, data, err := file.check.Check()
+	if err != nil {
+		return fmt.Errorf("check file %s err:%s", path, err.Error())
+	}
+	if !changed {
+		return nil
+	}
+
+	kv, err := parseConfigFile(path, data)
+	if err != nil {
+		// NOTE: 文件的 hash 已被记录, 内容不变时不再重复解析, 文件修正后重新加载
+		return fmt.Errorf("parse file %s err:%s", path, err.Error())
+	}
+	m.update(namespace, kv)
+	return nil
+}
+
+// parseConfigFile 按扩展名解析配置文件为扁平的 key/value
+func parseConfigFile(path string, data []byte) (map[string]string, error) {
+	kv := make(map[string]string)
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		if err := flattenValue("", v, kv); err != nil {
+			return nil, err
+		}
+	case ".json":
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		if err := flattenValue("", v, kv); err != nil {
+			return nil, err
+		}
+	case ".properties":
+		return parseProperties(data)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %s", filepath.Ext(path))
+	}
+	return kv, nil
+}
+
+// flattenValue 将 yaml/json 解析出的 v 以 prefix 为前缀展开到 kv
+func flattenValue(prefix string, v interface{}, kv map[string]string) error {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		for k, item := range val {
+			if err := flattenValue(join(fmt.Sprint(k)), item, kv); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for k, item := range val {
+			if err := flattenValue(join(k), item, kv); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, item := range val {
+			if err := flattenValue(fmt.Sprintf("%s[%d]", prefix, i), item, kv); err != nil {
+				return err
+			}
+		}
+	default:
+		if prefix == "" {
+			// 空文件
+			if v == nil {
+				return nil
+			}
+			return fmt.Errorf("top level of config must be a map, got %T", v)
+		}
+		kv[prefix] = scalarString(val)
+	}
+	return nil
+}
+
+func scalarString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// parseProperties 解析 key = value 格式的配置, # 与 ! 开头的行为注释, value 中可以包含 =
+func parseProperties(data []byte) (map[string]string, error) {
+	kv := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: expect key = value", n)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: empty key", n)
+		}
+		kv[key] = strings.TrimSpace(line[idx+1:])
+	}
+	return kv, scanner.Err()
+}
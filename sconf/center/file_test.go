@@ -0,0 +1,188 @@
+package center
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFile 写入文件并修改 modtime, FileAutoCheck 按秒比较 modtime
+func writeConfigFile(t *testing.T, path, data string, modtime time.Time) {
+	assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	assert.NoError(t, os.Chtimes(path, modtime, modtime))
+}
+
+func TestFileConfigCenter(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "sconfcenter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeConfigFile(t, filepath.Join(dir, "application.yaml"), `
+pool_size: 16
+ratio: 0.5
+redis:
+  addr: 127.0.0.1:6379
+  debug: true
+filters:
+  - name: AddRequestHeader
+    args:
+      name: foo
+tags: [a, b]
+`, now)
+	writeConfigFile(t, filepath.Join(dir, "infra.cache.json"), `{"base": {"default": {"redis": {"addr": "127.0.0.1:6379", "poolsize": 10}}}}`, now)
+	writeConfigFile(t, filepath.Join(dir, "db.properties"), "# comment\nurl = mysql://root@tcp/db?a=b\n\nuser=root\n", now)
+
+	center := newFileConfigCenter(dir, time.Hour)
+	defer center.Stop(ctx)
+	assert.NoError(t, center.Init(ctx, testService, []string{"application", "infra.cache", "db", "missing"}))
+
+	assert.Equal(t, []string{"filters[0].args.name", "filters[0].name", "pool_size", "ratio", "redis.addr", "redis.debug", "tags[0]", "tags[1]"},
+		center.GetAllKeys(ctx))
+	val, ok := center.GetInt(ctx, "pool_size")
+	assert.True(t, ok)
+	assert.Equal(t, 16, val)
+	str, _ := center.GetString(ctx, "ratio")
+	assert.Equal(t, "0.5", str)
+	b, ok := center.GetBool(ctx, "redis.debug")
+	assert.True(t, ok)
+	assert.True(t, b)
+
+	val, ok = center.GetIntWithNamespace(ctx, "infra.cache", "base.default.redis.poolsize")
+	assert.True(t, ok)
+	assert.Equal(t, 10, val)
+	str, _ = center.GetStringWithNamespace(ctx, "db", "url")
+	assert.Equal(t, "mysql://root@tcp/db?a=b", str)
+	assert.Equal(t, 0, len(center.GetAllKeysWithNamespace(ctx, "missing")))
+
+	type Args struct {
+		Name string `properties:"name"`
+	}
+	type Filter struct {
+		Name string `properties:"name"`
+		Args Args   `properties:"args"`
+	}
+	type Gateway struct {
+		Filters []Filter `properties:"filters"`
+	}
+	var g Gateway
+	assert.NoError(t, center.Unmarshal(ctx, &g))
+	assert.Equal(t, Gateway{[]Filter{{"AddRequestHeader", Args{"foo"}}}}, g)
+
+	recorder := newEventRecorder()
+	center.RegisterObserver(ctx, recorder)
+	center.StartWatchUpdate(ctx)
+
+	writeConfigFile(t, filepath.Join(dir, "infra.cache.json"), `{"base": {"default": {"redis": {"addr": "127.0.0.1:6380"}}}}`, now.Add(time.Second))
+	assert.NoError(t, center.checkNamespace(ctx, "infra.cache"))
+	assert.Equal(t, &ChangeEvent{Source: File, Namespace: "infra.cache", Changes: map[string]*Change{
+		"base.default.redis.addr":     {OldValue: "127.0.0.1:6379", NewValue: "127.0.0.1:6380", ChangeType: MODIFY},
+		"base.default.redis.poolsize": {OldValue: "10", ChangeType: DELETE},
+	}}, recorder.next(t))
+
+	// 内容不变时不通知
+	writeConfigFile(t, filepath.Join(dir, "infra.cache.json"), `{"base": {"default": {"redis": {"addr": "127.0.0.1:6380"}}}}`, now.Add(2*time.Second))
+	assert.NoError(t, center.checkNamespace(ctx, "infra.cache"))
+	recorder.assertEmpty(t)
+
+	// 解析失败时保留原配置
+	writeConfigFile(t, filepath.Join(dir, "db.properties"), "url\n", now.Add(time.Second))
+	assert.Error(t, center.checkNamespace(ctx, "db"))
+	str, _ = center.GetStringWithNamespace(ctx, "db", "url")
+	assert.Equal(t, "mysql://root@tcp/db?a=b", str)
+
+	// 文件新建与删除
+	writeConfigFile(t, filepath.Join(dir, "missing.yml"), "name: a\n", now)
+	assert.NoError(t, center.checkNamespace(ctx, "missing"))
+	assert.Equal(t, &ChangeEvent{Source: File, Namespace: "missing", Changes: map[string]*Change{
+		"name": {NewValue: "a", ChangeType: ADD},
+	}}, recorder.next(t))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "missing.yml")))
+	assert.NoError(t, center.checkNamespace(ctx, "missing"))
+	assert.Equal(t, &ChangeEvent{Source: File, Namespace: "missing", Changes: map[string]*Change{
+		"name": {OldValue: "a", ChangeType: DELETE},
+	}}, recorder.next(t))
+}
+
+func TestFileConfigCenterCheckLoop(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "sconfcenter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	center := newFileConfigCenter(dir, 10*time.Millisecond)
+	defer center.Stop(ctx)
+	assert.NoError(t, center.Init(ctx, testService, nil))
+
+	recorder := newEventRecorder()
+	center.RegisterObserver(ctx, recorder)
+	center.StartWatchUpdate(ctx)
+
+	writeConfigFile(t, filepath.Join(dir, "application.properties"), "pool_size = 16\n", time.Now())
+	assert.Equal(t, &ChangeEvent{Source: File, Namespace: "application", Changes: map[string]*Change{
+		"pool_size": {NewValue: "16", ChangeType: ADD},
+	}}, recorder.next(t))
+}
+
+func TestFileConfigCenterReady(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "sconfcenter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "application.json")
+	writeConfigFile(t, path, `{"pool_size": `, time.Now().Add(-time.Minute))
+
+	center := newFileConfigCenter(dir, 10*time.Millisecond)
+	defer center.Stop(ctx)
+	assert.Error(t, center.Init(ctx, testService, nil))
+
+	// 解析失败的 namespace 没有加载, Ready 等待
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	err = center.Ready(timeoutCtx)
+	cancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "[application]")
+
+	writeConfigFile(t, path, `{"pool_size": 16}`, time.Now())
+	timeoutCtx, cancel = context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	assert.NoError(t, center.Ready(timeoutCtx))
+	val, _ := center.GetInt(ctx, "pool_size")
+	assert.Equal(t, 16, val)
+}
+
+func TestFileConfigCenterReadyMissing(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "sconfcenter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	center := newFileConfigCenter(dir, 10*time.Millisecond)
+	defer center.Stop(ctx)
+	assert.NoError(t, center.Init(ctx, testService, nil))
+
+	// 配置文件不存在的 namespace 没有加载, Ready 等待
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	err = center.Ready(timeoutCtx)
+	cancel()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "[application]")
+
+	writeConfigFile(t, filepath.Join(dir, "application.json"), `{"pool_size": 16}`, time.Now())
+	timeoutCtx, cancel = context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	assert.NoError(t, center.Ready(timeoutCtx))
+	val, _ := center.GetInt(ctx, "pool_size")
+	assert.Equal(t, 16, val)
+}
@@ -3,18 +3,31 @@ package center
 import (
 	"context"
 	"fmt"
+	"github.com/shawnfeng/sutil/sconf/bind"
 )
 
 type ConfigCenterType int
 
 const (
 	ApolloConfigCenter ConfigCenterType = iota
+	// FileConfigCenter 读取环境变量 SCONF_FILE_DIR 目录下的配置文件, 见 NewFileConfigCenter
+	FileConfigCenter
+	// EtcdConfigCenter 读取环境变量 SCONF_ETCD_ENDPOINTS 中 etcd v3 的配置, 见 NewEtcdConfigCenter
+	EtcdConfigCenter
+	// MemoryConfigCenter 创建 *MemoryCenter, 用于测试
+	MemoryConfigCenter
 )
 
 func (c ConfigCenterType) String() string {
 	switch c {
 	case ApolloConfigCenter:
 		return "apollo"
+	case FileConfigCenter:
+		return "file"
+	case EtcdConfigCenter:
+		return "etcd"
+	case MemoryConfigCenter:
+		return "memory"
 	default:
 		return "unknown"
 	}
@@ -25,6 +38,12 @@ func NewConfigCenter(t ConfigCenterType) (ConfigCenter, error) {
 	switch t {
 	case ApolloConfigCenter:
 		return newApolloConfigCenter(), nil
+	case FileConfigCenter:
+		return NewFileConfigCenter(getEnvWithDefault(envFileConfigDir, defaultFileConfigDir)), nil
+	case EtcdConfigCenter:
+		return NewEtcdConfigCenter(etcdEndpointsFromEnv(), getEnvWithDefault(envEtcdPrefix, defaultEtcdPrefix)), nil
+	case MemoryConfigCenter:
+		return NewMemoryCenter(), nil
 	default:
 		return nil, fmt.Errorf("%s unsupported config center type:%v", fun, t)
 	}
@@ -60,6 +79,20 @@ type ConfigCenter interface {
 	RegisterObserver(ctx context.Context, observer ConfigObserver) (recall func())
 }
 
+// Binder 由可以按 struct tag 绑定配置的 ConfigCenter 实现, 见 Bind
+type Binder interface {
+	// Bind 按 struct tag 绑定配置, 支持默认值、校验与 time.Duration/slice/map, 见 sconf/bind
+	Bind(ctx context.Context, v interface{}) error
+	BindWithNamespace(ctx context.Context, namespace string, v interface{}) error
+}
+
+// Readier 由可以等待配置就绪的 ConfigCenter 实现, 见 Ready
+type Readier interface {
+	// Ready 等待订阅的 namespace 都从配置中心加载成功, ctx 结束时返回错误;
+	// 调用方可以据此选择阻塞到配置就绪, 或在超时后以本地快照(apollo)降级运行
+	Ready(ctx context.Context) error
+}
+
 func Init(ctx context.Context, serviceName string, namespaceNames []string) error {
 	defaultConfigCenter = newApolloConfigCenter()
 	return defaultConfigCenter.Init(ctx, serviceName, namespaceNames)
@@ -73,6 +106,14 @@ func SubscribeNamespaces(ctx context.Context, namespaceNames []string) error {
 	return defaultConfigCenter.SubscribeNamespaces(ctx, namespaceNames)
 }
 
+// Ready 等待默认配置中心就绪, 未实现 Readier 的配置中心视为已就绪
+func Ready(ctx context.Context) error {
+	if r, ok := defaultConfigCenter.(Readier); ok {
+		return r.Ready(ctx)
+	}
+	return nil
+}
+
 func GetString(ctx context.Context, key string) (string, bool) {
 	return defaultConfigCenter.GetString(ctx, key)
 }
@@ -119,4 +160,23 @@ func UnmarshalKey(ctx context.Context, key string, v interface{}) error {
 
 func UnmarshalKeyWithNamespace(ctx context.Context, namespace, key string, v interface{}) error {
 	return defaultConfigCenter.UnmarshalKeyWithNamespace(ctx, namespace, key, v)
-}
\ No newline at end of file
+}
+
+func Bind(ctx context.Context, v interface{}) error {
+	return BindWithNamespace(ctx, defaultNamespaceApplication, v)
+}
+
+// BindWithNamespace 绑定默认配置中心 namespace 下的配置, 未实现 Binder 的配置中心按 GetAllKeysWithNamespace 读取所有配置后绑定
+func BindWithNamespace(ctx context.Context, namespace string, v interface{}) error {
+	if b, ok := defaultConfigCenter.(Binder); ok {
+		return b.BindWithNamespace(ctx, namespace, v)
+	}
+
+	kv := make(map[string]string)
+	for _, k := range defaultConfigCenter.GetAllKeysWithNamespace(ctx, namespace) {
+		if val, ok := defaultConfigCenter.GetStringWithNamespace(ctx, namespace, k); ok {
+			kv[k] = val
+		}
+	}
+	return bind.KV(kv, v)
+}
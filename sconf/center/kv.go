@@ -0,0 +1,352 @@
+package center
+
+import (
+	"context"
+	"fmt"
+	"github.com/ZhengHe-MD/properties"
+	"github.com/shawnfeng/sutil/sconf/bind"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// kvConfigCenter 为按 namespace 保存 key/value 的 ConfigCenter 的公共部分, 本地文件、内存与 etcd 的实现
+// 通过 update 替换 namespace 的配置, 对比新旧配置生成与 apollo 相同的 ChangeEvent;
+// 与 agollo 一致, StartWatchUpdate 之前的变更不会通知 observer
+type kvConfigCenter struct {
+	source ChangeEventSource
+
+	// updateMu 串行化配置的替换与变更的投递, 使 observer 按发生的顺序收到变更
+	updateMu sync.Mutex
+	mu       sync.RWMutex
+	data     map[string]map[string]string
+	// pending 为已订阅但还未加载成功的 namespace, loaded 在有 namespace 加载成功时被关闭并替换
+	pending map[string]bool
+	loaded  chan struct{}
+
+	observerMu     sync.RWMutex
+	observers      map[int]ConfigObserver
+	nextObserverID int
+
+	watchUpdateOnce sync.Once
+	watching        bool
+	// queue 为等待分发的变更, 不限长度, 投递时不会阻塞; queued 通知分发的 goroutine
+	queueMu sync.Mutex
+	queue   []*ChangeEvent
+	queued  chan struct{}
+
+	stopOnce sync.Once
+	stopChan chan struct{}
+}
+
+func newKVConfigCenter(source ChangeEventSource) *kvConfigCenter {
+	return &kvConfigCenter{
+		source:    source,
+		data:      make(map[string]map[string]string),
+		pending:   make(map[string]bool),
+		loaded:    make(chan struct{}),
+		observers: make(map[int]ConfigObserver),
+		queued:    make(chan struct{}, 1),
+		stopChan:  make(chan struct{}),
+	}
+}
+
+// snapshot 返回 namespace 当前配置的拷贝
+func (m *kvConfigCenter) snapshot(namespace string) map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	kv := make(map[string]string, len(m.data[namespace]))
+	for k, v := range m.data[namespace] {
+		kv[k] = v
+	}
+	return kv
+}
+
+// update 将 namespace 的配置替换为 kv, 有变更时通知 observer
+func (m *kvConfigCenter) update(namespace string, kv map[string]string) {
+	m.apply(namespace, func(map[string]string) map[string]string {
+		return kv
+	})
+}
+
+// apply 以 fn 修改 namespace 当前配置的拷贝并替换, 有变更时通知 observer
+func (m *kvConfigCenter) apply(namespace string, fn func(kv map[string]string) map[string]string) {
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+
+	kv := fn(m.snapshot(namespace))
+
+	m.mu.Lock()
+	changes := diffChanges(m.data[namespace], kv)
+
+	data := make(map[string]string, len(kv))
+	for k, v := range kv {
+		data[k] = v
+	}
+	m.data[namespace] = data
+	if m.pending[namespace] {
+		delete(m.pending, namespace)
+		close(m.loaded)
+		m.loaded = make(chan struct{})
+	}
+	m.mu.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+	// NOTE: 在 updateMu 中加入队列以保证变更的顺序, 加入队列不会阻塞,
+	// observer 在 HandleChangeEvent 中修改配置(如 MemoryCenter.Set)时不会死锁
+	m.deliveryChangeEvent(&ChangeEvent{
+		Source:    m.source,
+		Namespace: namespace,
+		Changes:   changes,
+	})
+}
+
+// expect 记录订阅的 namespace, 第一次加载成功之前 Ready 会等待
+func (m *kvConfigCenter) expect(namespaces []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, namespace := range namespaces {
+		if _, ok := m.data[namespace]; !ok {
+			m.pending[namespace] = true
+		}
+	}
+}
+
+func (m *kvConfigCenter) hasNamespace(namespace string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.data[namespace]
+	return ok
+}
+
+// Ready 等待订阅的 namespace 都加载成功, ctx 结束时返回还未加载的 namespace
+func (m *kvConfigCenter) Ready(ctx context.Context) error {
+	for {
+		m.mu.RLock()
+		pending := make([]string, 0, len(m.pending))
+		for namespace := range m.pending {
+			pending = append(pending, namespace)
+		}
+		loaded := m.loaded
+		m.mu.RUnlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+		sort.Strings(pending)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("namespaces %v not loaded: %s", pending, ctx.Err().Error())
+		case <-loaded:
+		}
+	}
+}
+
+func (m *kvConfigCenter) deliveryChangeEvent(event *ChangeEvent) {
+	m.observerMu.RLock()
+	watching := m.watching
+	m.observerMu.RUnlock()
+	if !watching {
+		return
+	}
+
+	m.queueMu.Lock()
+	m.queue = append(m.queue, event)
+	m.queueMu.Unlock()
+
+	select {
+	case m.queued <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue 取出所有等待分发的变更
+func (m *kvConfigCenter) dequeue() []*ChangeEvent {
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+
+	events := m.queue
+	m.queue = nil
+	return events
+}
+
+// StartWatchUpdate 只启动一次, 启动后按顺序将变更分发给 observer
+func (m *kvConfigCenter) StartWatchUpdate(ctx context.Context) {
+	m.watchUpdateOnce.Do(func() {
+		m.observerMu.Lock()
+		m.watching = true
+		m.observerMu.Unlock()
+
+		go func() {
+			for {
+				select {
+				case <-m.stopChan:
+					return
+				case <-m.queued:
+					for _, event := range m.dequeue() {
+						m.dispatch(event)
+					}
+				}
+			}
+		}()
+	})
+}
+
+// dispatch 按注册的顺序将 event 分发给 observer
+func (m *kvConfigCenter) dispatch(event *ChangeEvent) {
+	m.observerMu.RLock()
+	ids := make([]int, 0, len(m.observers))
+	for id := range m.observers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	observers := make([]ConfigObserver, 0, len(ids))
+	for _, id := range ids {
+		observers = append(observers, m.observers[id])
+	}
+	m.observerMu.RUnlock()
+
+	for _, ob := range observers {
+		// NOTE: 与 agollo 一致, 每个 observer 收到各自的拷贝, observer 可以修改收到的 event
+		ob.HandleChangeEvent(copyChangeEvent(event))
+	}
+}
+
+func copyChangeEvent(event *ChangeEvent) *ChangeEvent {
+	changes := make(map[string]*Change, len(event.Changes))
+	for k, c := range event.Changes {
+		cc := *c
+		changes[k] = &cc
+	}
+	return &ChangeEvent{
+		Source:    event.Source,
+		Namespace: event.Namespace,
+		Changes:   changes,
+	}
+}
+
+func (m *kvConfigCenter) RegisterObserver(ctx context.Context, observer ConfigObserver) func() {
+	m.observerMu.Lock()
+	defer m.observerMu.Unlock()
+
+	id := m.nextObserverID
+	m.nextObserverID++
+	m.observers[id] = observer
+
+	return func() {
+		m.observerMu.Lock()
+		defer m.observerMu.Unlock()
+		delete(m.observers, id)
+	}
+}
+
+// stop 停止分发变更
+func (m *kvConfigCenter) stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
+}
+
+func (m *kvConfigCenter) GetString(ctx context.Context, key string) (string, bool) {
+	return m.GetStringWithNamespace(ctx, defaultNamespaceApplication, key)
+}
+
+func (m *kvConfigCenter) GetStringWithNamespace(ctx context.Context, namespace, key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	val, ok := m.data[namespace][key]
+	return val, ok
+}
+
+func (m *kvConfigCenter) GetBool(ctx context.Context, key string) (bool, bool) {
+	return m.GetBoolWithNamespace(ctx, defaultNamespaceApplication, key)
+}
+
+func (m *kvConfigCenter) GetBoolWithNamespace(ctx context.Context, namespace, key string) (bool, bool) {
+	fun := "kvConfigCenter.GetBoolWithNamespace -->"
+
+	val, ok := m.GetStringWithNamespace(ctx, namespace, key)
+	if !ok {
+		return false, false
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		slog.Warnf(ctx, "%s namespace:%s key:%s parse bool err:%s", fun, namespace, key, err.Error())
+		return false, false
+	}
+	return b, true
+}
+
+func (m *kvConfigCenter) GetInt(ctx context.Context, key string) (int, bool) {
+	return m.GetIntWithNamespace(ctx, defaultNamespaceApplication, key)
+}
+
+func (m *kvConfigCenter) GetIntWithNamespace(ctx context.Context, namespace, key string) (int, bool) {
+	fun := "kvConfigCenter.GetIntWithNamespace -->"
+
+	val, ok := m.GetStringWithNamespace(ctx, namespace, key)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		slog.Warnf(ctx, "%s namespace:%s key:%s parse int err:%s", fun, namespace, key, err.Error())
+		return 0, false
+	}
+	return i, true
+}
+
+func (m *kvConfigCenter) GetAllKeys(ctx context.Context) []string {
+	return m.GetAllKeysWithNamespace(ctx, defaultNamespaceApplication)
+}
+
+func (m *kvConfigCenter) GetAllKeysWithNamespace(ctx context.Context, namespace string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.data[namespace]))
+	for k := range m.data[namespace] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *kvConfigCenter) Unmarshal(ctx context.Context, v interface{}) error {
+	return m.UnmarshalWithNamespace(ctx, defaultNamespaceApplication, v)
+}
+
+func (m *kvConfigCenter) UnmarshalWithNamespace(ctx context.Context, namespace string, v interface{}) error {
+	return properties.UnmarshalKV(m.snapshot(namespace), v)
+}
+
+func (m *kvConfigCenter) UnmarshalKey(ctx context.Context, key string, v interface{}) error {
+	return m.UnmarshalKeyWithNamespace(ctx, defaultNamespaceApplication, key, v)
+}
+
+func (m *kvConfigCenter) UnmarshalKeyWithNamespace(ctx context.Context, namespace string, key string, v interface{}) error {
+	kv := m.snapshot(namespace)
+
+	bs, err := properties.Marshal(&kv)
+	if err != nil {
+		return err
+	}
+
+	return properties.UnmarshalKey(key, bs, v)
+}
+
+func (m *kvConfigCenter) Bind(ctx context.Context, v interface{}) error {
+	return m.BindWithNamespace(ctx, defaultNamespaceApplication, v)
+}
+
+func (m *kvConfigCenter) BindWithNamespace(ctx context.Context, namespace string, v interface{}) error {
+	return bind.KV(m.snapshot(namespace), v)
+}
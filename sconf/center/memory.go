@@ -0,0 +1,52 @@
+package center
+
+import (
+	"context"
+)
+
+// MemoryCenter 为保存在内存中的 ConfigCenter, 用于测试, 配置通过 Set/Delete/SetAll 修改,
+// 修改后与 apollo 相同地通知 observer
+type MemoryCenter struct {
+	*kvConfigCenter
+}
+
+func NewMemoryCenter() *MemoryCenter {
+	return &MemoryCenter{
+		kvConfigCenter: newKVConfigCenter(Memory),
+	}
+}
+
+// Init 不会清除已经 Set 的配置, 测试可以在 Init 之前准备好配置
+func (m *MemoryCenter) Init(ctx context.Context, serviceName string, namespaceNames []string) error {
+	return nil
+}
+
+func (m *MemoryCenter) Stop(ctx context.Context) error {
+	m.stop()
+	return nil
+}
+
+func (m *MemoryCenter) SubscribeNamespaces(ctx context.Context, namespaceNames []string) error {
+	return nil
+}
+
+// Set 设置 namespace 下 key 的配置值
+func (m *MemoryCenter) Set(ctx context.Context, namespace, key, value string) {
+	m.apply(namespace, func(kv map[string]string) map[string]string {
+		kv[key] = value
+		return kv
+	})
+}
+
+// Delete 删除 namespace 下 key 的配置
+func (m *MemoryCenter) Delete(ctx context.Context, namespace, key string) {
+	m.apply(namespace, func(kv map[string]string) map[string]string {
+		delete(kv, key)
+		return kv
+	})
+}
+
+// SetAll 将 namespace 的配置整体替换为 kv, 所有变更在同一个 ChangeEvent 中通知
+func (m *MemoryCenter) SetAll(ctx context.Context, namespace string, kv map[string]string) {
+	m.update(namespace, kv)
+}
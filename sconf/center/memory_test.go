@@ -0,0 +1,170 @@
+package center
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// eventRecorder 记录收到的 ChangeEvent
+type eventRecorder struct {
+	ch chan *ChangeEvent
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{ch: make(chan *ChangeEvent, 16)}
+}
+
+func (m *eventRecorder) HandleChangeEvent(event *ChangeEvent) {
+	m.ch <- event
+}
+
+func (m *eventRecorder) next(t *testing.T) *ChangeEvent {
+	select {
+	case event := <-m.ch:
+		return event
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait change event timeout")
+		return nil
+	}
+}
+
+func (m *eventRecorder) assertEmpty(t *testing.T) {
+	select {
+	case event := <-m.ch:
+		t.Fatalf("unexpected change event: %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryCenter(t *testing.T) {
+	ctx := context.Background()
+
+	cc, err := NewConfigCenter(MemoryConfigCenter)
+	assert.NoError(t, err)
+	center := cc.(*MemoryCenter)
+	defer center.Stop(ctx)
+
+	// StartWatchUpdate 之前的变更不通知
+	center.Set(ctx, "application", "pool_size", "16")
+	assert.NoError(t, center.Init(ctx, testService, nil))
+
+	recorder := newEventRecorder()
+	recall := center.RegisterObserver(ctx, recorder)
+	center.StartWatchUpdate(ctx)
+	recorder.assertEmpty(t)
+
+	val, ok := center.GetInt(ctx, "pool_size")
+	assert.True(t, ok)
+	assert.Equal(t, 16, val)
+
+	center.Set(ctx, "application", "pool_size", "32")
+	center.Set(ctx, "application", "pool_size", "32")
+	center.Set(ctx, "application", "debug", "true")
+	center.Delete(ctx, "application", "pool_size")
+	center.SetAll(ctx, "redis", map[string]string{"addr": "127.0.0.1:6379", "timeout": "3"})
+
+	assert.Equal(t, &ChangeEvent{Source: Memory, Namespace: "application", Changes: map[string]*Change{
+		"pool_size": {OldValue: "16", NewValue: "32", ChangeType: MODIFY},
+	}}, recorder.next(t))
+	assert.Equal(t, &ChangeEvent{Source: Memory, Namespace: "application", Changes: map[string]*Change{
+		"debug": {NewValue: "true", ChangeType: ADD},
+	}}, recorder.next(t))
+	assert.Equal(t, &ChangeEvent{Source: Memory, Namespace: "application", Changes: map[string]*Change{
+		"pool_size": {OldValue: "32", ChangeType: DELETE},
+	}}, recorder.next(t))
+	assert.Equal(t, &ChangeEvent{Source: Memory, Namespace: "redis", Changes: map[string]*Change{
+		"addr":    {NewValue: "127.0.0.1:6379", ChangeType: ADD},
+		"timeout": {NewValue: "3", ChangeType: ADD},
+	}}, recorder.next(t))
+	recorder.assertEmpty(t)
+
+	assert.Equal(t, []string{"addr", "timeout"}, center.GetAllKeysWithNamespace(ctx, "redis"))
+	b, ok := center.GetBool(ctx, "debug")
+	assert.True(t, ok)
+	assert.True(t, b)
+
+	type redisConfig struct {
+		Addr    string        `conf:"addr"`
+		Timeout time.Duration `conf:"timeout" default:"1s"`
+	}
+	var rc redisConfig
+	assert.Error(t, center.BindWithNamespace(ctx, "redis", &rc))
+	center.Set(ctx, "redis", "timeout", "3s")
+	assert.NoError(t, center.BindWithNamespace(ctx, "redis", &rc))
+	assert.Equal(t, redisConfig{"127.0.0.1:6379", 3 * time.Second}, rc)
+	recorder.next(t)
+
+	recall()
+	center.Set(ctx, "application", "debug", "false")
+	recorder.assertEmpty(t)
+}
+
+func TestMemoryCenterWatcher(t *testing.T) {
+	ctx := context.Background()
+
+	center := NewMemoryCenter()
+	defer center.Stop(ctx)
+	center.Set(ctx, "application", "pool_size", "16")
+
+	w := NewWatcher(center)
+	poolSize := w.IntWithNamespace(ctx, "application", "pool_size", 8)
+	assert.Equal(t, 16, poolSize.Get())
+
+	changed := make(chan int, 1)
+	poolSize.OnChange(func(old, new int) {
+		changed <- new
+	})
+	center.Set(ctx, "application", "pool_size", "32")
+	select {
+	case v := <-changed:
+		assert.Equal(t, 32, v)
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait change timeout")
+	}
+	assert.Equal(t, 32, poolSize.Get())
+}
+
+// setObserver 在 HandleChangeEvent 中修改配置
+type setObserver struct {
+	center *MemoryCenter
+	done   chan struct{}
+}
+
+func (m *setObserver) HandleChangeEvent(event *ChangeEvent) {
+	if event.Namespace != "application" {
+		return
+	}
+	for key, change := range event.Changes {
+		m.center.Set(context.Background(), "mirror", key, change.NewValue)
+		if key == "last" {
+			close(m.done)
+		}
+	}
+}
+
+func TestMemoryCenterObserverSet(t *testing.T) {
+	ctx := context.Background()
+
+	center := NewMemoryCenter()
+	defer center.Stop(ctx)
+	observer := &setObserver{center: center, done: make(chan struct{})}
+	center.RegisterObserver(ctx, observer)
+	center.StartWatchUpdate(ctx)
+
+	// 变更的数量超过 defaultChangeEventSize 时, observer 中的 Set 不会阻塞
+	for i := 0; i < 2*defaultChangeEventSize; i++ {
+		center.Set(ctx, "application", fmt.Sprintf("k%d", i), "v")
+	}
+	center.Set(ctx, "application", "last", "v")
+
+	select {
+	case <-observer.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("observer set deadlock")
+	}
+	assert.Equal(t, 2*defaultChangeEventSize+1, len(center.GetAllKeysWithNamespace(ctx, "mirror")))
+}
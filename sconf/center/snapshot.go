@@ -0,0 +1,104 @@
+package center
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/shawnfeng/sutil/smetric"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// envApolloBackupDir 为保存快照的目录, 默认的目录不在 /tmp 下, 避免容器重启时被清空
+	envApolloBackupDir   = "APOLLO_BACKUP_DIR"
+	defaultBackupDir     = "/var/lib/sconfcenter/backup"
+	defaultStateInterval = 10 * time.Second
+	defaultReadyInterval = 200 * time.Millisecond
+
+	metricNamespaceSynced    = "sconf_center_namespace_synced"
+	metricSnapshotAgeSeconds = "sconf_center_snapshot_age_seconds"
+	metricLabelService       = "service"
+	metricLabelNamespace     = "namespace"
+)
+
+// namespaceSnapshot 为持久化到本地的 namespace 配置, apollo 不可用时从中加载
+type namespaceSnapshot struct {
+	Namespace      string            `json:"namespace"`
+	ReleaseKey     string            `json:"releaseKey"`
+	UpdateTime     int64             `json:"updateTime"`
+	Configurations map[string]string `json:"configurations"`
+}
+
+// snapshotStore 将每个 namespace 的配置分别保存在 dir/<namespace>.json,
+// 某个 namespace 同步失败不影响其他 namespace 已保存的快照
+type snapshotStore struct {
+	dir string
+}
+
+func newSnapshotStore(dir string) *snapshotStore {
+	return &snapshotStore{dir: dir}
+}
+
+func (s *snapshotStore) path(namespace string) string {
+	return filepath.Join(s.dir, namespace+".json")
+}
+
+// save 先写临时文件再 rename, 进程在写入过程中退出时不会留下不完整的快照
+func (s *snapshotStore) save(snapshot *namespaceSnapshot) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.dir, "."+snapshot.Namespace+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(snapshot.Namespace))
+}
+
+func (s *snapshotStore) load(namespace string) (*namespaceSnapshot, error) {
+	data, err := ioutil.ReadFile(s.path(namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot namespaceSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("decode snapshot %s err:%s", s.path(namespace), err.Error())
+	}
+	if snapshot.Configurations == nil {
+		snapshot.Configurations = make(map[string]string)
+	}
+	return &snapshot, nil
+}
+
+// reportNamespaceState 上报 namespace 是否已从配置中心同步, 未同步时上报使用中快照的时长
+func reportNamespaceState(service, namespace string, synced bool, snapshotAge time.Duration) {
+	labels := []smetric.Label{
+		{Name: metricLabelService, Value: smetric.SafePromethuesValue(service)},
+		{Name: metricLabelNamespace, Value: smetric.SafePromethuesValue(namespace)},
+	}
+
+	var val float64
+	if synced {
+		val = 1
+	}
+	smetric.DefaultMetrics.SetGaugeCreateIfAbsent([]string{smetric.Name_space_palfish, metricNamespaceSynced}, val, labels)
+	smetric.DefaultMetrics.SetGaugeCreateIfAbsent([]string{smetric.Name_space_palfish, metricSnapshotAgeSeconds}, snapshotAge.Seconds(), labels)
+}
@@ -0,0 +1,395 @@
+package center
+
+import (
+	"context"
+	"fmt"
+	"github.com/shawnfeng/sutil/sconf/bind"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Watcher 维护随 ConfigCenter 变更自动更新的配置值, 配置变更时重新解析与校验,
+// 通过后原子地替换当前值并按注册顺序调用 OnChange 回调, 解析或校验失败时保留原值.
+// NOTE: 创建的配置值会一直被 Watcher 持有以接收变更, 应在初始化时创建一次并复用, 不要在每次请求中创建;
+// 不再使用的配置值需调用 Close
+type Watcher struct {
+	center ConfigCenter
+
+	registerOnce sync.Once
+	mu           sync.RWMutex
+	// namespace -> 该 namespace 下的配置值
+	values map[string][]*liveValue
+}
+
+func NewWatcher(center ConfigCenter) *Watcher {
+	return &Watcher{
+		center: center,
+		values: make(map[string][]*liveValue),
+	}
+}
+
+var (
+	defaultWatcherMu sync.Mutex
+	defaultWatcher   *Watcher
+)
+
+// getDefaultWatcher 返回 Init 创建的 ConfigCenter 上的 Watcher, 重新 Init 后创建新的 Watcher
+func getDefaultWatcher() *Watcher {
+	defaultWatcherMu.Lock()
+	defer defaultWatcherMu.Unlock()
+
+	if defaultWatcher == nil || defaultWatcher.center != defaultConfigCenter {
+		defaultWatcher = NewWatcher(defaultConfigCenter)
+	}
+	return defaultWatcher
+}
+
+type snapshot struct {
+	value interface{}
+}
+
+// liveValue 为一个配置值, key 为空时表示绑定整个 namespace 的结构体
+type liveValue struct {
+	namespace string
+	key       string
+	// load 从 ConfigCenter 读取并解析当前值
+	load func(ctx context.Context) (interface{}, error)
+
+	current atomic.Value
+
+	// watcher 为注册该配置值的 Watcher, Close 时从中移除
+	watcher *Watcher
+
+	mu        sync.Mutex
+	callbacks []func(old, new interface{})
+}
+
+func (m *liveValue) get() interface{} {
+	return m.current.Load().(snapshot).value
+}
+
+func (m *liveValue) onChange(fn func(old, new interface{})) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.callbacks = append(m.callbacks, fn)
+}
+
+func (m *liveValue) close() {
+	if m.watcher != nil {
+		m.watcher.unregister(m)
+	}
+}
+
+func (m *liveValue) reload(ctx context.Context) {
+	fun := "liveValue.reload -->"
+
+	// NOTE: 持有 mu 使并发的变更按顺序读取与替换, 回调在释放 mu 后调用, 回调中可以再调用 OnChange
+	m.mu.Lock()
+	value, err := m.load(ctx)
+	if err != nil {
+		m.mu.Unlock()
+		slog.Warnf(ctx, "%s namespace:%s key:%s keep old value, err:%s", fun, m.namespace, m.key, err.Error())
+		return
+	}
+
+	old := m.get()
+	if reflect.DeepEqual(old, value) {
+		m.mu.Unlock()
+		return
+	}
+	m.current.Store(snapshot{value})
+	callbacks := make([]func(old, new interface{}), len(m.callbacks))
+	copy(callbacks, m.callbacks)
+	m.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(old, value)
+	}
+}
+
+// register 开始跟踪 value 的变更, value 需已设置初始值
+func (m *Watcher) register(ctx context.Context, value *liveValue) {
+	m.registerOnce.Do(func() {
+		m.center.RegisterObserver(ctx, m)
+		m.center.StartWatchUpdate(ctx)
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value.watcher = m
+	m.values[value.namespace] = append(m.values[value.namespace], value)
+}
+
+// unregister 停止跟踪 value 的变更
+func (m *Watcher) unregister(value *liveValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := m.values[value.namespace]
+	for i, v := range values {
+		if v == value {
+			// NOTE: HandleChangeEvent 可能正在遍历旧的 slice, 不能原地修改
+			values = append(values[:i:i], values[i+1:]...)
+			break
+		}
+	}
+	if len(values) == 0 {
+		delete(m.values, value.namespace)
+	} else {
+		m.values[value.namespace] = values
+	}
+}
+
+// HandleChangeEvent 实现 ConfigObserver, 更新 event.Namespace 下发生变更的配置值
+func (m *Watcher) HandleChangeEvent(event *ChangeEvent) {
+	ctx := context.Background()
+
+	m.mu.RLock()
+	values := m.values[event.Namespace]
+	m.mu.RUnlock()
+
+	for _, value := range values {
+		if value.key != "" {
+			if _, ok := event.Changes[value.key]; !ok {
+				continue
+			}
+		}
+		value.reload(ctx)
+	}
+}
+
+// scalar 返回 namespace 下 key 的配置值, 配置不存在时为 deft, 解析失败时保留原值
+func (m *Watcher) scalar(ctx context.Context, namespace, key string, deft interface{}, parse func(string) (interface{}, error)) *liveValue {
+	fun := "Watcher.scalar -->"
+
+	value := &liveValue{
+		namespace: namespace,
+		key:       key,
+		load: func(ctx context.Context) (interface{}, error) {
+			raw, ok := m.center.GetStringWithNamespace(ctx, namespace, key)
+			if !ok {
+				return deft, nil
+			}
+			return parse(raw)
+		},
+	}
+
+	initial, err := value.load(ctx)
+	if err != nil {
+		// NOTE: 初始值解析失败时使用默认值, 后续变更解析成功后更新
+		slog.Errorf(ctx, "%s namespace:%s key:%s use default:%v, err:%s", fun, namespace, key, deft, err.Error())
+		initial = deft
+	}
+	value.current.Store(snapshot{initial})
+
+	m.register(ctx, value)
+	return value
+}
+
+type IntValue struct {
+	value *liveValue
+}
+
+func (m *IntValue) Get() int {
+	return m.value.get().(int)
+}
+
+func (m *IntValue) OnChange(fn func(old, new int)) {
+	m.value.onChange(func(old, new interface{}) {
+		fn(old.(int), new.(int))
+	})
+}
+
+// Close 停止跟踪配置变更, 之后 Get 返回最后的值, 不再调用回调
+func (m *IntValue) Close() {
+	m.value.close()
+}
+
+func (m *Watcher) IntWithNamespace(ctx context.Context, namespace, key string, deft int) *IntValue {
+	return &IntValue{m.scalar(ctx, namespace, key, deft, func(raw string) (interface{}, error) {
+		return strconv.Atoi(strings.TrimSpace(raw))
+	})}
+}
+
+type StringValue struct {
+	value *liveValue
+}
+
+func (m *StringValue) Get() string {
+	return m.value.get().(string)
+}
+
+func (m *StringValue) OnChange(fn func(old, new string)) {
+	m.value.onChange(func(old, new interface{}) {
+		fn(old.(string), new.(string))
+	})
+}
+
+// Close 停止跟踪配置变更, 之后 Get 返回最后的值, 不再调用回调
+func (m *StringValue) Close() {
+	m.value.close()
+}
+
+func (m *Watcher) StringWithNamespace(ctx context.Context, namespace, key string, deft string) *StringValue {
+	return &StringValue{m.scalar(ctx, namespace, key, deft, func(raw string) (interface{}, error) {
+		return raw, nil
+	})}
+}
+
+type BoolValue struct {
+	value *liveValue
+}
+
+func (m *BoolValue) Get() bool {
+	return m.value.get().(bool)
+}
+
+func (m *BoolValue) OnChange(fn func(old, new bool)) {
+	m.value.onChange(func(old, new interface{}) {
+		fn(old.(bool), new.(bool))
+	})
+}
+
+// Close 停止跟踪配置变更, 之后 Get 返回最后的值, 不再调用回调
+func (m *BoolValue) Close() {
+	m.value.close()
+}
+
+func (m *Watcher) BoolWithNamespace(ctx context.Context, namespace, key string, deft bool) *BoolValue {
+	return &BoolValue{m.scalar(ctx, namespace, key, deft, func(raw string) (interface{}, error) {
+		return strconv.ParseBool(strings.TrimSpace(raw))
+	})}
+}
+
+type DurationValue struct {
+	value *liveValue
+}
+
+func (m *DurationValue) Get() time.Duration {
+	return m.value.get().(time.Duration)
+}
+
+func (m *DurationValue) OnChange(fn func(old, new time.Duration)) {
+	m.value.onChange(func(old, new interface{}) {
+		fn(old.(time.Duration), new.(time.Duration))
+	})
+}
+
+// Close 停止跟踪配置变更, 之后 Get 返回最后的值, 不再调用回调
+func (m *DurationValue) Close() {
+	m.value.close()
+}
+
+// DurationWithNamespace 的配置值为 time.ParseDuration 的格式, 如 500ms, 3s
+func (m *Watcher) DurationWithNamespace(ctx context.Context, namespace, key string, deft time.Duration) *DurationValue {
+	return &DurationValue{m.scalar(ctx, namespace, key, deft, func(raw string) (interface{}, error) {
+		return time.ParseDuration(strings.TrimSpace(raw))
+	})}
+}
+
+// StructValue 为按 struct tag 绑定整个 namespace 的结构体, 规则见 sconf/bind
+type StructValue struct {
+	value *liveValue
+}
+
+// Load 返回最新的结构体指针, 返回的结构体不会被修改, 调用方也不应修改
+func (m *StructValue) Load() interface{} {
+	return m.value.get()
+}
+
+func (m *StructValue) OnChange(fn func(old, new interface{})) {
+	m.value.onChange(fn)
+}
+
+// Close 停止跟踪配置变更, 之后 Load 返回最后的值, 不再调用回调
+func (m *StructValue) Close() {
+	m.value.close()
+}
+
+// BindValueWithNamespace 将 namespace 绑定到 v 的结构体类型, v 为结构体指针, 初始绑定的结果同时写入 v;
+// 变更后整个 namespace 重新绑定, 校验全部通过才会替换
+func (m *Watcher) BindValueWithNamespace(ctx context.Context, namespace string, v interface{}) (*StructValue, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("bind target must be a non-nil pointer to struct, got %T", v)
+	}
+	t := rv.Elem().Type()
+
+	value := &liveValue{
+		namespace: namespace,
+		load: func(ctx context.Context) (interface{}, error) {
+			kv := make(map[string]string)
+			for _, k := range m.center.GetAllKeysWithNamespace(ctx, namespace) {
+				if val, ok := m.center.GetStringWithNamespace(ctx, namespace, k); ok {
+					kv[k] = val
+				}
+			}
+
+			// NOTE: 每次绑定到新的结构体上, 避免修改已经发布的值
+			n := reflect.New(t)
+			if err := bind.KV(kv, n.Interface()); err != nil {
+				return nil, err
+			}
+			return n.Interface(), nil
+		},
+	}
+
+	initial, err := value.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value.current.Store(snapshot{initial})
+	m.register(ctx, value)
+
+	rv.Elem().Set(reflect.ValueOf(initial).Elem())
+	return &StructValue{value}, nil
+}
+
+// Int 返回 application namespace 下 key 的配置值, 配置不存在时为 deft;
+// 与其他配置值一样应在初始化时创建一次, 每次调用都会注册新的配置值, 见 Watcher
+func Int(ctx context.Context, key string, deft int) *IntValue {
+	return getDefaultWatcher().IntWithNamespace(ctx, defaultNamespaceApplication, key, deft)
+}
+
+func IntWithNamespace(ctx context.Context, namespace, key string, deft int) *IntValue {
+	return getDefaultWatcher().IntWithNamespace(ctx, namespace, key, deft)
+}
+
+func String(ctx context.Context, key string, deft string) *StringValue {
+	return getDefaultWatcher().StringWithNamespace(ctx, defaultNamespaceApplication, key, deft)
+}
+
+func StringWithNamespace(ctx context.Context, namespace, key string, deft string) *StringValue {
+	return getDefaultWatcher().StringWithNamespace(ctx, namespace, key, deft)
+}
+
+func Bool(ctx context.Context, key string, deft bool) *BoolValue {
+	return getDefaultWatcher().BoolWithNamespace(ctx, defaultNamespaceApplication, key, deft)
+}
+
+func BoolWithNamespace(ctx context.Context, namespace, key string, deft bool) *BoolValue {
+	return getDefaultWatcher().BoolWithNamespace(ctx, namespace, key, deft)
+}
+
+func Duration(ctx context.Context, key string, deft time.Duration) *DurationValue {
+	return getDefaultWatcher().DurationWithNamespace(ctx, defaultNamespaceApplication, key, deft)
+}
+
+func DurationWithNamespace(ctx context.Context, namespace, key string, deft time.Duration) *DurationValue {
+	return getDefaultWatcher().DurationWithNamespace(ctx, namespace, key, deft)
+}
+
+func BindValue(ctx context.Context, v interface{}) (*StructValue, error) {
+	return getDefaultWatcher().BindValueWithNamespace(ctx, defaultNamespaceApplication, v)
+}
+
+func BindValueWithNamespace(ctx context.Context, namespace string, v interface{}) (*StructValue, error) {
+	return getDefaultWatcher().BindValueWithNamespace(ctx, namespace, v)
+}
@@ -0,0 +1,201 @@
+package center
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memConfigCenter 为内存中的 ConfigCenter, 只实现 Watcher 用到的方法
+type memConfigCenter struct {
+	ConfigCenter
+
+	mu        sync.Mutex
+	data      map[string]map[string]string
+	observers []ConfigObserver
+	watches   int
+}
+
+func newMemConfigCenter() *memConfigCenter {
+	return &memConfigCenter{data: make(map[string]map[string]string)}
+}
+
+func (m *memConfigCenter) GetStringWithNamespace(ctx context.Context, namespace, key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	val, ok := m.data[namespace][key]
+	return val, ok
+}
+
+func (m *memConfigCenter) GetAllKeysWithNamespace(ctx context.Context, namespace string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for k := range m.data[namespace] {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (m *memConfigCenter) RegisterObserver(ctx context.Context, observer ConfigObserver) func() {
+	m.observers = append(m.observers, observer)
+	return func() {}
+}
+
+func (m *memConfigCenter) StartWatchUpdate(ctx context.Context) {
+	m.watches++
+}
+
+func (m *memConfigCenter) set(namespace string, kv map[string]string) {
+	m.mu.Lock()
+	if m.data[namespace] == nil {
+		m.data[namespace] = make(map[string]string)
+	}
+	changes := make(map[string]*Change)
+	for k, v := range kv {
+		changes[k] = &Change{OldValue: m.data[namespace][k], NewValue: v, ChangeType: MODIFY}
+		m.data[namespace][k] = v
+	}
+	m.mu.Unlock()
+
+	for _, ob := range m.observers {
+		ob.HandleChangeEvent(&ChangeEvent{Source: Apollo, Namespace: namespace, Changes: changes})
+	}
+}
+
+func TestWatcherScalar(t *testing.T) {
+	ctx := context.Background()
+	center := newMemConfigCenter()
+	center.set("application", map[string]string{"pool_size": "16", "timeout": "bad"})
+	w := NewWatcher(center)
+
+	poolSize := w.IntWithNamespace(ctx, "application", "pool_size", 8)
+	timeout := w.DurationWithNamespace(ctx, "application", "timeout", time.Second)
+	debug := w.BoolWithNamespace(ctx, "application", "debug", false)
+	name := w.StringWithNamespace(ctx, "other", "name", "a")
+	assert.Equal(t, 16, poolSize.Get())
+	assert.Equal(t, time.Second, timeout.Get())
+	assert.False(t, debug.Get())
+	assert.Equal(t, "a", name.Get())
+	assert.Equal(t, 1, len(center.observers))
+	assert.Equal(t, 1, center.watches)
+
+	var changes [][2]int
+	poolSize.OnChange(func(old, new int) {
+		changes = append(changes, [2]int{old, new})
+	})
+
+	center.set("application", map[string]string{"pool_size": "32", "timeout": "3s"})
+	assert.Equal(t, 32, poolSize.Get())
+	assert.Equal(t, 3*time.Second, timeout.Get())
+
+	// 解析失败时保留原值, 不触发回调
+	center.set("application", map[string]string{"pool_size": "x"})
+	assert.Equal(t, 32, poolSize.Get())
+
+	// 没有变化时不触发回调
+	center.set("application", map[string]string{"pool_size": "32", "debug": "true"})
+	assert.True(t, debug.Get())
+	assert.Equal(t, [][2]int{{16, 32}}, changes)
+
+	center.set("other", map[string]string{"name": "b"})
+	assert.Equal(t, "b", name.Get())
+}
+
+func TestWatcherBindValue(t *testing.T) {
+	ctx := context.Background()
+	center := newMemConfigCenter()
+	w := NewWatcher(center)
+
+	type redisConf struct {
+		Addr     string        `validate:"required"`
+		PoolSize int           `conf:"pool_size" default:"8" validate:"min=1"`
+		Timeout  time.Duration `default:"1s"`
+	}
+
+	var c redisConf
+	_, err := w.BindValueWithNamespace(ctx, "redis", &c)
+	assert.Equal(t, "addr: required", err.Error())
+
+	center.set("redis", map[string]string{"addr": "127.0.0.1:6379"})
+	value, err := w.BindValueWithNamespace(ctx, "redis", &c)
+	assert.NoError(t, err)
+	assert.Equal(t, redisConf{Addr: "127.0.0.1:6379", PoolSize: 8, Timeout: time.Second}, c)
+	first := value.Load().(*redisConf)
+	assert.Equal(t, c, *first)
+
+	var olds, news []*redisConf
+	value.OnChange(func(old, new interface{}) {
+		olds = append(olds, old.(*redisConf))
+		news = append(news, new.(*redisConf))
+	})
+
+	center.set("redis", map[string]string{"pool_size": "64"})
+	assert.Equal(t, 64, value.Load().(*redisConf).PoolSize)
+	assert.Equal(t, 8, first.PoolSize)
+
+	// 校验失败时保留原值
+	center.set("redis", map[string]string{"pool_size": "0"})
+	assert.Equal(t, 64, value.Load().(*redisConf).PoolSize)
+
+	assert.Equal(t, []*redisConf{first}, olds)
+	assert.Equal(t, 1, len(news))
+	assert.Equal(t, 64, news[0].PoolSize)
+
+	_, err = w.BindValueWithNamespace(ctx, "redis", c)
+	assert.Error(t, err)
+}
+
+func TestWatcherOnChangeInCallback(t *testing.T) {
+	ctx := context.Background()
+	center := newMemConfigCenter()
+	w := NewWatcher(center)
+
+	poolSize := w.IntWithNamespace(ctx, "application", "pool_size", 8)
+	var nested []int
+	poolSize.OnChange(func(old, new int) {
+		// 回调中注册回调不应死锁
+		poolSize.OnChange(func(old, new int) {
+			nested = append(nested, new)
+		})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		center.set("application", map[string]string{"pool_size": "16"})
+		center.set("application", map[string]string{"pool_size": "32"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("OnChange in callback deadlocked")
+	}
+	assert.Equal(t, []int{32}, nested)
+}
+
+func TestWatcherClose(t *testing.T) {
+	ctx := context.Background()
+	center := newMemConfigCenter()
+	w := NewWatcher(center)
+
+	a := w.IntWithNamespace(ctx, "application", "pool_size", 8)
+	b := w.IntWithNamespace(ctx, "application", "pool_size", 8)
+	s := w.StringWithNamespace(ctx, "other", "name", "a")
+	assert.Equal(t, 2, len(w.values["application"]))
+
+	a.Close()
+	s.Close()
+	assert.Equal(t, 1, len(w.values["application"]))
+	_, ok := w.values["other"]
+	assert.False(t, ok)
+
+	center.set("application", map[string]string{"pool_size": "16"})
+	assert.Equal(t, 8, a.Get())
+	assert.Equal(t, 16, b.Get())
+}
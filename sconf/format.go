@@ -0,0 +1,190 @@
+// Copyright 2014 The sutil Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// yaml, toml 与 json 格式的配置转换为 TierConf 的 section/property:
+// 顶层的 map 为 section, 其中嵌套的 map 展开为 a.b 形式的 property, ${section.a.b} 可以引用;
+// 顶层的非 map 值在 section "" 中, 与 ini 文件开头不属于任何 section 的配置相同;
+// 元素都是标量的数组以逗号连接为一个值, 可以通过 ToSliceString 或 slice 字段读取,
+// 其他数组展开为 a[0].b 形式的 property, 可以 Unmarshal 到 struct 的 slice
+
+// LoadYAML 加载 yaml 格式的配置
+func (m *TierConf) LoadYAML(cfg []byte) error {
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(cfg, &tree); err != nil {
+		return err
+	}
+	return m.loadTree(tree)
+}
+
+// LoadTOML 加载 toml 格式的配置
+func (m *TierConf) LoadTOML(cfg []byte) error {
+	var tree map[string]interface{}
+	if _, err := toml.Decode(string(cfg), &tree); err != nil {
+		return err
+	}
+	return m.loadTree(tree)
+}
+
+// LoadJSON 加载 json 格式的配置, 顶层需为 object
+func (m *TierConf) LoadJSON(cfg []byte) error {
+	var tree map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(cfg))
+	d.UseNumber()
+	if err := d.Decode(&tree); err != nil {
+		return err
+	}
+	return m.loadTree(tree)
+}
+
+// loadByExt 按文件扩展名选择格式加载, 未知的扩展名按 ini 加载
+func (m *TierConf) loadByExt(file string, cfg []byte) error {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return m.LoadYAML(cfg)
+	case ".toml":
+		return m.LoadTOML(cfg)
+	case ".json":
+		return m.LoadJSON(cfg)
+	default:
+		return m.Load(cfg)
+	}
+}
+
+func (m *TierConf) loadTree(tree map[string]interface{}) error {
+	cfg := make(map[string]map[string]string)
+	for k, v := range tree {
+		section, prefix := k, ""
+		if _, ok := toStringMap(v); !ok {
+			section, prefix = "", k
+		}
+		if cfg[section] == nil {
+			cfg[section] = make(map[string]string)
+		}
+		if err := flattenTree(prefix, v, cfg[section]); err != nil {
+			return fmt.Errorf("%s: %s", k, err.Error())
+		}
+	}
+
+	m.LoadFromConf(cfg)
+	return nil
+}
+
+// toStringMap 将 yaml 的 map[interface{}]interface{} 与 toml/json 的 map[string]interface{} 统一为后者
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return val, true
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[fmt.Sprint(k)] = item
+		}
+		return m, true
+	default:
+		return nil, false
+	}
+}
+
+func toSlice(v interface{}) ([]interface{}, bool) {
+	switch val := v.(type) {
+	case []interface{}:
+		return val, true
+	case []map[string]interface{}:
+		// toml 的 [[table]]
+		s := make([]interface{}, 0, len(val))
+		for _, item := range val {
+			s = append(s, item)
+		}
+		return s, true
+	default:
+		return nil, false
+	}
+}
+
+// flattenTree 将 v 以 prefix 为前缀展开到 properties
+func flattenTree(prefix string, v interface{}, properties map[string]string) error {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	if sm, ok := toStringMap(v); ok {
+		for k, item := range sm {
+			if err := flattenTree(join(k), item, properties); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if s, ok := toSlice(v); ok {
+		scalars := make([]string, 0, len(s))
+		for _, item := range s {
+			str, ok := scalarToString(item)
+			if !ok {
+				break
+			}
+			scalars = append(scalars, str)
+		}
+		if len(scalars) == len(s) {
+			properties[prefix] = strings.Join(scalars, ",")
+			return nil
+		}
+
+		for i, item := range s {
+			if err := flattenTree(fmt.Sprintf("%s[%d]", prefix, i), item, properties); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	str, ok := scalarToString(v)
+	if !ok {
+		return fmt.Errorf("unsupported value type %T", v)
+	}
+	properties[prefix] = str
+	return nil
+}
+
+func scalarToString(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return val, true
+	case bool:
+		return strconv.FormatBool(val), true
+	case int:
+		return strconv.Itoa(val), true
+	case int64:
+		return strconv.FormatInt(val, 10), true
+	case uint64:
+		return strconv.FormatUint(val, 10), true
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case json.Number:
+		return val.String(), true
+	case time.Time:
+		return val.Format(time.RFC3339Nano), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,155 @@
+package sconf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type formatServer struct {
+	Host string `sconf:"host"`
+	Port int    `sconf:"port"`
+}
+
+type formatConf struct {
+	Name   string `sconf:"name"`
+	Routes []*struct {
+		Path    string   `sconf:"path"`
+		Methods []string `sconf:"methods"`
+	} `sconf:"routes"`
+	Server struct {
+		HTTP     formatServer   `sconf:"http"`
+		Backends []formatServer `sconf:"backends"`
+		Addr     string         `sconf:"addr"`
+		Home     string         `sconf:"home"`
+		Timeout  string         `sconf:"timeout"`
+	} `sconf:"server"`
+}
+
+var formatConfigs = map[string]string{
+	"a.yaml": `
+name: app
+routes:
+  - path: /a
+    methods: [GET, POST]
+  - path: /b
+server:
+  http:
+    host: 127.0.0.1
+    port: 8080
+  backends:
+    - host: 10.0.0.1
+      port: 80
+    - host: 10.0.0.2
+      port: 81
+  addr: ${server.http.host}:${server.http.port}
+  home: ${env:SCONF_TEST_HOME:-/root}
+  timeout: ${server.http.timeout:-3s}
+`,
+	"a.toml": `
+name = "app"
+
+[[routes]]
+path = "/a"
+methods = ["GET", "POST"]
+
+[[routes]]
+path = "/b"
+
+[server]
+addr = "${server.http.host}:${server.http.port}"
+home = "${env:SCONF_TEST_HOME:-/root}"
+timeout = "${server.http.timeout:-3s}"
+
+[server.http]
+host = "127.0.0.1"
+port = 8080
+
+[[server.backends]]
+host = "10.0.0.1"
+port = 80
+
+[[server.backends]]
+host = "10.0.0.2"
+port = 81
+`,
+	"a.json": `{
+	"name": "app",
+	"routes": [{"path": "/a", "methods": ["GET", "POST"]}, {"path": "/b"}],
+	"server": {
+		"http": {"host": "127.0.0.1", "port": 8080},
+		"backends": [{"host": "10.0.0.1", "port": 80}, {"host": "10.0.0.2", "port": 81}],
+		"addr": "${server.http.host}:${server.http.port}",
+		"home": "${env:SCONF_TEST_HOME:-/root}",
+		"timeout": "${server.http.timeout:-3s}"
+	}
+}`,
+}
+
+func TestTierConfFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sconf")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for file, data := range formatConfigs {
+		path := filepath.Join(dir, file)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+
+		tf := NewTierConf()
+		assert.NoError(t, tf.LoadFromFile(path), file)
+
+		assert.Equal(t, "app", tf.ToStringWithDefault("", "name", ""), file)
+		assert.Equal(t, 8080, tf.ToIntWithDefault("server", "http.port", 0), file)
+		assert.Equal(t, "127.0.0.1:8080", tf.ToStringWithDefault("server", "addr", ""), file)
+		assert.Equal(t, "3s", tf.ToStringWithDefault("server", "timeout", ""), file)
+		assert.Equal(t, []string{"GET", "POST"}, tf.ToSliceStringWithDefault("", "routes[0].methods", ",", nil), file)
+
+		os.Unsetenv("SCONF_TEST_HOME")
+		assert.Equal(t, "/root", tf.ToStringWithDefault("server", "home", ""), file)
+		os.Setenv("SCONF_TEST_HOME", "/home/app")
+		assert.Equal(t, "/home/app", tf.ToStringWithDefault("server", "home", ""), file)
+		os.Unsetenv("SCONF_TEST_HOME")
+
+		var c formatConf
+		assert.NoError(t, tf.Unmarshal(&c), file)
+		assert.Equal(t, "app", c.Name, file)
+		assert.Equal(t, 2, len(c.Routes), file)
+		assert.Equal(t, "/a", c.Routes[0].Path, file)
+		assert.Equal(t, []string{"GET", "POST"}, c.Routes[0].Methods, file)
+		assert.Equal(t, "/b", c.Routes[1].Path, file)
+		assert.Equal(t, formatServer{"127.0.0.1", 8080}, c.Server.HTTP, file)
+		assert.Equal(t, []formatServer{{"10.0.0.1", 80}, {"10.0.0.2", 81}}, c.Server.Backends, file)
+		assert.Equal(t, "127.0.0.1:8080", c.Server.Addr, file)
+	}
+}
+
+func TestTierConfInterpolation(t *testing.T) {
+	tf := NewTierConf()
+	assert.NoError(t, tf.Load([]byte(`
+name=app
+[log]
+dir=/data/${name}/${unknown}
+file=${log.dir}/${env:SCONF_TEST_NOT_SET}
+level=${log.none:-INFO}
+[cyclic]
+a=${cyclic.b:-x}
+b=${cyclic.a}
+`)))
+
+	assert.Equal(t, "/data/app/${unknown}", tf.ToStringWithDefault("log", "dir", ""))
+	assert.Equal(t, "/data/app/${unknown}/${env:SCONF_TEST_NOT_SET}", tf.ToStringWithDefault("log", "file", ""))
+	assert.Equal(t, "INFO", tf.ToStringWithDefault("log", "level", ""))
+
+	_, err := tf.ToString("cyclic", "a")
+	assert.Error(t, err)
+}
+
+func TestTierConfFormatErr(t *testing.T) {
+	tf := NewTierConf()
+	assert.Error(t, tf.LoadYAML([]byte("a: [")))
+	assert.Error(t, tf.LoadTOML([]byte("a = ")))
+	assert.Error(t, tf.LoadJSON([]byte(`[1, 2]`)))
+}
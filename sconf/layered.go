@@ -0,0 +1,397 @@
+// Copyright 2014 The sutil Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sconf
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SourceKind 为配置来源的类型, 值越大优先级越高
+type SourceKind int
+
+const (
+	SourceDefault SourceKind = iota
+	SourceFile
+	SourceCenter
+	SourceEnv
+	SourceFlag
+
+	sourceKindCount
+)
+
+func (k SourceKind) String() string {
+	switch k {
+	case SourceDefault:
+		return "default"
+	case SourceFile:
+		return "file"
+	case SourceCenter:
+		return "center"
+	case SourceEnv:
+		return "env"
+	case SourceFlag:
+		return "flag"
+	default:
+		return "unknown"
+	}
+}
+
+// Source 为配置值的来源, Name 为文件路径、配置中心的 namespace、环境变量名或 flag 名
+type Source struct {
+	Kind SourceKind
+	Name string
+}
+
+func (s Source) String() string {
+	if s.Name == "" {
+		return s.Kind.String()
+	}
+	return s.Kind.String() + ":" + s.Name
+}
+
+// CenterSource 为 LayeredConf 读取的配置中心, sconf/center.ConfigCenter 实现了该接口
+type CenterSource interface {
+	GetAllKeysWithNamespace(ctx context.Context, namespace string) []string
+	GetStringWithNamespace(ctx context.Context, namespace, key string) (string, bool)
+}
+
+const redactedValue = "xxxxx"
+
+// defaultRedactRegexp 匹配需要在 StringCheck 中隐藏值的 key
+var defaultRedactRegexp = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|credential|(private|access|api)_?key)`)
+
+type layeredValue struct {
+	value  string
+	source Source
+}
+
+// LayeredConf 合并多个来源的配置, 优先级从低到高为: 默认值, TierConf 文件, 配置中心, 环境变量, 命令行 flag,
+// 与加载的顺序无关; 同一类来源中后加载的覆盖先加载的.
+// 配置的 key 为 section.property, 没有 section 的配置 key 为 property; 合并后值中的 ${section.property} 引用被展开
+type LayeredConf struct {
+	mu     sync.RWMutex
+	layers [sourceKindCount]map[string]layeredValue
+	redact *regexp.Regexp
+}
+
+func NewLayeredConf() *LayeredConf {
+	m := &LayeredConf{
+		redact: defaultRedactRegexp,
+	}
+	for i := range m.layers {
+		m.layers[i] = make(map[string]layeredValue)
+	}
+	return m
+}
+
+func (m *LayeredConf) set(kind SourceKind, key, value, name string) {
+	m.layers[kind][key] = layeredValue{value: value, source: Source{Kind: kind, Name: name}}
+}
+
+// SetRedactRegexp 设置 StringCheck 中需要隐藏值的 key 的正则
+func (m *LayeredConf) SetRedactRegexp(re *regexp.Regexp) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.redact = re
+}
+
+func (m *LayeredConf) SetDefault(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(SourceDefault, key, value, "")
+}
+
+func (m *LayeredConf) SetDefaults(kv map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, v := range kv {
+		m.set(SourceDefault, k, v, "")
+	}
+}
+
+// LoadTierConf 加载 tc 中的配置, name 为来源的名字, 通常为文件路径
+func (m *LayeredConf) LoadTierConf(name string, tc *TierConf) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for section, properties := range tc.GetConf() {
+		for property, value := range properties {
+			m.set(SourceFile, joinSectionKey(section, property), value, name)
+		}
+	}
+}
+
+// LoadFile 加载 ini 格式的配置文件, 多个文件以逗号分隔, 后面的文件覆盖前面的
+func (m *LayeredConf) LoadFile(files string) error {
+	for _, file := range strings.Split(files, ",") {
+		tc := NewTierConf()
+		if err := tc.LoadFromOneFile(file); err != nil {
+			return err
+		}
+		m.LoadTierConf(file, tc)
+	}
+	return nil
+}
+
+// LoadCenter 加载配置中心 namespace 下当前的配置, prefix 不为空时 key 为 prefix.key;
+// 只加载调用时的配置, 配置中心变更后需要重新调用
+func (m *LayeredConf) LoadCenter(ctx context.Context, center CenterSource, namespace, prefix string) {
+	kv := make(map[string]string)
+	for _, k := range center.GetAllKeysWithNamespace(ctx, namespace) {
+		if v, ok := center.GetStringWithNamespace(ctx, namespace, k); ok {
+			kv[joinSectionKey(prefix, k)] = v
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, v := range kv {
+		m.set(SourceCenter, k, v, namespace)
+	}
+}
+
+// LoadEnv 加载以 prefix_ 开头的环境变量. 去掉前缀后, 与已有 key 的环境变量形式相同时覆盖该 key,
+// key 的环境变量形式为大写并将非字母数字替换为 _, 如 APP_LOG_LEVEL 覆盖 log.level 与 Log.Level;
+// 否则以 __ 分隔 section 与 property 生成小写的 key, 如 APP_DB__MAX_CONN 对应 db.max_conn
+func (m *LayeredConf) LoadEnv(prefix string) {
+	m.loadEnv(prefix, os.Environ())
+}
+
+func (m *LayeredConf) loadEnv(prefix string, environ []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix = strings.ToUpper(prefix) + "_"
+	for _, env := range environ {
+		idx := strings.Index(env, "=")
+		if idx < 0 {
+			continue
+		}
+		name, value := env[:idx], env[idx+1:]
+		if !strings.HasPrefix(strings.ToUpper(name), prefix) || len(name) == len(prefix) {
+			continue
+		}
+		// NOTE: 与已有 key 的对应在合并时进行, 与加载顺序无关
+		m.set(SourceEnv, strings.ToUpper(name[len(prefix):]), value, name)
+	}
+}
+
+// LoadFlags 加载 fs 中在命令行上设置过的 flag, flag 名与已有 key 忽略大小写相同时覆盖该 key, 否则以 flag 名为 key
+func (m *LayeredConf) LoadFlags(fs *flag.FlagSet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fs.Visit(func(f *flag.Flag) {
+		m.set(SourceFlag, f.Name, f.Value.String(), "-"+f.Name)
+	})
+}
+
+func joinSectionKey(section, property string) string {
+	if section == "" {
+		return property
+	}
+	return section + "." + property
+}
+
+func splitSectionKey(key string) (string, string) {
+	idx := strings.Index(key, ".")
+	if idx < 0 {
+		return "", key
+	}
+	return key[:idx], key[idx+1:]
+}
+
+var envNameRegexp = regexp.MustCompile(`[^A-Z0-9]`)
+
+func envName(key string) string {
+	return envNameRegexp.ReplaceAllString(strings.ToUpper(key), "_")
+}
+
+func envKey(name string) string {
+	return strings.ToLower(strings.Replace(name, "__", ".", 1))
+}
+
+func sortedKeys(kv map[string]layeredValue) []string {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// merged 返回合并后未展开引用的配置
+func (m *LayeredConf) merged() map[string]layeredValue {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	kv := make(map[string]layeredValue)
+	for kind := SourceDefault; kind <= SourceCenter; kind++ {
+		for k, v := range m.layers[kind] {
+			kv[k] = v
+		}
+	}
+
+	// 环境变量与 flag 优先对应到已有的 key
+	byEnvName := make(map[string]string)
+	byLower := make(map[string]string)
+	for _, k := range sortedKeys(kv) {
+		if _, ok := byEnvName[envName(k)]; !ok {
+			byEnvName[envName(k)] = k
+		}
+		if _, ok := byLower[strings.ToLower(k)]; !ok {
+			byLower[strings.ToLower(k)] = k
+		}
+	}
+
+	for _, name := range sortedKeys(m.layers[SourceEnv]) {
+		key, ok := byEnvName[name]
+		if !ok {
+			key = envKey(name)
+		}
+		kv[key] = m.layers[SourceEnv][name]
+	}
+	for _, name := range sortedKeys(m.layers[SourceFlag]) {
+		key, ok := byLower[strings.ToLower(name)]
+		if !ok {
+			key = name
+		}
+		kv[key] = m.layers[SourceFlag][name]
+	}
+	return kv
+}
+
+func toTierConf(kv map[string]layeredValue) *TierConf {
+	conf := make(map[string]map[string]string)
+	for k, v := range kv {
+		section, property := splitSectionKey(k)
+		if conf[section] == nil {
+			conf[section] = make(map[string]string)
+		}
+		conf[section][property] = v.value
+	}
+
+	tc := NewTierConf()
+	tc.LoadFromConf(conf)
+	return tc
+}
+
+// TierConf 返回合并后的配置, 可以使用 TierConf 的 ToXxx, Unmarshal 与 Bind 读取
+func (m *LayeredConf) TierConf() *TierConf {
+	return toTierConf(m.merged())
+}
+
+// Lookup 返回 key 合并后展开引用的值与来源
+func (m *LayeredConf) Lookup(key string) (string, Source, error) {
+	kv := m.merged()
+	v, ok := kv[key]
+	if !ok {
+		return "", Source{}, fmt.Errorf("property empty:%s", key)
+	}
+
+	section, property := splitSectionKey(key)
+	value, err := toTierConf(kv).ToString(section, property)
+	if err != nil {
+		return "", Source{}, err
+	}
+	return value, v.source, nil
+}
+
+func (m *LayeredConf) Get(key string) (string, bool) {
+	value, _, err := m.Lookup(key)
+	return value, err == nil
+}
+
+// Sources 返回每个 key 的值的来源
+func (m *LayeredConf) Sources() map[string]Source {
+	sources := make(map[string]Source)
+	for k, v := range m.merged() {
+		sources[k] = v.source
+	}
+	return sources
+}
+
+// Bind 按 struct tag 将合并后的配置绑定到 v, 规则见 sconf/bind
+func (m *LayeredConf) Bind(v interface{}) error {
+	return m.TierConf().Bind(v)
+}
+
+// StringCheck 与 TierConf.StringCheck 相同地按 section 输出合并后的配置, 每个值后注释其来源,
+// key 匹配 SetRedactRegexp 的值被替换为 xxxxx, 其他值中对这些 key 的 ${section.property} 引用展开为 xxxxx,
+// 用于启动日志与调试接口
+func (m *LayeredConf) StringCheck() (string, error) {
+	m.mu.RLock()
+	redact := m.redact
+	m.mu.RUnlock()
+
+	kv := m.merged()
+	// NOTE: 在展开引用之前替换, 只隐藏匹配的 key 及对它们的引用, 不按值替换, 避免短的密钥改写无关的值
+	redacted := make(map[string]layeredValue, len(kv))
+	for k, v := range kv {
+		_, property := splitSectionKey(k)
+		if redact != nil && redact.MatchString(property) && v.value != "" {
+			v.value = redactedValue
+		}
+		redacted[k] = v
+	}
+	tc := toTierConf(redacted)
+
+	type item struct {
+		property string
+		value    string
+		source   Source
+	}
+	sections := make(map[string][]*item)
+	for _, k := range sortedKeys(kv) {
+		section, property := splitSectionKey(k)
+		value, err := tc.ToString(section, property)
+		if err != nil {
+			return "", err
+		}
+		sections[section] = append(sections[section], &item{property, value, kv[k].source})
+	}
+
+	names := make([]string, 0, len(sections))
+	for section := range sections {
+		names = append(names, section)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, section := range names {
+		if section != "" {
+			fmt.Fprintf(&b, "[%s]\n", section)
+		}
+		for _, it := range sections[section] {
+			fmt.Fprintf(&b, "%s=%s ; %s\n", it.property, it.value, it.source)
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// ServeHTTP 以文本输出 StringCheck 的结果, 可以注册为调试接口
+func (m *LayeredConf) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, err := m.StringCheck()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(s))
+}
@@ -0,0 +1,157 @@
+package sconf
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mapCenter map[string]map[string]string
+
+func (m mapCenter) GetAllKeysWithNamespace(ctx context.Context, namespace string) []string {
+	var keys []string
+	for k := range m[namespace] {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (m mapCenter) GetStringWithNamespace(ctx context.Context, namespace, key string) (string, bool) {
+	v, ok := m[namespace][key]
+	return v, ok
+}
+
+func TestLayeredConf(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "sconf")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file0 := filepath.Join(dir, "a.ini")
+	file1 := filepath.Join(dir, "b.ini")
+	assert.NoError(t, ioutil.WriteFile(file0, []byte(`
+name=app
+[server]
+Host=127.0.0.1
+port=8080
+addr=${server.Host}:${server.port}
+[db]
+user=root
+password=file-secret
+dsn=${db.user}:${db.password}@tcp(127.0.0.1:3306)/app
+`), 0644))
+	assert.NoError(t, ioutil.WriteFile(file1, []byte("[server]\nport=8081\n"), 0644))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("server.host", "", "")
+	fs.Int("server.workers", 1, "")
+	fs.String("log.level", "info", "")
+	assert.NoError(t, fs.Parse([]string{"-server.host=10.0.0.1", "-server.workers=8"}))
+
+	lc := NewLayeredConf()
+	// 加载顺序不影响优先级
+	lc.LoadFlags(fs)
+	lc.loadEnv("app", []string{"APP_SERVER_PORT=9090", "APP_DB__MAX_CONN=16", "APP_DB_PASSWORD=env-secret", "OTHER_NAME=x", "APP_=y"})
+	lc.LoadCenter(ctx, mapCenter{"application": {"port": "7070", "timeout": "3s"}}, "application", "server")
+	assert.NoError(t, lc.LoadFile(file0+","+file1))
+	lc.SetDefaults(map[string]string{"server.timeout": "1s", "server.port": "80", "log.level": "debug"})
+
+	value, source, err := lc.Lookup("server.port")
+	assert.NoError(t, err)
+	assert.Equal(t, "9090", value)
+	assert.Equal(t, "env:APP_SERVER_PORT", source.String())
+
+	value, source, err = lc.Lookup("server.Host")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", value)
+	assert.Equal(t, "flag:-server.host", source.String())
+
+	value, _ = lc.Get("server.addr")
+	assert.Equal(t, "10.0.0.1:9090", value)
+
+	sources := lc.Sources()
+	assert.Equal(t, Source{SourceCenter, "application"}, sources["server.timeout"])
+	assert.Equal(t, Source{SourceFile, file0}, sources["name"])
+	assert.Equal(t, Source{SourceDefault, ""}, sources["log.level"])
+	assert.Equal(t, Source{SourceEnv, "APP_DB__MAX_CONN"}, sources["db.max_conn"])
+	assert.Equal(t, Source{SourceFlag, "-server.workers"}, sources["server.workers"])
+
+	_, ok := lc.Get("server.none")
+	assert.False(t, ok)
+
+	var c struct {
+		Name   string
+		Server struct {
+			Addr    string
+			Timeout time.Duration
+			Workers int
+		}
+		DB struct {
+			MaxConn int `conf:"max_conn"`
+		} `conf:"db"`
+	}
+	assert.NoError(t, lc.Bind(&c))
+	assert.Equal(t, "app", c.Name)
+	assert.Equal(t, "10.0.0.1:9090", c.Server.Addr)
+	assert.Equal(t, 3*time.Second, c.Server.Timeout)
+	assert.Equal(t, 8, c.Server.Workers)
+	assert.Equal(t, 16, c.DB.MaxConn)
+
+	s, err := lc.StringCheck()
+	assert.NoError(t, err)
+	assert.Equal(t, `name=app ; file:`+file0+`
+
+[db]
+dsn=root:xxxxx@tcp(127.0.0.1:3306)/app ; file:`+file0+`
+max_conn=16 ; env:APP_DB__MAX_CONN
+password=xxxxx ; env:APP_DB_PASSWORD
+user=root ; file:`+file0+`
+
+[log]
+level=debug ; default
+
+[server]
+Host=10.0.0.1 ; flag:-server.host
+addr=10.0.0.1:9090 ; file:`+file0+`
+port=9090 ; env:APP_SERVER_PORT
+timeout=3s ; center:application
+workers=8 ; flag:-server.workers
+
+`, s)
+
+	w := httptest.NewRecorder()
+	lc.ServeHTTP(w, httptest.NewRequest("GET", "/debug/conf", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, s, w.Body.String())
+}
+
+func TestLayeredConfStringCheckRedact(t *testing.T) {
+	lc := NewLayeredConf()
+	lc.SetDefaults(map[string]string{
+		"db.password": "1",
+		"db.port":     "3311",
+		"db.dsn":      "root:${db.password}@tcp(127.0.0.1:${db.port})/app",
+		"db.note":     "password is 1",
+		"api.token":   "",
+	})
+
+	s, err := lc.StringCheck()
+	assert.NoError(t, err)
+	assert.Equal(t, `[api]
+token= ; default
+
+[db]
+dsn=root:xxxxx@tcp(127.0.0.1:3311)/app ; default
+note=password is 1 ; default
+password=xxxxx ; default
+port=3311 ; default
+
+`, s)
+}
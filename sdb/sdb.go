@@ -12,6 +12,7 @@ import (
 )
 
 
+// Deprecated: 基于已停止维护的 mgo, 新代码使用 dbrouter.Router 的 MongoExec/MongoTx
 type MgoDb struct {
 	addr string
 	mgoSession *mgo.Session